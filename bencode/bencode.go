@@ -2,7 +2,12 @@ package bencode
 
 import (
 	"bufio"
+	"fmt"
 	"io"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
 )
 
 type BType uint8
@@ -14,11 +19,28 @@ const (
 	DICT
 )
 
+func (t BType) String() string {
+	switch t {
+	case STR:
+		return "string"
+	case INT:
+		return "int"
+	case LIST:
+		return "list"
+	case DICT:
+		return "dict"
+	}
+	return "unknown"
+}
+
 type BValue interface{}
 
+// BObject 整数能放进int64时保存为int64，否则保存为*big.Int，规范本身不限制整数的大小
 type BObject struct {
 	typ BType
 	val BValue
+
+	start, end int64 // 从流中解析出来时，值在输入中的位置[start, end)
 }
 
 func (b *BObject) Str() (string, error) {
@@ -28,11 +50,64 @@ func (b *BObject) Str() (string, error) {
 	return b.val.(string), nil
 }
 
+// Int 返回整数的值，超出int的范围时返回RangeError
 func (b *BObject) Int() (int, error) {
+	n, err := b.Int64()
+	if err != nil {
+		return 0, err
+	}
+	if n < math.MinInt || n > math.MaxInt {
+		return 0, fmt.Errorf("%w: %d overflows int", RangeError, n)
+	}
+	return int(n), nil
+}
+
+// Int64 返回整数的值，超出int64的范围时返回RangeError
+func (b *BObject) Int64() (int64, error) {
 	if b.typ != INT {
 		return 0, TypeError
 	}
-	return b.val.(int), nil
+	switch n := b.val.(type) {
+	case int64:
+		return n, nil
+	case *big.Int:
+		return 0, fmt.Errorf("%w: %s overflows int64", RangeError, n)
+	}
+	return 0, TypeError
+}
+
+// Uint64 返回无符号整数的值，负数或超出uint64的范围时返回RangeError
+func (b *BObject) Uint64() (uint64, error) {
+	if b.typ != INT {
+		return 0, TypeError
+	}
+	switch n := b.val.(type) {
+	case int64:
+		if n < 0 {
+			return 0, fmt.Errorf("%w: %d overflows uint64", RangeError, n)
+		}
+		return uint64(n), nil
+	case *big.Int:
+		if !n.IsUint64() {
+			return 0, fmt.Errorf("%w: %s overflows uint64", RangeError, n)
+		}
+		return n.Uint64(), nil
+	}
+	return 0, TypeError
+}
+
+// BigInt 返回任意大小的整数，返回的是一份拷贝
+func (b *BObject) BigInt() (*big.Int, error) {
+	if b.typ != INT {
+		return nil, TypeError
+	}
+	switch n := b.val.(type) {
+	case int64:
+		return big.NewInt(n), nil
+	case *big.Int:
+		return new(big.Int).Set(n), nil
+	}
+	return nil, TypeError
 }
 
 func (b *BObject) List() ([]*BObject, error) {
@@ -49,6 +124,35 @@ func (b *BObject) Dict() (map[string]*BObject, error) {
 	return b.val.(map[string]*BObject), nil
 }
 
+// 转换成Go的原生类型：string, int, []interface{}, map[string]interface{}，
+// 超出int范围的整数转换成int64或者*big.Int
+func (b *BObject) native() interface{} {
+	switch b.typ {
+	case INT:
+		if n, err := b.Int(); err == nil {
+			return n
+		}
+		if n, ok := b.val.(*big.Int); ok {
+			return new(big.Int).Set(n)
+		}
+	case LIST:
+		list := b.val.([]*BObject)
+		res := make([]interface{}, len(list))
+		for i, v := range list {
+			res[i] = v.native()
+		}
+		return res
+	case DICT:
+		dict := b.val.(map[string]*BObject)
+		res := make(map[string]interface{}, len(dict))
+		for k, v := range dict {
+			res[k] = v.native()
+		}
+		return res
+	}
+	return b.val
+}
+
 // Bencode 核心函数：往流中写入编码好的BObject，返回编码的字节长度
 func (b *BObject) Bencode(w io.Writer) (wLen int) {
 	bw, ok := w.(*bufio.Writer)
@@ -60,8 +164,13 @@ func (b *BObject) Bencode(w io.Writer) (wLen int) {
 		str, _ := b.Str()
 		wLen += EncodeString(bw, str)
 	case INT:
-		val, _ := b.Int()
-		wLen += EncodeInt(bw, val)
+		var buf [24]byte
+		switch n := b.val.(type) {
+		case int64:
+			wLen += writeBytes(bw, AppendInt(buf[:0], n))
+		case *big.Int:
+			wLen += writeBytes(bw, AppendBigInt(buf[:0], n))
+		}
 	case LIST:
 		// 写入l
 		bw.WriteByte('l')
@@ -79,13 +188,18 @@ func (b *BObject) Bencode(w io.Writer) (wLen int) {
 		// 写入d
 		bw.WriteByte('d')
 		wLen++
-		// 写入列表内容
+		// 写入字典内容，规范编码要求key按字节序升序排列
 		dict, _ := b.Dict()
-		for k, v := range dict {
+		keys := make([]string, 0, len(dict))
+		for k := range dict {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
 			// 字典的key必须是字符串
 			wLen += EncodeString(bw, k)
 			// 递归处理字典v部分
-			wLen += v.Bencode(bw)
+			wLen += dict[k].Bencode(bw)
 		}
 		// 写入e
 		bw.WriteByte('e')
@@ -97,129 +211,80 @@ func (b *BObject) Bencode(w io.Writer) (wLen int) {
 
 // EncodeString 编码字符串，把编码结果放到流中，返回编码的字节数
 func EncodeString(w io.Writer, val string) (wLen int) {
-	bw := bufio.NewWriter(w)
-	// 写入字符串的字节长度
-	wLen += writeInteger(bw, len(val))
-	// 写入冒号
-	bw.WriteByte(':')
-	wLen++
-	// 写入字符串内容
-	bw.WriteString(val)
-	wLen += len(val)
-	if err := bw.Flush(); err != nil {
+	// 长度前缀拼好后直接写入，不再为每次调用分配缓冲区
+	var buf [24]byte
+	head := strconv.AppendInt(buf[:0], int64(len(val)), 10)
+	head = append(head, ':')
+	if _, err := w.Write(head); err != nil {
 		return 0
 	}
-	return
+	if _, err := io.WriteString(w, val); err != nil {
+		return 0
+	}
+	return len(head) + len(val)
 }
 
 // DecodeString 解码字符串，从流中读取字节进行解码，返回解码结果
 func DecodeString(r io.Reader) (val string, err error) {
-	// 新建Reader
-	br, ok := r.(*bufio.Reader)
-	if !ok {
-		br = bufio.NewReader(r)
-	}
-	// 读取字符串的字节长度
-	num, rLen := readInteger(br)
-	if rLen == 0 {
-		return "", NumError
-	}
-	// 读取冒号
-	b, err := br.ReadByte()
-	if b != ':' {
-		return "", ColonError
-	}
-	// 读取字符串内容
-	buf := make([]byte, num)
-	_, err = io.ReadFull(br, buf)
-	val = string(buf)
-	return
+	return NewDecoder(r).decodeString()
 }
 
 // EncodeInt 编码整数
 func EncodeInt(w io.Writer, val int) (wLen int) {
-	bw := bufio.NewWriter(w)
-	// 写入i
-	bw.WriteByte('i')
-	wLen++
-	// 写入编码后的整数
-	wLen += writeInteger(bw, val)
-	// 写入e
-	bw.WriteByte('e')
-	wLen++
-	if err := bw.Flush(); err != nil {
-		return 0
-	}
-	return
+	var buf [24]byte
+	return writeBytes(w, AppendInt(buf[:0], int64(val)))
 }
 
-// DecodeInt 解码整数
-func DecodeInt(r io.Reader) (val int, err error) {
-	br, ok := r.(*bufio.Reader)
-	if !ok {
-		br = bufio.NewReader(r)
-	}
-	b, err := br.ReadByte()
-	if b != 'i' {
-		return 0, CharIError
-	}
-	val, _ = readInteger(br)
-	b, err = br.ReadByte()
-	if b != 'e' {
-		return 0, CharEError
-	}
-	return
+// AppendString 把字符串的编码追加到dst后面，供生成的代码使用
+func AppendString(dst []byte, val string) []byte {
+	dst = strconv.AppendInt(dst, int64(len(val)), 10)
+	dst = append(dst, ':')
+	return append(dst, val...)
 }
 
-// 将整数转成ASCII码放入流中，返回写入的字节数
-func writeInteger(w *bufio.Writer, val int) (wLen int) {
-	if val == 0 {
-		w.WriteByte('0')
-		wLen++
-		return
-	}
-	if val < 0 {
-		w.WriteByte('-')
-		wLen++
-		val = -val
-	}
-	digits := make([]int, 0)
-	for val > 0 {
-		digits = append(digits, val%10)
-		val /= 10
-	}
-	//fmt.Println(digits)
-	for i := len(digits) - 1; i >= 0; i-- {
-		//fmt.Println(byte(digits[i] + '0'))
-		w.WriteByte(byte(digits[i] + '0'))
-		wLen++
+// AppendBytes 把字节串的编码追加到dst后面
+func AppendBytes(dst []byte, val []byte) []byte {
+	dst = strconv.AppendInt(dst, int64(len(val)), 10)
+	dst = append(dst, ':')
+	return append(dst, val...)
+}
+
+// AppendInt 把整数的编码追加到dst后面
+func AppendInt(dst []byte, val int64) []byte {
+	dst = append(dst, 'i')
+	dst = strconv.AppendInt(dst, val, 10)
+	return append(dst, 'e')
+}
+
+// AppendBigInt 把任意大小的整数的编码追加到dst后面
+func AppendBigInt(dst []byte, val *big.Int) []byte {
+	dst = append(dst, 'i')
+	dst = val.Append(dst, 10)
+	return append(dst, 'e')
+}
+
+// AppendUint 把无符号整数的编码追加到dst后面
+func AppendUint(dst []byte, val uint64) []byte {
+	dst = append(dst, 'i')
+	dst = strconv.AppendUint(dst, val, 10)
+	return append(dst, 'e')
+}
+
+// DecodeInt 解码整数，超出int的范围时返回RangeError
+func DecodeInt(r io.Reader) (val int, err error) {
+	n, err := NewDecoder(r).decodeInt()
+	if err != nil {
+		return 0, err
 	}
-	return
+	return (&BObject{typ: INT, val: n}).Int()
 }
 
-// 从流中读取一个数字，返回这个数字和占用的字节数
-func readInteger(r *bufio.Reader) (int, int) {
-	// 读第一个字节判断是不是负数
-	val, rLen := 0, 0
-	sign := 1
-	b, _ := r.ReadByte()
-	rLen++
-	if b == '-' {
-		sign = -1
-		b, _ = r.ReadByte()
-		rLen++
-	}
-
-	for {
-		if !isNum(b) {
-			r.UnreadByte()
-			rLen--
-			return val * sign, rLen
-		}
-		val = val*10 + int(b-'0')
-		b, _ = r.ReadByte()
-		rLen++
+func writeBytes(w io.Writer, b []byte) int {
+	n, err := w.Write(b)
+	if err != nil {
+		return 0
 	}
+	return n
 }
 
 func isNum(b byte) bool {
@@ -0,0 +1,408 @@
+/*
+bencodegen 为结构体生成MarshalBencode和UnmarshalBencode方法，编解码时不再使用反射，
+结果和bencode.Marshal、bencode.Unmarshal一致。
+
+用法，在结构体所在的文件中加上：
+
+	//go:generate go run github.com/Ryan-ovo/go-bittorrent/bencode/bencodegen -type=TrackerResp
+
+会在同目录下生成xxx_bencode.go。支持的字段类型：
+string、[]byte、[N]byte、各种整数、bool、同一次生成的结构体，以及这些类型的切片，
+其他类型（指针、map、interface{}、自定义Marshaler等）会回退到反射处理。
+没有tag的嵌入结构体暂不支持。
+*/
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	typeNames = flag.String("type", "", "comma-separated list of struct type names; required")
+	output    = flag.String("output", "", "output file name; default <file>_bencode.go")
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("bencodegen: ")
+	flag.Parse()
+	if *typeNames == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	// go generate会设置GOFILE为当前文件
+	file := os.Getenv("GOFILE")
+	if flag.NArg() > 0 {
+		file = flag.Arg(0)
+	}
+	if file == "" {
+		log.Fatal("no input file, run with go generate or pass a file name")
+	}
+	src, err := generate(file, strings.Split(*typeNames, ","))
+	if err != nil {
+		log.Fatal(err)
+	}
+	out := *output
+	if out == "" {
+		out = outputName(file)
+	}
+	if err = os.WriteFile(out, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// a.go -> a_bencode.go，a_test.go -> a_bencode_test.go
+func outputName(file string) string {
+	base := strings.TrimSuffix(file, ".go")
+	if strings.HasSuffix(base, "_test") {
+		return strings.TrimSuffix(base, "_test") + "_bencode_test.go"
+	}
+	return base + "_bencode.go"
+}
+
+// 字段类型的分类
+type kind int
+
+const (
+	kString    kind = iota // string
+	kBytes                 // []byte
+	kByteArray             // [N]byte
+	kInt                   // int, int8 ... int64
+	kUint                  // uint, uint8 ... uint64
+	kBool                  // bool
+	kStruct                // 同一次生成的结构体
+	kSlice                 // 以上类型的切片
+	kFallback              // 其他类型，回退到反射
+)
+
+type fieldType struct {
+	kind   kind
+	expr   string     // 类型的源码
+	bits   int        // 整数的位数，0表示int/uint
+	length string     // 定长数组的长度
+	elem   *fieldType // 切片的元素类型
+}
+
+type structField struct {
+	name      string
+	key       string
+	omitEmpty bool
+	typ       *fieldType
+}
+
+type generator struct {
+	fset      *token.FileSet
+	buf       bytes.Buffer
+	structs   map[string]bool
+	needBytes bool
+}
+
+func generate(file string, names []string) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, file, nil, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	g := &generator{fset: fset, structs: map[string]bool{}}
+	for _, name := range names {
+		g.structs[strings.TrimSpace(name)] = true
+	}
+	decls := map[string]*ast.StructType{}
+	ast.Inspect(f, func(n ast.Node) bool {
+		if ts, ok := n.(*ast.TypeSpec); ok {
+			if st, ok := ts.Type.(*ast.StructType); ok && g.structs[ts.Name.Name] {
+				decls[ts.Name.Name] = st
+			}
+		}
+		return true
+	})
+	body := &g.buf
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		st, ok := decls[name]
+		if !ok {
+			return nil, fmt.Errorf("struct type %s not found in %s", name, file)
+		}
+		fields, err := g.parseFields(name, st)
+		if err != nil {
+			return nil, err
+		}
+		g.genMarshal(name, fields)
+		g.genUnmarshal(name, fields)
+	}
+
+	head := new(bytes.Buffer)
+	fmt.Fprintf(head, "// Code generated by bencodegen -type=%s; DO NOT EDIT.\n\n", strings.Join(names, ","))
+	fmt.Fprintf(head, "package %s\n\nimport (\n", f.Name.Name)
+	if g.needBytes {
+		fmt.Fprintf(head, "\t\"bytes\"\n\n")
+	}
+	fmt.Fprintf(head, "\t\"github.com/Ryan-ovo/go-bittorrent/bencode\"\n)\n")
+	src := append(head.Bytes(), body.Bytes()...)
+	res, err := format.Source(src)
+	if err != nil {
+		return nil, fmt.Errorf("format generated code: %v\n%s", err, src)
+	}
+	return res, nil
+}
+
+// 解析结构体字段，规则和bencode包的反射实现一致，返回按key排好序的字段
+func (g *generator) parseFields(name string, st *ast.StructType) ([]structField, error) {
+	var fields []structField
+	keys := map[string]bool{}
+	for _, f := range st.Fields.List {
+		var tag reflect.StructTag
+		if f.Tag != nil {
+			s, err := strconv.Unquote(f.Tag.Value)
+			if err != nil {
+				return nil, err
+			}
+			tag = reflect.StructTag(s)
+		}
+		key, opts, _ := strings.Cut(tag.Get("bencode"), ",")
+		if key == "-" && opts == "" {
+			continue
+		}
+		names := make([]string, 0, len(f.Names))
+		for _, n := range f.Names {
+			names = append(names, n.Name)
+		}
+		// 嵌入字段，只有带tag的才当作普通字段处理
+		if len(f.Names) == 0 {
+			if key == "" {
+				return nil, fmt.Errorf("%s: embedded field %s without bencode tag is not supported", name, g.expr(f.Type))
+			}
+			names = append(names, embeddedName(f.Type))
+		}
+		typ := g.fieldType(f.Type)
+		for _, n := range names {
+			if !ast.IsExported(n) {
+				continue
+			}
+			k := key
+			if k == "" {
+				k = strings.ToLower(n)
+			}
+			if keys[k] {
+				return nil, fmt.Errorf("%s: duplicate bencode key %q", name, k)
+			}
+			keys[k] = true
+			fields = append(fields, structField{
+				name:      n,
+				key:       k,
+				omitEmpty: strings.Contains(","+opts+",", ",omitempty,"),
+				typ:       typ,
+			})
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].key < fields[j].key
+	})
+	return fields, nil
+}
+
+func embeddedName(e ast.Expr) string {
+	switch t := e.(type) {
+	case *ast.StarExpr:
+		return embeddedName(t.X)
+	case *ast.SelectorExpr:
+		return t.Sel.Name
+	case *ast.Ident:
+		return t.Name
+	}
+	return ""
+}
+
+var intBits = map[string]int{
+	"int": 0, "int8": 8, "int16": 16, "int32": 32, "int64": 64,
+	"uint": 0, "uint8": 8, "byte": 8, "uint16": 16, "uint32": 32, "uint64": 64, "uintptr": 0,
+}
+
+func (g *generator) fieldType(e ast.Expr) *fieldType {
+	ft := &fieldType{kind: kFallback, expr: g.expr(e)}
+	switch t := e.(type) {
+	case *ast.Ident:
+		switch {
+		case t.Name == "string":
+			ft.kind = kString
+		case t.Name == "bool":
+			ft.kind = kBool
+		case g.structs[t.Name]:
+			ft.kind = kStruct
+		}
+		if bits, ok := intBits[t.Name]; ok {
+			ft.kind, ft.bits = kInt, bits
+			if strings.HasPrefix(t.Name, "u") || t.Name == "byte" {
+				ft.kind = kUint
+			}
+		}
+	case *ast.ArrayType:
+		elem := g.fieldType(t.Elt)
+		isByte := elem.kind == kUint && elem.bits == 8
+		if t.Len == nil {
+			if isByte {
+				ft.kind = kBytes
+			} else if elem.kind != kFallback && elem.kind != kSlice {
+				ft.kind, ft.elem = kSlice, elem
+			}
+		} else if isByte {
+			ft.kind, ft.length = kByteArray, g.expr(t.Len)
+		}
+	}
+	return ft
+}
+
+func (g *generator) expr(e ast.Expr) string {
+	buf := new(bytes.Buffer)
+	format.Node(buf, g.fset, e)
+	return buf.String()
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+func (g *generator) genMarshal(name string, fields []structField) {
+	g.printf("\n// MarshalBencode 把%s编码成Bencode字典\n", name)
+	g.printf("func (x %s) MarshalBencode() ([]byte, error) {\n", name)
+	g.printf("return x.appendBencode(make([]byte, 0, 64))\n}\n\n")
+	g.printf("func (x *%s) appendBencode(dst []byte) ([]byte, error) {\n", name)
+	if needErr(fields) {
+		g.printf("var err error\n")
+	}
+	g.printf("dst = append(dst, 'd')\n")
+	for _, f := range fields {
+		v := "x." + f.name
+		if f.typ.kind == kFallback {
+			g.printf("if dst, err = bencode.AppendField(dst, %q, &%s, %v); err != nil {\nreturn nil, err\n}\n", f.key, v, f.omitEmpty)
+			continue
+		}
+		cond := ""
+		if f.omitEmpty {
+			cond = nonEmpty(f.typ, v)
+		}
+		if cond != "" {
+			g.printf("if %s {\n", cond)
+		}
+		g.printf("dst = bencode.AppendString(dst, %q)\n", f.key)
+		g.appendValue(f.typ, v)
+		if cond != "" {
+			g.printf("}\n")
+		}
+	}
+	g.printf("dst = append(dst, 'e')\nreturn dst, nil\n}\n")
+}
+
+// 只有回退到反射或者嵌套结构体时才需要err变量
+func needErr(fields []structField) bool {
+	for _, f := range fields {
+		t := f.typ
+		if t.kind == kSlice {
+			t = t.elem
+		}
+		if t.kind == kFallback || t.kind == kStruct {
+			return true
+		}
+	}
+	return false
+}
+
+func nonEmpty(t *fieldType, v string) string {
+	switch t.kind {
+	case kString, kBytes, kSlice:
+		return "len(" + v + ") != 0"
+	case kByteArray:
+		if t.length == "0" {
+			return "false"
+		}
+	case kInt, kUint:
+		return v + " != 0"
+	case kBool:
+		return v
+	}
+	return ""
+}
+
+func (g *generator) appendValue(t *fieldType, v string) {
+	switch t.kind {
+	case kString:
+		g.printf("dst = bencode.AppendString(dst, %s)\n", v)
+	case kBytes:
+		g.printf("dst = bencode.AppendBytes(dst, %s)\n", v)
+	case kByteArray:
+		g.printf("dst = bencode.AppendBytes(dst, %s[:])\n", v)
+	case kInt:
+		g.printf("dst = bencode.AppendInt(dst, int64(%s))\n", v)
+	case kUint:
+		g.printf("dst = bencode.AppendUint(dst, uint64(%s))\n", v)
+	case kBool:
+		g.printf("if %s {\ndst = bencode.AppendInt(dst, 1)\n} else {\ndst = bencode.AppendInt(dst, 0)\n}\n", v)
+	case kStruct:
+		g.printf("if dst, err = %s.appendBencode(dst); err != nil {\nreturn nil, err\n}\n", v)
+	case kSlice:
+		g.printf("dst = append(dst, 'l')\nfor i := range %s {\n", v)
+		g.appendValue(t.elem, v+"[i]")
+		g.printf("}\ndst = append(dst, 'e')\n")
+	}
+}
+
+func (g *generator) genUnmarshal(name string, fields []structField) {
+	g.printf("\n// UnmarshalBencode 从Bencode字典解码%s\n", name)
+	g.printf("func (x *%s) UnmarshalBencode(data []byte) error {\n", name)
+	g.printf("return x.decodeBencode(bencode.NewScanner(data))\n}\n\n")
+	g.printf("func (x *%s) decodeBencode(s *bencode.Scanner) error {\n", name)
+	g.printf("if err := s.DictStart(); err != nil {\nreturn err\n}\n")
+	g.printf("for s.More() {\nkey, err := s.ReadString()\nif err != nil {\nreturn err\n}\n")
+	g.printf("switch string(key) {\n")
+	for _, f := range fields {
+		g.printf("case %q:\n", f.key)
+		g.decodeValue(f.typ, "x."+f.name)
+	}
+	g.printf("default:\nerr = s.Skip()\n}\nif err != nil {\nreturn err\n}\n}\n")
+	g.printf("return s.End()\n}\n")
+}
+
+// 生成解码到v的代码，出错时把错误赋值给外层的err
+func (g *generator) decodeValue(t *fieldType, v string) {
+	switch t.kind {
+	case kString, kBytes:
+		g.printf("var b []byte\nif b, err = s.ReadString(); err == nil {\n")
+		if t.kind == kString {
+			g.printf("%s = string(b)\n", v)
+		} else {
+			g.printf("%s = append([]byte{}, b...)\n", v)
+		}
+		g.printf("}\n")
+	case kByteArray:
+		g.printf("err = s.ReadFixed(%s[:])\n", v)
+	case kInt:
+		g.printf("var n int64\nif n, err = s.ReadInt(%d); err == nil {\n%s = %s(n)\n}\n", t.bits, v, t.expr)
+	case kUint:
+		g.printf("var n uint64\nif n, err = s.ReadUint(%d); err == nil {\n%s = %s(n)\n}\n", t.bits, v, t.expr)
+	case kBool:
+		g.printf("%s, err = s.ReadBool()\n", v)
+	case kStruct:
+		g.printf("err = %s.decodeBencode(s)\n", v)
+	case kSlice:
+		g.printf("if err = s.ListStart(); err != nil {\nreturn err\n}\n")
+		g.printf("list := make(%s, 0)\nfor s.More() {\nvar elem %s\n", t.expr, t.elem.expr)
+		g.decodeValue(t.elem, "elem")
+		g.printf("if err != nil {\nreturn err\n}\nlist = append(list, elem)\n}\n")
+		g.printf("%s = list\nerr = s.End()\n", v)
+	default:
+		g.needBytes = true
+		g.printf("var raw []byte\nif raw, err = s.ReadValue(); err == nil {\nerr = bencode.Unmarshal(bytes.NewReader(raw), &%s)\n}\n", v)
+	}
+}
@@ -0,0 +1,238 @@
+// Code generated by bencodegen -type=Announce,AnnouncePeer; DO NOT EDIT.
+
+package bencode_test
+
+import (
+	"bytes"
+
+	"github.com/Ryan-ovo/go-bittorrent/bencode"
+)
+
+// MarshalBencode 把Announce编码成Bencode字典
+func (x Announce) MarshalBencode() ([]byte, error) {
+	return x.appendBencode(make([]byte, 0, 64))
+}
+
+func (x *Announce) appendBencode(dst []byte) ([]byte, error) {
+	var err error
+	dst = append(dst, 'd')
+	dst = bencode.AppendString(dst, "complete")
+	dst = bencode.AppendInt(dst, int64(x.Complete))
+	if dst, err = bencode.AppendField(dst, "extra", &x.Extra, true); err != nil {
+		return nil, err
+	}
+	if x.Flags != 0 {
+		dst = bencode.AppendString(dst, "flags")
+		dst = bencode.AppendInt(dst, int64(x.Flags))
+	}
+	dst = bencode.AppendString(dst, "incomplete")
+	dst = bencode.AppendInt(dst, int64(x.Incomplete))
+	dst = bencode.AppendString(dst, "info hash")
+	dst = bencode.AppendBytes(dst, x.InfoHash[:])
+	dst = bencode.AppendString(dst, "interval")
+	dst = bencode.AppendInt(dst, int64(x.Interval))
+	if x.MinInterval != 0 {
+		dst = bencode.AppendString(dst, "min interval")
+		dst = bencode.AppendInt(dst, int64(x.MinInterval))
+	}
+	dst = bencode.AppendString(dst, "peers")
+	dst = append(dst, 'l')
+	for i := range x.Peers {
+		if dst, err = x.Peers[i].appendBencode(dst); err != nil {
+			return nil, err
+		}
+	}
+	dst = append(dst, 'e')
+	if len(x.Peers6) != 0 {
+		dst = bencode.AppendString(dst, "peers6")
+		dst = bencode.AppendBytes(dst, x.Peers6)
+	}
+	dst = bencode.AppendString(dst, "private")
+	if x.Private {
+		dst = bencode.AppendInt(dst, 1)
+	} else {
+		dst = bencode.AppendInt(dst, 0)
+	}
+	if len(x.Sizes) != 0 {
+		dst = bencode.AppendString(dst, "sizes")
+		dst = append(dst, 'l')
+		for i := range x.Sizes {
+			dst = bencode.AppendInt(dst, int64(x.Sizes[i]))
+		}
+		dst = append(dst, 'e')
+	}
+	if len(x.TrackerID) != 0 {
+		dst = bencode.AppendString(dst, "tracker id")
+		dst = bencode.AppendString(dst, x.TrackerID)
+	}
+	if len(x.Warning) != 0 {
+		dst = bencode.AppendString(dst, "warning message")
+		dst = bencode.AppendString(dst, x.Warning)
+	}
+	dst = append(dst, 'e')
+	return dst, nil
+}
+
+// UnmarshalBencode 从Bencode字典解码Announce
+func (x *Announce) UnmarshalBencode(data []byte) error {
+	return x.decodeBencode(bencode.NewScanner(data))
+}
+
+func (x *Announce) decodeBencode(s *bencode.Scanner) error {
+	if err := s.DictStart(); err != nil {
+		return err
+	}
+	for s.More() {
+		key, err := s.ReadString()
+		if err != nil {
+			return err
+		}
+		switch string(key) {
+		case "complete":
+			var n int64
+			if n, err = s.ReadInt(0); err == nil {
+				x.Complete = int(n)
+			}
+		case "extra":
+			var raw []byte
+			if raw, err = s.ReadValue(); err == nil {
+				err = bencode.Unmarshal(bytes.NewReader(raw), &x.Extra)
+			}
+		case "flags":
+			var n int64
+			if n, err = s.ReadInt(8); err == nil {
+				x.Flags = int8(n)
+			}
+		case "incomplete":
+			var n int64
+			if n, err = s.ReadInt(0); err == nil {
+				x.Incomplete = int(n)
+			}
+		case "info hash":
+			err = s.ReadFixed(x.InfoHash[:])
+		case "interval":
+			var n int64
+			if n, err = s.ReadInt(0); err == nil {
+				x.Interval = int(n)
+			}
+		case "min interval":
+			var n int64
+			if n, err = s.ReadInt(0); err == nil {
+				x.MinInterval = int(n)
+			}
+		case "peers":
+			if err = s.ListStart(); err != nil {
+				return err
+			}
+			list := make([]AnnouncePeer, 0)
+			for s.More() {
+				var elem AnnouncePeer
+				err = elem.decodeBencode(s)
+				if err != nil {
+					return err
+				}
+				list = append(list, elem)
+			}
+			x.Peers = list
+			err = s.End()
+		case "peers6":
+			var b []byte
+			if b, err = s.ReadString(); err == nil {
+				x.Peers6 = append([]byte{}, b...)
+			}
+		case "private":
+			x.Private, err = s.ReadBool()
+		case "sizes":
+			if err = s.ListStart(); err != nil {
+				return err
+			}
+			list := make([]int64, 0)
+			for s.More() {
+				var elem int64
+				var n int64
+				if n, err = s.ReadInt(64); err == nil {
+					elem = int64(n)
+				}
+				if err != nil {
+					return err
+				}
+				list = append(list, elem)
+			}
+			x.Sizes = list
+			err = s.End()
+		case "tracker id":
+			var b []byte
+			if b, err = s.ReadString(); err == nil {
+				x.TrackerID = string(b)
+			}
+		case "warning message":
+			var b []byte
+			if b, err = s.ReadString(); err == nil {
+				x.Warning = string(b)
+			}
+		default:
+			err = s.Skip()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return s.End()
+}
+
+// MarshalBencode 把AnnouncePeer编码成Bencode字典
+func (x AnnouncePeer) MarshalBencode() ([]byte, error) {
+	return x.appendBencode(make([]byte, 0, 64))
+}
+
+func (x *AnnouncePeer) appendBencode(dst []byte) ([]byte, error) {
+	dst = append(dst, 'd')
+	dst = bencode.AppendString(dst, "ip")
+	dst = bencode.AppendString(dst, x.IP)
+	dst = bencode.AppendString(dst, "peer id")
+	dst = bencode.AppendBytes(dst, x.ID)
+	dst = bencode.AppendString(dst, "port")
+	dst = bencode.AppendUint(dst, uint64(x.Port))
+	dst = append(dst, 'e')
+	return dst, nil
+}
+
+// UnmarshalBencode 从Bencode字典解码AnnouncePeer
+func (x *AnnouncePeer) UnmarshalBencode(data []byte) error {
+	return x.decodeBencode(bencode.NewScanner(data))
+}
+
+func (x *AnnouncePeer) decodeBencode(s *bencode.Scanner) error {
+	if err := s.DictStart(); err != nil {
+		return err
+	}
+	for s.More() {
+		key, err := s.ReadString()
+		if err != nil {
+			return err
+		}
+		switch string(key) {
+		case "ip":
+			var b []byte
+			if b, err = s.ReadString(); err == nil {
+				x.IP = string(b)
+			}
+		case "peer id":
+			var b []byte
+			if b, err = s.ReadString(); err == nil {
+				x.ID = append([]byte{}, b...)
+			}
+		case "port":
+			var n uint64
+			if n, err = s.ReadUint(16); err == nil {
+				x.Port = uint16(n)
+			}
+		default:
+			err = s.Skip()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return s.End()
+}
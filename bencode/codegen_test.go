@@ -0,0 +1,170 @@
+package bencode_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Ryan-ovo/go-bittorrent/bencode"
+	"github.com/stretchr/testify/assert"
+)
+
+//go:generate go run ./bencodegen -type=Announce,AnnouncePeer
+
+// Announce tracker的announce响应，编解码方法由bencodegen生成
+type Announce struct {
+	Complete    int            `bencode:"complete"`
+	Incomplete  int            `bencode:"incomplete"`
+	Interval    int            `bencode:"interval"`
+	MinInterval int            `bencode:"min interval,omitempty"`
+	TrackerID   string         `bencode:"tracker id,omitempty"`
+	Warning     string         `bencode:"warning message,omitempty"`
+	Peers       []AnnouncePeer `bencode:"peers"`
+	Peers6      []byte         `bencode:"peers6,omitempty"`
+	Private     bool           `bencode:"private"`
+	InfoHash    [20]byte       `bencode:"info hash"`
+	Sizes       []int64        `bencode:"sizes,omitempty"`
+	Flags       int8           `bencode:"flags,omitempty"`
+	Extra       map[string]int `bencode:"extra,omitempty"`
+	Cache       string         `bencode:"-"`
+}
+
+type AnnouncePeer struct {
+	ID   []byte `bencode:"peer id"`
+	IP   string `bencode:"ip"`
+	Port uint16 `bencode:"port"`
+}
+
+// 和上面字段完全一样但没有生成方法的结构体，走反射
+type plainAnnounce struct {
+	Complete    int            `bencode:"complete"`
+	Incomplete  int            `bencode:"incomplete"`
+	Interval    int            `bencode:"interval"`
+	MinInterval int            `bencode:"min interval,omitempty"`
+	TrackerID   string         `bencode:"tracker id,omitempty"`
+	Warning     string         `bencode:"warning message,omitempty"`
+	Peers       []plainPeer    `bencode:"peers"`
+	Peers6      []byte         `bencode:"peers6,omitempty"`
+	Private     bool           `bencode:"private"`
+	InfoHash    [20]byte       `bencode:"info hash"`
+	Sizes       []int64        `bencode:"sizes,omitempty"`
+	Flags       int8           `bencode:"flags,omitempty"`
+	Extra       map[string]int `bencode:"extra,omitempty"`
+	Cache       string         `bencode:"-"`
+}
+
+type plainPeer struct {
+	ID   []byte `bencode:"peer id"`
+	IP   string `bencode:"ip"`
+	Port uint16 `bencode:"port"`
+}
+
+func newAnnounce(peers int) *Announce {
+	a := &Announce{Complete: 12, Incomplete: 3, Interval: 1800, TrackerID: "abc", Private: true}
+	copy(a.InfoHash[:], "0123456789abcdefghij")
+	for i := 0; i < peers; i++ {
+		a.Peers = append(a.Peers, AnnouncePeer{
+			ID:   []byte("-GB0001-abcdefghijkl"),
+			IP:   "192.168.1.100",
+			Port: uint16(6881 + i),
+		})
+	}
+	return a
+}
+
+func encode(t testing.TB, v interface{}) []byte {
+	buf := new(bytes.Buffer)
+	if err := bencode.NewEncoder(buf).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGeneratedMatchesReflect(t *testing.T) {
+	a := newAnnounce(3)
+	a.Sizes = []int64{-1, 1 << 40}
+	a.Extra = map[string]int{"x": 1}
+	a.Cache = "ignored"
+	data, err := a.MarshalBencode()
+	assert.Equal(t, nil, err)
+
+	// 编码结果和反射一致
+	p := &plainAnnounce{}
+	assert.Equal(t, nil, bencode.Unmarshal(bytes.NewReader(data), p))
+	assert.Equal(t, encode(t, p), data)
+
+	// 解码结果和反射一致
+	inputs := []string{
+		string(data),
+		"d8:completei1e5:peerslee",
+		"d5:extrad1:ai1ee5:flagsi-3e7:privatei0e6:unused3:abce",
+		"d8:completei1e8:completei2ee",
+	}
+	for _, in := range inputs {
+		g, p := &Announce{}, &plainAnnounce{}
+		errG := g.UnmarshalBencode([]byte(in))
+		errP := bencode.Unmarshal(bytes.NewBufferString(in), p)
+		assert.Equal(t, nil, errG, in)
+		assert.Equal(t, nil, errP, in)
+		assert.Equal(t, encode(t, p), encode(t, g), in)
+	}
+
+	// 出错的情况也一致
+	bad := []string{
+		"d5:flagsi300ee",
+		"d5:peersld4:porti-1eeee",
+		"d7:privatei2ee",
+		"d9:info hash3:abce",
+		"d8:complete3:abce",
+		"d5:peersld4:porti70000eeee",
+		"d8:completei1e",
+	}
+	for _, in := range bad {
+		g, p := &Announce{}, &plainAnnounce{}
+		assert.NotEqual(t, nil, g.UnmarshalBencode([]byte(in)), in)
+		assert.NotEqual(t, nil, bencode.Unmarshal(bytes.NewBufferString(in), p), in)
+	}
+}
+
+func BenchmarkMarshalReflect(b *testing.B) {
+	p := &plainAnnounce{}
+	data, _ := newAnnounce(50).MarshalBencode()
+	bencode.Unmarshal(bytes.NewReader(data), p)
+	buf := new(bytes.Buffer)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		bencode.Marshal(buf, p)
+	}
+}
+
+func BenchmarkMarshalGenerated(b *testing.B) {
+	a := newAnnounce(50)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		a.MarshalBencode()
+	}
+}
+
+func BenchmarkUnmarshalReflect(b *testing.B) {
+	data, _ := newAnnounce(50).MarshalBencode()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p := &plainAnnounce{}
+		bencode.Unmarshal(bytes.NewReader(data), p)
+	}
+}
+
+func BenchmarkUnmarshalGenerated(b *testing.B) {
+	data, _ := newAnnounce(50).MarshalBencode()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		a := &Announce{}
+		a.UnmarshalBencode(data)
+	}
+}
@@ -1,6 +1,9 @@
 package bencode
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	TypeError  = errors.New("wrong type")
@@ -8,4 +11,39 @@ var (
 	ColonError = errors.New("expect colon")
 	CharIError = errors.New("expect char i")
 	CharEError = errors.New("expect char e")
+
+	// 严格模式下的错误
+	LeadingZeroError  = errors.New("leading zero in number")
+	NegativeZeroError = errors.New("negative zero")
+	UnsortedKeyError  = errors.New("dict keys not sorted")
+	DuplicateKeyError = errors.New("duplicate dict key")
+	TrailingDataError = errors.New("trailing data after value")
+
+	UnknownFieldError = errors.New("unknown field")
+	NotFoundError     = errors.New("value not found")
+	RangeError        = errors.New("integer out of range")
+
+	// 解析不可信数据时的资源限制错误
+	OverflowError    = errors.New("integer overflow")
+	StringLimitError = errors.New("string too long")
+	DepthLimitError  = errors.New("nesting too deep")
+	SizeLimitError   = errors.New("input too large")
 )
+
+// SyntaxError 解析错误，带上出错的字节偏移和key路径
+type SyntaxError struct {
+	Offset int64  // 出错位置的字节偏移
+	Path   string // 出错值的key路径，比如info.files[3].length
+	Err    error  // 具体的错误原因
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("bencode: %v at offset %d", e.Err, e.Offset)
+	}
+	return fmt.Sprintf("bencode: %v at offset %d (%s)", e.Err, e.Offset, e.Path)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
@@ -1,60 +1,246 @@
 package bencode
 
 import (
+	"bytes"
+	"encoding"
+	"fmt"
 	"io"
+	"math/big"
 	"reflect"
-	"strings"
+	"sort"
+	"strconv"
+	"time"
 )
 
-// Marshal 把x这个结构序列化到TorrentFile中，返回写入的字节数
+// Marshaler 自定义类型的序列化，返回的必须是一个完整合法的Bencode值
+type Marshaler interface {
+	MarshalBencode() ([]byte, error)
+}
+
+var (
+	marshalerType     = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	timeType          = reflect.TypeOf(time.Time{})
+	bigIntType        = reflect.TypeOf(big.Int{})
+)
+
+// Marshal 把x这个结构序列化到TorrentFile中，返回写入的字节数，序列化失败返回0
 func Marshal(w io.Writer, x interface{}) int {
+	wLen, err := marshal(w, x)
+	if err != nil {
+		return 0
+	}
+	return wLen
+}
+
+// Encoder 把Go的值序列化后写入流中，和Marshal不同的是会返回具体的错误
+type Encoder struct {
+	w io.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+func (e *Encoder) Encode(v interface{}) error {
+	_, err := marshal(e.w, v)
+	return err
+}
+
+// 先序列化到缓冲区，成功后再一次写入w，失败时不会在w中留下不完整的数据
+func marshal(w io.Writer, x interface{}) (int, error) {
 	v := reflect.ValueOf(x)
 	// 如果是指针，则取一下值
-	if v.Kind() == reflect.Pointer {
+	if v.Kind() == reflect.Pointer && !v.Type().Implements(marshalerType) {
 		v = v.Elem()
 	}
-	return marshalValue(w, v)
+	buf := new(bytes.Buffer)
+	if _, err := marshalValue(buf, v); err != nil {
+		return 0, err
+	}
+	return w.Write(buf.Bytes())
 }
 
-func marshalValue(w io.Writer, v reflect.Value) int {
-	wLen := 0
+func marshalValue(w io.Writer, v reflect.Value) (int, error) {
+	if !v.IsValid() {
+		return 0, fmt.Errorf("%w: cannot marshal nil", TypeError)
+	}
+	// time.Time编码成unix时间戳，比如种子文件的creation date
+	if v.Type() == timeType {
+		return writeRawInt(w, strconv.FormatInt(v.Interface().(time.Time).Unix(), 10))
+	}
+	// big.Int编码成整数，不能走TextMarshaler
+	if v.Type() == bigIntType {
+		n := v.Interface().(big.Int)
+		return writeRawInt(w, n.String())
+	}
+	if v.Kind() == reflect.Pointer && v.Type().Elem() == bigIntType && !v.IsNil() {
+		return writeRawInt(w, v.Interface().(*big.Int).String())
+	}
+	if m, ok := asType(v, marshalerType); ok {
+		return marshalCustom(w, m.(Marshaler))
+	}
+	if m, ok := asType(v, textMarshalerType); ok {
+		text, err := m.(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return 0, err
+		}
+		return EncodeString(w, string(text)), nil
+	}
 	switch v.Kind() {
 	case reflect.String:
-		wLen += EncodeString(w, v.String())
-	case reflect.Int:
-		wLen += EncodeInt(w, int(v.Int()))
+		return EncodeString(w, v.String()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return writeRawInt(w, strconv.FormatInt(v.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return writeRawInt(w, strconv.FormatUint(v.Uint(), 10))
+	case reflect.Bool:
+		// bool编码成0或1
+		if v.Bool() {
+			return writeRawInt(w, "1")
+		}
+		return writeRawInt(w, "0")
 	case reflect.Slice:
-		wLen += marshalList(w, v)
+		// []byte当作字符串处理
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return EncodeString(w, string(v.Bytes())), nil
+		}
+		return marshalList(w, v)
+	case reflect.Array:
+		// [20]byte这种定长字节数组也当作字符串处理
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			buf := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(buf), v)
+			return EncodeString(w, string(buf)), nil
+		}
+		return marshalList(w, v)
+	case reflect.Map:
+		return marshalMap(w, v)
 	case reflect.Struct:
-		wLen += marshalDict(w, v)
+		return marshalDict(w, v)
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return 0, fmt.Errorf("%w: cannot marshal nil %s", TypeError, v.Type())
+		}
+		return marshalValue(w, v.Elem())
 	}
-	return wLen
+	return 0, fmt.Errorf("%w: cannot marshal %s", TypeError, v.Kind())
 }
 
-func marshalList(w io.Writer, vl reflect.Value) int {
+func marshalList(w io.Writer, vl reflect.Value) (int, error) {
 	wLen := 2
 	w.Write([]byte{'l'})
 	for i := 0; i < vl.Len(); i++ {
 		elem := vl.Index(i)
-		wLen += marshalValue(w, elem)
+		n, err := marshalValue(w, elem)
+		if err != nil {
+			return 0, err
+		}
+		wLen += n
 	}
 	w.Write([]byte{'e'})
-	return wLen
+	return wLen, nil
+}
+
+// 序列化map[string]T，key按字节序排列
+func marshalMap(w io.Writer, vm reflect.Value) (int, error) {
+	if vm.Type().Key().Kind() != reflect.String {
+		return 0, fmt.Errorf("%w: map key must be string, get %s", TypeError, vm.Type().Key())
+	}
+	keys := make([]string, 0, vm.Len())
+	for _, k := range vm.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	wLen := 2
+	w.Write([]byte{'d'})
+	for _, k := range keys {
+		elem := vm.MapIndex(reflect.ValueOf(k).Convert(vm.Type().Key()))
+		// 空指针没有对应的编码，直接跳过
+		if isNil(elem) {
+			continue
+		}
+		wLen += EncodeString(w, k)
+		n, err := marshalValue(w, elem)
+		if err != nil {
+			return 0, err
+		}
+		wLen += n
+	}
+	w.Write([]byte{'e'})
+	return wLen, nil
 }
 
-func marshalDict(w io.Writer, vd reflect.Value) int {
+func marshalDict(w io.Writer, vd reflect.Value) (int, error) {
 	wLen := 2
 	w.Write([]byte{'d'})
-	for i := 0; i < vd.NumField(); i++ {
-		tf := vd.Type().Field(i)
-		vf := vd.Field(i)
-		key := tf.Tag.Get("bencode")
-		if key == "" {
-			key = strings.ToLower(tf.Name)
+	for _, f := range cachedFields(vd.Type()) {
+		vf, ok := fieldByIndex(vd, f.index, false)
+		// 空指针没有对应的编码，直接跳过
+		if !ok || isNil(vf) || (f.omitEmpty && isEmptyValue(vf)) {
+			continue
+		}
+		wLen += EncodeString(w, f.key)
+		n, err := marshalValue(w, vf)
+		if err != nil {
+			return 0, err
 		}
-		wLen += EncodeString(w, key)
-		wLen += marshalValue(w, vf)
+		wLen += n
 	}
 	w.Write([]byte{'e'})
-	return wLen
+	return wLen, nil
+}
+
+// AppendField 供bencodegen生成的代码使用：用反射把ptr指向的字段作为key的值追加到dst后面，
+// 规则和Marshal一致，空指针跳过，omitEmpty为true时零值也跳过
+func AppendField(dst []byte, key string, ptr interface{}, omitEmpty bool) ([]byte, error) {
+	v := reflect.ValueOf(ptr).Elem()
+	if isNil(v) || (omitEmpty && isEmptyValue(v)) {
+		return dst, nil
+	}
+	buf := bytes.NewBuffer(AppendString(dst, key))
+	if _, err := marshalValue(buf, v); err != nil {
+		return dst, err
+	}
+	return buf.Bytes(), nil
+}
+
+// 判断v或者v的指针是否实现了接口t，空指针不算实现
+func asType(v reflect.Value, t reflect.Type) (interface{}, bool) {
+	if v.Kind() == reflect.Pointer && v.IsNil() {
+		return nil, false
+	}
+	if v.Type().Implements(t) && v.CanInterface() {
+		return v.Interface(), true
+	}
+	// 值可以取地址时，指针接收者的方法也可以使用
+	if v.Kind() != reflect.Pointer && v.CanAddr() && reflect.PointerTo(v.Type()).Implements(t) && v.Addr().CanInterface() {
+		return v.Addr().Interface(), true
+	}
+	return nil, false
+}
+
+// 写入自定义序列化的结果，写入前校验是不是一个完整的规范编码的Bencode值
+func marshalCustom(w io.Writer, m Marshaler) (int, error) {
+	b, err := m.MarshalBencode()
+	if err != nil {
+		return 0, err
+	}
+	if err = validCanonical(b); err != nil {
+		return 0, fmt.Errorf("invalid output of MarshalBencode for %T: %w", m, err)
+	}
+	return w.Write(b)
+}
+
+// 把已经转成十进制的整数编码到流中
+func writeRawInt(w io.Writer, digits string) (int, error) {
+	return io.WriteString(w, "i"+digits+"e")
+}
+
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
 }
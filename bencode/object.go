@@ -0,0 +1,235 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+/*
+直接构造和修改BObject，不需要为每个key声明结构体：
+
+	root, err := Parse(r)
+	path, err := root.Get("info", "files", 0, "path")
+	info, _ := root.Get("info")
+	info.Set("private", NewInt(1))
+	root.Bencode(w)
+*/
+
+func NewString(val string) *BObject {
+	return &BObject{typ: STR, val: val}
+}
+
+func NewInt(val int) *BObject {
+	return &BObject{typ: INT, val: int64(val)}
+}
+
+func NewInt64(val int64) *BObject {
+	return &BObject{typ: INT, val: val}
+}
+
+// NewBigInt 构造任意大小的整数，会拷贝一份val
+func NewBigInt(val *big.Int) *BObject {
+	return &BObject{typ: INT, val: bigValue(val)}
+}
+
+// 能放进int64的整数统一保存为int64
+func bigValue(n *big.Int) BValue {
+	if n.IsInt64() {
+		return n.Int64()
+	}
+	return new(big.Int).Set(n)
+}
+
+func NewList(items ...*BObject) *BObject {
+	list := make([]*BObject, 0, len(items))
+	return &BObject{typ: LIST, val: append(list, items...)}
+}
+
+// NewDict 构造字典，dict为nil时返回空字典
+func NewDict(dict map[string]*BObject) *BObject {
+	if dict == nil {
+		dict = make(map[string]*BObject)
+	}
+	return &BObject{typ: DICT, val: dict}
+}
+
+// Type 返回值的类型，方便按类型分支处理
+func (b *BObject) Type() BType {
+	return b.typ
+}
+
+// Len 返回字符串的长度、列表或字典的元素个数，整数返回0
+func (b *BObject) Len() int {
+	switch b.typ {
+	case STR:
+		return len(b.val.(string))
+	case LIST:
+		return len(b.val.([]*BObject))
+	case DICT:
+		return len(b.val.(map[string]*BObject))
+	}
+	return 0
+}
+
+// Keys 按字节序返回字典的所有key，和编码时的顺序一致
+func (b *BObject) Keys() ([]string, error) {
+	dict, err := b.Dict()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(dict))
+	for k := range dict {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+/*
+Get 按路径查找子节点，路径的元素是字典key(string)或者列表下标(int)：
+
+	obj.Get("info", "files", 0, "path")
+
+路径不存在时返回NotFoundError，中间节点的类型不匹配时返回TypeError
+*/
+func (b *BObject) Get(path ...interface{}) (*BObject, error) {
+	cur := b
+	for i, p := range path {
+		switch p := p.(type) {
+		case string:
+			dict, err := cur.Dict()
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s is %s, not dict", TypeError, pathName(path[:i]), cur.typ)
+			}
+			next, ok := dict[p]
+			if !ok {
+				return nil, fmt.Errorf("%w: %s", NotFoundError, formatPath(path[:i+1]))
+			}
+			cur = next
+		case int:
+			list, err := cur.List()
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s is %s, not list", TypeError, pathName(path[:i]), cur.typ)
+			}
+			if p < 0 || p >= len(list) {
+				return nil, fmt.Errorf("%w: %s", NotFoundError, formatPath(path[:i+1]))
+			}
+			cur = list[p]
+		default:
+			return nil, fmt.Errorf("%w: path element %v must be string or int", TypeError, p)
+		}
+	}
+	return cur, nil
+}
+
+// 路径为空时表示根节点
+func pathName(path []interface{}) string {
+	if len(path) == 0 {
+		return "root"
+	}
+	return formatPath(path)
+}
+
+// SetStr 把值修改为字符串
+func (b *BObject) SetStr(val string) {
+	b.typ, b.val = STR, val
+}
+
+// SetInt 把值修改为整数
+func (b *BObject) SetInt(val int) {
+	b.typ, b.val = INT, int64(val)
+}
+
+// SetBigInt 把值修改为任意大小的整数
+func (b *BObject) SetBigInt(val *big.Int) {
+	b.typ, b.val = INT, bigValue(val)
+}
+
+// Set 设置字典中key对应的值，key已存在时覆盖
+func (b *BObject) Set(key string, val *BObject) error {
+	dict, err := b.Dict()
+	if err != nil {
+		return err
+	}
+	if val == nil {
+		return fmt.Errorf("%w: nil value for key %q", TypeError, key)
+	}
+	dict[key] = val
+	return nil
+}
+
+// Delete 删除字典中的key，key不存在时不做任何事
+func (b *BObject) Delete(key string) error {
+	dict, err := b.Dict()
+	if err != nil {
+		return err
+	}
+	delete(dict, key)
+	return nil
+}
+
+// Append 在列表末尾追加元素
+func (b *BObject) Append(items ...*BObject) error {
+	list, err := b.List()
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if item == nil {
+			return fmt.Errorf("%w: nil list item", TypeError)
+		}
+	}
+	b.val = append(list, items...)
+	return nil
+}
+
+// SetIndex 替换列表中第i个元素
+func (b *BObject) SetIndex(i int, val *BObject) error {
+	list, err := b.List()
+	if err != nil {
+		return err
+	}
+	if i < 0 || i >= len(list) {
+		return fmt.Errorf("%w: index %d", NotFoundError, i)
+	}
+	if val == nil {
+		return fmt.Errorf("%w: nil list item", TypeError)
+	}
+	list[i] = val
+	return nil
+}
+
+// RemoveIndex 删除列表中第i个元素
+func (b *BObject) RemoveIndex(i int) error {
+	list, err := b.List()
+	if err != nil {
+		return err
+	}
+	if i < 0 || i >= len(list) {
+		return fmt.Errorf("%w: index %d", NotFoundError, i)
+	}
+	b.val = append(list[:i], list[i+1:]...)
+	return nil
+}
+
+// MarshalBencode 使BObject可以作为结构体字段参与序列化
+func (b *BObject) MarshalBencode() ([]byte, error) {
+	if b.typ < STR || b.typ > DICT {
+		return nil, fmt.Errorf("%w: empty BObject", TypeError)
+	}
+	buf := new(bytes.Buffer)
+	b.Bencode(buf)
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBencode 使BObject可以作为结构体字段，保存对应的整棵子树
+func (b *BObject) UnmarshalBencode(data []byte) error {
+	obj, err := Parse(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	*b = *obj
+	return nil
+}
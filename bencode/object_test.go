@@ -0,0 +1,84 @@
+package bencode
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildObject(t *testing.T) {
+	root := NewDict(nil)
+	assert.Equal(t, DICT, root.Type())
+	assert.Equal(t, nil, root.Set("announce", NewString("http://tracker")))
+	assert.Equal(t, nil, root.Set("info", NewDict(map[string]*BObject{
+		"name":  NewString("dir"),
+		"files": NewList(NewDict(map[string]*BObject{"length": NewInt(3), "path": NewList(NewString("a"))})),
+	})))
+	files, err := root.Get("info", "files")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, files.Append(NewDict(map[string]*BObject{"length": NewInt(5), "path": NewList(NewString("b"))})))
+	assert.Equal(t, 2, files.Len())
+
+	buf := new(bytes.Buffer)
+	root.Bencode(buf)
+	assert.Equal(t, "d8:announce14:http://tracker4:infod5:filesld6:lengthi3e4:pathl1:aeed6:lengthi5e4:pathl1:beee4:name3:diree", buf.String())
+
+	// 修改后再查询
+	path, err := root.Get("info", "files", 1, "path", 0)
+	assert.Equal(t, nil, err)
+	path.SetStr("c")
+	length, _ := root.Get("info", "files", 0, "length")
+	length.SetInt(7)
+	assert.Equal(t, nil, files.RemoveIndex(1))
+	assert.Equal(t, nil, root.Delete("announce"))
+	keys, _ := root.Keys()
+	assert.Equal(t, []string{"info"}, keys)
+	buf.Reset()
+	root.Bencode(buf)
+	assert.Equal(t, "d4:infod5:filesld6:lengthi7e4:pathl1:aeee4:name3:diree", buf.String())
+}
+
+func TestGetPath(t *testing.T) {
+	root, err := Parse(bytes.NewBufferString("d4:infod5:filesld6:lengthi3e4:pathl1:a1:beeeee"))
+	assert.Equal(t, nil, err)
+	path, err := root.Get("info", "files", 0, "path", 1)
+	assert.Equal(t, nil, err)
+	str, _ := path.Str()
+	assert.Equal(t, "b", str)
+	self, _ := root.Get()
+	assert.Equal(t, root, self)
+
+	_, err = root.Get("info", "files", 1)
+	assert.ErrorIs(t, err, NotFoundError)
+	assert.Equal(t, "value not found: info.files[1]", err.Error())
+	_, err = root.Get("info", "name")
+	assert.ErrorIs(t, err, NotFoundError)
+	_, err = root.Get("info", "files", "x")
+	assert.ErrorIs(t, err, TypeError)
+	_, err = root.Get(0)
+	assert.ErrorIs(t, err, TypeError)
+	_, err = root.Get(1.5)
+	assert.ErrorIs(t, err, TypeError)
+
+	// 类型不对的修改
+	assert.ErrorIs(t, path.Append(NewInt(1)), TypeError)
+	assert.ErrorIs(t, root.SetIndex(0, NewInt(1)), TypeError)
+	files, _ := root.Get("info", "files")
+	assert.ErrorIs(t, files.SetIndex(2, NewInt(1)), NotFoundError)
+	assert.ErrorIs(t, root.Set("x", nil), TypeError)
+}
+
+func TestObjectField(t *testing.T) {
+	type meta struct {
+		Info *BObject `bencode:"info"`
+		Name string   `bencode:"name"`
+	}
+	str := "d4:infod1:ai1e1:bl1:xee4:name1:ne"
+	v := &meta{}
+	assert.Equal(t, nil, Unmarshal(bytes.NewBufferString(str), v))
+	assert.Equal(t, DICT, v.Info.Type())
+	buf := new(bytes.Buffer)
+	Marshal(buf, v)
+	assert.Equal(t, str, buf.String())
+}
@@ -2,75 +2,444 @@ package bencode
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"io"
+	"math/big"
+	"strconv"
 )
 
+// 数字最多的位数，防止恶意构造的超长数字
+const maxNumLen = 256
+
+// 字符串按块读取，避免一次性分配对方声称的长度
+const readChunk = 32 * 1024
+
+// Limits 解析时的资源限制，字段为0表示不限制
+type Limits struct {
+	MaxStringLen int   // 单个字符串的最大长度
+	MaxDepth     int   // 列表和字典的最大嵌套深度
+	MaxSize      int64 // 最多读取的字节数
+}
+
+// DefaultLimits 默认的资源限制，足够解析常见的种子文件和tracker响应
+var DefaultLimits = Limits{
+	MaxStringLen: 64 << 20,
+	MaxDepth:     256,
+}
+
 // Parse 解析流中的Bencode编码为BObject
 func Parse(r io.Reader) (*BObject, error) {
+	return NewDecoder(r).parse()
+}
+
+// Decoder 从流中解析Bencode编码，默认是宽松模式，兼容各种不规范的编码
+type Decoder struct {
+	r      *bufio.Reader
+	strict bool
+	limits Limits
+	state  decodeState
+
+	offset int64         // 已经读取的字节数
+	rec    *bytes.Buffer // 不为nil时记录读取的原始输入
+	depth  int           // 当前的嵌套深度
+	path   []interface{} // 当前值的key路径，元素是字典key(string)或者列表下标(int)
+}
+
+func NewDecoder(r io.Reader) *Decoder {
 	br, ok := r.(*bufio.Reader)
 	if !ok {
 		br = bufio.NewReader(r)
 	}
-	// 查看流中的第一个字节，但不读取
-	b, err := br.Peek(1)
+	return &Decoder{r: br, limits: DefaultLimits}
+}
+
+// Strict 开启严格模式，拒绝所有非规范编码：
+// 字典key未排序或重复、数字带前导零、i-0e，以及值后面多余的数据
+func (d *Decoder) Strict() {
+	d.strict = true
+}
+
+// DisallowUnknownFields 反序列化到结构体时，如果字典中有结构体没有的key则报错
+func (d *Decoder) DisallowUnknownFields() {
+	d.state.disallowUnknown = true
+}
+
+// SetLimits 设置解析时的资源限制，解析不可信的数据时应该设置MaxSize
+func (d *Decoder) SetLimits(l Limits) {
+	d.limits = l
+}
+
+// InputOffset 返回已经读取的字节数
+func (d *Decoder) InputOffset() int64 {
+	return d.offset
+}
+
+// Parse 从流中解析一个完整的BObject
+func (d *Decoder) Parse() (*BObject, error) {
+	d.depth, d.path = 0, d.path[:0]
+	obj, err := d.parse()
 	if err != nil {
 		return nil, err
 	}
-	obj := &BObject{}
+	if d.strict {
+		// 严格模式下值后面不能再有任何数据，读取出错时原样返回
+		if _, err = d.r.Peek(1); err == nil {
+			return nil, d.errorAt(d.offset, TrailingDataError)
+		} else if err != io.EOF {
+			return nil, err
+		}
+	}
+	return obj, nil
+}
+
+// Decode 从流中解析一个BObject，并反序列化到v中
+func (d *Decoder) Decode(v interface{}) error {
+	// 记录这个值的原始输入，Unmarshaler拿到的是值在输入中的原始编码，而不是重新编码的结果
+	d.rec = new(bytes.Buffer)
+	base := d.offset
+	obj, err := d.Parse()
+	src := d.rec.Bytes()
+	d.rec = nil
+	if err != nil {
+		return err
+	}
+	d.state.src, d.state.base = src, base
+	defer func() { d.state.src = nil }()
+	return d.state.unmarshal(obj, v)
+}
+
+func (d *Decoder) parse() (*BObject, error) {
+	// 查看流中的第一个字节，但不读取
+	b, err := d.r.Peek(1)
+	if err != nil {
+		// 流的开头就没有数据，返回io.EOF让调用方知道已经读完
+		if err == io.EOF && d.depth == 0 {
+			return nil, io.EOF
+		}
+		return nil, d.error(err)
+	}
+	obj := &BObject{start: d.offset}
 	if b[0] >= '0' && b[0] <= '9' { // string
-		val, err := DecodeString(br)
+		val, err := d.decodeString()
 		if err != nil {
 			return nil, err
 		}
 		obj.typ = STR
 		obj.val = val
 	} else if b[0] == 'i' { // int
-		val, err := DecodeInt(br)
+		val, err := d.decodeInt()
 		if err != nil {
 			return nil, err
 		}
 		obj.typ = INT
 		obj.val = val
 	} else if b[0] == 'l' { // list
-		br.ReadByte()
+		if err = d.enter(); err != nil {
+			return nil, err
+		}
 		objs := make([]*BObject, 0)
 		for {
 			// 如果读取到e，直接退出
-			if a, _ := br.Peek(1); a[0] == 'e' {
-				br.ReadByte()
+			end, err := d.peekEnd()
+			if err != nil {
+				return nil, err
+			}
+			if end {
 				break
 			}
-			elem, err := Parse(br)
+			// 递归解析
+			d.path = append(d.path, len(objs))
+			elem, err := d.parse()
 			if err != nil {
 				return nil, err
 			}
+			d.path = d.path[:len(d.path)-1]
 			objs = append(objs, elem)
 		}
+		d.leave()
 		obj.typ = LIST
 		obj.val = objs
 	} else if b[0] == 'd' { // dict
-		br.ReadByte()
+		if err = d.enter(); err != nil {
+			return nil, err
+		}
 		objs := make(map[string]*BObject)
+		prev, first := "", true
 		for {
-			if a, _ := br.Peek(1); a[0] == 'e' {
-				br.ReadByte()
+			end, err := d.peekEnd()
+			if err != nil {
+				return nil, err
+			}
+			if end {
 				break
 			}
-			key, err := DecodeString(br)
+			start := d.offset
+			key, err := d.decodeString()
 			if err != nil {
 				return nil, err
 			}
-			elem, err := Parse(br)
+			d.path = append(d.path, key)
+			// 严格模式下key必须按字节序严格递增
+			if d.strict && !first {
+				if key == prev {
+					return nil, d.errorAt(start, DuplicateKeyError)
+				}
+				if key < prev {
+					return nil, d.errorAt(start, UnsortedKeyError)
+				}
+			}
+			prev, first = key, false
+			elem, err := d.parse()
 			if err != nil {
 				return nil, err
 			}
+			d.path = d.path[:len(d.path)-1]
 			objs[key] = elem
 		}
+		d.leave()
 		obj.typ = DICT
 		obj.val = objs
 	} else {
-		return nil, TypeError
+		return nil, d.error(TypeError)
 	}
-	// 递归解析
+	obj.end = d.offset
 	return obj, nil
 }
+
+// 进入列表或字典，消费掉开头的l或d，检查嵌套深度
+func (d *Decoder) enter() error {
+	if d.limits.MaxDepth > 0 && d.depth >= d.limits.MaxDepth {
+		return d.error(DepthLimitError)
+	}
+	if _, err := d.readByte(); err != nil {
+		return err
+	}
+	d.depth++
+	return nil
+}
+
+func (d *Decoder) leave() {
+	d.depth--
+}
+
+// 判断下一个字节是不是列表或字典的结束符e，是的话直接消费掉
+func (d *Decoder) peekEnd() (bool, error) {
+	a, err := d.r.Peek(1)
+	if err != nil {
+		return false, d.error(err)
+	}
+	if a[0] != 'e' {
+		return false, nil
+	}
+	_, err = d.readByte()
+	return err == nil, err
+}
+
+// 解码字符串：长度 + 冒号 + 内容
+func (d *Decoder) decodeString() (string, error) {
+	start := d.offset
+	// 读取字符串的字节长度
+	raw, err := d.readNumber()
+	if err != nil {
+		return "", err
+	}
+	if len(raw) == 0 || raw[0] == '-' {
+		return "", d.errorAt(start, NumError)
+	}
+	if d.strict {
+		if err = checkCanonical(raw); err != nil {
+			return "", d.errorAt(start, err)
+		}
+	}
+	num, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil {
+		return "", d.errorAt(start, StringLimitError)
+	}
+	if d.limits.MaxStringLen > 0 && num > int64(d.limits.MaxStringLen) {
+		return "", d.errorAt(start, StringLimitError)
+	}
+	// 读取冒号
+	if b, err := d.readByte(); err != nil {
+		return "", err
+	} else if b != ':' {
+		return "", d.errorAt(d.offset-1, ColonError)
+	}
+	// 读取字符串内容
+	buf, err := d.readN(num)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// 解码整数：i + 数字 + e，超出int64的整数用*big.Int保存
+func (d *Decoder) decodeInt() (BValue, error) {
+	start := d.offset
+	if b, err := d.readByte(); err != nil {
+		return 0, err
+	} else if b != 'i' {
+		return 0, d.errorAt(start, CharIError)
+	}
+	raw, err := d.readNumber()
+	if err != nil {
+		return 0, err
+	}
+	if len(raw) == 0 || (len(raw) == 1 && raw[0] == '-') {
+		return 0, d.errorAt(start, NumError)
+	}
+	if d.strict {
+		if err = checkCanonical(raw); err != nil {
+			return 0, d.errorAt(start, err)
+		}
+	}
+	val, err := parseInt(raw)
+	if err != nil {
+		return 0, d.errorAt(start, err)
+	}
+	if b, err := d.readByte(); err != nil {
+		return 0, err
+	} else if b != 'e' {
+		return 0, d.errorAt(d.offset-1, CharEError)
+	}
+	return val, nil
+}
+
+// 从流中读取一个可能带负号的数字，返回读到的原始字节
+func (d *Decoder) readNumber() ([]byte, error) {
+	raw := make([]byte, 0, 8)
+	for {
+		a, err := d.r.Peek(1)
+		if err != nil {
+			return nil, d.error(err)
+		}
+		c := a[0]
+		if !isNum(c) && !(c == '-' && len(raw) == 0) {
+			return raw, nil
+		}
+		if len(raw) >= maxNumLen {
+			return nil, d.error(OverflowError)
+		}
+		if _, err = d.readByte(); err != nil {
+			return nil, err
+		}
+		raw = append(raw, c)
+	}
+}
+
+// 把数字转换成int64，超出范围时转换成*big.Int
+func parseInt(raw []byte) (BValue, error) {
+	val, err := strconv.ParseInt(string(raw), 10, 64)
+	if err == nil {
+		return val, nil
+	}
+	n, ok := new(big.Int).SetString(string(raw), 10)
+	if !ok {
+		return nil, NumError
+	}
+	return n, nil
+}
+
+// 校验数字是否是规范编码：不能只有负号，不能有前导零，不能是负零
+func checkCanonical(raw []byte) error {
+	digits := raw
+	neg := len(digits) > 0 && digits[0] == '-'
+	if neg {
+		digits = digits[1:]
+	}
+	if len(digits) == 0 {
+		return NumError
+	}
+	if digits[0] == '0' {
+		if neg && len(digits) == 1 {
+			return NegativeZeroError
+		}
+		if neg || len(digits) > 1 {
+			return LeadingZeroError
+		}
+	}
+	return nil
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	if d.limits.MaxSize > 0 && d.offset >= d.limits.MaxSize {
+		return 0, d.error(SizeLimitError)
+	}
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, d.error(err)
+	}
+	d.offset++
+	if d.rec != nil {
+		d.rec.WriteByte(b)
+	}
+	return b, nil
+}
+
+// 读取n个字节，按块读取，实际收到多少数据才分配多少内存
+func (d *Decoder) readN(n int64) ([]byte, error) {
+	if d.limits.MaxSize > 0 && d.offset+n > d.limits.MaxSize {
+		return nil, d.error(SizeLimitError)
+	}
+	if n <= readChunk {
+		buf := make([]byte, n)
+		read, err := io.ReadFull(d.r, buf)
+		d.offset += int64(read)
+		if err != nil {
+			return nil, d.error(err)
+		}
+		d.record(buf)
+		return buf, nil
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, readChunk))
+	read, err := io.CopyN(buf, d.r, n)
+	d.offset += read
+	if err != nil {
+		return nil, d.error(err)
+	}
+	d.record(buf.Bytes())
+	return buf.Bytes(), nil
+}
+
+// 记录读取的原始输入
+func (d *Decoder) record(b []byte) {
+	if d.rec != nil {
+		d.rec.Write(b)
+	}
+}
+
+// 在当前位置生成错误
+func (d *Decoder) error(err error) error {
+	return d.errorAt(d.offset, err)
+}
+
+// 在指定位置生成错误，带上当前的key路径
+func (d *Decoder) errorAt(offset int64, err error) error {
+	var se *SyntaxError
+	if errors.As(err, &se) {
+		return err
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return &SyntaxError{Offset: offset, Path: formatPath(d.path), Err: err}
+}
+
+// 把key路径格式化成info.files[3].length的形式
+func formatPath(path []interface{}) string {
+	buf := new(bytes.Buffer)
+	for _, p := range path {
+		switch p := p.(type) {
+		case string:
+			if buf.Len() > 0 {
+				buf.WriteByte('.')
+			}
+			buf.WriteString(p)
+		case int:
+			buf.WriteByte('[')
+			buf.WriteString(strconv.Itoa(p))
+			buf.WriteByte(']')
+		}
+	}
+	return buf.String()
+}
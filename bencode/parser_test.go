@@ -2,8 +2,12 @@ package bencode
 
 import (
 	"bytes"
+	"errors"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func assertString(t *testing.T, str string, obj *BObject) {
@@ -78,11 +82,10 @@ func TestParseDict(t *testing.T) {
 	assertString(t, "Ryan", mp["name"])
 	assertInt(t, 20, mp["age"])
 
-	// 校验反编码
+	// 校验反编码，编码后key按字节序排列
 	out := bytes.NewBufferString("")
 	assert.Equal(t, len(code), obj.Bencode(out))
-	// 编码后key的顺序可能与原本不一致
-	//assert.Equal(t, code, out.String())
+	assert.Equal(t, "d3:agei20e4:name4:Ryane", out.String())
 }
 
 func TestParseMultiDict(t *testing.T) {
@@ -96,3 +99,108 @@ func TestParseMultiDict(t *testing.T) {
 	assert.Equal(t, DICT, mp["user"].typ)
 	assert.Equal(t, LIST, mp["hobby"].typ)
 }
+
+func TestParseStrict(t *testing.T) {
+	// 规范编码在严格模式下可以正常解析
+	code := "d3:agei-20e4:name4:Ryan5:piecei0ee"
+	obj, err := parseStrict(code)
+	assert.Equal(t, nil, err)
+	out := bytes.NewBufferString("")
+	obj.Bencode(out)
+	assert.Equal(t, code, out.String())
+
+	cases := map[string]error{
+		"d4:name4:Ryan3:agei20ee": UnsortedKeyError,
+		"d3:agei20e3:agei21ee":    DuplicateKeyError,
+		"i03e":                    LeadingZeroError,
+		"i-0e":                    NegativeZeroError,
+		"i-03e":                   LeadingZeroError,
+		"03:abc":                  LeadingZeroError,
+		"3:abcxyz":                TrailingDataError,
+		"li1ei2eeli3ee":           TrailingDataError,
+		"ld3:agei20e3:agei21eee":  DuplicateKeyError,
+		"d4:userd1:bi1e1:ai2eee":  UnsortedKeyError,
+	}
+	for code, expect := range cases {
+		_, err := parseStrict(code)
+		assert.ErrorIs(t, err, expect, code)
+		// 宽松模式下仍然兼容
+		_, err = Parse(bytes.NewBufferString(code))
+		assert.Equal(t, nil, err, code)
+	}
+
+	// 检查多余数据时的读取错误原样返回
+	readErr := errors.New("read error")
+	d := NewDecoder(io.MultiReader(bytes.NewBufferString("i1e"), iotest.ErrReader(readErr)))
+	d.Strict()
+	_, err = d.Parse()
+	assert.Equal(t, readErr, err)
+}
+
+func TestParseTruncated(t *testing.T) {
+	for _, code := range []string{"l", "li1e", "d", "d3:age", "5:abc", "i12"} {
+		_, err := Parse(bytes.NewBufferString(code))
+		assert.NotEqual(t, nil, err, code)
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	cases := []struct {
+		code   string
+		limits Limits
+		expect error
+		offset int64
+		path   string
+	}{
+		{"d4:infod5:filesld6:lengthi1eed6:lengthi" + strings.Repeat("9", 300) + "eeeee", DefaultLimits, OverflowError, 295, "info.files[1].length"},
+		{"d4:name4294967296:abce", DefaultLimits, StringLimitError, 7, "name"},
+		{"l5:abcdee", Limits{MaxStringLen: 4}, StringLimitError, 1, "[0]"},
+		{"lllleeee", Limits{MaxDepth: 3}, DepthLimitError, 3, "[0][0][0]"},
+		{"li1ei2ei3ee", Limits{MaxSize: 6}, SizeLimitError, 6, "[1]"},
+		{"d3:agei20e4:name", DefaultLimits, io.ErrUnexpectedEOF, 16, "name"},
+		{"d3:agei20e4:name10:abc", DefaultLimits, io.ErrUnexpectedEOF, 22, "name"},
+		{"d3:agei2x", DefaultLimits, CharEError, 8, "age"},
+		{"l1:ax", DefaultLimits, TypeError, 4, "[1]"},
+	}
+	for _, c := range cases {
+		d := NewDecoder(bytes.NewBufferString(c.code))
+		d.SetLimits(c.limits)
+		_, err := d.Parse()
+		assert.ErrorIs(t, err, c.expect, c.code)
+		var se *SyntaxError
+		if assert.ErrorAs(t, err, &se, c.code) {
+			assert.Equal(t, c.offset, se.Offset, c.code)
+			assert.Equal(t, c.path, se.Path, c.code)
+		}
+	}
+
+	// 空的流返回io.EOF
+	_, err := Parse(bytes.NewBufferString(""))
+	assert.Equal(t, io.EOF, err)
+}
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{"3:abc", "i-12e", "li1e4:Ryane", "d4:userd3:agei20eee", "l", "d3:age", "99999999999:a", "i-e", "-3:abc"} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// 任意输入都不能panic，解析成功的结果重新编码后能再次解析
+		obj, err := Parse(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		buf := new(bytes.Buffer)
+		obj.Bencode(buf)
+		d := NewDecoder(buf)
+		d.Strict()
+		if _, err = d.Parse(); err != nil {
+			t.Fatalf("re-encoded value is not canonical: %v", err)
+		}
+	})
+}
+
+func parseStrict(code string) (*BObject, error) {
+	d := NewDecoder(bytes.NewBufferString(code))
+	d.Strict()
+	return d.Parse()
+}
@@ -0,0 +1,171 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+)
+
+/*
+RawValue 一个完整的Bencode值的原始编码，直接引用输入的内存，不做任何拷贝。
+访问时才按需解析，不需要的子树会被直接跳过，适合只读取种子文件中少数几个字段的场景：
+
+	root, err := ParseBytes(data)
+	info, err := root.Get("info")
+	infoHash := sha1.Sum(info)
+	name, err := info.Get("name")
+*/
+type RawValue []byte
+
+// ParseBytes 校验data开头的一个完整的Bencode值并返回，后面多余的数据会被忽略
+func ParseBytes(data []byte) (RawValue, error) {
+	s := NewScanner(data)
+	return s.ReadValue()
+}
+
+// Type 返回值的类型
+func (r RawValue) Type() BType {
+	t, _ := NewScanner(r).Peek()
+	return t
+}
+
+// Bytes 返回字符串的内容，引用原始内存
+func (r RawValue) Bytes() ([]byte, error) {
+	return NewScanner(r).ReadString()
+}
+
+// Str 返回字符串的内容，会拷贝一份
+func (r RawValue) Str() (string, error) {
+	b, err := r.Bytes()
+	return string(b), err
+}
+
+// Int 返回整数的值
+func (r RawValue) Int() (int, error) {
+	n, err := NewScanner(r).ReadInt(0)
+	return int(n), err
+}
+
+// Int64 返回整数的值，超出int64的范围时返回RangeError
+func (r RawValue) Int64() (int64, error) {
+	return NewScanner(r).ReadInt(64)
+}
+
+// BigInt 返回任意大小的整数
+func (r RawValue) BigInt() (*big.Int, error) {
+	return NewScanner(r).ReadBigInt()
+}
+
+// List 返回列表的所有元素
+func (r RawValue) List() ([]RawValue, error) {
+	var list []RawValue
+	err := r.ForEach(func(_ []byte, v RawValue) error {
+		list = append(list, v)
+		return nil
+	})
+	return list, err
+}
+
+// Dict 返回字典的所有key和值
+func (r RawValue) Dict() (map[string]RawValue, error) {
+	dict := make(map[string]RawValue)
+	err := r.ForEach(func(key []byte, v RawValue) error {
+		dict[string(key)] = v
+		return nil
+	})
+	return dict, err
+}
+
+// ForEach 按顺序遍历列表或字典的元素，列表的key为nil，fn返回错误时停止遍历
+func (r RawValue) ForEach(fn func(key []byte, v RawValue) error) error {
+	s := NewScanner(r)
+	typ, err := s.Peek()
+	if err != nil {
+		return err
+	}
+	if typ != LIST && typ != DICT {
+		return fmt.Errorf("%w: expect list or dict, get %s", TypeError, typ)
+	}
+	s.start(typ)
+	for s.More() {
+		var key []byte
+		if typ == DICT {
+			if key, err = s.ReadString(); err != nil {
+				return err
+			}
+		}
+		v, err := s.ReadValue()
+		if err != nil {
+			return err
+		}
+		if err = fn(key, v); err != nil {
+			return err
+		}
+	}
+	return s.End()
+}
+
+// Get 返回字典中key对应的值，其他key的值直接跳过，不会解析
+func (r RawValue) Get(key string) (RawValue, error) {
+	s := NewScanner(r)
+	if err := s.DictStart(); err != nil {
+		return nil, err
+	}
+	for s.More() {
+		k, err := s.ReadString()
+		if err != nil {
+			return nil, err
+		}
+		if string(k) == key {
+			return s.ReadValue()
+		}
+		if err = s.Skip(); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%w: key %q", NotFoundError, key)
+}
+
+// Index 返回列表中第i个元素
+func (r RawValue) Index(i int) (RawValue, error) {
+	s := NewScanner(r)
+	if err := s.ListStart(); err != nil {
+		return nil, err
+	}
+	for n := 0; s.More(); n++ {
+		if n == i {
+			return s.ReadValue()
+		}
+		if err := s.Skip(); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%w: index %d", NotFoundError, i)
+}
+
+// Object 把原始编码完整解析成BObject
+func (r RawValue) Object() (*BObject, error) {
+	return Parse(bytes.NewReader(r))
+}
+
+// Decode 把原始编码反序列化到v中，v实现了Unmarshaler时直接使用原始编码
+func (r RawValue) Decode(v interface{}) error {
+	if u, ok := v.(Unmarshaler); ok {
+		return u.UnmarshalBencode(r)
+	}
+	return Unmarshal(bytes.NewReader(r), v)
+}
+
+// MarshalBencode 原样输出原始编码
+func (r RawValue) MarshalBencode() ([]byte, error) {
+	if len(r) == 0 {
+		return nil, fmt.Errorf("%w: empty RawValue", TypeError)
+	}
+	return r, nil
+}
+
+// UnmarshalBencode 保存一份原始编码的拷贝，可以作为结构体字段延迟解析
+func (r *RawValue) UnmarshalBencode(data []byte) error {
+	*r = append((*r)[:0], data...)
+	return nil
+}
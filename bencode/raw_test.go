@@ -0,0 +1,126 @@
+package bencode
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBytes(t *testing.T) {
+	data := []byte("d4:infod6:lengthi10e4:name3:abc6:pieces4:\x01\x02\x03\x04e4:listli1e3:xyzd1:ai1eeee")
+	root, err := ParseBytes(data)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, DICT, root.Type())
+
+	// 字符串直接引用输入的内存
+	info, err := root.Get("info")
+	assert.Equal(t, nil, err)
+	pieces, err := info.Get("pieces")
+	assert.Equal(t, nil, err)
+	b, err := pieces.Bytes()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte{1, 2, 3, 4}, b)
+	assert.Equal(t, &data[bytes.Index(data, []byte{1})], &b[0])
+
+	name, _ := info.Get("name")
+	str, err := name.Str()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "abc", str)
+	length, _ := info.Get("length")
+	n, err := length.Int()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 10, n)
+
+	list, _ := root.Get("list")
+	items, err := list.List()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, len(items))
+	assert.Equal(t, RawValue("3:xyz"), items[1])
+	item, err := list.Index(2)
+	assert.Equal(t, nil, err)
+	dict, err := item.Dict()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, RawValue("i1e"), dict["a"])
+
+	_, err = root.Get("missing")
+	assert.ErrorIs(t, err, NotFoundError)
+	_, err = list.Index(3)
+	assert.ErrorIs(t, err, NotFoundError)
+	_, err = list.Get("a")
+	assert.ErrorIs(t, err, TypeError)
+
+	// 超出uint64的整数可以正常跳过和读取
+	huge, err := ParseBytes([]byte("d1:ai99999999999999999999999e1:bi1ee"))
+	assert.Equal(t, nil, err)
+	bv, _ := huge.Get("b")
+	n, _ = bv.Int()
+	assert.Equal(t, 1, n)
+	av, _ := huge.Get("a")
+	_, err = av.Int64()
+	assert.ErrorIs(t, err, RangeError)
+	bi, err := av.BigInt()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "99999999999999999999999", bi.String())
+
+	// 非法输入
+	for _, code := range []string{"", "d4:info", "l1:a4", "li1e", "x"} {
+		_, err = ParseBytes([]byte(code))
+		assert.NotEqual(t, nil, err, code)
+	}
+}
+
+func TestRawValueField(t *testing.T) {
+	type lazy struct {
+		Name string   `bencode:"name"`
+		Info RawValue `bencode:"info"`
+	}
+	str := "d4:infod1:ai1ee4:name1:xe"
+	v := &lazy{}
+	assert.Equal(t, nil, Unmarshal(bytes.NewBufferString(str), v))
+	assert.Equal(t, RawValue("d1:ai1ee"), v.Info)
+
+	u := &map[string]int{}
+	assert.Equal(t, nil, v.Info.Decode(u))
+	assert.Equal(t, map[string]int{"a": 1}, *u)
+
+	buf := new(bytes.Buffer)
+	Marshal(buf, v)
+	assert.Equal(t, str, buf.String())
+
+	// 不规范的编码原样保留，不会被重新编码
+	str = "d4:infod1:bi2e1:ai01ee4:name1:xe"
+	assert.Equal(t, nil, Unmarshal(bytes.NewBufferString(str), v))
+	assert.Equal(t, RawValue("d1:bi2e1:ai01ee"), v.Info)
+	// 同一个流中的第二个值
+	d := NewDecoder(bytes.NewBufferString("i1e" + str))
+	assert.Equal(t, nil, d.Decode(new(int)))
+	assert.Equal(t, nil, d.Decode(v))
+	assert.Equal(t, RawValue("d1:bi2e1:ai01ee"), v.Info)
+}
+
+func BenchmarkParseTorrent(b *testing.B) {
+	data, _ := os.ReadFile("../testfile/debian-iso.torrent")
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		obj, _ := Parse(bytes.NewReader(data))
+		dict, _ := obj.Dict()
+		buf := new(bytes.Buffer)
+		dict["info"].Bencode(buf)
+		sha1.Sum(buf.Bytes())
+	}
+}
+
+func BenchmarkParseBytesTorrent(b *testing.B) {
+	data, _ := os.ReadFile("../testfile/debian-iso.torrent")
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		root, _ := ParseBytes(data)
+		info, _ := root.Get("info")
+		sha1.Sum(info)
+	}
+}
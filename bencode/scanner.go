@@ -0,0 +1,369 @@
+package bencode
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+/*
+Scanner 直接在[]byte上按顺序读取Bencode的值，不构建BObject也不使用反射，
+读到的字符串直接引用输入的内存，主要供bencodegen生成的代码使用：
+
+	s := NewScanner(data)
+	if err := s.DictStart(); err != nil {...}
+	for s.More() {
+		key, err := s.ReadString()
+		...
+	}
+	err := s.End()
+*/
+type Scanner struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+func NewScanner(data []byte) *Scanner {
+	return &Scanner{data: data}
+}
+
+// Offset 返回当前读取到的位置
+func (s *Scanner) Offset() int {
+	return s.pos
+}
+
+// Done 判断输入是否已经全部读完
+func (s *Scanner) Done() bool {
+	return s.pos >= len(s.data)
+}
+
+// Peek 返回下一个值的类型，不消费任何数据
+func (s *Scanner) Peek() (BType, error) {
+	if s.pos >= len(s.data) {
+		return 0, s.error(io.ErrUnexpectedEOF)
+	}
+	switch c := s.data[s.pos]; {
+	case isNum(c):
+		return STR, nil
+	case c == 'i':
+		return INT, nil
+	case c == 'l':
+		return LIST, nil
+	case c == 'd':
+		return DICT, nil
+	}
+	return 0, s.error(TypeError)
+}
+
+// ReadString 读取一个字符串，返回的切片引用输入的内存
+func (s *Scanner) ReadString() ([]byte, error) {
+	if err := s.expect(STR); err != nil {
+		return nil, err
+	}
+	return s.readString(false)
+}
+
+// ReadFixed 读取一个长度必须等于len(dst)的字符串并拷贝到dst中，用于[20]byte这种定长数组
+func (s *Scanner) ReadFixed(dst []byte) error {
+	start := s.pos
+	b, err := s.ReadString()
+	if err != nil {
+		return err
+	}
+	if len(b) != len(dst) {
+		return s.errorAt(start, fmt.Errorf("%w: string length %d does not match [%d]byte", TypeError, len(b), len(dst)))
+	}
+	copy(dst, b)
+	return nil
+}
+
+func (s *Scanner) readString(strict bool) ([]byte, error) {
+	start, i := s.pos, s.pos
+	n := 0
+	for i < len(s.data) && isNum(s.data[i]) {
+		if n > (math.MaxInt32-9)/10 {
+			return nil, s.errorAt(start, StringLimitError)
+		}
+		n = n*10 + int(s.data[i]-'0')
+		i++
+	}
+	if strict && s.data[start] == '0' && i-start > 1 {
+		return nil, s.errorAt(start, LeadingZeroError)
+	}
+	if i >= len(s.data) {
+		return nil, s.errorAt(i, io.ErrUnexpectedEOF)
+	}
+	if s.data[i] != ':' {
+		return nil, s.errorAt(i, ColonError)
+	}
+	i++
+	if n > len(s.data)-i {
+		return nil, s.errorAt(len(s.data), io.ErrUnexpectedEOF)
+	}
+	s.pos = i + n
+	// 限制容量，防止调用方append覆盖后面的数据
+	return s.data[i : i+n : i+n], nil
+}
+
+// ReadInt 读取一个整数，bitSize和strconv.ParseInt一样，0表示int，超出范围时报错
+func (s *Scanner) ReadInt(bitSize int) (int64, error) {
+	start := s.pos
+	neg, n, err := s.readInt(false)
+	if err != nil {
+		return 0, err
+	}
+	if bitSize == 0 {
+		bitSize = strconv.IntSize
+	}
+	limit := uint64(1) << uint(bitSize-1)
+	if (!neg && n >= limit) || (neg && n > limit) {
+		return 0, s.errorAt(start, fmt.Errorf("%w: overflows int%d", RangeError, bitSize))
+	}
+	if neg {
+		return int64(^n + 1), nil
+	}
+	return int64(n), nil
+}
+
+// ReadUint 读取一个无符号整数，负数或超出范围时报错
+func (s *Scanner) ReadUint(bitSize int) (uint64, error) {
+	start := s.pos
+	neg, n, err := s.readInt(false)
+	if err != nil {
+		return 0, err
+	}
+	if bitSize == 0 {
+		bitSize = strconv.IntSize
+	}
+	if (neg && n != 0) || (bitSize < 64 && n >= uint64(1)<<uint(bitSize)) {
+		return 0, s.errorAt(start, fmt.Errorf("%w: overflows uint%d", RangeError, bitSize))
+	}
+	return n, nil
+}
+
+// ReadBool 读取一个取值为0或1的整数
+func (s *Scanner) ReadBool() (bool, error) {
+	start := s.pos
+	n, err := s.ReadInt(64)
+	if err != nil {
+		return false, err
+	}
+	if n != 0 && n != 1 {
+		return false, s.errorAt(start, fmt.Errorf("%w: %d is not a bool", TypeError, n))
+	}
+	return n == 1, nil
+}
+
+// ReadBigInt 读取任意大小的整数
+func (s *Scanner) ReadBigInt() (*big.Int, error) {
+	start := s.pos
+	raw, err := s.scanInt(false)
+	if err != nil {
+		return nil, err
+	}
+	n, ok := new(big.Int).SetString(string(raw), 10)
+	if !ok {
+		return nil, s.errorAt(start, NumError)
+	}
+	return n, nil
+}
+
+// 读取i<数字>e，返回符号和绝对值，绝对值超出uint64时返回RangeError
+func (s *Scanner) readInt(strict bool) (bool, uint64, error) {
+	start := s.pos
+	raw, err := s.scanInt(strict)
+	if err != nil {
+		return false, 0, err
+	}
+	neg := raw[0] == '-'
+	if neg {
+		raw = raw[1:]
+	}
+	var n uint64
+	for _, c := range raw {
+		d := uint64(c - '0')
+		if n > (math.MaxUint64-d)/10 {
+			return false, 0, s.errorAt(start, RangeError)
+		}
+		n = n*10 + d
+	}
+	return neg, n, nil
+}
+
+// 读取i<数字>e，只校验格式，返回数字部分的原始字节，不限制整数的大小
+func (s *Scanner) scanInt(strict bool) ([]byte, error) {
+	if err := s.expect(INT); err != nil {
+		return nil, err
+	}
+	start := s.pos
+	i := s.pos + 1
+	if i < len(s.data) && s.data[i] == '-' {
+		i++
+	}
+	first := i
+	for i < len(s.data) && isNum(s.data[i]) {
+		i++
+	}
+	if i == first {
+		return nil, s.errorAt(start, NumError)
+	}
+	if i-start-1 > maxNumLen {
+		return nil, s.errorAt(start, OverflowError)
+	}
+	if strict {
+		if err := checkCanonical(s.data[start+1 : i]); err != nil {
+			return nil, s.errorAt(start, err)
+		}
+	}
+	if i >= len(s.data) {
+		return nil, s.errorAt(i, io.ErrUnexpectedEOF)
+	}
+	if s.data[i] != 'e' {
+		return nil, s.errorAt(i, CharEError)
+	}
+	s.pos = i + 1
+	return s.data[start+1 : i], nil
+}
+
+// ListStart 读取列表的开头l
+func (s *Scanner) ListStart() error {
+	return s.start(LIST)
+}
+
+// DictStart 读取字典的开头d
+func (s *Scanner) DictStart() error {
+	return s.start(DICT)
+}
+
+func (s *Scanner) start(typ BType) error {
+	if err := s.expect(typ); err != nil {
+		return err
+	}
+	if s.depth >= DefaultLimits.MaxDepth {
+		return s.error(DepthLimitError)
+	}
+	s.depth++
+	s.pos++
+	return nil
+}
+
+// More 判断当前列表或字典中是否还有元素
+func (s *Scanner) More() bool {
+	return s.pos < len(s.data) && s.data[s.pos] != 'e'
+}
+
+// End 读取列表或字典的结尾e
+func (s *Scanner) End() error {
+	if s.pos >= len(s.data) {
+		return s.error(io.ErrUnexpectedEOF)
+	}
+	if s.data[s.pos] != 'e' {
+		return s.error(CharEError)
+	}
+	s.depth--
+	s.pos++
+	return nil
+}
+
+// Skip 跳过下一个完整的值
+func (s *Scanner) Skip() error {
+	return s.skip(false)
+}
+
+// ReadValue 读取下一个完整的值，返回它的原始编码，引用输入的内存
+func (s *Scanner) ReadValue() ([]byte, error) {
+	start := s.pos
+	if err := s.skip(false); err != nil {
+		return nil, err
+	}
+	return s.data[start:s.pos:s.pos], nil
+}
+
+func (s *Scanner) skip(strict bool) error {
+	typ, err := s.Peek()
+	if err != nil {
+		return err
+	}
+	switch typ {
+	case STR:
+		_, err = s.readString(strict)
+		return err
+	case INT:
+		_, err = s.scanInt(strict)
+		return err
+	case LIST:
+		if err = s.start(LIST); err != nil {
+			return err
+		}
+		for s.More() {
+			if err = s.skip(strict); err != nil {
+				return err
+			}
+		}
+		return s.End()
+	default:
+		if err = s.start(DICT); err != nil {
+			return err
+		}
+		var prev []byte
+		for i := 0; s.More(); i++ {
+			keyStart := s.pos
+			if _, err = s.Peek(); err != nil {
+				return err
+			}
+			key, err := s.readString(strict)
+			if err != nil {
+				return err
+			}
+			// 严格模式下key必须按字节序严格递增
+			if strict && i > 0 {
+				if string(key) == string(prev) {
+					return s.errorAt(keyStart, DuplicateKeyError)
+				}
+				if string(key) < string(prev) {
+					return s.errorAt(keyStart, UnsortedKeyError)
+				}
+			}
+			prev = key
+			if err = s.skip(strict); err != nil {
+				return err
+			}
+		}
+		return s.End()
+	}
+}
+
+// 校验data是否是一个完整的规范编码的Bencode值
+func validCanonical(data []byte) error {
+	s := NewScanner(data)
+	if err := s.skip(true); err != nil {
+		return err
+	}
+	if !s.Done() {
+		return s.error(TrailingDataError)
+	}
+	return nil
+}
+
+// 校验下一个值的类型
+func (s *Scanner) expect(typ BType) error {
+	t, err := s.Peek()
+	if err != nil {
+		return err
+	}
+	if t != typ {
+		return s.error(fmt.Errorf("%w: expect %s, get %s", TypeError, typ, t))
+	}
+	return nil
+}
+
+func (s *Scanner) error(err error) error {
+	return s.errorAt(s.pos, err)
+}
+
+func (s *Scanner) errorAt(offset int, err error) error {
+	return &SyntaxError{Offset: int64(offset), Err: err}
+}
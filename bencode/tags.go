@@ -0,0 +1,173 @@
+package bencode
+
+import (
+	"math/big"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 结构体字段和它对应的字典key
+type field struct {
+	key       string
+	index     []int // 字段路径，嵌入结构体的字段会有多级
+	tagged    bool  // key是否由tag指定
+	omitEmpty bool  // 零值时不编码
+}
+
+// 每个结构体类型的字段解析结果只需要计算一次
+var fieldCache sync.Map // map[reflect.Type][]field
+
+/*
+解析结构体的bencode tag，返回按key字节序排好的字段列表，规则和encoding/json一致：
+ 1. `bencode:"-"` 跳过字段
+ 2. `bencode:"name,omitempty"` 指定key，零值时不编码
+ 3. 没有tag的嵌入结构体会被展开，字段提升到外层；带tag的嵌入结构体当作普通字段
+ 4. 同名key浅层优先；同一层有tag的优先，否则都丢弃
+*/
+func cachedFields(t reflect.Type) []field {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]field)
+	}
+	f, _ := fieldCache.LoadOrStore(t, typeFields(t))
+	return f.([]field)
+}
+
+func typeFields(t reflect.Type) []field {
+	type level struct {
+		typ   reflect.Type
+		index []int
+	}
+	current, next := []level{}, []level{{typ: t}}
+	visited := map[reflect.Type]bool{}
+	byKey := map[string]field{}
+	// 按深度逐层展开嵌入结构体
+	for len(next) > 0 {
+		current, next = next, nil
+		found := map[string][]field{}
+		for _, l := range current {
+			if visited[l.typ] {
+				continue
+			}
+			visited[l.typ] = true
+			for i := 0; i < l.typ.NumField(); i++ {
+				tf := l.typ.Field(i)
+				ft := tf.Type
+				if ft.Kind() == reflect.Pointer {
+					ft = ft.Elem()
+				}
+				// 未导出的字段跳过，但未导出的嵌入结构体的导出字段仍然可见
+				if !tf.IsExported() && !(tf.Anonymous && ft.Kind() == reflect.Struct) {
+					continue
+				}
+				tag := tf.Tag.Get("bencode")
+				if tag == "-" {
+					continue
+				}
+				name, opts, _ := strings.Cut(tag, ",")
+				index := make([]int, len(l.index)+1)
+				copy(index, l.index)
+				index[len(l.index)] = i
+				if tf.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+					next = append(next, level{ft, index})
+					continue
+				}
+				if !tf.IsExported() {
+					continue
+				}
+				f := field{key: name, index: index, tagged: name != ""}
+				if f.key == "" {
+					// 如果没设置tag，就把key设置为字段名
+					f.key = strings.ToLower(tf.Name)
+				}
+				for _, opt := range strings.Split(opts, ",") {
+					if opt == "omitempty" {
+						f.omitEmpty = true
+					}
+				}
+				found[f.key] = append(found[f.key], f)
+			}
+		}
+		for key, fs := range found {
+			// 浅层的字段已经占用了这个key
+			if _, ok := byKey[key]; ok {
+				continue
+			}
+			if f, ok := dominantField(fs); ok {
+				byKey[key] = f
+			} else {
+				// 同层冲突的key标记为占用，更深层的同名字段也不再生效
+				byKey[key] = field{}
+			}
+		}
+	}
+	fields := make([]field, 0, len(byKey))
+	for _, f := range byKey {
+		if f.index != nil {
+			fields = append(fields, f)
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].key < fields[j].key
+	})
+	return fields
+}
+
+// 同一层同名的字段，只有唯一一个带tag的或者只有一个字段时才有效
+func dominantField(fs []field) (field, bool) {
+	if len(fs) == 1 {
+		return fs[0], true
+	}
+	var res field
+	cnt := 0
+	for _, f := range fs {
+		if f.tagged {
+			res = f
+			cnt++
+		}
+	}
+	return res, cnt == 1
+}
+
+// 按字段路径取值，alloc为true时会给路径上的空指针分配内存，否则遇到空指针返回false
+func fieldByIndex(v reflect.Value, index []int, alloc bool) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				if !alloc || !v.CanSet() {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	case reflect.Struct:
+		if v.Type() == timeType {
+			return v.Interface().(time.Time).IsZero()
+		}
+		if v.Type() == bigIntType {
+			n := v.Interface().(big.Int)
+			return n.Sign() == 0
+		}
+	}
+	return false
+}
@@ -1,202 +1,276 @@
 package bencode
 
 import (
+	"bytes"
+	"encoding"
 	"errors"
+	"fmt"
 	"io"
-	"log"
 	"reflect"
-	"strings"
+	"time"
 )
 
+// Unmarshaler 自定义类型的反序列化，入参是这个值完整的Bencode编码
+type Unmarshaler interface {
+	UnmarshalBencode([]byte) error
+}
+
 /*
-	Unmarshal 将TorrentFile中的数据反序列化到结构v中，根据反序列化的结果推断v的类型
-	v必须是slice或者struct的指针才能序列化成功
+Unmarshal 将TorrentFile中的数据反序列化到结构v中，根据反序列化的结果推断v的类型
+v必须是非空指针才能反序列化成功
 */
 func Unmarshal(r io.Reader, v interface{}) error {
-	obj, err := Parse(r)
-	if err != nil {
-		return err
-	}
+	return NewDecoder(r).Decode(v)
+}
+
+// 反序列化过程中的配置
+type decodeState struct {
+	disallowUnknown bool // 字典中有结构体没有的key时报错
+
+	src  []byte // 正在反序列化的值的原始输入
+	base int64  // src的第一个字节在流中的位置
+}
+
+// 将解析好的BObject反序列化到v中
+func (d *decodeState) unmarshal(obj *BObject, v interface{}) error {
 	rv := reflect.ValueOf(v)
-	if rv.Type().Kind() != reflect.Pointer {
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
 		return errors.New("unmarshal structure need to be a pointer")
 	}
-	switch obj.typ {
-	case LIST:
-		list, err := obj.List()
-		if err != nil {
-			return err
+	return d.unmarshalValue(rv.Elem(), obj)
+}
+
+// obj在原始输入中的编码，obj不是从输入中解析出来的时候返回nil
+func (d *decodeState) raw(obj *BObject) []byte {
+	start, end := obj.start-d.base, obj.end-d.base
+	if obj.end <= obj.start || start < 0 || end > int64(len(d.src)) {
+		return nil
+	}
+	return d.src[start:end]
+}
+
+/*
+按照BObject的类型分发，入参（反序列化的值对象, BObject）
+ 1. 实现了Unmarshaler或者encoding.TextUnmarshaler的类型，交给自定义方法处理
+ 2. 指针，按需分配内存后递归处理
+ 3. interface{}，直接转换成Go的原生类型
+ 4. time.Time，从unix时间戳转换
+ 5. 其他类型按照BObject的类型处理
+*/
+func (d *decodeState) unmarshalValue(v reflect.Value, obj *BObject) error {
+	u, tu, v := indirect(v)
+	if u != nil {
+		// 优先使用原始输入，重新编码会把不规范的编码（比如乱序的key）改掉
+		if raw := d.raw(obj); raw != nil {
+			return u.UnmarshalBencode(raw)
+		}
+		buf := new(bytes.Buffer)
+		obj.Bencode(buf)
+		return u.UnmarshalBencode(buf.Bytes())
+	}
+	if tu != nil {
+		if obj.typ != STR {
+			return fmt.Errorf("%w: cannot unmarshal %s into %T", TypeError, obj.typ, tu)
 		}
-		// 如果v的值类型不是slice，报错
-		if rv.Elem().Type().Kind() != reflect.Slice {
-			return errors.New("dest must be pointer to slice")
+		return tu.UnmarshalText([]byte(obj.val.(string)))
+	}
+	if v.Type() == timeType {
+		if obj.typ != INT {
+			return mismatch(obj.typ.String(), v)
 		}
-		a := reflect.MakeSlice(rv.Elem().Type(), len(list), len(list))
-		rv.Elem().Set(a)
-		if err = unmarshalList(rv, list); err != nil {
+		sec, err := obj.Int64()
+		if err != nil {
 			return err
 		}
+		v.Set(reflect.ValueOf(time.Unix(sec, 0)))
+		return nil
+	}
+	if v.Type() == bigIntType {
+		n, err := obj.BigInt()
+		if err != nil {
+			return mismatch(obj.typ.String(), v)
+		}
+		v.Set(reflect.ValueOf(n).Elem())
+		return nil
+	}
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		v.Set(reflect.ValueOf(obj.native()))
+		return nil
+	}
+	switch obj.typ {
+	case STR:
+		return unmarshalString(v, obj.val.(string))
+	case INT:
+		return unmarshalInt(v, obj)
+	case LIST:
+		return d.unmarshalList(v, obj.val.([]*BObject))
 	case DICT:
-		dict, err := obj.Dict()
+		return d.unmarshalDict(v, obj.val.(map[string]*BObject))
+	}
+	return TypeError
+}
+
+// 字符串可以反序列化到string、[]byte和定长字节数组中
+func unmarshalString(v reflect.Value, str string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(str)
+		return nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes([]byte(str))
+			return nil
+		}
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if v.Len() != len(str) {
+				return fmt.Errorf("%w: string length %d does not match %s", TypeError, len(str), v.Type())
+			}
+			reflect.Copy(v, reflect.ValueOf([]byte(str)))
+			return nil
+		}
+	}
+	return mismatch("string", v)
+}
+
+// 整数可以反序列化到有符号、无符号整数和bool中，超出范围时返回RangeError
+func unmarshalInt(v reflect.Value, obj *BObject) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		a, err := obj.Int64()
 		if err != nil {
-			return err
+			return fmt.Errorf("%w: %v overflows %s", RangeError, obj.val, v.Type())
 		}
-		if err = unmarshalDict(rv, dict); err != nil {
-			return err
+		if v.OverflowInt(a) {
+			return fmt.Errorf("%w: %d overflows %s", RangeError, a, v.Type())
 		}
-	default:
-		return errors.New("src code must be struct or slice")
+		v.SetInt(a)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		a, err := obj.Uint64()
+		if err != nil || v.OverflowUint(a) {
+			return fmt.Errorf("%w: %v overflows %s", RangeError, obj.val, v.Type())
+		}
+		v.SetUint(a)
+		return nil
+	case reflect.Bool:
+		a, err := obj.Int64()
+		if err != nil || (a != 0 && a != 1) {
+			return fmt.Errorf("%w: %v is not a bool", TypeError, obj.val)
+		}
+		v.SetBool(a == 1)
+		return nil
 	}
-	return nil
+	return mismatch("int", v)
 }
 
 /*
-	反序列化列表，按照第一个元素区分类型，入参（反序列化的值对象, BObject的value）
-		1. string, 列表元素全部都是string
-		2. int, 列表元素全部都是int
-		3. list, 列表元素全部都是list，递归处理
-		4. dict, 列表元素全部都是dict，递归处理
+反序列化列表，每个元素单独按照自己的类型处理，入参（反序列化的值对象, BObject的value）
+ 1. slice, 按列表长度重新分配
+ 2. array, 多余的元素报错，不足的部分置零
 */
-func unmarshalList(v reflect.Value, list []*BObject) error {
-	if v.Kind() != reflect.Pointer || v.Elem().Type().Kind() != reflect.Slice {
-		log.Println("unmarshal list need slice ptr")
-		return TypeError
-	}
-	if len(list) == 0 {
-		return nil
+func (d *decodeState) unmarshalList(v reflect.Value, list []*BObject) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		// 在反射中使用append操作比较麻烦，所以直接开辟一块空间，后续直接在对应索引上set即可
+		v.Set(reflect.MakeSlice(v.Type(), len(list), len(list)))
+	case reflect.Array:
+		if len(list) > v.Len() {
+			return fmt.Errorf("%w: list length %d exceeds %s", TypeError, len(list), v.Type())
+		}
+		v.Set(reflect.Zero(v.Type()))
+	default:
+		return mismatch("list", v)
 	}
-	// *[]int -> []int, *[][]int -> [][]int
-	e := v.Elem()
-	switch list[0].typ {
-	case STR:
-		for i, obj := range list {
-			s, err := obj.Str()
-			if err != nil {
-				return err
-			}
-			e.Index(i).SetString(s)
+	for i, obj := range list {
+		if err := d.unmarshalValue(v.Index(i), obj); err != nil {
+			return err
 		}
-	case INT:
-		for i, obj := range list {
-			a, err := obj.Int()
-			if err != nil {
-				return err
-			}
-			e.Index(i).SetInt(int64(a))
+	}
+	return nil
+}
+
+// 反序列化字典，支持结构体和map[string]T
+func (d *decodeState) unmarshalDict(v reflect.Value, dict map[string]*BObject) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		return d.unmarshalStruct(v, dict)
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("%w: map key must be string, get %s", TypeError, v.Type().Key())
 		}
-	case LIST:
-		for i, obj := range list {
-			l, err := obj.List()
-			if err != nil {
-				return err
-			}
-			// 获取数组元素的类型
-			if e.Type().Elem().Kind() != reflect.Slice {
-				return TypeError
-			}
-			// 创建指向子元素类型的指针
-			// 在反射中使用append操作比较麻烦，所以直接开辟一块空间然后让指针指向内存，后续直接在对应索引上set即可
-			ptr := reflect.New(e.Type().Elem()) // *[]int
-			// 创建子元素类型的数组
-			subArray := reflect.MakeSlice(e.Type().Elem(), len(l), len(l))
-			ptr.Elem().Set(subArray)
-			if err = unmarshalList(ptr, l); err != nil {
-				return err
-			}
-			e.Index(i).Set(ptr.Elem())
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(v.Type(), len(dict)))
 		}
-	case DICT:
-		for i, obj := range list {
-			d, err := obj.Dict()
-			if err != nil {
-				return err
-			}
-			if e.Type().Elem().Kind() != reflect.Struct {
-				return TypeError
-			}
-			ptr := reflect.New(e.Type().Elem())
-			if err = unmarshalDict(ptr, d); err != nil {
+		for key, obj := range dict {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := d.unmarshalValue(elem, obj); err != nil {
 				return err
 			}
-			e.Index(i).Set(ptr.Elem())
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
 		}
+		return nil
 	}
-	return nil
+	return mismatch("dict", v)
 }
 
-/*
-	反序列化列表, 入参（反序列化的值对象, BObject的value）
-*/
-func unmarshalDict(v reflect.Value, dict map[string]*BObject) error {
-	if v.Kind() != reflect.Ptr || v.Elem().Type().Kind() != reflect.Struct {
-		return errors.New("unmarshal dict need struct ptr")
-	}
-	// v是指针，做值修改先转换为Elem
-	e := v.Elem()
-	for i, n := 0, e.NumField(); i < n; i++ {
-		vf := e.Field(i) // 表示v的Field，返回的是Value
-		if !vf.CanSet() {
-			continue
+func (d *decodeState) unmarshalStruct(e reflect.Value, dict map[string]*BObject) error {
+	fields := cachedFields(e.Type())
+	if d.disallowUnknown {
+		known := make(map[string]bool, len(fields))
+		for _, f := range fields {
+			known[f.key] = true
 		}
-		tf := e.Type().Field(i)
-		key := tf.Tag.Get("bencode") //获取结构体的bencode tag
-		if key == "" {
-			// 如果没设置tag，就把key设置为字段名
-			key = strings.ToLower(tf.Name)
+		for key := range dict {
+			if !known[key] {
+				return fmt.Errorf("%w: %q in %s", UnknownFieldError, key, e.Type())
+			}
 		}
+	}
+	for _, f := range fields {
 		// 字典中没有，直接跳过
-		val := dict[key]
+		val := dict[f.key]
 		if val == nil {
 			continue
 		}
-		switch val.typ {
-		case STR:
-			if vf.Kind() != reflect.String {
-				break
-			}
-			str, err := val.Str()
-			if err != nil {
-				return err
-			}
-			vf.SetString(str)
-		case INT:
-			if vf.Kind() != reflect.Int {
-				break
-			}
-			a, err := val.Int()
-			if err != nil {
-				return err
-			}
-			vf.SetInt(int64(a))
-		case LIST:
-			if vf.Kind() != reflect.Slice {
-				break
-			}
-			list, err := val.List()
-			if err != nil {
-				return err
-			}
-			ptr := reflect.New(vf.Type())
-			array := reflect.MakeSlice(vf.Type(), len(list), len(list))
-			ptr.Elem().Set(array)
-			if err = unmarshalList(ptr, list); err != nil {
-				continue
-			}
-			vf.Set(ptr.Elem())
-		case DICT:
-			if vf.Kind() != reflect.Struct {
-				break
-			}
-			d, err := val.Dict()
-			if err != nil {
-				return err
+		vf, ok := fieldByIndex(e, f.index, true)
+		if !ok {
+			continue
+		}
+		if err := d.unmarshalValue(vf, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 沿着指针向下找到实现了Unmarshaler或者encoding.TextUnmarshaler的值，路径上的空指针会被分配内存
+func indirect(v reflect.Value) (Unmarshaler, encoding.TextUnmarshaler, reflect.Value) {
+	// 非指针的值取地址，让指针接收者的方法也能被调用
+	if v.Kind() != reflect.Pointer && v.Type().Name() != "" && v.CanAddr() {
+		v = v.Addr()
+	}
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		// time.Time和big.Int也实现了TextUnmarshaler，需要单独处理
+		if t := v.Elem().Type(); t == timeType || t == bigIntType {
+			return nil, nil, v.Elem()
+		}
+		if v.CanInterface() {
+			if u, ok := v.Interface().(Unmarshaler); ok {
+				return u, nil, reflect.Value{}
 			}
-			ptr := reflect.New(vf.Type())
-			if err = unmarshalDict(ptr, d); err != nil {
-				continue
+			if tu, ok := v.Interface().(encoding.TextUnmarshaler); ok {
+				return nil, tu, reflect.Value{}
 			}
-			vf.Set(ptr.Elem())
 		}
+		v = v.Elem()
 	}
-	return nil
+	return nil, nil, v
+}
+
+func mismatch(typ string, v reflect.Value) error {
+	return fmt.Errorf("%w: cannot unmarshal %s into %s", TypeError, typ, v.Type())
 }
@@ -2,7 +2,12 @@ package bencode
 
 import (
 	"bytes"
+	"math"
+	"math/big"
+	"net"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -53,7 +58,7 @@ func TestUnmarshalMultiList(t *testing.T) {
 }
 
 func TestUnmarshalUser(t *testing.T) {
-	str := "d4:name4:Ryan3:agei20ee"
+	str := "d3:agei20e4:name4:Ryane"
 	u := &User{}
 	Unmarshal(bytes.NewBufferString(str), u)
 	t.Logf("%+v", u)
@@ -67,7 +72,7 @@ func TestUnmarshalUser(t *testing.T) {
 }
 
 func TestUnmarshalRole(t *testing.T) {
-	str := "d2:idi1e4:userd4:name4:Ryan3:agei20eee"
+	str := "d2:idi1e4:userd3:agei20e4:name4:Ryanee"
 	r := &Role{}
 	Unmarshal(bytes.NewBufferString(str), r)
 	assert.Equal(t, 1, r.Id)
@@ -81,7 +86,7 @@ func TestUnmarshalRole(t *testing.T) {
 }
 
 func TestUnmarshalScore(t *testing.T) {
-	str := "d4:userd4:name4:Ryan3:agei20ee5:valueli1ei2ei3eee"
+	str := "d4:userd3:agei20e4:name4:Ryane5:valueli1ei2ei3eee"
 	s := &Score{}
 	Unmarshal(bytes.NewBufferString(str), s)
 	assert.Equal(t, "Ryan", s.Name)
@@ -95,7 +100,7 @@ func TestUnmarshalScore(t *testing.T) {
 }
 
 func TestUnmarshalTeam(t *testing.T) {
-	str := "d4:name6:team014:sizei2e6:memberld4:name4:Ryan3:agei20eed4:name5:nancy3:agei31eeee"
+	str := "d6:memberld3:agei20e4:name4:Ryaned3:agei31e4:name5:nancyee4:name6:team014:sizei2ee"
 	team := &Team{}
 	Unmarshal(bytes.NewBufferString(str), team)
 	assert.Equal(t, "team01", team.Name)
@@ -120,3 +125,240 @@ func TestMarshalBasic(t *testing.T) {
 	assert.Equal(t, 5, len)
 	assert.Equal(t, "i199e", buf.String())
 }
+
+type Types struct {
+	I8     int8              `bencode:"i8"`
+	I64    int64             `bencode:"i64"`
+	U16    uint16            `bencode:"u16"`
+	U64    uint64            `bencode:"u64"`
+	Flag   bool              `bencode:"flag"`
+	Raw    []byte            `bencode:"raw"`
+	Hash   [4]byte           `bencode:"hash"`
+	Ptr    *User             `bencode:"ptr"`
+	Attrs  map[string]int    `bencode:"attrs"`
+	Any    interface{}       `bencode:"any"`
+	Mixed  []interface{}     `bencode:"mixed"`
+	Groups map[string][]User `bencode:"groups"`
+}
+
+func TestUnmarshalTypes(t *testing.T) {
+	str := "d3:anyli1e1:ae5:attrsd1:ai1e1:bi2ee4:flagi1e6:groupsd1:xld3:agei1e4:name1:aeee" +
+		"4:hash4:abcd3:i64i-9000000000e2:i8i-8e5:mixedli1e3:abcd1:ki2eee3:ptrd3:agei20e4:name4:Ryane" +
+		"3:raw3:xyz3:u16i65535e3:u64i18000000000ee"
+	v := &Types{}
+	err := Unmarshal(bytes.NewBufferString(str), v)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int8(-8), v.I8)
+	assert.Equal(t, int64(-9000000000), v.I64)
+	assert.Equal(t, uint16(65535), v.U16)
+	assert.Equal(t, uint64(18000000000), v.U64)
+	assert.Equal(t, true, v.Flag)
+	assert.Equal(t, []byte("xyz"), v.Raw)
+	assert.Equal(t, [4]byte{'a', 'b', 'c', 'd'}, v.Hash)
+	assert.Equal(t, &User{Name: "Ryan", Age: 20}, v.Ptr)
+	assert.Equal(t, map[string]int{"a": 1, "b": 2}, v.Attrs)
+	assert.Equal(t, []interface{}{1, "a"}, v.Any)
+	assert.Equal(t, []interface{}{1, "abc", map[string]interface{}{"k": 2}}, v.Mixed)
+	assert.Equal(t, map[string][]User{"x": {{Name: "a", Age: 1}}}, v.Groups)
+
+	// 反向编码结果一致
+	buf := bytes.NewBuffer([]byte{})
+	wLen := Marshal(buf, v)
+	assert.Equal(t, len(str), wLen)
+	assert.Equal(t, str, buf.String())
+}
+
+func TestUnmarshalTypeError(t *testing.T) {
+	cases := map[string]interface{}{
+		"d4:flagi2ee":   &Types{},
+		"d4:hash2:abe":  &Types{},
+		"d3:rawi1ee":    &Types{},
+		"d4:name3:abce": &map[int]string{},
+		"l3:abce":       &[]int{},
+		"li1ei2ei3ee":   &[2]int{},
+		"d3:agei1ee":    &[]int{},
+		"d4:namei123ee": &User{},
+	}
+	for str, v := range cases {
+		err := Unmarshal(bytes.NewBufferString(str), v)
+		assert.ErrorIs(t, err, TypeError, str)
+	}
+}
+
+type Sizes struct {
+	I32  int32    `bencode:"i32"`
+	I64  int64    `bencode:"i64"`
+	U64  uint64   `bencode:"u64"`
+	Big  *big.Int `bencode:"big"`
+	Huge big.Int  `bencode:"huge,omitempty"`
+}
+
+func TestUnmarshalBigInt(t *testing.T) {
+	str := "d3:bigi-123456789012345678901234567890e3:i32i-5e3:i64i9223372036854775807e3:u64i18446744073709551615ee"
+	v := &Sizes{}
+	assert.Equal(t, nil, Unmarshal(bytes.NewBufferString(str), v))
+	assert.Equal(t, int64(math.MaxInt64), v.I64)
+	assert.Equal(t, uint64(math.MaxUint64), v.U64)
+	assert.Equal(t, "-123456789012345678901234567890", v.Big.String())
+	buf := new(bytes.Buffer)
+	Marshal(buf, v)
+	assert.Equal(t, str, buf.String())
+
+	// 目标类型放不下时返回RangeError
+	cases := map[string]interface{}{
+		"d3:i32i2147483648ee":            &Sizes{},
+		"d3:i64i9223372036854775808ee":   &Sizes{},
+		"d3:u64i18446744073709551616ee":  &Sizes{},
+		"d3:u64i-1ee":                    &Sizes{},
+		"d2:i8i300ee":                    &Types{},
+		"d3:u16i-1ee":                    &Types{},
+		"i99999999999999999999e":         new(int),
+		"li1ei99999999999999999999ee":    &[]int64{},
+		"d3:agei99999999999999999999ee":  &User{},
+		"d3:agei-99999999999999999999ee": &map[string]uint{},
+	}
+	for str, v := range cases {
+		err := Unmarshal(bytes.NewBufferString(str), v)
+		assert.ErrorIs(t, err, RangeError, str)
+	}
+	_, err := DecodeInt(bytes.NewBufferString("i99999999999999999999e"))
+	assert.ErrorIs(t, err, RangeError)
+
+	// BObject和interface{}保留完整的值
+	obj, err := Parse(bytes.NewBufferString("i-99999999999999999999e"))
+	assert.Equal(t, nil, err)
+	n, err := obj.BigInt()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "-99999999999999999999", n.String())
+	_, err = obj.Int64()
+	assert.ErrorIs(t, err, RangeError)
+	var val interface{}
+	assert.Equal(t, nil, Unmarshal(bytes.NewBufferString("li1ei99999999999999999999ee"), &val))
+	assert.Equal(t, 1, val.([]interface{})[0])
+	assert.Equal(t, "99999999999999999999", val.([]interface{})[1].(*big.Int).String())
+	buf.Reset()
+	NewBigInt(n).Bencode(buf)
+	assert.Equal(t, "i-99999999999999999999e", buf.String())
+}
+
+func TestMarshalNil(t *testing.T) {
+	// 空指针字段直接跳过
+	buf := new(bytes.Buffer)
+	Marshal(buf, &Types{})
+	assert.Equal(t, "d5:attrsde4:flagi0e6:groupsde4:hash4:\x00\x00\x00\x003:i64i0e2:i8i0e5:mixedle3:raw0:3:u16i0e3:u64i0ee", buf.String())
+
+	// 列表中的空指针无法编码，失败时不写入任何数据
+	buf.Reset()
+	assert.Equal(t, 0, Marshal(buf, []*User{{}, nil}))
+	assert.Equal(t, 0, buf.Len())
+}
+
+type Base struct {
+	ID      int    `bencode:"id"`
+	Comment string `bencode:"comment,omitempty"`
+}
+
+type Extra struct {
+	Source string `bencode:"source,omitempty"`
+}
+
+type Options struct {
+	Base
+	*Extra
+	Name    string   `bencode:"name"`
+	Private int      `bencode:"private,omitempty"`
+	Files   []string `bencode:"files,omitempty"`
+	Cache   string   `bencode:"-"`
+}
+
+func TestTagOptions(t *testing.T) {
+	// 零值的omitempty字段不编码，"-"字段跳过，嵌入结构体的字段提升到外层
+	o := &Options{Base: Base{ID: 1}, Name: "a", Cache: "x"}
+	buf := new(bytes.Buffer)
+	Marshal(buf, o)
+	assert.Equal(t, "d2:idi1e4:name1:ae", buf.String())
+
+	str := "d7:comment2:hi5:filesl1:xe2:idi2e4:name1:b7:privatei1e6:source1:se"
+	o = &Options{}
+	err := Unmarshal(bytes.NewBufferString(str), o)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, o.ID)
+	assert.Equal(t, "hi", o.Comment)
+	assert.Equal(t, "s", o.Source)
+	assert.Equal(t, 1, o.Private)
+	assert.Equal(t, []string{"x"}, o.Files)
+
+	buf.Reset()
+	Marshal(buf, o)
+	assert.Equal(t, str, buf.String())
+}
+
+func TestDisallowUnknownFields(t *testing.T) {
+	str := "d3:agei20e4:name4:Ryan3:sexi1ee"
+	u := &User{}
+	assert.Equal(t, nil, Unmarshal(bytes.NewBufferString(str), u))
+
+	d := NewDecoder(bytes.NewBufferString(str))
+	d.DisallowUnknownFields()
+	assert.ErrorIs(t, d.Decode(u), UnknownFieldError)
+
+	// 展开的嵌入字段不算未知字段
+	d = NewDecoder(bytes.NewBufferString("d7:comment2:hi2:idi2e6:source1:se"))
+	d.DisallowUnknownFields()
+	assert.Equal(t, nil, d.Decode(&Options{}))
+}
+
+// 用逗号分隔的字符串列表
+type CSV []string
+
+func (c CSV) MarshalBencode() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	EncodeString(buf, strings.Join(c, ","))
+	return buf.Bytes(), nil
+}
+
+func (c *CSV) UnmarshalBencode(b []byte) error {
+	var s string
+	if err := Unmarshal(bytes.NewReader(b), &s); err != nil {
+		return err
+	}
+	*c = strings.Split(s, ",")
+	return nil
+}
+
+type BadMarshaler struct{}
+
+func (BadMarshaler) MarshalBencode() ([]byte, error) {
+	return []byte("d1:bi1e1:ai2ee"), nil
+}
+
+type Custom struct {
+	Tags    CSV       `bencode:"tags"`
+	TagPtr  *CSV      `bencode:"tagptr,omitempty"`
+	Addr    net.IP    `bencode:"addr"`
+	Created time.Time `bencode:"creation date,omitempty"`
+}
+
+func TestCustomMarshaler(t *testing.T) {
+	str := "d4:addr8:10.0.0.113:creation datei1671494400e6:tagptr3:x,y4:tags5:a,b,ce"
+	c := &Custom{}
+	err := Unmarshal(bytes.NewBufferString(str), c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, CSV{"a", "b", "c"}, c.Tags)
+	assert.Equal(t, &CSV{"x", "y"}, c.TagPtr)
+	assert.Equal(t, "10.0.0.1", c.Addr.String())
+	assert.Equal(t, int64(1671494400), c.Created.Unix())
+
+	buf := new(bytes.Buffer)
+	assert.Equal(t, nil, NewEncoder(buf).Encode(c))
+	assert.Equal(t, str, buf.String())
+
+	// 自定义序列化的结果必须是规范编码
+	buf.Reset()
+	err = NewEncoder(buf).Encode([]BadMarshaler{{}})
+	assert.ErrorIs(t, err, UnsortedKeyError)
+	assert.Equal(t, 0, buf.Len())
+	// TextUnmarshaler只接受字符串
+	err = Unmarshal(bytes.NewBufferString("d4:addri1ee"), c)
+	assert.ErrorIs(t, err, TypeError)
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Ryan-ovo/go-bittorrent/bencode"
+)
+
+const bencodeUsage = `usage: bencode [flags] [file]
+
+查看和转换Bencode编码的文件，file为空或者-时从标准输入读取：
+
+  bencode a.torrent                    按缩进的树形结构输出
+  bencode -json a.torrent              输出JSON
+  bencode -get info.files[0].path a.torrent
+  bencode -get info -raw a.torrent     输出info字典的原始编码
+  bencode -encode a.json               把JSON转换成规范的Bencode编码
+
+JSON中的二进制字符串表示为{"$hex": "..."}或{"$base64": "..."}，
+pieces默认只输出统计信息，需要转换回Bencode时加上-full
+
+flags:
+`
+
+// JSON中表示二进制字符串和省略内容的特殊key
+const (
+	hexKey     = "$hex"
+	base64Key  = "$base64"
+	summaryKey = "$summary"
+)
+
+type bencodeCmd struct {
+	json   bool
+	full   bool
+	raw    bool
+	binary string
+	out    *bufio.Writer
+	key    string // 根节点对应的key，-get提取出pieces时也要省略
+}
+
+// 执行bencode子命令
+func runBencode(args []string) error {
+	fs := flag.NewFlagSet("bencode", flag.ContinueOnError)
+	c := &bencodeCmd{}
+	fs.BoolVar(&c.json, "json", false, "输出JSON")
+	fs.BoolVar(&c.full, "full", false, "完整输出pieces，不做省略")
+	fs.BoolVar(&c.raw, "raw", false, "输出原始的Bencode编码")
+	fs.StringVar(&c.binary, "binary", "hex", "二进制字符串的输出格式：hex或base64")
+	encode := fs.Bool("encode", false, "把JSON转换成规范的Bencode编码")
+	get := fs.String("get", "", "按key路径提取值，比如info.files[0].length")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), bencodeUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if c.binary != "hex" && c.binary != "base64" {
+		return fmt.Errorf("unknown binary format %q", c.binary)
+	}
+	in, err := openInput(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	c.out = bufio.NewWriter(os.Stdout)
+	defer c.out.Flush()
+
+	if *encode {
+		obj, err := decodeJSON(in)
+		if err != nil {
+			return err
+		}
+		obj.Bencode(c.out)
+		return nil
+	}
+	var path []interface{}
+	if *get != "" {
+		if path, err = parsePath(*get); err != nil {
+			return err
+		}
+		if k, ok := path[len(path)-1].(string); ok {
+			c.key = k
+		}
+	}
+	if c.raw {
+		return c.writeRaw(in, path)
+	}
+	obj, err := bencode.Parse(in)
+	if err != nil {
+		return err
+	}
+	if obj, err = obj.Get(path...); err != nil {
+		return err
+	}
+	switch {
+	case c.json:
+		data, err := json.MarshalIndent(c.toJSON(c.key, obj), "", "  ")
+		if err != nil {
+			return err
+		}
+		c.out.Write(data)
+		c.out.WriteByte('\n')
+	default:
+		c.printTree(obj, 0)
+	}
+	return nil
+}
+
+// 输出path对应的值在输入中的原始编码，不重新编码，非规范的输入也能得到和info hash一致的内容
+func (c *bencodeCmd) writeRaw(in io.Reader, path []interface{}) error {
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	raw, err := bencode.ParseBytes(data)
+	if err != nil {
+		return err
+	}
+	for _, p := range path {
+		switch p := p.(type) {
+		case string:
+			raw, err = raw.Get(p)
+		case int:
+			raw, err = raw.Index(p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err = c.out.Write(raw); err != nil {
+		return err
+	}
+	return c.out.Flush()
+}
+
+func openInput(name string) (io.ReadCloser, error) {
+	if name == "" || name == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(name)
+}
+
+// 把info.files[0].path这种形式的路径解析成BObject.Get的参数
+func parsePath(s string) ([]interface{}, error) {
+	var path []interface{}
+	for _, part := range strings.Split(s, ".") {
+		key := part
+		idx := strings.IndexByte(part, '[')
+		if idx >= 0 {
+			key = part[:idx]
+		}
+		if key != "" {
+			path = append(path, key)
+		}
+		for rest := part[len(key):]; rest != ""; {
+			end := strings.IndexByte(rest, ']')
+			if rest[0] != '[' || end < 0 {
+				return nil, fmt.Errorf("invalid path %q", s)
+			}
+			n, err := strconv.Atoi(rest[1:end])
+			if err != nil {
+				return nil, fmt.Errorf("invalid index in path %q", s)
+			}
+			path = append(path, n)
+			rest = rest[end+1:]
+		}
+		if key == "" && idx < 0 {
+			return nil, fmt.Errorf("empty key in path %q", s)
+		}
+	}
+	return path, nil
+}
+
+// 按缩进的树形结构输出
+func (c *bencodeCmd) printTree(obj *bencode.BObject, indent int) {
+	pad := strings.Repeat("  ", indent)
+	switch obj.Type() {
+	case bencode.LIST:
+		list, _ := obj.List()
+		if len(list) == 0 {
+			fmt.Fprintf(c.out, "%s[]\n", pad)
+		}
+		for _, v := range list {
+			if isScalar(v) {
+				fmt.Fprintf(c.out, "%s- %s\n", pad, c.scalar("", v))
+				continue
+			}
+			fmt.Fprintf(c.out, "%s-\n", pad)
+			c.printTree(v, indent+1)
+		}
+	case bencode.DICT:
+		keys, _ := obj.Keys()
+		if len(keys) == 0 {
+			fmt.Fprintf(c.out, "%s{}\n", pad)
+		}
+		for _, k := range keys {
+			v, _ := obj.Get(k)
+			if isScalar(v) {
+				fmt.Fprintf(c.out, "%s%s: %s\n", pad, quoteKey(k), c.scalar(k, v))
+				continue
+			}
+			fmt.Fprintf(c.out, "%s%s:\n", pad, quoteKey(k))
+			c.printTree(v, indent+1)
+		}
+	default:
+		fmt.Fprintf(c.out, "%s%s\n", pad, c.scalar(c.key, obj))
+	}
+}
+
+func isScalar(obj *bencode.BObject) bool {
+	return obj.Type() == bencode.STR || obj.Type() == bencode.INT || obj.Len() == 0
+}
+
+// 输出字符串、整数以及空的列表和字典，key用来判断是不是pieces
+func (c *bencodeCmd) scalar(key string, obj *bencode.BObject) string {
+	switch obj.Type() {
+	case bencode.INT:
+		n, _ := obj.BigInt()
+		return n.String()
+	case bencode.LIST:
+		return "[]"
+	case bencode.DICT:
+		return "{}"
+	}
+	str, _ := obj.Str()
+	if s, ok := c.summary(key, str); ok {
+		return "<" + s + ">"
+	}
+	if isText(str) {
+		return strconv.Quote(str)
+	}
+	if c.binary == "base64" {
+		return "base64:" + base64.StdEncoding.EncodeToString([]byte(str))
+	}
+	return "hex:" + hex.EncodeToString([]byte(str))
+}
+
+// pieces是所有分片哈希拼起来的，通常有几十KB，默认只输出统计信息
+func (c *bencodeCmd) summary(key, str string) (string, bool) {
+	if c.full || key != "pieces" || len(str)%20 != 0 {
+		return "", false
+	}
+	return fmt.Sprintf("%d piece hashes, %d bytes", len(str)/20, len(str)), true
+}
+
+// 转换成可以直接输出JSON的结构，map的key在输出时会按字典序排列，和Bencode一致
+func (c *bencodeCmd) toJSON(key string, obj *bencode.BObject) interface{} {
+	switch obj.Type() {
+	case bencode.INT:
+		n, _ := obj.BigInt()
+		return json.Number(n.String())
+	case bencode.LIST:
+		list, _ := obj.List()
+		res := make([]interface{}, len(list))
+		for i, v := range list {
+			res[i] = c.toJSON("", v)
+		}
+		return res
+	case bencode.DICT:
+		dict, _ := obj.Dict()
+		res := make(map[string]interface{}, len(dict))
+		for k, v := range dict {
+			res[k] = c.toJSON(k, v)
+		}
+		return res
+	}
+	str, _ := obj.Str()
+	if s, ok := c.summary(key, str); ok {
+		return map[string]string{summaryKey: s}
+	}
+	if isText(str) {
+		return str
+	}
+	if c.binary == "base64" {
+		return map[string]string{base64Key: base64.StdEncoding.EncodeToString([]byte(str))}
+	}
+	return map[string]string{hexKey: hex.EncodeToString([]byte(str))}
+}
+
+// 合法的UTF-8并且没有控制字符的字符串才当作文本输出
+func isText(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if !unicode.IsPrint(r) && r != '\n' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+func quoteKey(k string) string {
+	if k != "" && isText(k) && !strings.ContainsAny(k, ":\"") && strings.TrimSpace(k) == k {
+		return k
+	}
+	if isText(k) {
+		return strconv.Quote(k)
+	}
+	return "hex:" + hex.EncodeToString([]byte(k))
+}
+
+// 从JSON构造BObject，整数保持任意精度
+func decodeJSON(r io.Reader) (*bencode.BObject, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return fromJSON(v)
+}
+
+func fromJSON(v interface{}) (*bencode.BObject, error) {
+	switch v := v.(type) {
+	case string:
+		return bencode.NewString(v), nil
+	case json.Number:
+		n, ok := new(big.Int).SetString(string(v), 10)
+		if !ok {
+			return nil, fmt.Errorf("bencode only supports integers, get %s", v)
+		}
+		return bencode.NewBigInt(n), nil
+	case bool:
+		if v {
+			return bencode.NewInt(1), nil
+		}
+		return bencode.NewInt(0), nil
+	case []interface{}:
+		list := bencode.NewList()
+		for _, e := range v {
+			obj, err := fromJSON(e)
+			if err != nil {
+				return nil, err
+			}
+			list.Append(obj)
+		}
+		return list, nil
+	case map[string]interface{}:
+		if len(v) == 1 {
+			if obj, ok, err := fromBinary(v); ok {
+				return obj, err
+			}
+		}
+		dict := bencode.NewDict(nil)
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			obj, err := fromJSON(v[k])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			dict.Set(k, obj)
+		}
+		return dict, nil
+	}
+	return nil, fmt.Errorf("cannot convert %v to bencode", v)
+}
+
+// 解析{"$hex": "..."}这种表示二进制字符串的对象
+func fromBinary(v map[string]interface{}) (*bencode.BObject, bool, error) {
+	for k, e := range v {
+		s, isStr := e.(string)
+		if !isStr {
+			return nil, false, nil
+		}
+		switch k {
+		case hexKey:
+			b, err := hex.DecodeString(s)
+			return bencode.NewString(string(b)), true, err
+		case base64Key:
+			b, err := base64.StdEncoding.DecodeString(s)
+			return bencode.NewString(string(b)), true, err
+		case summaryKey:
+			return nil, true, fmt.Errorf("value was summarised (%s), dump with -full to convert back", s)
+		}
+	}
+	return nil, false, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Ryan-ovo/go-bittorrent/torrent"
+)
+
+// 执行cat子命令：按顺序下载种子的内容，边下载边写到标准输出
+// 下载的内容保存在文件中，默认是退出时删除的临时文件，内存占用和种子的大小无关
+func runCat(args []string) error {
+	fs := flag.NewFlagSet("cat", flag.ContinueOnError)
+	readahead := fs.Int64("readahead", torrent.DefaultReadahead>>10, "readahead in KiB")
+	offset := fs.Int64("offset", 0, "start from this byte offset")
+	output := fs.String("o", "", "keep the downloaded file at this path instead of a temporary file")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: cat [-readahead KiB] [-offset n] [-o file] <torrent file>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("missing torrent file")
+	}
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	tf, err := torrent.ParseFile(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	peerID := torrent.NewPeerID()
+	peers := torrent.FindPeers(tf, peerID)
+	if len(peers) == 0 {
+		return errors.New("peers not found")
+	}
+	name := *output
+	if name == "" {
+		tmp, err := os.CreateTemp("", "bt-cat-*")
+		if err != nil {
+			return err
+		}
+		tmp.Close()
+		name = tmp.Name()
+		defer os.Remove(name)
+	}
+	task := &torrent.TorrentTask{
+		PeerID:   peerID,
+		Tracker:  tf.Announce,
+		PeerList: peers,
+		InfoSHA:  tf.InfoSHA,
+		FileName: name,
+		FileLen:  tf.FileLen,
+		PieceLen: tf.PieceLen,
+		PieceSHA: tf.PieceSHA,
+	}
+	task.SetSequential(true)
+	r := task.NewReader()
+	defer r.Close()
+	r.SetReadahead(*readahead << 10)
+	if _, err = r.Seek(*offset, io.SeekStart); err != nil {
+		return err
+	}
+	go announceLoop(task, tf, false)
+	done := make(chan error, 1)
+	go func() { done <- torrent.Download(task) }()
+	_, err = io.Copy(os.Stdout, r)
+	// 输出出错或者不保留文件时，不需要再下载剩下的部分
+	if err != nil || *output == "" {
+		task.Stop()
+	}
+	// 等待下载的文件写完
+	if derr := <-done; err == nil && !errors.Is(derr, torrent.ErrStopped) {
+		err = derr
+	}
+	return err
+}
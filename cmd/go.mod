@@ -2,6 +2,12 @@ module github.com/Ryan-ovo/go-bittorrent/cmd
 
 go 1.18
 
-require github.com/Ryan-ovo/go-bittorrent/torrent v0.0.0-20221229072350-4a1c833d6b6c
+require (
+	github.com/Ryan-ovo/go-bittorrent/bencode v0.0.0-20221220152422-90dbd36df35d
+	github.com/Ryan-ovo/go-bittorrent/torrent v0.0.0-20221229072350-4a1c833d6b6c
+)
 
-require github.com/Ryan-ovo/go-bittorrent/bencode v0.0.0-20221220152422-90dbd36df35d // indirect
+replace (
+	github.com/Ryan-ovo/go-bittorrent/bencode => ../bencode
+	github.com/Ryan-ovo/go-bittorrent/torrent => ../torrent
+)
@@ -1,38 +1,143 @@
 package main
 
 import (
-	"crypto/rand"
+	"flag"
+	"fmt"
 	"github.com/Ryan-ovo/go-bittorrent/torrent"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 )
 
+// 重新向tracker获取peer的间隔
+const reannounceInterval = 5 * time.Minute
+
 func main() {
-	// 1. 打开种子文件
-	file, err := os.Open(os.Args[1])
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: main [flags] <torrent file>... | main bencode [flags] [file] | main cat [flags] <torrent file>")
+		os.Exit(2)
+	}
+	// 子命令
+	if os.Args[1] == "bencode" {
+		if err := runBencode(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "bencode:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if os.Args[1] == "cat" {
+		if err := runCat(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "cat:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	fs := flag.NewFlagSet("main", flag.ExitOnError)
+	ipfilter := fs.String("ipfilter", "", "IP blocklist (ipfilter.dat, P2P or CIDR), reloaded on SIGHUP")
+	up := fs.Int("up", 0, "upload limit in KiB/s, 0 for unlimited")
+	down := fs.Int("down", 0, "download limit in KiB/s, 0 for unlimited")
+	unlimited := fs.String("unlimited", "", "time span without limits, e.g. 23:00-07:00")
+	port := fs.Int("port", torrent.PeerPort, "listen port shared by all torrents")
+	maxConns := fs.Int("maxconns", torrent.MaxConns, "max peer connections of all torrents, 0 for unlimited")
+	maxActive := fs.Int("maxactive", torrent.MaxActiveDownloads, "max torrents downloading at the same time, 0 for unlimited")
+	maxSeeds := fs.Int("maxseeds", torrent.MaxActiveSeeds, "max torrents seeding at the same time, 0 for unlimited")
+	queue := fs.String("queue", "", "file to save the download queue, restored on start")
+	fs.Parse(os.Args[1:])
+	if fs.NArg() == 0 && *queue == "" {
+		fmt.Fprintln(os.Stderr, "usage: main [-ipfilter file] [-up KiB/s] [-down KiB/s] [-unlimited HH:MM-HH:MM] [-port port] [-maxconns n] [-maxactive n] [-maxseeds n] [-queue file] <torrent file>...")
+		os.Exit(2)
+	}
+	if err := setRateLimit(*up*1024, *down*1024, *unlimited); err != nil {
+		log.Println("set rate limit error = ", err)
+		return
+	}
+	if *ipfilter != "" {
+		if err := loadIPFilter(*ipfilter); err != nil {
+			log.Println("load ip filter error = ", err)
+			return
+		}
+	}
+	// 1. 所有种子共用一个端口和连接数限制
+	torrent.MaxConns = *maxConns
+	client, err := torrent.NewClient(":" + strconv.Itoa(*port))
 	if err != nil {
-		log.Println("open file error = ", err)
+		log.Println("listen error = ", err)
 		return
 	}
+	defer client.Close()
+	torrent.AnnouncePort = client.Port()
+	torrent.UTP = client.UTPSocket()
+	client.SetMaxActive(*maxActive)
+	client.SetMaxSeeds(*maxSeeds)
+	// 2. 恢复上次保存的队列
+	if *queue != "" {
+		restored, err := client.LoadQueue(*queue)
+		if err != nil {
+			log.Println("load queue error = ", err)
+			return
+		}
+		for _, task := range restored {
+			if task.Tracker == "" {
+				continue
+			}
+			go announceLoop(task, &torrent.TorrentFile{
+				Announce: task.Tracker,
+				InfoSHA:  task.InfoSHA,
+				FileName: task.FileName,
+				FileLen:  task.FileLen,
+				PieceLen: task.PieceLen,
+				PieceSHA: task.PieceSHA,
+			}, true)
+		}
+	}
+	// 3. 加入命令行中的种子
+	failed := false
+	for _, path := range fs.Args() {
+		if err := addTorrent(client, path); err != nil {
+			log.Printf("add torrent error, file = [%s], err = [%v]\n", path, err)
+			failed = true
+		}
+	}
+	// 4. 等待所有种子下载结束，暂停的种子留到下次
+	for _, item := range client.Queue() {
+		if item.State == torrent.StatePaused {
+			continue
+		}
+		if err := client.Wait(item.InfoSHA); err != nil {
+			log.Printf("download error, file = [%s], err = [%v]\n", item.FileName, err)
+			failed = true
+		}
+	}
+	if failed {
+		client.Close()
+		os.Exit(1)
+	}
+}
+
+// 解析种子文件，从tracker获取peer后加入Client的下载队列，已经在队列中时什么也不做
+func addTorrent(client *torrent.Client, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
 	defer file.Close()
-	// 2. 解析种子文件
 	tf, err := torrent.ParseFile(file)
 	if err != nil {
-		log.Println("parse file error = ", err)
-		return
+		return err
+	}
+	if client.Get(tf.InfoSHA) != nil {
+		return nil
 	}
-	// 3. 生成客户端的peer id
-	var peerID [torrent.IDLen]byte
-	_, _ = rand.Read(peerID[:])
-	// 4. 连接tracker，获取peer的信息
-	peers := torrent.FindPeers(tf, peerID)
+	// 没有获取到peer时继续等待其他peer主动连接和之后的announce
+	peers := torrent.FindPeers(tf, client.PeerID)
 	if len(peers) == 0 {
-		log.Println("peers not found")
-		return
+		log.Printf("peers not found, file = [%s]\n", path)
 	}
-	// 5. 封装下载对象
 	task := &torrent.TorrentTask{
-		PeerID:   peerID,
+		Tracker:  tf.Announce,
 		PeerList: peers,
 		InfoSHA:  tf.InfoSHA,
 		FileName: tf.FileName,
@@ -40,5 +145,65 @@ func main() {
 		PieceLen: tf.PieceLen,
 		PieceSHA: tf.PieceSHA,
 	}
-	torrent.Download(task)
+	if err = client.Add(task); err != nil {
+		return err
+	}
+	go announceLoop(task, tf, false)
+	return nil
+}
+
+// 定期重新向tracker获取peer，加入到下载任务中，直到下载完成，now为true时马上获取一次
+func announceLoop(task *torrent.TorrentTask, tf *torrent.TorrentFile, now bool) {
+	ticker := time.NewTicker(reannounceInterval)
+	defer ticker.Stop()
+	for {
+		if s := task.Status(); s.PiecesDone == s.PiecesTotal {
+			return
+		}
+		if now {
+			if err := task.Announce(tf); err != nil {
+				log.Println("announce to tracker error = ", err)
+			}
+		}
+		now = true
+		<-ticker.C
+	}
+}
+
+// 加载IP黑名单，收到SIGHUP时重新加载
+func loadIPFilter(path string) error {
+	filter, err := torrent.LoadIPFilter(path)
+	if err != nil {
+		return err
+	}
+	torrent.PeerFilter = filter
+	log.Printf("load ip filter, ranges = [%d]\n", filter.Len())
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := filter.Reload(); err != nil {
+				log.Println("reload ip filter error = ", err)
+				continue
+			}
+			log.Printf("reload ip filter, ranges = [%d]\n", filter.Len())
+		}
+	}()
+	return nil
+}
+
+// 设置全局限速，unlimited不为空时在这个时间段内不限速
+func setRateLimit(up, down int, unlimited string) error {
+	if unlimited == "" {
+		torrent.UploadLimiter.SetRate(up)
+		torrent.DownloadLimiter.SetRate(down)
+		return nil
+	}
+	rule, err := torrent.ParseScheduleRule(unlimited, 0, 0)
+	if err != nil {
+		return err
+	}
+	schedule := &torrent.Schedule{Rules: []torrent.ScheduleRule{rule}, Upload: up, Download: down}
+	go schedule.Run(torrent.UploadLimiter, torrent.DownloadLimiter, nil)
+	return nil
 }
@@ -1,6 +1,9 @@
 package torrent
 
-import "strconv"
+import (
+	"math/bits"
+	"strconv"
+)
 
 type Bitfield []byte
 
@@ -20,6 +23,15 @@ func (b Bitfield) SetPiece(index int) {
 	b[idx] |= 1 << uint(7-offset)
 }
 
+// Count 拥有的分片数量
+func (b Bitfield) Count() int {
+	n := 0
+	for _, v := range b {
+		n += bits.OnesCount8(v)
+	}
+	return n
+}
+
 func (b Bitfield) String() string {
 	str := "piece# "
 	for i := 0; i < len(b)*8; i++ {
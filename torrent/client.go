@@ -0,0 +1,385 @@
+package torrent
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MaxConns Client所有任务加起来的连接数上限，0表示不限制
+var MaxConns = 200
+
+// Client 同时管理多个下载任务
+/*
+1. 所有任务共用一个端口，TCP和uTP都在这个端口上监听，按对方握手消息中的info hash把连接交给对应的任务
+2. 所有任务共用全局限速UploadLimiter和DownloadLimiter，每个任务还可以有自己的限速
+3. 所有任务的连接数加起来不超过MaxConns，包括主动建立和对方建立的连接
+4. 监听的端口需要通过AnnouncePort告诉tracker，发起uTP连接需要把UTP设置成UTPSocket()
+5. 任务按队列顺序下载，同时下载的任务数不超过MaxActiveDownloads，下载完成后做种，同时做种的任务数不超过MaxActiveSeeds，见queue.go
+*/
+type Client struct {
+	PeerID [IDLen]byte // 所有任务共用的peer id
+
+	mu        sync.Mutex
+	changed   *sync.Cond // 任务的队列状态变化时通知Wait
+	tasks     map[[SHALEN]byte]*clientTask
+	order     []*clientTask // 下载队列，按优先级从高到低排列
+	maxActive int
+	maxSeeds  int
+	stallTime time.Duration
+	queueFile string // 保存队列的文件，为空时不保存
+	ln        net.Listener
+	utp       *UTPSocket
+	conns     *connLimit
+	closed    bool
+	quit      chan struct{}
+	wg        sync.WaitGroup // 监听和检查队列的协程
+}
+
+// Client中的一个任务
+type clientTask struct {
+	task     *TorrentTask
+	state    QueueState
+	priority int
+	lastPeer time.Time     // 最近一次有peer连接的时间，用来判断任务是否停滞
+	done     chan struct{} // 这一次Download结束时关闭，还没有开始下载时为nil
+	err      error         // 最近一次Download的结果
+}
+
+// NewClient 在addr上监听TCP和uTP，addr为空时使用PeerPort
+func NewClient(addr string) (*Client, error) {
+	if addr == "" {
+		addr = ":" + strconv.Itoa(PeerPort)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// uTP使用和TCP相同的端口
+	utp, err := ListenUTP(ln.Addr().String())
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	c := &Client{
+		PeerID: NewPeerID(),
+		tasks:  make(map[[SHALEN]byte]*clientTask),
+		ln:     ln,
+		utp:    utp,
+		conns:  newConnLimit(MaxConns),
+		quit:   make(chan struct{}),
+
+		maxActive: MaxActiveDownloads,
+		maxSeeds:  MaxActiveSeeds,
+		stallTime: StallTimeout,
+	}
+	c.changed = sync.NewCond(&c.mu)
+	c.wg.Add(3)
+	go c.acceptLoop(ln)
+	go c.acceptLoop(utp)
+	go c.queueLoop()
+	return c, nil
+}
+
+// Addr 监听的地址
+func (c *Client) Addr() net.Addr {
+	return c.ln.Addr()
+}
+
+// Port 监听的端口
+func (c *Client) Port() int {
+	return c.ln.Addr().(*net.TCPAddr).Port
+}
+
+// UTPSocket 监听端口上的uTP socket
+func (c *Client) UTPSocket() *UTPSocket {
+	return c.utp
+}
+
+// Add 把任务加入下载队列，有空闲名额时马上开始下载，任务使用Client的peer id
+func (c *Client) Add(task *TorrentTask) error {
+	return c.AddWithPriority(task, 0)
+}
+
+// AddWithPriority 按优先级加入下载队列，排在相同优先级的任务之后
+func (c *Client) AddWithPriority(task *TorrentTask, priority int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.add(task, priority, StateQueued); err != nil {
+		return err
+	}
+	c.schedule()
+	c.save()
+	return nil
+}
+
+// 需要持有锁
+func (c *Client) add(task *TorrentTask, priority int, state QueueState) error {
+	if c.closed {
+		return ErrClientClosed
+	}
+	if _, ok := c.tasks[task.InfoSHA]; ok {
+		return ErrTorrentExists
+	}
+	task.mu.Lock()
+	task.PeerID = c.PeerID
+	task.conns = c.conns
+	ct := &clientTask{task: task, state: state, priority: priority}
+	task.listening = true
+	task.seed = func() bool { return c.seed(ct) }
+	task.mu.Unlock()
+	c.tasks[task.InfoSHA] = ct
+	c.order = append(c.order, ct)
+	c.sortQueue()
+	return nil
+}
+
+// Remove 停止下载并移除任务，已经下载的内容随任务一起丢弃
+func (c *Client) Remove(infoSHA [SHALEN]byte) error {
+	c.mu.Lock()
+	ct, ok := c.tasks[infoSHA]
+	if !ok {
+		c.mu.Unlock()
+		return ErrUnknownTorrent
+	}
+	delete(c.tasks, infoSHA)
+	c.order = removeTask(c.order, ct)
+	c.mu.Unlock()
+	c.stop(ct)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.changed.Broadcast()
+	c.schedule()
+	c.save()
+	return nil
+}
+
+// Pause 停止下载并等待任务结束，已经校验通过的分片会保留，暂停的任务不会被自动开始
+func (c *Client) Pause(infoSHA [SHALEN]byte) error {
+	c.mu.Lock()
+	ct, ok := c.tasks[infoSHA]
+	if !ok {
+		c.mu.Unlock()
+		return ErrUnknownTorrent
+	}
+	if ct.state == StateCompleted || ct.state == StatePaused {
+		c.mu.Unlock()
+		return nil
+	}
+	// 做种的任务暂停后不再做种，Resume后重新开始做种
+	ct.state = StatePaused
+	c.changed.Broadcast()
+	c.mu.Unlock()
+	c.stop(ct)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.schedule()
+	c.save()
+	return nil
+}
+
+// Resume 把暂停或者失败的任务放回队列，正在下载或者已经完成时什么也不做
+func (c *Client) Resume(infoSHA [SHALEN]byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClientClosed
+	}
+	ct, ok := c.tasks[infoSHA]
+	if !ok {
+		return ErrUnknownTorrent
+	}
+	if ct.state != StatePaused && ct.state != StateFailed {
+		return nil
+	}
+	ct.state = StateQueued
+	c.schedule()
+	c.save()
+	return nil
+}
+
+// Wait 等待任务完成、失败或者被暂停，返回Download的结果，暂停的任务返回ErrStopped，开始做种就算完成
+func (c *Client) Wait(infoSHA [SHALEN]byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		ct, ok := c.tasks[infoSHA]
+		switch {
+		case !ok:
+			return ErrUnknownTorrent
+		case ct.state == StateCompleted || ct.state == StateSeeding:
+			return nil
+		case ct.state == StateFailed:
+			return ct.err
+		case ct.state == StatePaused:
+			return ErrStopped
+		case c.closed:
+			return ErrClientClosed
+		}
+		c.changed.Wait()
+	}
+}
+
+// Get 按info hash查找任务，没有时返回nil
+func (c *Client) Get(infoSHA [SHALEN]byte) *TorrentTask {
+	ct, err := c.get(infoSHA)
+	if err != nil {
+		return nil
+	}
+	return ct.task
+}
+
+// Torrents 所有任务，按队列顺序排列
+func (c *Client) Torrents() []*TorrentTask {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tasks := make([]*TorrentTask, 0, len(c.order))
+	for _, ct := range c.order {
+		tasks = append(tasks, ct.task)
+	}
+	return tasks
+}
+
+// Close 停止所有任务并关闭监听
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClientClosed
+	}
+	c.closed = true
+	close(c.quit)
+	tasks := append([]*clientTask(nil), c.order...)
+	c.changed.Broadcast()
+	c.mu.Unlock()
+	err := c.ln.Close()
+	c.utp.Close()
+	c.wg.Wait()
+	for _, ct := range tasks {
+		c.stop(ct)
+	}
+	// 正在下载的任务保存成等待下载，下次启动后继续
+	c.mu.Lock()
+	c.save()
+	c.mu.Unlock()
+	return err
+}
+
+func (c *Client) get(infoSHA [SHALEN]byte) (*clientTask, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ct, ok := c.tasks[infoSHA]
+	if !ok {
+		return nil, ErrUnknownTorrent
+	}
+	return ct, nil
+}
+
+// 在新的协程中下载或者做种，结束后更新队列状态并开始下一个任务，需要持有锁
+func (c *Client) start(ct *clientTask, state QueueState) error {
+	stop, err := ct.task.begin()
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	ct.done = done
+	ct.state = state
+	ct.lastPeer = time.Now()
+	go func() {
+		err := ct.task.run(stop)
+		if err != nil && !errors.Is(err, ErrStopped) {
+			log.Printf("download error, file = [%s], err = [%v]\n", ct.task.FileName, err)
+		}
+		c.mu.Lock()
+		ct.err = err
+		switch {
+		case ct.state == StatePaused:
+		case err == nil:
+			// 包括停止做种
+			ct.state = StateCompleted
+		case errors.Is(err, ErrStopped):
+			// 被移除或者Client被关闭
+			ct.state = StateQueued
+		default:
+			ct.state = StateFailed
+		}
+		close(done)
+		c.changed.Broadcast()
+		c.schedule()
+		c.save()
+		c.mu.Unlock()
+	}()
+	return nil
+}
+
+// 任务下载完成时调用，有空闲的做种名额时开始做种，空出下载名额给下一个任务
+func (c *Client) seed(ct *clientTask) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// 已经完成的任务由schedule开始做种，开始时已经占用了名额
+	if ct.state == StateSeeding {
+		return true
+	}
+	if c.closed || (ct.state != StateDownloading && ct.state != StateStalled) {
+		return false
+	}
+	if c.maxSeeds > 0 && c.count(StateSeeding) >= c.maxSeeds {
+		return false
+	}
+	ct.state = StateSeeding
+	c.changed.Broadcast()
+	c.schedule()
+	c.save()
+	return true
+}
+
+// 停止下载并等待任务结束
+func (c *Client) stop(ct *clientTask) {
+	c.mu.Lock()
+	done := ct.done
+	c.mu.Unlock()
+	if done == nil {
+		return
+	}
+	ct.task.Stop()
+	<-done
+}
+
+func (c *Client) acceptLoop(ln interface{ Accept() (net.Conn, error) }) {
+	defer c.wg.Done()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go c.handleConn(conn)
+	}
+}
+
+// 握手之后按info hash把连接交给对应的任务
+func (c *Client) handleConn(conn net.Conn) {
+	c.mu.Lock()
+	hashes := make([][SHALEN]byte, 0, len(c.tasks))
+	for h := range c.tasks {
+		hashes = append(hashes, h)
+	}
+	c.mu.Unlock()
+	var task *TorrentTask
+	pc, err := acceptPeerConn(conn, hashes, c.PeerID, func(h [SHALEN]byte) (int, bool) {
+		if ct, err := c.get(h); err == nil {
+			task = ct.task
+			return len(task.PieceSHA), true
+		}
+		return 0, false
+	})
+	if err != nil {
+		log.Printf("accept peer error, addr = [%s], err = [%v]\n", conn.RemoteAddr(), err)
+		return
+	}
+	if err = task.acceptConn(pc); err != nil {
+		log.Printf("drop inbound peer, addr = [%s], err = [%v]\n", conn.RemoteAddr(), err)
+	}
+}
@@ -0,0 +1,194 @@
+package torrent
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestClient(t *testing.T) *Client {
+	c, err := NewClient("127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func testData(n int, seed byte) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i)*seed + seed
+	}
+	return data
+}
+
+// 等待下载开始，之后对方建立的连接才会被接收
+func waitRunning(t *testing.T, task *TorrentTask) {
+	for i := 0; i < 100; i++ {
+		task.mu.Lock()
+		pool := task.pool
+		task.mu.Unlock()
+		if pool != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("download not started")
+}
+
+// 主动连接Client，握手后作为做种方
+func dialSeeder(t *testing.T, addr string, infoSHA [SHALEN]byte, data []byte, pieceLen int) net.Conn {
+	conn, err := dialPeer(addr, infoSHA, Encryption)
+	assert.Equal(t, nil, err)
+	_, err = handshake(conn, infoSHA, NewPeerID())
+	assert.Equal(t, nil, err)
+	t.Cleanup(func() { conn.Close() })
+	if data != nil {
+		go pieceSeeder(&PeerConn{Conn: conn}, data, pieceLen, []byte{0xff, 0xff})
+	}
+	return conn
+}
+
+func TestClientDownload(t *testing.T) {
+	const pieceLen = 1024
+	c := newTestClient(t)
+	var tasks []*TorrentTask
+	var datas [][]byte
+	for i := 0; i < 2; i++ {
+		data := testData(testPieces*pieceLen-i*100, byte(i+3))
+		task := newTestTask(t, data, pieceLen)
+		task.InfoSHA = [SHALEN]byte{byte(i + 10)}
+		task.PeerList = []PeerInfo{listenSeeder(t, "127.0.0.1:0", task.InfoSHA, data, pieceLen)}
+		assert.Equal(t, nil, c.Add(task))
+		assert.Equal(t, c.PeerID, task.PeerID)
+		tasks = append(tasks, task)
+		datas = append(datas, data)
+	}
+	assert.Equal(t, ErrTorrentExists, c.Add(&TorrentTask{InfoSHA: tasks[0].InfoSHA}))
+	assert.Equal(t, 2, len(c.Torrents()))
+
+	for i, task := range tasks {
+		assert.Equal(t, nil, c.Wait(task.InfoSHA))
+		got, err := os.ReadFile(task.FileName)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, datas[i], got)
+		// 已经完成的任务不会重新下载
+		assert.Equal(t, nil, c.Resume(task.InfoSHA))
+		assert.Equal(t, nil, c.Wait(task.InfoSHA))
+	}
+
+	assert.Equal(t, nil, c.Remove(tasks[0].InfoSHA))
+	assert.Equal(t, (*TorrentTask)(nil), c.Get(tasks[0].InfoSHA))
+	assert.Equal(t, tasks[1], c.Get(tasks[1].InfoSHA))
+	assert.Equal(t, ErrUnknownTorrent, c.Remove(tasks[0].InfoSHA))
+	assert.Equal(t, ErrUnknownTorrent, c.Pause(tasks[0].InfoSHA))
+
+	assert.Equal(t, nil, c.Close())
+	assert.Equal(t, ErrClientClosed, c.Add(&TorrentTask{}))
+	assert.Equal(t, ErrClientClosed, c.Resume(tasks[1].InfoSHA))
+}
+
+func TestClientPauseResume(t *testing.T) {
+	const pieceLen = 1024
+	c := newTestClient(t)
+	data := testData(testPieces*pieceLen, 7)
+	task := newTestTask(t, data, pieceLen)
+	task.PeerList = []PeerInfo{listenSeeder(t, "127.0.0.1:0", task.InfoSHA, data, pieceLen)}
+	// 限速让下载持续几秒
+	task.DownloadLimit = NewLimiter(4 * pieceLen)
+	events, cancel := task.Subscribe()
+	defer cancel()
+	assert.Equal(t, nil, c.Add(task))
+	for e := range events {
+		if e.Type == EventPieceVerified {
+			break
+		}
+	}
+	assert.Equal(t, nil, c.Pause(task.InfoSHA))
+	assert.Equal(t, ErrStopped, c.Wait(task.InfoSHA))
+	paused := task.Status()
+	assert.Equal(t, true, paused.Done)
+	assert.Equal(t, true, paused.PiecesDone > 0 && paused.PiecesDone < testPieces)
+
+	// 新的peer只有还没有完成的分片，暂停前已经完成的分片不会重新下载
+	task.DownloadLimit.SetRate(0)
+	bitfield := make(Bitfield, 2)
+	for i := 0; i < testPieces; i++ {
+		if !task.have[i] {
+			bitfield.SetPiece(i)
+		}
+	}
+	task.PeerList = []PeerInfo{listenPartialSeeder(t, "127.0.0.1:0", task.InfoSHA, data, pieceLen, bitfield)}
+	assert.Equal(t, nil, c.Resume(task.InfoSHA))
+	assert.Equal(t, nil, c.Wait(task.InfoSHA))
+	got, err := os.ReadFile(task.FileName)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, data, got)
+}
+
+func TestClientInbound(t *testing.T) {
+	const pieceLen = 1024
+	c := newTestClient(t)
+	var tasks []*TorrentTask
+	var datas [][]byte
+	for i := 0; i < 2; i++ {
+		data := testData(testPieces*pieceLen-100, byte(i+5))
+		task := newTestTask(t, data, pieceLen)
+		task.InfoSHA = [SHALEN]byte{byte(i + 20)}
+		assert.Equal(t, nil, c.Add(task))
+		waitRunning(t, task)
+		tasks = append(tasks, task)
+		datas = append(datas, data)
+	}
+	// 没有这个任务，握手后直接断开
+	conn, err := dialPeer(c.Addr().String(), [SHALEN]byte{99}, Encryption)
+	assert.Equal(t, nil, err)
+	_, err = handshake(conn, [SHALEN]byte{99}, NewPeerID())
+	assert.NotEqual(t, nil, err)
+	conn.Close()
+
+	// 按info hash交给对应的任务，即使没有其他peer也会继续等待
+	for i := len(tasks) - 1; i >= 0; i-- {
+		dialSeeder(t, c.Addr().String(), tasks[i].InfoSHA, datas[i], pieceLen)
+	}
+	for i, task := range tasks {
+		assert.Equal(t, nil, c.Wait(task.InfoSHA))
+		got, err := os.ReadFile(task.FileName)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, datas[i], got)
+	}
+}
+
+func TestClientConnLimit(t *testing.T) {
+	defer func(n int) { MaxConns = n }(MaxConns)
+	MaxConns = 1
+	c := newTestClient(t)
+	task := newTestTask(t, testData(1024, 1), 1024)
+	assert.Equal(t, nil, c.Add(task))
+	waitRunning(t, task)
+
+	// 第一个连接不发送bitfield，一直占用名额
+	dialSeeder(t, c.Addr().String(), task.InfoSHA, nil, 0)
+	for i := 0; i < 100 && c.conns.count() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 1, c.conns.count())
+	// 超过上限的连接握手后被断开
+	conn := dialSeeder(t, c.Addr().String(), task.InfoSHA, nil, 0)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	assert.NotEqual(t, nil, err)
+	if ne, ok := err.(net.Error); ok {
+		assert.Equal(t, false, ne.Timeout())
+	}
+	assert.Equal(t, 1, c.conns.count())
+
+	// 暂停后连接断开，名额被释放
+	assert.Equal(t, nil, c.Pause(task.InfoSHA))
+	for i := 0; i < 100 && c.conns.count() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, c.conns.count())
+}
@@ -0,0 +1,89 @@
+package torrent
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// DialPolicy 发起连接时使用的传输协议
+type DialPolicy int
+
+const (
+	DialTCP          DialPolicy = iota // 只使用TCP
+	DialUTPPreferred                   // 优先uTP，连接失败时使用TCP
+	DialRace                           // 同时尝试TCP和uTP，使用先建立的连接
+)
+
+func (p DialPolicy) String() string {
+	switch p {
+	case DialTCP:
+		return "tcp"
+	case DialUTPPreferred:
+		return "utp"
+	case DialRace:
+		return "race"
+	}
+	return fmt.Sprintf("DialPolicy(%d)", int(p))
+}
+
+var (
+	// Transport 发起连接使用的传输协议
+	Transport = DialTCP
+	// UTP 发起uTP连接使用的socket，通常就是监听端口上的socket，为nil时只使用TCP
+	UTP *UTPSocket
+)
+
+const (
+	dialTimeout    = 5 * time.Second
+	utpDialTimeout = 3 * time.Second // uTP失败后还要尝试TCP，超时时间短一些
+)
+
+// 按Transport建立到addr的连接
+func dialTransport(addr string) (net.Conn, error) {
+	return dialWith(addr, Transport, UTP)
+}
+
+func dialWith(addr string, policy DialPolicy, sock *UTPSocket) (net.Conn, error) {
+	if sock == nil || policy == DialTCP {
+		return net.DialTimeout("tcp", addr, dialTimeout)
+	}
+	if policy == DialUTPPreferred {
+		if conn, err := sock.DialTimeout(addr, utpDialTimeout); err == nil {
+			return conn, nil
+		}
+		return net.DialTimeout("tcp", addr, dialTimeout)
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 2)
+	go func() {
+		conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+		results <- result{conn, err}
+	}()
+	go func() {
+		conn, err := sock.DialTimeout(addr, dialTimeout)
+		results <- result{conn, err}
+	}()
+	var err error
+	for i := 0; i < 2; i++ {
+		res := <-results
+		if res.err != nil {
+			err = res.err
+			continue
+		}
+		// 后建立的连接直接关闭
+		if i == 0 {
+			go func() {
+				if late := <-results; late.err == nil {
+					late.conn.Close()
+				}
+			}()
+		}
+		return res.conn, nil
+	}
+	return nil, err
+}
@@ -3,25 +3,76 @@ package torrent
 import (
 	"bytes"
 	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"sync"
 	"time"
 )
 
 const (
 	BLOCKSIZE  = 1024 * 16 // block = sub-piece
 	MAXBACKLOG = 5         // 一个peer协程最多同时发送5个请求
+
+	stuckCheckInterval = time.Second // 检查是否还有peer能提供剩下分片的间隔
+	maxPieceFailures   = 3           // 同一个连接上一个分片最多校验失败几次，之后不再从这个连接下载这个分片
 )
 
+// 下载分片时超过这么久没有收到任何子分片算超时，每收到一个子分片重新计时，限速很低时分片整体下载慢也不会超时
+var pieceTimeout = 15 * time.Second
+
 // TorrentTask 下载任务的抽象
 type TorrentTask struct {
 	PeerID   [IDLen]byte    // 客户端id
+	Tracker  string         // tracker的地址，Client保存队列时一起保存
 	PeerList []PeerInfo     // 获取到的peer列表
 	InfoSHA  [SHALEN]byte   // 文件哈希值
 	FileName string         // 文件名
 	FileLen  int            // 文件长度
 	PieceLen int            // 分片长度
 	PieceSHA [][SHALEN]byte // 所有分片哈希值
+
+	UploadLimit   *Limiter // 这个任务的上传限速，为nil时只受全局限速
+	DownloadLimit *Limiter // 这个任务的下载限速
+
+	mu         sync.Mutex
+	pool       *PeerPool // 下载过程中管理peer的连接
+	ban        *smartBan // 找出并封禁发送错误数据的peer
+	events     *eventHub // 事件的订阅者
+	upMeter    rateMeter // 所有连接的上传速度
+	downMeter  rateMeter // 所有连接的下载速度
+	piecesDone int
+	bytesDone  int64
+	have       []bool        // 每个分片是否已经校验通过，校验通过的分片已经写入FileName
+	upload     *os.File      // 回复对方的请求时从这里读取，下载结束时关闭
+	stop       chan struct{} // 正在下载时不为nil，关闭后停止下载
+	conns      *connLimit    // Client的全局连接数限制
+	listening  bool          // 由Client管理，可以接收对方建立的连接，所有peer都放弃后继续等待
+	seed       func() bool   // 由Client管理，所有分片都校验通过时调用，返回true时继续做种直到Stop
+	picker     *piecePicker  // 选择下一个下载的分片，Reader通过它调整优先级
+	verified   chan struct{} // 有分片校验通过或者下载结束时关闭，唤醒等待数据的Reader
+	done       bool          // 下载已经结束
+	err        error         // 下载失败的原因
+}
+
+// TaskStats 下载任务的统计信息
+type TaskStats struct {
+	HashFailures int            // 校验失败的次数
+	PeerFailures map[string]int // 每个peer确认发送的错误子分片数，key是IP
+	Banned       []string       // 被封禁的peer的IP
+}
+
+// Stats 获取下载任务的统计信息
+func (t *TorrentTask) Stats() TaskStats {
+	t.mu.Lock()
+	ban := t.ban
+	t.mu.Unlock()
+	if ban == nil {
+		return TaskStats{PeerFailures: map[string]int{}}
+	}
+	return ban.stats()
 }
 
 func (t *TorrentTask) getPieceBounds(index int) (int, int) {
@@ -33,41 +84,169 @@ func (t *TorrentTask) getPieceBounds(index int) (int, int) {
 	return begin, end
 }
 
-func (t *TorrentTask) peerRoutine(peer PeerInfo, taskQueue chan *pieceTask, resultQueue chan *pieceResult) {
-	// 建立peer的连接
-	conn, err := NewPeerConn(peer, t.InfoSHA, t.PeerID)
+// AddPeers 加入新的peer，下载过程中也可以调用，比如tracker重新announce的结果
+func (t *TorrentTask) AddPeers(peers ...PeerInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pool == nil {
+		t.PeerList = append(t.PeerList, peers...)
+		return
+	}
+	t.pool.Add(peers...)
+}
+
+// Announce 向tracker重新获取peer并加入下载任务
+func (t *TorrentTask) Announce(tf *TorrentFile) error {
+	resp, err := Announce(tf, t.PeerID)
+	if err != nil {
+		t.publish(Event{Type: EventAnnounce, Err: err})
+		return err
+	}
+	t.AddPeers(resp.Peers...)
+	t.publish(Event{Type: EventAnnounce, Peers: len(resp.Peers)})
+	return nil
+}
+
+func (t *TorrentTask) connectPeer(peer PeerInfo) (*PeerConn, error) {
+	if t.ban.Banned(peer.IP.String()) {
+		return nil, ErrBannedPeer
+	}
+	// 加入连接池之后黑名单可能重新加载过
+	if PeerFilter.Blocked(peer.IP) {
+		return nil, ErrBlockedIP
+	}
+	conn, err := NewPeerConn(peer, t.InfoSHA, t.PeerID, len(t.PieceSHA))
 	if err != nil {
 		log.Println("connect to peer error = ", err)
-		return
+		return nil, err
+	}
+	conn.SetLimiters(t.UploadLimit, t.DownloadLimit)
+	conn.setMeters(&t.upMeter, &t.downMeter)
+	return conn, nil
+}
+
+// 使用对方主动建立的连接，由Client在握手之后调用
+func (t *TorrentTask) acceptConn(conn *PeerConn) error {
+	t.mu.Lock()
+	pool, ban, running := t.pool, t.ban, t.stop != nil
+	t.mu.Unlock()
+	if pool == nil || !running {
+		conn.Close()
+		return ErrNotRunning
+	}
+	if ban != nil && ban.Banned(conn.peer.IP.String()) {
+		conn.Close()
+		return ErrBannedPeer
 	}
+	conn.SetLimiters(t.UploadLimit, t.DownloadLimit)
+	conn.setMeters(&t.upMeter, &t.downMeter)
+	return pool.Accept(conn)
+}
+
+// 使用一个已经建立的连接下载，直到连接断开或者下载结束，返回nil表示下载已经结束
+func (t *TorrentTask) peerRoutine(conn *PeerConn, peers *PeerSet, picker *piecePicker, resultQueue chan *pieceResult, stop <-chan struct{}) (err error) {
 	defer conn.Close()
-	log.Printf("complete handshake with peer, ip = [%s], port = [%d]", conn.peer.IP.String(), conn.peer.Port)
-	// 给peer发送interested消息表示想要下载
-	if _, err = conn.WriteMsg(&PeerMsg{MsgInterested, nil}); err != nil {
-		log.Println("write msg to conn error = ", err)
-		return
+	peer := conn.peer
+	// 同一个peer只保留一个连接
+	if err := peers.Add(conn); err != nil {
+		log.Println("drop peer connection, err = ", err)
+		return err
+	}
+	defer peers.Remove(conn)
+	// 断开后唤醒其他peer，让给这个peer的分片可能需要它们重试
+	defer picker.wake()
+	t.publish(Event{Type: EventPeerConnected, Peer: peer})
+	defer func() {
+		t.publish(Event{Type: EventPeerDisconnected, Peer: peer, Err: err})
+	}()
+	// 对方的请求由读协程直接从文件中回复，先告诉对方我们已经有的分片，之后校验通过的分片由下载循环广播
+	conn.setSource(t.readBlock)
+	have := t.havePieces()
+	for _, index := range have {
+		if err := conn.Send(newHaveMsg(index)); err != nil {
+			return err
+		}
 	}
-	// 从任务队列获取分片进行下载
-	for task := range taskQueue {
-		// 如果这个peer没有我们想要的分片，就把任务重新放回队列中
-		if !conn.Field.HasPiece(task.index) {
-			taskQueue <- task
+	log.Printf("complete handshake with peer, ip = [%s], port = [%d], client = [%s]", peer.IP.String(), peer.Port, conn.Client())
+	// 这个peer发过错误数据的分片，有其他连接上的peer拥有时让给对方，否则重试，失败太多次后不再下载
+	skip := func(index int) bool {
+		n := conn.hashFailures(index)
+		if n == 0 {
+			return false
+		}
+		if n >= maxPieceFailures {
+			return true
+		}
+		return peers.Any(func(c *PeerConn) bool {
+			return c != conn && c.HasPiece(index) && c.hashFailures(index) < maxPieceFailures
+		})
+	}
+	// 给peer发送interested消息表示想要下载，做种时不需要
+	if len(have) < len(t.PieceSHA) {
+		if err := conn.Send(&PeerMsg{MsgInterested, nil}); err != nil {
+			log.Println("write msg to conn error = ", err)
+			return err
+		}
+	}
+	for {
+		// 对方还没有告诉我们拥有哪些分片，先不领取任务，等bitfield、have all或have
+		var task *pieceTask
+		changed := picker.wait()
+		if conn.PieceCount() > 0 {
+			// 跳过这个peer没有的分片和这个peer发过校验失败数据的分片，优先下载对方建议的分片
+			task = picker.pick(conn.HasPiece, skip, conn.Suggested())
+		}
+		if task == nil {
+			select {
+			case <-changed:
+			case <-stop:
+				return nil
+			case msg, ok := <-conn.Msgs():
+				// 空闲时收到的消息，连接状态已经在读协程中更新过了
+				if !ok {
+					log.Printf("peer disconnected, peer = [%s], err = [%v]\n", peer.IP.String(), conn.Err())
+					if conn.Err() != nil {
+						return conn.Err()
+					}
+					return ErrConnClosed
+				}
+				if err := rejectRequest(conn, msg); err != nil {
+					return err
+				}
+			}
 			continue
 		}
+		if t.ban.Banned(peer.IP.String()) {
+			picker.put(task)
+			return ErrBannedPeer
+		}
 		log.Printf("get task, index = [%d], peer = [%s]\n", task.index, peer.IP.String())
 		res, err := downloadPiece(conn, task)
 		if err != nil {
-			// 下载失败，把任务重新放到队列中，让其他peer下载这些任务
-			taskQueue <- task
+			// 下载失败，把任务放回去，让其他peer下载
+			picker.put(task)
 			log.Printf("download piece error = [%v]\n", err)
-			return
+			return err
 		}
 		if !checkPiece(task, res) {
-			taskQueue <- task
+			// 记录每个子分片的内容，等分片被重新下载后找出发送错误数据的peer
+			t.ban.Failed(task.index, blockRecords(peer.IP.String(), res.data))
+			conn.addHashFailed(task.index)
+			t.publish(Event{Type: EventHashFailed, Piece: task.index, Peer: peer})
+			picker.put(task)
 			continue
 		}
+		conn.addVerified()
+		for _, ip := range t.ban.Passed(task.index, res.data) {
+			log.Printf("ban peer for sending corrupt data, ip = [%s]\n", ip)
+			peers.CloseIP(ip)
+		}
 		// 校验哈希值通过，把分片下载结果发送到通道中
-		resultQueue <- res
+		select {
+		case resultQueue <- res:
+		case <-stop:
+			return nil
+		}
 	}
 }
 
@@ -78,136 +257,543 @@ type pieceTask struct {
 	length int          // 分片长度，最后一片可能不均等
 }
 
+// 子分片的下载状态
+const (
+	blockPending   = iota // 还没有请求
+	blockRequested        // 已经请求，等待对方发送
+	blockReceived         // 已经收到
+)
+
 // 下载中间态的抽象
 type taskState struct {
 	index      int       // 分片序号
 	conn       *PeerConn // peer之间的连接
-	requested  int       // 还剩多少字节没有请求
+	blocks     []int     // 每个子分片的下载状态
 	downloaded int       // 已经下载的字节数
 	backlog    int       // 并发度
 	data       []byte
 }
 
-func (ts *taskState) handleMsg() error {
-	msg, err := ts.conn.ReadMsg()
-	if err != nil {
-		return err
-	}
-	// 空消息是探活消息
-	if msg == nil {
-		return nil
-	}
-
+func (ts *taskState) handleMsg(msg *PeerMsg) error {
 	switch msg.ID {
-	case MsgChoke: // 对方拒绝上传数据，默认状态
-		ts.conn.Choked = true
-	case MsgUnchoke: // 对方上传数据
-		ts.conn.Choked = false
-	case MsgHave: // 通知拥有某个分片
-		index, err := GetIndex(msg)
-		if err != nil {
+	case MsgChoke: // 对方拒绝上传数据，已经发出的请求会被对方丢弃，需要重新请求
+		// Fast扩展下请求不会被丢弃，对方会逐个回复reject
+		if ts.conn.Fast() {
+			return nil
+		}
+		for i, b := range ts.blocks {
+			if b == blockRequested {
+				ts.blocks[i] = blockPending
+			}
+		}
+		ts.backlog = 0
+	case MsgReject: // 对方拒绝了某个请求，马上放回去等待重新请求，不用等超时
+		reject := &RejectRequest{}
+		if err := reject.UnmarshalBinary(msg.Payload); err != nil {
 			return err
 		}
-		ts.conn.Field.SetPiece(index)
+		block := int(reject.Begin) / BLOCKSIZE
+		if int(reject.Index) != ts.index || block >= len(ts.blocks) || ts.blocks[block] != blockRequested {
+			return nil
+		}
+		ts.blocks[block] = blockPending
+		ts.backlog--
+	case MsgRequest:
+		return rejectRequest(ts.conn, msg)
 	case MsgPiece: // 数据消息
+		if len(msg.Payload) < 8 {
+			return fmt.Errorf("payload too short, expect 8, get %d", len(msg.Payload))
+		}
+		block := int(binary.BigEndian.Uint32(msg.Payload[4:8])) / BLOCKSIZE
+		// 不是我们正在等待的子分片，忽略
+		if block >= len(ts.blocks) || ts.blocks[block] != blockRequested {
+			return nil
+		}
 		n, err := CopyPieceData(ts.index, ts.data, msg)
 		if err != nil {
 			return err
 		}
+		ts.blocks[block] = blockReceived
 		ts.downloaded += n
 		ts.backlog--
 	}
 	return nil
 }
 
+// 发送请求，直到并发度达到上限
+func (ts *taskState) sendRequests() error {
+	for i, b := range ts.blocks {
+		if ts.backlog >= MAXBACKLOG {
+			break
+		}
+		if b != blockPending {
+			continue
+		}
+		// 默认一个sub piece是16k，如果最后一个子分片不足16k，就手动计算一下最后一片的大小
+		begin := i * BLOCKSIZE
+		length := BLOCKSIZE
+		if len(ts.data)-begin < BLOCKSIZE {
+			length = len(ts.data) - begin
+		}
+		// 封装请求体并发送
+		if err := ts.conn.Send(NewRequestMsg(ts.index, begin, length)); err != nil {
+			return err
+		}
+		ts.blocks[i] = blockRequested
+		ts.backlog++
+	}
+	return nil
+}
+
 // 分片下载结果
 type pieceResult struct {
 	index int    // 分片序号
 	data  []byte // 下载的内容
 }
 
+// Download 下载任务，结束后发送EventCompleted、EventStopped或者EventError事件
+// 已经校验通过的分片会保留在任务中，Stop之后再次调用Download会继续下载，订阅者需要重新订阅
 func Download(task *TorrentTask) error {
+	stop, err := task.begin()
+	if err != nil {
+		return err
+	}
+	return task.run(stop)
+}
+
+// 标记任务开始下载，之后Stop就能生效
+func (t *TorrentTask) begin() (chan struct{}, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stop != nil {
+		return nil, ErrRunning
+	}
+	stop := make(chan struct{})
+	t.stop = stop
+	t.done, t.err = false, nil
+	// 重新下载时，上一次下载结束后的订阅者已经被关闭
+	if t.events != nil && t.events.isClosed() {
+		t.events = nil
+	}
+	return stop, nil
+}
+
+// 下载直到结束，发送最后一个事件
+func (t *TorrentTask) run(stop chan struct{}) error {
+	err := download(t, stop)
+	t.mu.Lock()
+	t.stopOnce(stop)
+	t.stop = nil
+	t.done, t.err = true, err
+	t.broadcastVerified()
+	if t.upload != nil {
+		t.upload.Close()
+		t.upload = nil
+	}
+	t.mu.Unlock()
+	switch {
+	case err == nil:
+		t.hub().close(Event{Type: EventCompleted})
+	case errors.Is(err, ErrStopped):
+		t.hub().close(Event{Type: EventStopped, Err: err})
+	default:
+		t.hub().close(Event{Type: EventError, Err: err})
+	}
+	return err
+}
+
+// SetSequential 设置是否按顺序下载，可以在下载过程中调整
+func (t *TorrentTask) SetSequential(on bool) {
+	t.mu.Lock()
+	picker := t.pieces()
+	t.mu.Unlock()
+	picker.setSequential(on)
+}
+
+// 需要持有锁
+func (t *TorrentTask) pieces() *piecePicker {
+	if t.picker == nil {
+		t.picker = newPiecePicker()
+	}
+	return t.picker
+}
+
+// 需要持有锁
+func (t *TorrentTask) verifiedCh() chan struct{} {
+	if t.verified == nil {
+		t.verified = make(chan struct{})
+	}
+	return t.verified
+}
+
+// 唤醒等待数据的Reader，需要持有锁
+func (t *TorrentTask) broadcastVerified() {
+	if t.verified != nil {
+		close(t.verified)
+		t.verified = nil
+	}
+}
+
+// 标记为已经下载完成，内容在文件中
+func (t *TorrentTask) markCompleted() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.piecesDone = len(t.PieceSHA)
+	t.bytesDone = int64(t.FileLen)
+	t.done = true
+}
+
+// Stop 停止正在进行的下载，Download返回ErrStopped，没有在下载时什么也不做
+func (t *TorrentTask) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stop != nil {
+		t.stopOnce(t.stop)
+	}
+}
+
+// 需要持有锁
+func (t *TorrentTask) stopOnce(stop chan struct{}) {
+	select {
+	case <-stop:
+	default:
+		close(stop)
+	}
+}
+
+func download(task *TorrentTask, stop chan struct{}) error {
 	log.Println("start downloading ", task.FileName)
 	// 初始化通道：分片任务通道，下载结果通道
-	taskQueue := make(chan *pieceTask, len(task.PieceSHA))
 	resultQueue := make(chan *pieceResult)
 
+	task.mu.Lock()
+	// 从队列文件恢复的已完成任务，内容已经在文件中，只需要做种
+	if task.have == nil && task.piecesDone == len(task.PieceSHA) {
+		task.have = make([]bool, len(task.PieceSHA))
+		for index := range task.have {
+			task.have[index] = true
+		}
+	}
+	// 第一次下载时文件中可能已经有内容，比如从队列文件恢复的没有完成的任务，校验通过的分片不再下载
+	if task.have == nil {
+		task.mu.Unlock()
+		have := task.checkExisting()
+		task.mu.Lock()
+		if task.have == nil {
+			task.have = have
+			for index, ok := range have {
+				if ok {
+					begin, end := task.getPieceBounds(index)
+					task.piecesDone++
+					task.bytesDone += int64(end - begin)
+				}
+			}
+		}
+	}
+	// 下载的内容直接写入文件，内存中只有正在下载的分片，文件中已经校验通过的分片保留
+	var file *os.File
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+	// 只下载还没有校验通过的分片
+	var tasks []*pieceTask
 	for index, sha := range task.PieceSHA {
+		if task.have[index] {
+			continue
+		}
 		begin, end := task.getPieceBounds(index)
-		taskQueue <- &pieceTask{
+		tasks = append(tasks, &pieceTask{
 			index:  index,
 			sha:    sha,
 			length: end - begin,
-		}
+		})
+	}
+	picker := task.pieces()
+	task.mu.Unlock()
+	picker.reset(tasks)
+	// 由连接池管理peer的连接，断开后自动重连
+	peers := NewPeerSet()
+	pool := NewPeerPool(task.connectPeer, func(conn *PeerConn) error {
+		return task.peerRoutine(conn, peers, picker, resultQueue, stop)
+	})
+	defer pool.Close()
+	// 结束时断开所有连接，正在下载的分片不再等待
+	defer peers.CloseAll()
+	task.mu.Lock()
+	task.pool = pool
+	pool.setConnLimit(task.conns)
+	if task.ban == nil {
+		task.ban = newSmartBan()
 	}
-	// 每个peer开一个协程处理
-	for _, peer := range task.PeerList {
-		go task.peerRoutine(peer, taskQueue, resultQueue)
+	if task.piecesDone < len(task.PieceSHA) {
+		pool.Add(task.PeerList...)
 	}
-	buf := make([]byte, task.FileLen)
-	cnt := 0
-	for cnt < len(task.PieceSHA) {
-		res := <-resultQueue
-		begin, end := task.getPieceBounds(res.index)
-		copy(buf[begin:end], res.data)
-		cnt++
+	listening := task.listening
+	var stuck <-chan time.Time
+	if !listening {
+		ticker := time.NewTicker(stuckCheckInterval)
+		defer ticker.Stop()
+		stuck = ticker.C
+	}
+	task.mu.Unlock()
+
+	for {
+		task.mu.Lock()
+		cnt := task.piecesDone
+		task.mu.Unlock()
+		if cnt == len(task.PieceSHA) {
+			break
+		}
+		// 放弃所有peer之后再加入新的peer时会换成新的通道，每次都重新获取
+		var exhausted <-chan struct{}
+		if !listening {
+			exhausted = pool.Exhausted()
+		}
+		select {
+		case res := <-resultQueue:
+			begin, end := task.getPieceBounds(res.index)
+			task.mu.Lock()
+			// 上一次下载遗留的peer协程可能放回了同一个分片
+			dup := task.have[res.index]
+			task.mu.Unlock()
+			if dup {
+				continue
+			}
+			// 第一个分片校验通过时才打开文件，没有下载到任何内容时不会创建文件
+			if file == nil {
+				var err error
+				if file, err = openStorage(task.FileName, task.FileLen); err != nil {
+					log.Println("open file error = ", err)
+					return err
+				}
+			}
+			// 写入文件之后才标记为已经校验通过，Reader从文件中读取
+			if _, err := file.WriteAt(res.data, int64(begin)); err != nil {
+				log.Println("write to file error = ", err)
+				return err
+			}
+			task.mu.Lock()
+			task.have[res.index] = true
+			task.piecesDone++
+			task.bytesDone += int64(end - begin)
+			cnt = task.piecesDone
+			task.broadcastVerified()
+			task.mu.Unlock()
+			peers.Send(newHaveMsg(res.index))
+			task.publish(Event{Type: EventPieceVerified, Piece: res.index})
+		case <-exhausted:
+			// 所有peer都已经放弃，不可能再有进展
+			log.Printf("all peers dropped, downloaded %d of %d pieces\n", cnt, len(task.PieceSHA))
+			return fmt.Errorf("%w: downloaded %d of %d pieces", ErrNoPeers, cnt, len(task.PieceSHA))
+		case <-stuck:
+			if task.canProgress(pool, peers) {
+				continue
+			}
+			// 连接上的peer都没有剩下的分片，也没有其他peer可以连接
+			log.Printf("no peer has the remaining pieces, downloaded %d of %d pieces\n", cnt, len(task.PieceSHA))
+			return fmt.Errorf("%w: no peer has the remaining %d pieces", ErrNoPeers, len(task.PieceSHA)-cnt)
+		case <-stop:
+			return ErrStopped
+		}
 		// 打印进度条日志
 		ratio := float64(cnt) / float64(len(task.PieceSHA)) * 100
 		log.Printf("downloading, progress = (%0.2f%%)\n", ratio)
 	}
-	// 关闭通道
-	close(taskQueue)
-	close(resultQueue)
-	// 把数据从内存写入文件
-	file, err := os.Create(task.FileName)
-	if err != nil {
-		log.Println("create file error = ", err)
-		return err
+	// 上一次下载已经写完了所有分片时没有打开文件
+	if file != nil {
+		err := file.Close()
+		file = nil
+		if err != nil {
+			log.Println("close file error = ", err)
+			return err
+		}
 	}
-	if _, err = file.Write(buf); err != nil {
-		log.Println("write to file error = ", err)
-		return err
+	// 做种时连接池继续接收对方建立的连接，已经建立的连接也继续上传，直到Stop
+	task.mu.Lock()
+	seed := task.seed
+	task.mu.Unlock()
+	if seed != nil && seed() {
+		task.publish(Event{Type: EventSeeding})
+		<-stop
 	}
 	return nil
 }
 
+// 打开保存下载内容的文件，不清空原来的内容，文件大小固定为size
+func openStorage(name string, size int) (*os.File, error) {
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = file.Truncate(int64(size)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// 是否还有peer可能提供剩下的分片：等待连接的peer、还没有告诉我们拥有哪些分片的peer、
+// 拥有剩下的分片并且没有在这些分片上失败太多次的peer
+func (t *TorrentTask) canProgress(pool *PeerPool, peers *PeerSet) bool {
+	// 刚建立的连接可能还没有加入peers
+	if pool.waiting() || pool.Connected() != peers.Len() {
+		return true
+	}
+	t.mu.Lock()
+	var missing []int
+	for index, have := range t.have {
+		if !have {
+			missing = append(missing, index)
+		}
+	}
+	t.mu.Unlock()
+	return peers.Any(func(c *PeerConn) bool {
+		if !c.knownPieces() {
+			return true
+		}
+		for _, index := range missing {
+			if c.HasPiece(index) && c.hashFailures(index) < maxPieceFailures {
+				return true
+			}
+		}
+		return false
+	})
+}
+
 // 下载单个分片
 func downloadPiece(conn *PeerConn, task *pieceTask) (*pieceResult, error) {
 	state := &taskState{
-		index: task.index,
-		conn:  conn,
-		data:  make([]byte, task.length),
+		index:  task.index,
+		conn:   conn,
+		blocks: make([]int, (task.length+BLOCKSIZE-1)/BLOCKSIZE),
+		data:   make([]byte, task.length),
 	}
-	conn.SetDeadline(time.Now().Add(15 * time.Second))
-	defer conn.SetDeadline(time.Time{})
+	timeout := time.NewTimer(pieceTimeout)
+	defer timeout.Stop()
 	// 等全部下载完成再退出
 	for state.downloaded < task.length {
-		// 轮询判断如果对面发送了unchoked消息，就能继续下载
-		if !conn.Choked {
-			// 最多同时发起5次请求
-			for state.backlog < MAXBACKLOG && state.requested < task.length {
-				// 默认一个sub piece是16k，如果最后一个子分片不足16k，就手动计算一下最后一片的大小
-				length := BLOCKSIZE
-				if task.length-state.requested < BLOCKSIZE {
-					length = task.length - state.requested
-				}
-				// 封装请求体并发送
-				msg := NewRequestMsg(state.index, state.requested, length)
-				if _, err := conn.WriteMsg(msg); err != nil {
-					return nil, err
-				}
-				state.requested += length
-				state.backlog++
+		// 对面发送了unchoke消息，或者这个分片在allowed fast集合中，就能继续下载
+		if !conn.PeerChoking() || conn.AllowedFast(task.index) {
+			if err := state.sendRequests(); err != nil {
+				return nil, err
 			}
 		}
-		// 分类处理各类消息，包括探活，拒绝上传，通知拥有分片，下载分片等
-		if err := state.handleMsg(); err != nil {
-			return nil, err
+		// 分类处理各类消息，包括拒绝上传，下载分片等，其他状态在读协程中已经更新
+		select {
+		case msg, ok := <-conn.Msgs():
+			if !ok {
+				return nil, conn.Err()
+			}
+			downloaded := state.downloaded
+			if err := state.handleMsg(msg); err != nil {
+				return nil, err
+			}
+			// 收到了新的子分片，重新计时
+			if state.downloaded > downloaded {
+				if !timeout.Stop() {
+					select {
+					case <-timeout.C:
+					default:
+					}
+				}
+				timeout.Reset(pieceTimeout)
+			}
+		case <-timeout.C:
+			return nil, fmt.Errorf("download piece %d timeout", task.index)
 		}
 	}
 	return &pieceResult{state.index, state.data}, nil
 }
 
+// 按PieceSHA校验文件中已经有的分片，文件不存在或者长度不够的部分都算没有
+func (t *TorrentTask) checkExisting() []bool {
+	have := make([]bool, len(t.PieceSHA))
+	file, err := os.Open(t.FileName)
+	if err != nil {
+		return have
+	}
+	defer file.Close()
+	buf := make([]byte, t.PieceLen)
+	for index, sha := range t.PieceSHA {
+		begin, end := t.getPieceBounds(index)
+		if n, _ := file.ReadAt(buf[:end-begin], int64(begin)); n < end-begin {
+			break
+		}
+		have[index] = sha1.Sum(buf[:end-begin]) == sha
+	}
+	return have
+}
+
+// 已经校验通过的分片
+func (t *TorrentTask) havePieces() []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var pieces []int
+	for index := range t.PieceSHA {
+		if t.hasPiece(index) {
+			pieces = append(pieces, index)
+		}
+	}
+	return pieces
+}
+
+// 分片是否已经校验通过并写入文件，从队列文件恢复的已完成任务没有have，需要持有锁
+func (t *TorrentTask) hasPiece(index int) bool {
+	if t.have == nil {
+		return t.piecesDone == len(t.PieceSHA)
+	}
+	return t.have[index]
+}
+
+// 从文件中读取已经校验通过的子分片，用来回复对方的请求
+func (t *TorrentTask) readBlock(index, begin, length int) ([]byte, bool) {
+	pieceBegin, pieceEnd := t.getPieceBounds(index)
+	if begin+length > pieceEnd-pieceBegin {
+		return nil, false
+	}
+	t.mu.Lock()
+	if !t.hasPiece(index) {
+		t.mu.Unlock()
+		return nil, false
+	}
+	if t.upload == nil {
+		file, err := os.Open(t.FileName)
+		if err != nil {
+			t.mu.Unlock()
+			log.Println("open file for upload error = ", err)
+			return nil, false
+		}
+		t.upload = file
+	}
+	file := t.upload
+	t.mu.Unlock()
+	data := make([]byte, length)
+	if _, err := file.ReadAt(data, int64(pieceBegin+begin)); err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+func newHaveMsg(index int) *PeerMsg {
+	msg, _ := NewMsg(&Have{Index: uint32(index)})
+	return msg
+}
+
+// 连接没有设置上传的数据来源时，Fast扩展下需要明确拒绝对方的请求，否则对方会一直等待
+func rejectRequest(conn *PeerConn, msg *PeerMsg) error {
+	if msg.ID != MsgRequest || !conn.Fast() {
+		return nil
+	}
+	req := &Request{}
+	if err := req.UnmarshalBinary(msg.Payload); err != nil {
+		return err
+	}
+	reject, _ := NewMsg(&RejectRequest{Index: req.Index, Begin: req.Begin, Length: req.Length})
+	return conn.Send(reject)
+}
+
 func checkPiece(task *pieceTask, res *pieceResult) bool {
 	sha := sha1.Sum(res.data)
 	if !bytes.Equal(task.sha[:], sha[:]) {
@@ -0,0 +1,160 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 模拟一个拥有全部数据的peer，按请求返回数据，每收到chokeEvery个请求choke一次再unchoke
+func fakeSeeder(remote *PeerConn, data []byte, chokeEvery int) {
+	remote.WriteMsg(&PeerMsg{MsgBitfield, []byte{0xff, 0xff}})
+	remote.WriteMsg(&PeerMsg{MsgUnchoke, nil})
+	requests := 0
+	for {
+		msg, err := remote.ReadMsg()
+		if err != nil {
+			return
+		}
+		if msg == nil || msg.ID != MsgRequest {
+			continue
+		}
+		requests++
+		if chokeEvery > 0 && requests%chokeEvery == 0 {
+			// choke后丢弃这个请求，对方需要重新请求
+			remote.WriteMsg(&PeerMsg{MsgChoke, nil})
+			remote.WriteMsg(&PeerMsg{MsgUnchoke, nil})
+			continue
+		}
+		index := binary.BigEndian.Uint32(msg.Payload[0:4])
+		begin := binary.BigEndian.Uint32(msg.Payload[4:8])
+		length := binary.BigEndian.Uint32(msg.Payload[8:12])
+		payload := make([]byte, 8+length)
+		binary.BigEndian.PutUint32(payload[0:4], index)
+		binary.BigEndian.PutUint32(payload[4:8], begin)
+		copy(payload[8:], data[begin:begin+length])
+		remote.WriteMsg(&PeerMsg{MsgPiece, payload})
+	}
+}
+
+func TestDownloadPiece(t *testing.T) {
+	data := make([]byte, 5*BLOCKSIZE+100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	task := &pieceTask{index: 0, sha: sha1.Sum(data), length: len(data)}
+
+	for _, chokeEvery := range []int{0, 3} {
+		pc, remote := newTestConn(time.Minute, time.Minute)
+		go fakeSeeder(remote, data, chokeEvery)
+		// 等对方unchoke
+		for pc.PeerChoking() {
+			<-pc.Msgs()
+		}
+		res, err := downloadPiece(pc, task)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, checkPiece(task, res))
+		pc.Close()
+		remote.Conn.Close()
+	}
+}
+
+func TestDownloadPieceSlow(t *testing.T) {
+	defer func(d time.Duration) { pieceTimeout = d }(pieceTimeout)
+	pieceTimeout = 100 * time.Millisecond
+	data := make([]byte, 5*BLOCKSIZE)
+	for i := range data {
+		data[i] = byte(i * 5)
+	}
+	task := &pieceTask{index: 0, sha: sha1.Sum(data), length: len(data)}
+
+	// 每个子分片间隔60ms，整个分片超过了超时时间，但是一直有进展
+	pc, remote := newTestConn(time.Minute, time.Minute)
+	defer pc.Close()
+	defer remote.Conn.Close()
+	go func() {
+		remote.WriteMsg(&PeerMsg{MsgUnchoke, nil})
+		for {
+			msg, err := remote.ReadMsg()
+			if err != nil {
+				return
+			}
+			if msg == nil || msg.ID != MsgRequest {
+				continue
+			}
+			req := &Request{}
+			req.UnmarshalBinary(msg.Payload)
+			time.Sleep(60 * time.Millisecond)
+			piece, _ := NewMsg(&Piece{Index: req.Index, Begin: req.Begin, Block: data[req.Begin : req.Begin+req.Length]})
+			remote.WriteMsg(piece)
+		}
+	}()
+	for pc.PeerChoking() {
+		<-pc.Msgs()
+	}
+	res, err := downloadPiece(pc, task)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, checkPiece(task, res))
+
+	// 一直没有收到数据时超时
+	pc2, remote2 := newTestConn(time.Minute, time.Minute)
+	defer pc2.Close()
+	defer remote2.Conn.Close()
+	remote2.WriteMsg(&PeerMsg{MsgUnchoke, nil})
+	for pc2.PeerChoking() {
+		<-pc2.Msgs()
+	}
+	_, err = downloadPiece(pc2, task)
+	assert.NotEqual(t, nil, err)
+}
+
+// 模拟支持Fast扩展的seed：发送have all，不unchoke，只允许请求allowed fast集合中的分片，每收到rejectEvery个请求拒绝一次
+func fakeFastSeeder(remote *PeerConn, data []byte, rejectEvery int) {
+	remote.WriteMsg(&PeerMsg{MsgHaveAll, nil})
+	allowed, _ := NewMsg(&AllowedFast{Index: 0})
+	remote.WriteMsg(allowed)
+	requests := 0
+	for {
+		msg, err := remote.ReadMsg()
+		if err != nil {
+			return
+		}
+		if msg == nil || msg.ID != MsgRequest {
+			continue
+		}
+		req := &Request{}
+		req.UnmarshalBinary(msg.Payload)
+		requests++
+		if requests%rejectEvery == 0 {
+			reject, _ := NewMsg(&RejectRequest{Index: req.Index, Begin: req.Begin, Length: req.Length})
+			remote.WriteMsg(reject)
+			continue
+		}
+		piece, _ := NewMsg(&Piece{Index: req.Index, Begin: req.Begin, Block: data[req.Begin : req.Begin+req.Length]})
+		remote.WriteMsg(piece)
+	}
+}
+
+func TestDownloadPieceFast(t *testing.T) {
+	data := make([]byte, 3*BLOCKSIZE+10)
+	for i := range data {
+		data[i] = byte(i * 3)
+	}
+	task := &pieceTask{index: 0, sha: sha1.Sum(data), length: len(data)}
+
+	pc, remote := newFastTestConn()
+	defer remote.Conn.Close()
+	defer pc.Close()
+	go fakeFastSeeder(remote, data, 2)
+	// 等对方告知allowed fast集合，被choke时也可以下载
+	for !pc.AllowedFast(0) {
+		<-pc.Msgs()
+	}
+	assert.Equal(t, true, pc.PeerChoking())
+	res, err := downloadPiece(pc, task)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, checkPiece(task, res))
+}
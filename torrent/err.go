@@ -0,0 +1,55 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrConnClosed   = errors.New("peer conn closed")
+	ErrIdleTimeout  = errors.New("peer idle timeout")
+	ErrEncryption   = errors.New("encryption handshake failed")
+	ErrNoPeers      = errors.New("no peers available")
+	ErrStopped      = errors.New("download stopped")
+	ErrRunning      = errors.New("download already running")
+	ErrNotRunning   = errors.New("download not running")
+	ErrTooManyPeers = errors.New("too many peer connections")
+	ErrReaderClosed = errors.New("reader closed")
+	ErrBadOffset    = errors.New("invalid offset")
+
+	// Client管理任务的错误
+	ErrUnknownTorrent = errors.New("unknown torrent")
+	ErrTorrentExists  = errors.New("torrent already added")
+	ErrClientClosed   = errors.New("client closed")
+
+	// 握手时校验peer id的错误
+	ErrSelfConnect    = errors.New("connected to self")
+	ErrPeerIDMismatch = errors.New("peer id mismatch")
+	ErrDuplicatePeer  = errors.New("duplicate peer connection")
+	ErrBannedPeer     = errors.New("peer banned")
+	ErrBlockedIP      = errors.New("ip blocked by filter")
+
+	// 对方违反协议的错误，会被包装成ProtocolError
+	ErrMsgTooLarge      = errors.New("message too large")
+	ErrBadPayload       = errors.New("invalid payload length")
+	ErrBadBitfield      = errors.New("invalid bitfield")
+	ErrBadIndex         = errors.New("piece index out of range")
+	ErrUnsolicitedPiece = errors.New("unsolicited piece")
+	ErrUnknownMsg       = errors.New("unknown message")
+	ErrFastDisabled     = errors.New("fast extension not enabled")
+	ErrBadReject        = errors.New("reject for unknown request")
+)
+
+// ProtocolError 对方发送了不合法的消息，连接会被断开
+type ProtocolError struct {
+	ID  MsgID // 出错的消息类型
+	Err error // 具体的错误原因
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("peer protocol error: %s: %v", e.ID, e.Err)
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,44 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+)
+
+// AllowedFastNum 发给每个peer的allowed fast分片数量
+const AllowedFastNum = 10
+
+/*
+AllowedFastSet 按BEP 6的算法计算允许对方在被choke时请求的分片：
+对方IPv4地址的前24位和info hash拼接后反复做SHA-1，每次的哈希值按4字节一组对分片数量取模，
+直到得到k个不重复的分片序号。同一个网段的peer得到相同的集合，防止换IP刷分片。
+不是IPv4地址时返回nil
+*/
+func AllowedFastSet(ip net.IP, infoSHA [SHALEN]byte, numPieces, k int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces <= 0 {
+		return nil
+	}
+	if k > numPieces {
+		k = numPieces
+	}
+	x := make([]byte, 0, 4+SHALEN)
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoSHA[:]...)
+
+	set := make([]int, 0, k)
+	seen := make(map[int]bool, k)
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces))
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
@@ -0,0 +1,39 @@
+package torrent
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	// BEP 6中的例子
+	var infoSHA [SHALEN]byte
+	copy(infoSHA[:], bytes.Repeat([]byte{0xaa}, SHALEN))
+	ip := net.ParseIP("80.4.4.200")
+	assert.Equal(t, []int{1059, 431, 808, 1217, 287, 376, 1188}, AllowedFastSet(ip, infoSHA, 1313, 7))
+	assert.Equal(t, []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}, AllowedFastSet(ip, infoSHA, 1313, 9))
+
+	// 同一个/24网段的结果相同
+	assert.Equal(t, AllowedFastSet(ip, infoSHA, 1313, 9), AllowedFastSet(net.ParseIP("80.4.4.1"), infoSHA, 1313, 9))
+	// 分片数量不足k个时返回全部分片
+	assert.Equal(t, 3, len(AllowedFastSet(ip, infoSHA, 3, AllowedFastNum)))
+	assert.Equal(t, 0, len(AllowedFastSet(net.ParseIP("::1"), infoSHA, 1313, 7)))
+}
+
+func TestHandShakeFlags(t *testing.T) {
+	buf := new(bytes.Buffer)
+	msg := NewHandShakeMsg([SHALEN]byte{1}, [IDLen]byte{2})
+	assert.Equal(t, true, msg.SupportFast())
+	_, err := WriteHandShake(buf, msg)
+	assert.Equal(t, nil, err)
+	res, err := ReadHandShake(buf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, msg, res)
+
+	EnableFast = false
+	defer func() { EnableFast = true }()
+	assert.Equal(t, false, NewHandShakeMsg([SHALEN]byte{1}, [IDLen]byte{2}).SupportFast())
+}
@@ -10,19 +10,38 @@ const (
 	HsMsgLen = Reserved + SHALEN + IDLen
 )
 
+// 保留字节中表示支持Fast扩展的位，BEP 6
+const (
+	fastByte = 7
+	fastBit  = 0x04
+)
+
+// EnableFast 是否在握手时声明支持Fast扩展
+var EnableFast = true
+
 // HandShakeMsg 握手消息格式：协议长度 + 协议名 + SHA-1哈希值 + peer_id
 type HandShakeMsg struct {
 	PreStr  string
+	Flags   [Reserved]byte // 保留字节，每一位表示是否支持某个扩展
 	InfoSHA [SHALEN]byte
 	PeerID  [IDLen]byte
 }
 
 func NewHandShakeMsg(infoSHA [SHALEN]byte, peerID [IDLen]byte) *HandShakeMsg {
-	return &HandShakeMsg{
+	msg := &HandShakeMsg{
 		PreStr:  "BitTorrent protocol",
 		InfoSHA: infoSHA,
 		PeerID:  peerID,
 	}
+	if EnableFast {
+		msg.Flags[fastByte] |= fastBit
+	}
+	return msg
+}
+
+// SupportFast 对方是否支持Fast扩展
+func (m *HandShakeMsg) SupportFast() bool {
+	return m.Flags[fastByte]&fastBit != 0
 }
 
 func WriteHandShake(w io.Writer, msg *HandShakeMsg) (int, error) {
@@ -30,7 +49,7 @@ func WriteHandShake(w io.Writer, msg *HandShakeMsg) (int, error) {
 	buf[0] = byte(len(msg.PreStr))
 	wLen := 1
 	wLen += copy(buf[wLen:], msg.PreStr)
-	wLen += copy(buf[wLen:], make([]byte, Reserved))
+	wLen += copy(buf[wLen:], msg.Flags[:])
 	wLen += copy(buf[wLen:], msg.InfoSHA[:])
 	wLen += copy(buf[wLen:], msg.PeerID[:])
 	return w.Write(buf)
@@ -51,9 +70,12 @@ func ReadHandShake(r io.Reader) (*HandShakeMsg, error) {
 	if _, err := io.ReadFull(r, msgBuf); err != nil {
 		return nil, err
 	}
+	var flags [Reserved]byte
 	var infoSHA [SHALEN]byte
 	var peerID [IDLen]byte
 
+	// 拷贝保留字节
+	copy(flags[:], msgBuf[preLen:preLen+Reserved])
 	// 拷贝哈希值
 	copy(infoSHA[:], msgBuf[preLen+Reserved:preLen+Reserved+SHALEN])
 	// 拷贝peer id
@@ -62,6 +84,7 @@ func ReadHandShake(r io.Reader) (*HandShakeMsg, error) {
 	// 封装消息返回
 	return &HandShakeMsg{
 		PreStr:  string(msgBuf[0:preLen]),
+		Flags:   flags,
 		InfoSHA: infoSHA,
 		PeerID:  peerID,
 	}, nil
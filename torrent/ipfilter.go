@@ -0,0 +1,253 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PeerFilter 不允许连接的IP，对tracker等来源的peer和接入的连接都生效，为nil时不过滤
+var PeerFilter *IPFilter
+
+// 一段IP，IPv4统一转成16字节的IPv4-mapped形式，和IPv6放在同一个有序列表中
+type ipRange struct {
+	start, end [net.IPv6len]byte
+}
+
+// IPFilter IP黑名单
+/*
+支持的格式，每行一条，按内容自动识别，#和//开头的行是注释：
+1. eMule的ipfilter.dat：001.002.003.000 - 001.002.003.255 , 000 , 描述，访问级别小于128的才屏蔽
+2. PeerGuardian的P2P格式：描述:1.2.3.0-1.2.3.255
+3. CIDR或单个IP：10.0.0.0/8、fc00::/7、1.2.3.4
+*/
+type IPFilter struct {
+	mu     sync.RWMutex
+	ranges []ipRange // 按起点排序并且合并过，互不重叠
+	paths  []string  // 加载的文件，Reload时重新读取
+	added  []ipRange // 通过Add加入的区间，Reload时保留
+}
+
+func NewIPFilter() *IPFilter {
+	return &IPFilter{}
+}
+
+// LoadIPFilter 从文件加载黑名单
+func LoadIPFilter(paths ...string) (*IPFilter, error) {
+	f := &IPFilter{paths: paths}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload 重新读取加载过的文件，读取失败时保留原来的黑名单
+func (f *IPFilter) Reload() error {
+	f.mu.RLock()
+	paths := f.paths
+	f.mu.RUnlock()
+	var ranges []ipRange
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		rs, err := parseIPFilter(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		ranges = append(ranges, rs...)
+	}
+	f.mu.Lock()
+	f.ranges = mergeRanges(append(ranges, f.added...))
+	f.mu.Unlock()
+	return nil
+}
+
+// Add 从r中读取黑名单，加入到已有的黑名单中
+func (f *IPFilter) Add(r io.Reader) error {
+	rs, err := parseIPFilter(r)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.added = append(f.added, rs...)
+	f.ranges = mergeRanges(append(rs, f.ranges...))
+	return nil
+}
+
+// Blocked 是否在黑名单中，f为nil时不屏蔽任何IP
+func (f *IPFilter) Blocked(ip net.IP) bool {
+	if f == nil {
+		return false
+	}
+	key, ok := ipKey(ip)
+	if !ok {
+		return false
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	// 第一个终点不小于ip的区间
+	i := sort.Search(len(f.ranges), func(i int) bool {
+		return bytes.Compare(f.ranges[i].end[:], key[:]) >= 0
+	})
+	return i < len(f.ranges) && bytes.Compare(f.ranges[i].start[:], key[:]) <= 0
+}
+
+// Len 合并后的区间数
+func (f *IPFilter) Len() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.ranges)
+}
+
+func ipKey(ip net.IP) ([net.IPv6len]byte, bool) {
+	var key [net.IPv6len]byte
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return key, false
+	}
+	copy(key[:], ip16)
+	return key, true
+}
+
+// 排序并合并重叠或相邻的区间
+func mergeRanges(ranges []ipRange) []ipRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].start[:], ranges[j].start[:]) < 0
+	})
+	var merged []ipRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			// 上一个区间已经到了最大的IP，或者这个区间的起点不超过上一个区间终点的下一个IP
+			next := last.end
+			if !incIP(&next) || bytes.Compare(r.start[:], next[:]) <= 0 {
+				if bytes.Compare(r.end[:], last.end[:]) > 0 {
+					last.end = r.end
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// ip加一，溢出时返回false
+func incIP(ip *[net.IPv6len]byte) bool {
+	for i := len(ip) - 1; i >= 0; i-- {
+		ip[i]++
+		if ip[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func parseIPFilter(r io.Reader) ([]ipRange, error) {
+	var ranges []ipRange
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		rng, ok, err := parseFilterLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if ok {
+			ranges = append(ranges, rng)
+		}
+	}
+	return ranges, scanner.Err()
+}
+
+// 解析一行，ok为false表示这一行不需要屏蔽
+func parseFilterLine(line string) (rng ipRange, ok bool, err error) {
+	// CIDR
+	if _, ipNet, err := net.ParseCIDR(line); err == nil {
+		return cidrRange(ipNet), true, nil
+	}
+	// 单个IP
+	if ip := parseFilterIP(line); ip != nil {
+		rng, err = newIPRange(ip, ip)
+		return rng, err == nil, err
+	}
+	// eMule：范围 , 访问级别 , 描述
+	if fields := strings.SplitN(line, ",", 3); len(fields) >= 2 {
+		if level, err := strconv.Atoi(strings.TrimSpace(fields[1])); err == nil {
+			rng, err = parseRange(fields[0])
+			return rng, err == nil && level < 128, err
+		}
+	}
+	// P2P：描述:起点-终点，描述中也可能有冒号
+	if i := strings.LastIndex(line, ":"); i >= 0 {
+		rng, err = parseRange(line[i+1:])
+		return rng, err == nil, err
+	}
+	return rng, false, fmt.Errorf("unknown format %q", line)
+}
+
+func parseRange(s string) (ipRange, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return ipRange{}, fmt.Errorf("invalid range %q", s)
+	}
+	start := parseFilterIP(strings.TrimSpace(parts[0]))
+	end := parseFilterIP(strings.TrimSpace(parts[1]))
+	if start == nil || end == nil {
+		return ipRange{}, fmt.Errorf("invalid range %q", s)
+	}
+	return newIPRange(start, end)
+}
+
+func newIPRange(start, end net.IP) (ipRange, error) {
+	var r ipRange
+	r.start, _ = ipKey(start)
+	r.end, _ = ipKey(end)
+	if bytes.Compare(r.start[:], r.end[:]) > 0 || (start.To4() == nil) != (end.To4() == nil) {
+		return r, fmt.Errorf("invalid range %s-%s", start, end)
+	}
+	return r, nil
+}
+
+func cidrRange(ipNet *net.IPNet) ipRange {
+	start := ipNet.IP
+	end := make(net.IP, len(start))
+	for i := range start {
+		end[i] = start[i] | ^ipNet.Mask[i]
+	}
+	r, _ := newIPRange(start, end)
+	return r
+}
+
+// ipfilter.dat中的IPv4每段补齐成3位，net.ParseIP不接受前导0
+func parseFilterIP(s string) net.IP {
+	if strings.Contains(s, ":") {
+		return net.ParseIP(s)
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != net.IPv4len {
+		return nil
+	}
+	var ip [net.IPv4len]byte
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || n > 255 || len(p) > 3 {
+			return nil
+		}
+		ip[i] = byte(n)
+	}
+	return net.IPv4(ip[0], ip[1], ip[2], ip[3])
+}
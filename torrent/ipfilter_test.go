@@ -0,0 +1,106 @@
+package torrent
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPFilter(t *testing.T) {
+	list := `# comment
+// eMule
+001.002.003.000 - 001.002.003.255 , 000 , Bad Range
+005.000.000.000 - 005.255.255.255 , 200 , Allowed Range
+Some Org, Inc:10.0.0.0-10.0.0.255
+Level3:10.0.1.0-10.0.1.10
+192.168.0.0/16
+fc00::/7
+8.8.8.8
+`
+	f := NewIPFilter()
+	assert.Equal(t, nil, f.Add(strings.NewReader(list)))
+	// 10.0.0.0-10.0.0.255和10.0.1.0-10.0.1.10相邻，合并成一个区间
+	assert.Equal(t, 5, f.Len())
+	cases := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"1.2.3.0", true},
+		{"1.2.3.255", true},
+		{"1.2.4.0", false},
+		{"5.1.1.1", false},
+		{"10.0.0.7", true},
+		{"10.0.1.10", true},
+		{"10.0.1.11", false},
+		{"192.168.100.1", true},
+		{"8.8.8.8", true},
+		{"8.8.8.9", false},
+		{"fd12::1", true},
+		{"2001:db8::1", false},
+		{"::ffff:1.2.3.4", true},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.blocked, f.Blocked(net.ParseIP(c.ip)), c.ip)
+	}
+	assert.Equal(t, false, (*IPFilter)(nil).Blocked(net.ParseIP("1.2.3.4")))
+
+	err := f.Add(strings.NewReader("ok:1.1.1.1-1.1.1.2\nbad line\n"))
+	assert.Equal(t, true, err != nil && strings.Contains(err.Error(), "line 2"))
+	err = f.Add(strings.NewReader("1.1.1.9 - 1.1.1.1 , 0 , reversed\n"))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestIPFilterReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ipfilter.dat")
+	assert.Equal(t, nil, os.WriteFile(path, []byte("1.0.0.0/8\n"), 0644))
+	f, err := LoadIPFilter(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, f.Add(strings.NewReader("9.9.9.9\n")))
+	assert.Equal(t, true, f.Blocked(net.ParseIP("1.1.1.1")))
+
+	assert.Equal(t, nil, os.WriteFile(path, []byte("2.0.0.0/8\n"), 0644))
+	assert.Equal(t, nil, f.Reload())
+	assert.Equal(t, false, f.Blocked(net.ParseIP("1.1.1.1")))
+	assert.Equal(t, true, f.Blocked(net.ParseIP("2.1.1.1")))
+	// Add加入的区间在重新加载后保留
+	assert.Equal(t, true, f.Blocked(net.ParseIP("9.9.9.9")))
+
+	// 文件有错误时保留原来的黑名单
+	assert.Equal(t, nil, os.WriteFile(path, []byte("garbage\n"), 0644))
+	assert.NotEqual(t, nil, f.Reload())
+	assert.Equal(t, true, f.Blocked(net.ParseIP("2.1.1.1")))
+}
+
+func TestPeerFilter(t *testing.T) {
+	PeerFilter = NewIPFilter()
+	defer func() { PeerFilter = nil }()
+	PeerFilter.Add(strings.NewReader("127.0.0.0/8\n10.0.0.1\n"))
+
+	pool := NewPeerPool(func(PeerInfo) (*PeerConn, error) {
+		return nil, ErrConnClosed
+	}, nil)
+	defer pool.Close()
+	// 10.0.0.1在黑名单中
+	assert.Equal(t, 1, pool.Add(testPeer(1), testPeer(2)))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer ln.Close()
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		_, err = AcceptPeerConn(conn, [SHALEN]byte{}, NewPeerID(), testPieces)
+		accepted <- err
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	assert.Equal(t, ErrBlockedIP, <-accepted)
+}
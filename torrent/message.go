@@ -0,0 +1,405 @@
+package torrent
+
+import (
+	"encoding"
+	"encoding/binary"
+	"fmt"
+)
+
+/*
+Message 有类型的peer消息，MarshalBinary和UnmarshalBinary处理的是消息的payload部分，
+和PeerMsg之间用NewMsg和ParseMsg互相转换：
+
+	msg, err := NewMsg(&Request{Index: 1, Begin: 0, Length: BLOCKSIZE})
+	conn.Send(msg)
+
+	m, err := ParseMsg(msg)
+	switch m := m.(type) {
+	case *Piece:
+		...
+	}
+*/
+type Message interface {
+	ID() MsgID
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+	fmt.Stringer
+}
+
+// NewMsg 把有类型的消息编码成PeerMsg
+func NewMsg(m Message) (*PeerMsg, error) {
+	payload, err := m.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return &PeerMsg{ID: m.ID(), Payload: payload}, nil
+}
+
+// ParseMsg 按消息类型解码PeerMsg，未知的消息类型返回ErrUnknownMsg
+func ParseMsg(msg *PeerMsg) (Message, error) {
+	var m Message
+	switch msg.ID {
+	case MsgChoke:
+		m = &Choke{}
+	case MsgUnchoke:
+		m = &Unchoke{}
+	case MsgInterested:
+		m = &Interested{}
+	case MsgNotInterest:
+		m = &NotInterested{}
+	case MsgHave:
+		m = &Have{}
+	case MsgBitfield:
+		m = &Bitfield{}
+	case MsgRequest:
+		m = &Request{}
+	case MsgPiece:
+		m = &Piece{}
+	case MsgCancel:
+		m = &Cancel{}
+	case MsgPort:
+		m = &Port{}
+	case MsgSuggest:
+		m = &SuggestPiece{}
+	case MsgHaveAll:
+		m = &HaveAll{}
+	case MsgHaveNone:
+		m = &HaveNone{}
+	case MsgReject:
+		m = &RejectRequest{}
+	case MsgAllowedFast:
+		m = &AllowedFast{}
+	case MsgExtended:
+		m = &Extended{}
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMsg, msg.ID)
+	}
+	if err := m.UnmarshalBinary(msg.Payload); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MarshalBinary 编码成完整的消息：4字节长度 + 1字节id + payload，nil是keep-alive
+func (m *PeerMsg) MarshalBinary() ([]byte, error) {
+	if m == nil {
+		return make([]byte, LenByte), nil
+	}
+	length := 1 + len(m.Payload)
+	buf := make([]byte, LenByte+length)
+	binary.BigEndian.PutUint32(buf[0:LenByte], uint32(length))
+	buf[LenByte] = byte(m.ID)
+	copy(buf[LenByte+1:], m.Payload)
+	return buf, nil
+}
+
+// 消息在连接上占用的字节数，用于限速
+func (m *PeerMsg) wireLen() int {
+	if m == nil {
+		return LenByte
+	}
+	return LenByte + 1 + len(m.Payload)
+}
+
+// UnmarshalBinary 解码一条完整的消息，keep-alive不能解码到PeerMsg中
+func (m *PeerMsg) UnmarshalBinary(data []byte) error {
+	if len(data) < LenByte+1 {
+		return fmt.Errorf("%w: message too short", ErrBadPayload)
+	}
+	length := binary.BigEndian.Uint32(data[0:LenByte])
+	if int64(length) != int64(len(data)-LenByte) {
+		return fmt.Errorf("%w: length %d, get %d bytes", ErrBadPayload, length, len(data)-LenByte)
+	}
+	m.ID = MsgID(data[LenByte])
+	m.Payload = append([]byte(nil), data[LenByte+1:]...)
+	return nil
+}
+
+// String 用于日志，能解码的消息输出解码后的内容
+func (m *PeerMsg) String() string {
+	if m == nil {
+		return "keep-alive"
+	}
+	if msg, err := ParseMsg(m); err == nil {
+		return msg.String()
+	}
+	return fmt.Sprintf("%s(%d bytes)", m.ID, len(m.Payload))
+}
+
+// 没有payload的消息
+type Choke struct{}
+
+func (*Choke) ID() MsgID                           { return MsgChoke }
+func (*Choke) MarshalBinary() ([]byte, error)      { return nil, nil }
+func (m *Choke) UnmarshalBinary(data []byte) error { return checkLen(m.ID(), data, 0) }
+func (m *Choke) String() string                    { return m.ID().String() }
+
+type Unchoke struct{}
+
+func (*Unchoke) ID() MsgID                           { return MsgUnchoke }
+func (*Unchoke) MarshalBinary() ([]byte, error)      { return nil, nil }
+func (m *Unchoke) UnmarshalBinary(data []byte) error { return checkLen(m.ID(), data, 0) }
+func (m *Unchoke) String() string                    { return m.ID().String() }
+
+type Interested struct{}
+
+func (*Interested) ID() MsgID                           { return MsgInterested }
+func (*Interested) MarshalBinary() ([]byte, error)      { return nil, nil }
+func (m *Interested) UnmarshalBinary(data []byte) error { return checkLen(m.ID(), data, 0) }
+func (m *Interested) String() string                    { return m.ID().String() }
+
+type NotInterested struct{}
+
+func (*NotInterested) ID() MsgID                           { return MsgNotInterest }
+func (*NotInterested) MarshalBinary() ([]byte, error)      { return nil, nil }
+func (m *NotInterested) UnmarshalBinary(data []byte) error { return checkLen(m.ID(), data, 0) }
+func (m *NotInterested) String() string                    { return m.ID().String() }
+
+// HaveAll 拥有全部分片，代替bitfield
+type HaveAll struct{}
+
+func (*HaveAll) ID() MsgID                           { return MsgHaveAll }
+func (*HaveAll) MarshalBinary() ([]byte, error)      { return nil, nil }
+func (m *HaveAll) UnmarshalBinary(data []byte) error { return checkLen(m.ID(), data, 0) }
+func (m *HaveAll) String() string                    { return m.ID().String() }
+
+// HaveNone 没有任何分片，代替bitfield
+type HaveNone struct{}
+
+func (*HaveNone) ID() MsgID                           { return MsgHaveNone }
+func (*HaveNone) MarshalBinary() ([]byte, error)      { return nil, nil }
+func (m *HaveNone) UnmarshalBinary(data []byte) error { return checkLen(m.ID(), data, 0) }
+func (m *HaveNone) String() string                    { return m.ID().String() }
+
+// Have 通知拥有某个分片
+type Have struct {
+	Index uint32
+}
+
+func (*Have) ID() MsgID                           { return MsgHave }
+func (m *Have) MarshalBinary() ([]byte, error)    { return marshalIndex(m.Index), nil }
+func (m *Have) UnmarshalBinary(data []byte) error { return unmarshalIndex(m.ID(), data, &m.Index) }
+func (m *Have) String() string                    { return fmt.Sprintf("%s(index=%d)", m.ID(), m.Index) }
+
+// SuggestPiece 建议对方下载某个分片，通常是已经在缓存中的分片
+type SuggestPiece struct {
+	Index uint32
+}
+
+func (*SuggestPiece) ID() MsgID                        { return MsgSuggest }
+func (m *SuggestPiece) MarshalBinary() ([]byte, error) { return marshalIndex(m.Index), nil }
+func (m *SuggestPiece) UnmarshalBinary(data []byte) error {
+	return unmarshalIndex(m.ID(), data, &m.Index)
+}
+func (m *SuggestPiece) String() string { return fmt.Sprintf("%s(index=%d)", m.ID(), m.Index) }
+
+// AllowedFast 即使被choke也可以请求的分片
+type AllowedFast struct {
+	Index uint32
+}
+
+func (*AllowedFast) ID() MsgID                        { return MsgAllowedFast }
+func (m *AllowedFast) MarshalBinary() ([]byte, error) { return marshalIndex(m.Index), nil }
+func (m *AllowedFast) UnmarshalBinary(data []byte) error {
+	return unmarshalIndex(m.ID(), data, &m.Index)
+}
+func (m *AllowedFast) String() string { return fmt.Sprintf("%s(index=%d)", m.ID(), m.Index) }
+
+// Request 请求一个子分片
+type Request struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+func (*Request) ID() MsgID                        { return MsgRequest }
+func (m *Request) MarshalBinary() ([]byte, error) { return marshalBlock(m.key()), nil }
+func (m *Request) String() string                 { return formatBlock(m.ID(), m.key()) }
+func (m *Request) key() blockKey                  { return blockKey{m.Index, m.Begin, m.Length} }
+
+func (m *Request) UnmarshalBinary(data []byte) error {
+	key, err := unmarshalBlock(m.ID(), data)
+	m.Index, m.Begin, m.Length = key.index, key.begin, key.length
+	return err
+}
+
+// Cancel 取消之前发出的请求
+type Cancel struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+func (*Cancel) ID() MsgID                        { return MsgCancel }
+func (m *Cancel) MarshalBinary() ([]byte, error) { return marshalBlock(m.key()), nil }
+func (m *Cancel) String() string                 { return formatBlock(m.ID(), m.key()) }
+func (m *Cancel) key() blockKey                  { return blockKey{m.Index, m.Begin, m.Length} }
+
+func (m *Cancel) UnmarshalBinary(data []byte) error {
+	key, err := unmarshalBlock(m.ID(), data)
+	m.Index, m.Begin, m.Length = key.index, key.begin, key.length
+	return err
+}
+
+// RejectRequest 拒绝对方的请求，对方不用再等待这个子分片
+type RejectRequest struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+func (*RejectRequest) ID() MsgID                        { return MsgReject }
+func (m *RejectRequest) MarshalBinary() ([]byte, error) { return marshalBlock(m.key()), nil }
+func (m *RejectRequest) String() string                 { return formatBlock(m.ID(), m.key()) }
+func (m *RejectRequest) key() blockKey                  { return blockKey{m.Index, m.Begin, m.Length} }
+
+func (m *RejectRequest) UnmarshalBinary(data []byte) error {
+	key, err := unmarshalBlock(m.ID(), data)
+	m.Index, m.Begin, m.Length = key.index, key.begin, key.length
+	return err
+}
+
+func marshalIndex(index uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, index)
+	return buf
+}
+
+func unmarshalIndex(id MsgID, data []byte, index *uint32) error {
+	if err := checkLen(id, data, 4); err != nil {
+		return err
+	}
+	*index = binary.BigEndian.Uint32(data)
+	return nil
+}
+
+// 子分片请求的格式：分片序号 + 偏移 + 长度
+func marshalBlock(key blockKey) []byte {
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint32(buf[0:4], key.index)
+	binary.BigEndian.PutUint32(buf[4:8], key.begin)
+	binary.BigEndian.PutUint32(buf[8:12], key.length)
+	return buf
+}
+
+func unmarshalBlock(id MsgID, data []byte) (blockKey, error) {
+	if err := checkLen(id, data, 12); err != nil {
+		return blockKey{}, err
+	}
+	return blockKey{
+		binary.BigEndian.Uint32(data[0:4]),
+		binary.BigEndian.Uint32(data[4:8]),
+		binary.BigEndian.Uint32(data[8:12]),
+	}, nil
+}
+
+func formatBlock(id MsgID, key blockKey) string {
+	return fmt.Sprintf("%s(index=%d, begin=%d, length=%d)", id, key.index, key.begin, key.length)
+}
+
+// Piece 子分片的数据，解码时Block直接引用payload的内存
+type Piece struct {
+	Index uint32
+	Begin uint32
+	Block []byte
+}
+
+func (*Piece) ID() MsgID { return MsgPiece }
+
+func (m *Piece) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 8+len(m.Block))
+	binary.BigEndian.PutUint32(buf[0:4], m.Index)
+	binary.BigEndian.PutUint32(buf[4:8], m.Begin)
+	copy(buf[8:], m.Block)
+	return buf, nil
+}
+
+func (m *Piece) UnmarshalBinary(data []byte) error {
+	if len(data) < 8 {
+		return fmt.Errorf("%w: %s expect at least 8, get %d", ErrBadPayload, m.ID(), len(data))
+	}
+	m.Index = binary.BigEndian.Uint32(data[0:4])
+	m.Begin = binary.BigEndian.Uint32(data[4:8])
+	m.Block = data[8:]
+	return nil
+}
+
+func (m *Piece) String() string {
+	return fmt.Sprintf("%s(index=%d, begin=%d, length=%d)", m.ID(), m.Index, m.Begin, len(m.Block))
+}
+
+func (m *Piece) key() blockKey {
+	return blockKey{m.Index, m.Begin, uint32(len(m.Block))}
+}
+
+// Bitfield本身也是一条消息
+func (*Bitfield) ID() MsgID { return MsgBitfield }
+
+func (b *Bitfield) MarshalBinary() ([]byte, error) {
+	return append([]byte(nil), *b...), nil
+}
+
+func (b *Bitfield) UnmarshalBinary(data []byte) error {
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+// Port DHT节点监听的端口
+type Port struct {
+	Port uint16
+}
+
+func (*Port) ID() MsgID { return MsgPort }
+
+func (m *Port) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, m.Port)
+	return buf, nil
+}
+
+func (m *Port) UnmarshalBinary(data []byte) error {
+	if err := checkLen(m.ID(), data, 2); err != nil {
+		return err
+	}
+	m.Port = binary.BigEndian.Uint16(data)
+	return nil
+}
+
+func (m *Port) String() string {
+	return fmt.Sprintf("%s(%d)", m.ID(), m.Port)
+}
+
+// Extended 扩展协议的消息：1字节扩展id + 内容，扩展id为0的是扩展握手
+type Extended struct {
+	ExtID   uint8
+	Payload []byte
+}
+
+func (*Extended) ID() MsgID { return MsgExtended }
+
+func (m *Extended) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 1+len(m.Payload))
+	buf[0] = m.ExtID
+	copy(buf[1:], m.Payload)
+	return buf, nil
+}
+
+func (m *Extended) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 {
+		return fmt.Errorf("%w: %s expect at least 1, get 0", ErrBadPayload, m.ID())
+	}
+	m.ExtID = data[0]
+	m.Payload = data[1:]
+	return nil
+}
+
+func (m *Extended) String() string {
+	return fmt.Sprintf("%s(id=%d, length=%d)", m.ID(), m.ExtID, len(m.Payload))
+}
+
+func checkLen(id MsgID, data []byte, size int) error {
+	if len(data) != size {
+		return fmt.Errorf("%w: %s expect %d, get %d", ErrBadPayload, id, size, len(data))
+	}
+	return nil
+}
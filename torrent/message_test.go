@@ -0,0 +1,86 @@
+package torrent
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	bf := Bitfield{0xa0, 0x01}
+	msgs := []Message{
+		&Choke{},
+		&Unchoke{},
+		&Interested{},
+		&NotInterested{},
+		&Have{Index: 7},
+		&bf,
+		&Request{Index: 1, Begin: BLOCKSIZE, Length: BLOCKSIZE},
+		&Piece{Index: 1, Begin: 16, Block: []byte("hello")},
+		&Cancel{Index: 2, Begin: 0, Length: 100},
+		&Port{Port: 6881},
+		&SuggestPiece{Index: 3},
+		&HaveAll{},
+		&HaveNone{},
+		&RejectRequest{Index: 4, Begin: 32, Length: 64},
+		&AllowedFast{Index: 5},
+		&Extended{ExtID: 1, Payload: []byte("d1:ai1ee")},
+	}
+	for _, m := range msgs {
+		msg, err := NewMsg(m)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, m.ID(), msg.ID)
+
+		data, err := msg.MarshalBinary()
+		assert.Equal(t, nil, err)
+		read := &PeerMsg{}
+		assert.Equal(t, nil, read.UnmarshalBinary(data))
+
+		res, err := ParseMsg(read)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, m.String(), res.String())
+		assert.Equal(t, m.String(), msg.String())
+		assert.Equal(t, m, res)
+	}
+	assert.Equal(t, "request(index=1, begin=16384, length=16384)", msgs[6].String())
+	assert.Equal(t, "keep-alive", (*PeerMsg)(nil).String())
+}
+
+func TestMessageBadPayload(t *testing.T) {
+	cases := []*PeerMsg{
+		{MsgChoke, []byte{0}},
+		{MsgHave, []byte{0, 0, 1}},
+		{MsgRequest, make([]byte, 11)},
+		{MsgCancel, make([]byte, 13)},
+		{MsgPiece, make([]byte, 7)},
+		{MsgPort, []byte{1}},
+		{MsgHaveAll, []byte{1}},
+		{MsgReject, nil},
+		{MsgAllowedFast, make([]byte, 5)},
+		{MsgExtended, nil},
+	}
+	for _, msg := range cases {
+		_, err := ParseMsg(msg)
+		assert.Equal(t, true, errors.Is(err, ErrBadPayload), msg.ID.String())
+	}
+	_, err := ParseMsg(&PeerMsg{MsgID(99), nil})
+	assert.Equal(t, true, errors.Is(err, ErrUnknownMsg))
+	assert.Equal(t, "unknown(99)(0 bytes)", (&PeerMsg{MsgID(99), nil}).String())
+}
+
+func TestPeerMsgBinary(t *testing.T) {
+	msg := &PeerMsg{MsgHave, []byte{0, 0, 0, 9}}
+	data, err := msg.MarshalBinary()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte{0, 0, 0, 5, 4, 0, 0, 0, 9}, data)
+
+	res := &PeerMsg{}
+	assert.Equal(t, nil, res.UnmarshalBinary(data))
+	assert.Equal(t, msg, res)
+	assert.Equal(t, true, errors.Is(res.UnmarshalBinary(data[:7]), ErrBadPayload))
+	assert.Equal(t, true, errors.Is(res.UnmarshalBinary([]byte{0, 0, 0, 0}), ErrBadPayload))
+
+	data, _ = (*PeerMsg)(nil).MarshalBinary()
+	assert.Equal(t, []byte{0, 0, 0, 0}, data)
+}
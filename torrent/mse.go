@@ -0,0 +1,372 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"time"
+)
+
+/*
+MSE/PE（Message Stream Encryption）握手，A是发起方，B是接收方：
+
+	1 A->B: Ya, PadA
+	2 B->A: Yb, PadB
+	3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	5 之后按crypto_select决定用RC4加密还是明文传输
+
+Y是Diffie-Hellman公钥，S是共享密钥，SKEY是info hash，VC是8个0字节。
+Pad的长度是随机的，双方通过查找HASH('req1', S)和ENCRYPT(VC)来定位后面的内容
+*/
+
+// EncryptionPolicy 连接的加密策略
+type EncryptionPolicy int
+
+const (
+	EncryptionDisabled  EncryptionPolicy = iota // 只使用明文连接
+	EncryptionPreferred                         // 优先加密，对方不支持时使用明文
+	EncryptionRequired                          // 只使用RC4加密的连接
+)
+
+func (p EncryptionPolicy) String() string {
+	switch p {
+	case EncryptionDisabled:
+		return "disabled"
+	case EncryptionPreferred:
+		return "preferred"
+	case EncryptionRequired:
+		return "required"
+	}
+	return fmt.Sprintf("EncryptionPolicy(%d)", int(p))
+}
+
+// Encryption 新建连接使用的加密策略
+var Encryption = EncryptionPreferred
+
+const (
+	mseKeyLen  = 96 // DH公钥和共享密钥的长度
+	msePadMax  = 512
+	mseTimeout = 10 * time.Second
+
+	// crypto_provide和crypto_select中的加密方式
+	cryptoPlain = 0x01
+	cryptoRC4   = 0x02
+)
+
+var (
+	// 768位的素数
+	mseP, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	mseG    = big.NewInt(2)
+	mseVC   = make([]byte, 8)
+)
+
+// 握手成功后的连接，按协商结果加解密，enc和dec为nil时是明文
+type cryptoConn struct {
+	net.Conn
+	r       io.Reader // 握手时用带缓冲的reader读取，缓冲中可能已经有后面的数据
+	pending []byte    // 已经解密的初始数据(IA)，先于r中的数据返回
+	enc     *rc4.Cipher
+	dec     *rc4.Cipher
+}
+
+func (c *cryptoConn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	n, err := c.r.Read(b)
+	if c.dec != nil {
+		c.dec.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+func (c *cryptoConn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+// 生成DH私钥和公钥
+func mseKeys() (*big.Int, []byte, error) {
+	priv := make([]byte, 20)
+	if _, err := rand.Read(priv); err != nil {
+		return nil, nil, err
+	}
+	x := new(big.Int).SetBytes(priv)
+	y := new(big.Int).Exp(mseG, x, mseP)
+	return x, y.FillBytes(make([]byte, mseKeyLen)), nil
+}
+
+// 根据对方的公钥计算共享密钥
+func mseSecret(x *big.Int, remote []byte) ([]byte, error) {
+	y := new(big.Int).SetBytes(remote)
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(new(big.Int).Sub(mseP, big.NewInt(1))) >= 0 {
+		return nil, fmt.Errorf("%w: invalid public key", ErrEncryption)
+	}
+	return new(big.Int).Exp(y, x, mseP).FillBytes(make([]byte, mseKeyLen)), nil
+}
+
+func mseHash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// 按方向生成RC4密钥流，丢弃前1024字节
+func mseCipher(name string, s []byte, skey [SHALEN]byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(mseHash([]byte(name), s, skey[:]))
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+// 随机长度的填充，内容为0
+func msePad() []byte {
+	var n [2]byte
+	rand.Read(n[:])
+	return make([]byte, int(binary.BigEndian.Uint16(n[:]))%(msePadMax+1))
+}
+
+func xorBytes(a, b []byte) []byte {
+	res := make([]byte, len(a))
+	for i := range a {
+		res[i] = a[i] ^ b[i]
+	}
+	return res
+}
+
+// 在最多max字节的填充之后找到pattern，读完pattern为止
+func syncTo(r *bufio.Reader, pattern []byte, max int) error {
+	window := make([]byte, 0, len(pattern)+max)
+	for len(window) < cap(window) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: sync pattern not found", ErrEncryption)
+}
+
+// 读取长度为2字节的填充或初始数据，用dec解密
+func readSized(r io.Reader, dec *rc4.Cipher, max int) ([]byte, error) {
+	var n [2]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(n[:], n[:])
+	size := int(binary.BigEndian.Uint16(n[:]))
+	if size > max {
+		return nil, fmt.Errorf("%w: length %d > %d", ErrEncryption, size, max)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(buf, buf)
+	return buf, nil
+}
+
+// 按加密策略选择一种对方提供的加密方式
+func cryptoSelect(provide uint32, policy EncryptionPolicy) (uint32, error) {
+	switch {
+	case provide&cryptoRC4 != 0 && policy != EncryptionDisabled:
+		return cryptoRC4, nil
+	case provide&cryptoPlain != 0 && policy != EncryptionRequired:
+		return cryptoPlain, nil
+	}
+	return 0, fmt.Errorf("%w: no acceptable crypto method in %#x", ErrEncryption, provide)
+}
+
+// 作为发起方完成加密握手，之后的BT握手和消息都通过返回的连接收发
+func mseDial(conn net.Conn, infoSHA [SHALEN]byte, policy EncryptionPolicy) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(mseTimeout))
+	defer conn.SetDeadline(time.Time{})
+	x, ya, err := mseKeys()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(ya, msePad()...)); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	yb := make([]byte, mseKeyLen)
+	if _, err := io.ReadFull(r, yb); err != nil {
+		return nil, err
+	}
+	s, err := mseSecret(x, yb)
+	if err != nil {
+		return nil, err
+	}
+	enc := mseCipher("keyA", s, infoSHA)
+	dec := mseCipher("keyB", s, infoSHA)
+
+	provide := uint32(cryptoRC4)
+	if policy == EncryptionPreferred {
+		provide |= cryptoPlain
+	}
+	// VC + crypto_provide + len(PadC) + len(IA)，PadC和IA都为空
+	plain := make([]byte, 8+4+2+2)
+	binary.BigEndian.PutUint32(plain[8:12], provide)
+	enc.XORKeyStream(plain, plain)
+	buf := mseHash([]byte("req1"), s)
+	buf = append(buf, xorBytes(mseHash([]byte("req2"), infoSHA[:]), mseHash([]byte("req3"), s))...)
+	if _, err := conn.Write(append(buf, plain...)); err != nil {
+		return nil, err
+	}
+
+	// 对方的回复在PadB之后，以加密后的VC开头
+	vc := make([]byte, len(mseVC))
+	dec.XORKeyStream(vc, mseVC)
+	if err := syncTo(r, vc, msePadMax); err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(hdr, hdr)
+	if _, err := readSized(r, dec, msePadMax); err != nil {
+		return nil, err
+	}
+	selected := binary.BigEndian.Uint32(hdr)
+	if selected != cryptoRC4 && selected != cryptoPlain || selected&provide == 0 {
+		return nil, fmt.Errorf("%w: peer selected %#x", ErrEncryption, selected)
+	}
+	if selected == cryptoPlain {
+		return &cryptoConn{Conn: conn, r: r}, nil
+	}
+	return &cryptoConn{Conn: conn, r: r, enc: enc, dec: dec}, nil
+}
+
+/*
+作为接收方识别对方发起的握手：以BT握手开头的是明文连接，否则是加密握手。
+infoSHAs是可以接受的info hash，返回的连接从对方的BT握手开始读取
+*/
+func mseAccept(conn net.Conn, infoSHAs [][SHALEN]byte, policy EncryptionPolicy) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(mseTimeout))
+	defer conn.SetDeadline(time.Time{})
+	r := bufio.NewReader(conn)
+	head, err := r.Peek(20)
+	if err != nil {
+		return nil, err
+	}
+	if head[0] == 19 && string(head[1:]) == "BitTorrent protocol" {
+		if policy == EncryptionRequired {
+			return nil, fmt.Errorf("%w: plaintext connection refused", ErrEncryption)
+		}
+		return &cryptoConn{Conn: conn, r: r}, nil
+	}
+	if policy == EncryptionDisabled {
+		return nil, fmt.Errorf("%w: encrypted connection refused", ErrEncryption)
+	}
+
+	ya := make([]byte, mseKeyLen)
+	if _, err := io.ReadFull(r, ya); err != nil {
+		return nil, err
+	}
+	x, yb, err := mseKeys()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(yb, msePad()...)); err != nil {
+		return nil, err
+	}
+	s, err := mseSecret(x, ya)
+	if err != nil {
+		return nil, err
+	}
+	if err := syncTo(r, mseHash([]byte("req1"), s), msePadMax); err != nil {
+		return nil, err
+	}
+	// 根据HASH('req2', SKEY)找到对方要下载的种子
+	obfs := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(r, obfs); err != nil {
+		return nil, err
+	}
+	req2 := xorBytes(obfs, mseHash([]byte("req3"), s))
+	var infoSHA [SHALEN]byte
+	found := false
+	for _, sha := range infoSHAs {
+		if bytes.Equal(req2, mseHash([]byte("req2"), sha[:])) {
+			infoSHA, found = sha, true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: unknown info hash", ErrEncryption)
+	}
+	dec := mseCipher("keyA", s, infoSHA)
+	enc := mseCipher("keyB", s, infoSHA)
+
+	hdr := make([]byte, 8+4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(hdr, hdr)
+	if !bytes.Equal(hdr[:8], mseVC) {
+		return nil, fmt.Errorf("%w: bad verification constant", ErrEncryption)
+	}
+	selected, err := cryptoSelect(binary.BigEndian.Uint32(hdr[8:12]), policy)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := readSized(r, dec, msePadMax); err != nil {
+		return nil, err
+	}
+	// IA是对方的BT握手等初始数据，已经解密，放在连接的最前面
+	ia, err := readSized(r, dec, 1<<16-1)
+	if err != nil {
+		return nil, err
+	}
+
+	// VC + crypto_select + len(padD)，padD为空
+	reply := make([]byte, 8+4+2)
+	binary.BigEndian.PutUint32(reply[8:12], selected)
+	enc.XORKeyStream(reply, reply)
+	if _, err := conn.Write(reply); err != nil {
+		return nil, err
+	}
+	if selected == cryptoPlain {
+		return &cryptoConn{Conn: conn, r: r, pending: ia}, nil
+	}
+	return &cryptoConn{Conn: conn, r: r, pending: ia, enc: enc, dec: dec}, nil
+}
+
+// 发起连接，按加密策略决定是否加密，优先加密时握手失败会重新建立明文连接
+func dialPeer(addr string, infoSHA [SHALEN]byte, policy EncryptionPolicy) (net.Conn, error) {
+	conn, err := dialTransport(addr)
+	if err != nil || policy == EncryptionDisabled {
+		return conn, err
+	}
+	encrypted, err := mseDial(conn, infoSHA, policy)
+	if err == nil {
+		return encrypted, nil
+	}
+	conn.Close()
+	if policy == EncryptionRequired {
+		return nil, err
+	}
+	// 对方不支持加密时通常直接断开连接
+	log.Println("encrypted handshake failed, fallback to plaintext, err = ", err)
+	return dialTransport(addr)
+}
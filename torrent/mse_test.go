@@ -0,0 +1,152 @@
+package torrent
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 本地两端分别按各自的加密策略建立连接，接收方可能要处理回退后的第二次连接
+func msePair(t *testing.T, dialPolicy, acceptPolicy EncryptionPolicy) (net.Conn, net.Conn, error, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer ln.Close()
+	infoSHA := [SHALEN]byte{1, 2, 3}
+	other := [SHALEN]byte{4, 5, 6}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	accepted := make(chan result, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c, err := mseAccept(conn, [][SHALEN]byte{other, infoSHA}, acceptPolicy)
+			if err == nil {
+				_, err = acceptHandshake(c, infoSHA, [IDLen]byte{'b'})
+			}
+			if err != nil {
+				conn.Close()
+			}
+			accepted <- result{c, err}
+		}
+	}()
+
+	dialed, dialErr := dialPeer(ln.Addr().String(), infoSHA, dialPolicy)
+	if dialErr == nil {
+		_, dialErr = handshake(dialed, infoSHA, [IDLen]byte{'a'})
+	}
+	// 取最后一次连接的结果
+	var res result
+	for res = <-accepted; res.err != nil && dialErr == nil; res = <-accepted {
+	}
+	return dialed, res.conn, dialErr, res.err
+}
+
+func TestMSE(t *testing.T) {
+	cases := []struct {
+		dial, accept EncryptionPolicy
+		encrypted    bool
+		fail         bool
+	}{
+		{EncryptionPreferred, EncryptionPreferred, true, false},
+		{EncryptionRequired, EncryptionPreferred, true, false},
+		{EncryptionPreferred, EncryptionRequired, true, false},
+		{EncryptionDisabled, EncryptionPreferred, false, false},
+		{EncryptionDisabled, EncryptionDisabled, false, false},
+		// 对方不接受加密连接时回退到明文
+		{EncryptionPreferred, EncryptionDisabled, false, false},
+		{EncryptionDisabled, EncryptionRequired, false, true},
+		{EncryptionRequired, EncryptionDisabled, false, true},
+	}
+	for _, c := range cases {
+		name := c.dial.String() + "/" + c.accept.String()
+		dialed, accepted, dialErr, acceptErr := msePair(t, c.dial, c.accept)
+		if c.fail {
+			assert.NotEqual(t, nil, acceptErr, name)
+			if dialErr == nil {
+				dialed.Close()
+			}
+			continue
+		}
+		assert.Equal(t, nil, dialErr, name)
+		assert.Equal(t, nil, acceptErr, name)
+
+		// 握手之后双向收发数据
+		pc := &PeerConn{Conn: dialed}
+		remote := &PeerConn{Conn: accepted}
+		assert.Equal(t, c.encrypted, pc.Encrypted(), name)
+		assert.Equal(t, c.encrypted, remote.Encrypted(), name)
+		go pc.WriteMsg(NewRequestMsg(1, 2, 3))
+		msg, err := remote.ReadMsg()
+		assert.Equal(t, nil, err, name)
+		assert.Equal(t, NewRequestMsg(1, 2, 3), msg, name)
+		go remote.WriteMsg(&PeerMsg{MsgHave, []byte{0, 0, 0, 7}})
+		msg, err = pc.ReadMsg()
+		assert.Equal(t, nil, err, name)
+		assert.Equal(t, &PeerMsg{MsgHave, []byte{0, 0, 0, 7}}, msg, name)
+		dialed.Close()
+		accepted.Close()
+	}
+}
+
+func TestMSEInitialPayload(t *testing.T) {
+	// 接收方解密的IA要先于后面的数据返回
+	cc := &cryptoConn{r: io.MultiReader(), pending: []byte("abc")}
+	buf := make([]byte, 2)
+	n, _ := cc.Read(buf)
+	assert.Equal(t, "ab", string(buf[:n]))
+	n, _ = cc.Read(buf)
+	assert.Equal(t, "c", string(buf[:n]))
+	_, err := cc.Read(buf)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestAcceptPeerConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer ln.Close()
+	infoSHA := [SHALEN]byte{9}
+	accepted := make(chan *PeerConn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		pc, _ := AcceptPeerConn(conn, infoSHA, [IDLen]byte{'b'}, testPieces)
+		accepted <- pc
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	pc, err := NewPeerConn(PeerInfo{IP: addr.IP, Port: uint16(addr.Port)}, infoSHA, [IDLen]byte{'a'}, testPieces)
+	assert.Equal(t, nil, err)
+	defer pc.Close()
+	var remote *PeerConn
+	select {
+	case remote = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept timeout")
+	}
+	assert.NotEqual(t, (*PeerConn)(nil), remote)
+	defer remote.Close()
+
+	assert.Equal(t, true, pc.Encrypted())
+	assert.Equal(t, true, remote.Encrypted())
+	assert.Equal(t, true, pc.Fast())
+	// 双方都先发送have none
+	assert.Equal(t, MsgHaveNone, (<-pc.Msgs()).ID)
+	assert.Equal(t, MsgHaveNone, (<-remote.Msgs()).ID)
+	assert.Equal(t, nil, pc.Send(&PeerMsg{MsgInterested, nil}))
+	for msg := range remote.Msgs() {
+		if msg.ID == MsgInterested {
+			break
+		}
+	}
+	assert.Equal(t, true, remote.PeerInterested())
+}
@@ -3,11 +3,12 @@ package torrent
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"strconv"
+	"sync"
 	"time"
 )
 
@@ -23,70 +24,764 @@ const (
 	MsgRequest     MsgID = 6
 	MsgPiece       MsgID = 7
 	MsgCancel      MsgID = 8
+	MsgPort        MsgID = 9 // DHT端口，BEP 5
+
+	// Fast扩展的消息，BEP 6
+	MsgSuggest     MsgID = 13
+	MsgHaveAll     MsgID = 14
+	MsgHaveNone    MsgID = 15
+	MsgReject      MsgID = 16
+	MsgAllowedFast MsgID = 17
+
+	MsgExtended MsgID = 20 // 扩展协议，BEP 10
 )
 
+func (id MsgID) String() string {
+	switch id {
+	case MsgChoke:
+		return "choke"
+	case MsgUnchoke:
+		return "unchoke"
+	case MsgInterested:
+		return "interested"
+	case MsgNotInterest:
+		return "not interested"
+	case MsgHave:
+		return "have"
+	case MsgBitfield:
+		return "bitfield"
+	case MsgRequest:
+		return "request"
+	case MsgPiece:
+		return "piece"
+	case MsgCancel:
+		return "cancel"
+	case MsgPort:
+		return "port"
+	case MsgSuggest:
+		return "suggest piece"
+	case MsgHaveAll:
+		return "have all"
+	case MsgHaveNone:
+		return "have none"
+	case MsgReject:
+		return "reject request"
+	case MsgAllowedFast:
+		return "allowed fast"
+	case MsgExtended:
+		return "extended"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(id))
+}
+
 const LenByte = 4
 
+const (
+	MaxBlockLen = 128 * 1024          // 请求的子分片最大长度，常见客户端都不超过16K
+	MaxMsgLen   = 1 + 8 + MaxBlockLen // 除了bitfield之外消息的最大长度
+)
+
+const (
+	msgQueueLen   = 64 // 收到的消息最多缓存多少条
+	writeQueueLen = 32 // 待发送的消息最多缓存多少条
+)
+
+var (
+	KeepAliveInterval = 2 * time.Minute  // 超过这个时间没有发送过消息就发送keep-alive
+	IdleTimeout       = 3 * time.Minute  // 超过这个时间没有收到任何消息就断开连接
+	WriteTimeout      = 30 * time.Second // 单条消息的发送超时
+)
+
 type PeerMsg struct {
 	ID      MsgID
 	Payload []byte
 }
 
 func NewRequestMsg(index, offset, length int) *PeerMsg {
-	payload := make([]byte, 12)
-	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
-	binary.BigEndian.PutUint32(payload[4:8], uint32(offset))
-	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
-	return &PeerMsg{MsgRequest, payload}
+	req := &Request{Index: uint32(index), Begin: uint32(offset), Length: uint32(length)}
+	msg, _ := NewMsg(req)
+	return msg
 }
 
+/*
+PeerConn 和一个peer之间的连接，全双工：
+ 1. 读协程不停读取消息，更新choke/interest状态和对方的bitfield，再通过Msgs()分发给下载逻辑
+ 2. 写协程按顺序发送Send()放进队列的消息，空闲时定时发送keep-alive
+ 3. 超过IdleTimeout没有收到任何消息，或者读写出错时断开连接，Msgs()会被关闭
+*/
 type PeerConn struct {
 	net.Conn
-	Choked  bool
-	Field   Bitfield
-	peer    PeerInfo
-	peerID  [IDLen]byte
-	infoSHA [SHALEN]byte
+	peer      PeerInfo
+	peerID    [IDLen]byte // 对方的peer id
+	client    ClientInfo  // 从对方的peer id解析出的客户端
+	infoSHA   [SHALEN]byte
+	numPieces int  // 分片数量，用来校验bitfield和have
+	fast      bool // 双方都支持Fast扩展
+
+	mu             sync.Mutex
+	field          Bitfield
+	amChoking      bool                  // 我方拒绝给对方上传
+	amInterested   bool                  // 我方想从对方下载
+	peerChoking    bool                  // 对方拒绝给我方上传
+	peerInterested bool                  // 对方想从我方下载
+	gotMsg         bool                  // 是否已经收到过消息，bitfield只能是第一条消息
+	requests       map[blockKey]struct{} // 已经发出、还没有收到数据的请求
+	cancelled      map[blockKey]struct{} // 取消或者被choke丢弃的请求，对方仍然可能发送数据
+	allowedFast    map[uint32]struct{}   // 对方允许我方在被choke时请求的分片
+	allowedOut     map[uint32]struct{}   // 我方允许对方在被choke时请求的分片
+	suggested      []int                 // 对方建议下载的分片，最近的在后面
+	verified       int                   // 这个连接上下载并校验通过的分片数
+	hashFailed     map[int]int           // 这个连接上每个分片校验失败的次数
+	upLimiter      *Limiter              // 任务的上传限速，和全局限速同时生效
+	downLimiter    *Limiter              // 任务的下载限速
+	upMeter        *rateMeter            // 统计任务的上传速度
+	downMeter      *rateMeter            // 统计任务的下载速度
+	source         blockSource           // 读取我方已经有的子分片，为nil时不上传
+
+	keepAlive time.Duration
+	idle      time.Duration
+	msgs      chan *PeerMsg
+	writeQ    chan *PeerMsg
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// 读取我方已经校验通过的子分片，没有这个分片时返回false
+type blockSource func(index, begin, length int) ([]byte, bool)
+
+// 一个子分片请求
+type blockKey struct {
+	index, begin, length uint32
 }
 
-func NewPeerConn(peer PeerInfo, infoSHA [SHALEN]byte, peerID [SHALEN]byte) (*PeerConn, error) {
-	addr := net.JoinHostPort(peer.IP.String(), strconv.Itoa(int(peer.Port)))
-	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+// NewPeerConn 连接peer并完成握手，peerID是我方的peer id
+func NewPeerConn(peer PeerInfo, infoSHA [SHALEN]byte, peerID [IDLen]byte, numPieces int) (*PeerConn, error) {
+	conn, err := dialPeer(peer.Addr(), infoSHA, Encryption)
 	if err != nil {
 		log.Println("establish conn error = ", err)
 		return nil, err
 	}
 	// 建立p2p连接
-	if err = handshake(conn, infoSHA, peerID); err != nil {
+	res, err := handshake(conn, infoSHA, peerID)
+	if err != nil {
 		conn.Close()
 		log.Println("handshake error = ", err)
 		return nil, err
 	}
+	if err = checkPeerID(peer, res.PeerID, peerID); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newPeerConn(conn, peer, infoSHA, res.PeerID, numPieces, EnableFast && res.SupportFast()), nil
+}
+
+// AcceptPeerConn 处理对方主动建立的连接：按加密策略完成加密握手，交换握手消息后启动读写协程
+func AcceptPeerConn(conn net.Conn, infoSHA [SHALEN]byte, peerID [IDLen]byte, numPieces int) (*PeerConn, error) {
+	return acceptPeerConn(conn, [][SHALEN]byte{infoSHA}, peerID, func(h [SHALEN]byte) (int, bool) {
+		return numPieces, h == infoSHA
+	})
+}
 
+// 按对方握手消息中的info hash选择任务，lookup返回任务的分片数量，没有这个任务时返回false
+func acceptPeerConn(conn net.Conn, infoSHAs [][SHALEN]byte, peerID [IDLen]byte, lookup func([SHALEN]byte) (int, bool)) (*PeerConn, error) {
+	if PeerFilter.Blocked(addrPeer(conn.RemoteAddr()).IP) {
+		conn.Close()
+		return nil, ErrBlockedIP
+	}
+	c, err := mseAccept(conn, infoSHAs, Encryption)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res, numPieces, err := routeHandshake(c, peerID, lookup)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	peer := addrPeer(conn.RemoteAddr())
+	if err = checkPeerID(peer, res.PeerID, peerID); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newPeerConn(c, peer, res.InfoSHA, res.PeerID, numPieces, EnableFast && res.SupportFast()), nil
+}
+
+// 从连接的地址得到peer的ip和端口
+func addrPeer(addr net.Addr) PeerInfo {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return PeerInfo{IP: addr.IP, Port: uint16(addr.Port)}
+	case *net.UDPAddr:
+		return PeerInfo{IP: addr.IP, Port: uint16(addr.Port)}
+	}
+	return PeerInfo{}
+}
+
+// 在已经完成握手的连接上启动读写协程，peerID是对方的peer id
+func newPeerConn(conn net.Conn, peer PeerInfo, infoSHA [SHALEN]byte, peerID [IDLen]byte, numPieces int, fast bool) *PeerConn {
 	pc := &PeerConn{
-		Conn:    conn,
-		Choked:  true,
-		peer:    peer,
-		peerID:  peerID,
-		infoSHA: infoSHA,
+		Conn:        conn,
+		peer:        peer,
+		peerID:      peerID,
+		client:      ParseClient(peerID),
+		infoSHA:     infoSHA,
+		numPieces:   numPieces,
+		fast:        fast,
+		field:       make(Bitfield, (numPieces+7)/8),
+		requests:    make(map[blockKey]struct{}),
+		cancelled:   make(map[blockKey]struct{}),
+		allowedFast: make(map[uint32]struct{}),
+		allowedOut:  make(map[uint32]struct{}),
+		amChoking:   true,
+		peerChoking: true,
+		keepAlive:   KeepAliveInterval,
+		idle:        IdleTimeout,
+		msgs:        make(chan *PeerMsg, msgQueueLen),
+		writeQ:      make(chan *PeerMsg, writeQueueLen),
+		done:        make(chan struct{}),
+	}
+	if fast {
+		pc.sendFastSet()
 	}
-	if err = fillBitField(pc); err != nil {
-		log.Println("fill bit field error = ", err)
+	go pc.readLoop()
+	go pc.writeLoop()
+	return pc
+}
+
+/*
+Fast扩展要求第一条消息必须是bitfield、have all或have none之一，握手后先发送have none，
+再发送allowed fast集合，我方已经有的分片之后再逐个发送have。发送队列的容量足够，读写协程启动前不会阻塞
+*/
+func (c *PeerConn) sendFastSet() {
+	c.writeQ <- &PeerMsg{MsgHaveNone, nil}
+	for _, index := range AllowedFastSet(c.peer.IP, c.infoSHA, c.numPieces, AllowedFastNum) {
+		c.allowedOut[uint32(index)] = struct{}{}
+		msg, _ := NewMsg(&AllowedFast{Index: uint32(index)})
+		c.writeQ <- msg
+	}
+}
+
+// Msgs 收到的消息，keep-alive不会分发，连接断开后通道会被关闭
+func (c *PeerConn) Msgs() <-chan *PeerMsg {
+	return c.msgs
+}
+
+// Done 连接断开后通道会被关闭
+func (c *PeerConn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err 返回连接断开的原因
+func (c *PeerConn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Send 把消息放进发送队列，队列满时阻塞，连接已经断开时返回ErrConnClosed
+func (c *PeerConn) Send(msg *PeerMsg) error {
+	select {
+	case <-c.done:
+		return ErrConnClosed
+	default:
+	}
+	if msg != nil {
+		c.mu.Lock()
+		switch msg.ID {
+		case MsgChoke:
+			c.amChoking = true
+		case MsgUnchoke:
+			c.amChoking = false
+		case MsgInterested:
+			c.amInterested = true
+		case MsgNotInterest:
+			c.amInterested = false
+		case MsgRequest:
+			// 记录发出的请求，收到的数据必须对应其中一个请求
+			req := &Request{}
+			if req.UnmarshalBinary(msg.Payload) == nil {
+				c.requests[req.key()] = struct{}{}
+			}
+		case MsgCancel:
+			cancel := &Cancel{}
+			if cancel.UnmarshalBinary(msg.Payload) == nil {
+				delete(c.requests, cancel.key())
+				c.cancel(cancel.key())
+			}
+		}
+		c.mu.Unlock()
+	}
+	select {
+	case c.writeQ <- msg:
+		return nil
+	case <-c.done:
+		return ErrConnClosed
+	}
+}
+
+// SetLimiters 设置任务的上传和下载限速，为nil时只受全局限速
+func (c *PeerConn) SetLimiters(up, down *Limiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.upLimiter, c.downLimiter = up, down
+}
+
+// 消息需要依次获取令牌的限速器
+func (c *PeerConn) limiters(up bool) []*Limiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if up {
+		return []*Limiter{UploadLimiter, c.upLimiter}
+	}
+	return []*Limiter{DownloadLimiter, c.downLimiter}
+}
+
+// 设置上传的数据来源，之后对方的请求由读协程直接回复，不再分发
+func (c *PeerConn) setSource(source blockSource) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.source = source
+}
+
+func (c *PeerConn) setMeters(up, down *rateMeter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.upMeter, c.downMeter = up, down
+}
+
+func (c *PeerConn) meter(up bool) *rateMeter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if up {
+		return c.upMeter
+	}
+	return c.downMeter
+}
+
+// Close 断开连接，可以重复调用
+func (c *PeerConn) Close() error {
+	c.closeWithError(ErrConnClosed)
+	return nil
+}
+
+func (c *PeerConn) closeWithError(err error) {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+		close(c.done)
+		c.Conn.Close()
+	})
+}
+
+func (c *PeerConn) AmChoking() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.amChoking
+}
+
+func (c *PeerConn) AmInterested() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.amInterested
+}
+
+func (c *PeerConn) PeerChoking() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peerChoking
+}
+
+func (c *PeerConn) PeerInterested() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peerInterested
+}
+
+// HasPiece 判断对方是否拥有某个分片
+func (c *PeerConn) HasPiece(index int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.field.HasPiece(index)
+}
+
+// PieceCount 对方拥有的分片数量，还没有收到bitfield或have时为0
+func (c *PeerConn) PieceCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.field.Count()
+}
+
+// PeerID 对方的peer id
+func (c *PeerConn) PeerID() [IDLen]byte {
+	return c.peerID
+}
+
+// Client 对方使用的客户端，用于展示
+func (c *PeerConn) Client() ClientInfo {
+	return c.client
+}
+
+// Encrypted 连接是否使用RC4加密
+func (c *PeerConn) Encrypted() bool {
+	cc, ok := c.Conn.(*cryptoConn)
+	return ok && cc.enc != nil
+}
+
+// Fast 双方是否都支持Fast扩展
+func (c *PeerConn) Fast() bool {
+	return c.fast
+}
+
+// AllowedFast 对方是否允许我方在被choke时请求这个分片
+func (c *PeerConn) AllowedFast(index int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.allowedFast[uint32(index)]
+	return ok
+}
+
+// 对方是否已经告诉过我们拥有哪些分片，bitfield只能是第一条消息，之后没有收到的就是没有
+func (c *PeerConn) knownPieces() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gotMsg
+}
+
+// 记录一个校验通过的分片
+func (c *PeerConn) addVerified() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.verified++
+}
+
+// 这个连接上校验通过的分片数
+func (c *PeerConn) verifiedPieces() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.verified
+}
+
+// 记录一个校验失败的分片，返回这个分片在这个连接上失败的次数
+func (c *PeerConn) addHashFailed(index int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.hashFailed == nil {
+		c.hashFailed = make(map[int]int)
+	}
+	c.hashFailed[index]++
+	return c.hashFailed[index]
+}
+
+// 分片在这个连接上校验失败的次数
+func (c *PeerConn) hashFailures(index int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hashFailed[index]
+}
+
+// Suggested 对方建议下载的分片，最近建议的在后面
+func (c *PeerConn) Suggested() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]int(nil), c.suggested...)
+}
+
+// 读协程：更新连接状态后把消息分发出去
+func (c *PeerConn) readLoop() {
+	defer close(c.msgs)
+	for {
+		c.SetReadDeadline(time.Now().Add(c.idle))
+		msg, err := c.ReadMsg()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				err = ErrIdleTimeout
+			}
+			c.closeWithError(err)
+			return
+		}
+		// 限速：读完一条消息后再获取令牌，等待期间对方的发送会被TCP流控挡住
+		if waitLimiters(c.limiters(false), msg.wireLen(), c.done) != nil {
+			return
+		}
+		c.meter(false).add(msg.wireLen())
+		// 空消息是探活消息
+		if msg == nil {
+			continue
+		}
+		forward, reply, err := c.handleMsg(msg)
+		if err != nil {
+			c.closeWithError(&ProtocolError{ID: msg.ID, Err: err})
+			return
+		}
+		if reply != nil && c.Send(reply) != nil {
+			return
+		}
+		if !forward || c.serve(msg) {
+			continue
+		}
+		select {
+		case c.msgs <- msg:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// 校验消息并更新连接状态，返回消息是否需要分发以及需要直接回复的消息，返回错误表示对方违反了协议
+func (c *PeerConn) handleMsg(msg *PeerMsg) (bool, *PeerMsg, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	first := !c.gotMsg
+	c.gotMsg = true
+	m, err := ParseMsg(msg)
+	if errors.Is(err, ErrUnknownMsg) {
+		// 不认识的消息直接忽略，交给上层决定
+		return true, nil, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	if isFastMsg(msg.ID) && !c.fast {
+		return false, nil, ErrFastDisabled
+	}
+	switch m := m.(type) {
+	case *Choke:
+		c.peerChoking = true
+		// Fast扩展下choke不会丢弃请求，对方会逐个回复reject
+		if c.fast {
+			break
+		}
+		// 对方choke之后会丢弃还没有处理的请求，但choke之前已经在路上的数据仍然可能到达
+		for key := range c.requests {
+			c.cancel(key)
+		}
+		c.requests = make(map[blockKey]struct{})
+	case *Unchoke:
+		c.peerChoking = false
+	case *Interested:
+		c.peerInterested = true
+	case *NotInterested:
+		c.peerInterested = false
+	case *Have:
+		if err := c.checkIndex(m.Index); err != nil {
+			return false, nil, err
+		}
+		c.field.SetPiece(int(m.Index))
+	case *Bitfield:
+		if !first {
+			return false, nil, fmt.Errorf("%w: bitfield must be the first message", ErrBadBitfield)
+		}
+		if err := checkBitfield(*m, c.numPieces); err != nil {
+			return false, nil, err
+		}
+		c.field = *m
+	case *HaveAll:
+		if !first {
+			return false, nil, fmt.Errorf("%w: have all must be the first message", ErrBadBitfield)
+		}
+		for i := 0; i < c.numPieces; i++ {
+			c.field.SetPiece(i)
+		}
+	case *HaveNone:
+		if !first {
+			return false, nil, fmt.Errorf("%w: have none must be the first message", ErrBadBitfield)
+		}
+	case *SuggestPiece:
+		if err := c.checkIndex(m.Index); err != nil {
+			return false, nil, err
+		}
+		if len(c.suggested) >= maxSuggested {
+			c.suggested = c.suggested[1:]
+		}
+		c.suggested = append(c.suggested, int(m.Index))
+	case *AllowedFast:
+		if err := c.checkIndex(m.Index); err != nil {
+			return false, nil, err
+		}
+		c.allowedFast[m.Index] = struct{}{}
+	case *RejectRequest:
+		key := m.key()
+		if _, ok := c.requests[key]; ok {
+			delete(c.requests, key)
+			return true, nil, nil
+		}
+		// 取消请求后对方可能回复reject，从来没有请求过的是违反协议的
+		if _, ok := c.cancelled[key]; ok {
+			delete(c.cancelled, key)
+			return false, nil, nil
+		}
+		return false, nil, fmt.Errorf("%w: index %d, begin %d, length %d", ErrBadReject, key.index, key.begin, key.length)
+	case *Request:
+		if err := c.checkRequest(m.key()); err != nil {
+			return false, nil, err
+		}
+		// Fast扩展下choke期间只处理allowed fast集合中的请求，其余的直接拒绝
+		if _, ok := c.allowedOut[m.Index]; c.fast && c.amChoking && !ok {
+			reject, _ := NewMsg(&RejectRequest{Index: m.Index, Begin: m.Begin, Length: m.Length})
+			return false, reject, nil
+		}
+	case *Cancel:
+		return true, nil, c.checkRequest(m.key())
+	case *Piece:
+		key := m.key()
+		if _, ok := c.requests[key]; ok {
+			delete(c.requests, key)
+			return true, nil, nil
+		}
+		// 已经取消的请求的数据直接丢弃，从来没有请求过的数据是违反协议的
+		if _, ok := c.cancelled[key]; ok {
+			delete(c.cancelled, key)
+			return false, nil, nil
+		}
+		return false, nil, fmt.Errorf("%w: index %d, begin %d, length %d", ErrUnsolicitedPiece, key.index, key.begin, key.length)
+	}
+	return true, nil, nil
+}
+
+/*
+设置了上传的数据来源时处理对方的interested和请求，返回true表示消息已经处理完，不需要分发：
+ 1. 不限制上传的连接数，对方interested时马上unchoke
+ 2. choke期间只回复allowed fast集合中的请求，我方没有的分片回复reject，没有协商Fast扩展时直接丢弃
+*/
+func (c *PeerConn) serve(msg *PeerMsg) bool {
+	c.mu.Lock()
+	source, choking := c.source, c.amChoking
+	c.mu.Unlock()
+	if source == nil {
+		return false
+	}
+	switch msg.ID {
+	case MsgInterested:
+		if choking {
+			c.Send(&PeerMsg{MsgUnchoke, nil})
+		}
+	case MsgRequest:
+		req := &Request{}
+		if req.UnmarshalBinary(msg.Payload) != nil {
+			return true
+		}
+		c.mu.Lock()
+		_, allowed := c.allowedOut[req.Index]
+		c.mu.Unlock()
+		var reply *PeerMsg
+		if data, ok := source(int(req.Index), int(req.Begin), int(req.Length)); ok && (!choking || allowed) {
+			reply, _ = NewMsg(&Piece{Index: req.Index, Begin: req.Begin, Block: data})
+		} else if c.fast {
+			reply, _ = NewMsg(&RejectRequest{Index: req.Index, Begin: req.Begin, Length: req.Length})
+		}
+		if reply != nil {
+			c.Send(reply)
+		}
+		return true
+	}
+	return false
+}
+
+// Fast扩展新增的消息，没有协商Fast扩展时对方不能发送
+func isFastMsg(id MsgID) bool {
+	return id >= MsgSuggest && id <= MsgAllowedFast
+}
+
+func (c *PeerConn) checkIndex(index uint32) error {
+	if int64(index) >= int64(c.numPieces) {
+		return fmt.Errorf("%w: %d >= %d", ErrBadIndex, index, c.numPieces)
+	}
+	return nil
+}
+
+// 校验对方的请求
+func (c *PeerConn) checkRequest(key blockKey) error {
+	if err := c.checkIndex(key.index); err != nil {
+		return err
+	}
+	if key.length == 0 || key.length > MaxBlockLen {
+		return fmt.Errorf("%w: request length %d", ErrBadPayload, key.length)
+	}
+	return nil
+}
+
+const (
+	maxCancelled = 1024 // 最多记录多少个取消的请求，超过后清空，防止一直不回复的peer占用内存
+	maxSuggested = 32   // 最多记录多少个建议下载的分片
+)
+
+func (c *PeerConn) cancel(key blockKey) {
+	if len(c.cancelled) >= maxCancelled {
+		c.cancelled = make(map[blockKey]struct{})
+	}
+	c.cancelled[key] = struct{}{}
+}
+
+// 校验bitfield的长度必须正好容纳所有分片，多余的位必须是0
+func checkBitfield(field []byte, numPieces int) error {
+	if len(field) != (numPieces+7)/8 {
+		return fmt.Errorf("%w: expect %d bytes, get %d", ErrBadBitfield, (numPieces+7)/8, len(field))
+	}
+	if spare := len(field)*8 - numPieces; spare > 0 && field[len(field)-1]&(1<<uint(spare)-1) != 0 {
+		return fmt.Errorf("%w: spare bits set", ErrBadBitfield)
+	}
+	return nil
+}
+
+// 消息的最大长度，bitfield的长度取决于分片数量，可能超过MaxMsgLen
+func (c *PeerConn) maxMsgLen() uint32 {
+	n := uint32(MaxMsgLen)
+	if bf := uint32(1 + (c.numPieces+7)/8); bf > n {
+		n = bf
+	}
+	return n
+}
+
+// 写协程：按顺序发送队列中的消息，超过KeepAliveInterval没有发送过消息时发送keep-alive
+func (c *PeerConn) writeLoop() {
+	timer := time.NewTimer(c.keepAlive)
+	defer timer.Stop()
+	for {
+		var msg *PeerMsg
+		select {
+		case msg = <-c.writeQ:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-timer.C:
+			// 定时器到期，msg为nil，发送keep-alive
+		case <-c.done:
+			return
+		}
+		// 先获取令牌再设置发送超时
+		if waitLimiters(c.limiters(true), msg.wireLen(), c.done) != nil {
+			return
+		}
+		c.SetWriteDeadline(time.Now().Add(WriteTimeout))
+		if _, err := c.WriteMsg(msg); err != nil {
+			c.closeWithError(err)
+			return
+		}
+		c.meter(true).add(msg.wireLen())
+		timer.Reset(c.keepAlive)
 	}
-	return pc, nil
 }
 
 func (c *PeerConn) ReadMsg() (*PeerMsg, error) {
 	lenBuf := make([]byte, LenByte)
-	if _, err := io.ReadFull(c, lenBuf); err != nil {
+	if _, err := io.ReadFull(c.Conn, lenBuf); err != nil {
 		return nil, err
 	}
 	length := binary.BigEndian.Uint32(lenBuf)
 	if length == 0 {
 		return nil, nil
 	}
+	// 先检查长度再分配内存，防止对方让我们分配任意大小的内存
+	if length > c.maxMsgLen() {
+		id := make([]byte, 1)
+		io.ReadFull(c.Conn, id)
+		return nil, &ProtocolError{ID: MsgID(id[0]), Err: fmt.Errorf("%w: %d > %d", ErrMsgTooLarge, length, c.maxMsgLen())}
+	}
 	msgBuf := make([]byte, length)
-	if _, err := io.ReadFull(c, msgBuf); err != nil {
+	if _, err := io.ReadFull(c.Conn, msgBuf); err != nil {
 		return nil, err
 	}
 
@@ -97,61 +792,62 @@ func (c *PeerConn) ReadMsg() (*PeerMsg, error) {
 }
 
 // WriteMsg 写入格式：消息长度（id + payload） + id + payload
-// Peer约定消息格式：前4字节是消息长度，后面1字节是消息id，再往后是消息内容
+// Peer约定消息格式：前4字节是消息长度，后面1字节是消息id，再往后是消息内容，msg为nil时发送keep-alive
+// 读写协程启动后应该使用Send，直接调用WriteMsg会和写协程并发写入
 func (c *PeerConn) WriteMsg(msg *PeerMsg) (int, error) {
-	var buf []byte
-	if msg == nil {
-		buf = make([]byte, LenByte)
+	buf, err := msg.MarshalBinary()
+	if err != nil {
+		return 0, err
 	}
-	length := 1 + len(msg.Payload)
-	buf = make([]byte, LenByte+length)
-	binary.BigEndian.PutUint32(buf[0:LenByte], uint32(length))
-	buf[LenByte] = byte(msg.ID)
-	copy(buf[LenByte+1:], msg.Payload)
-	return c.Write(buf)
+	return c.Conn.Write(buf)
 }
 
-func handshake(conn net.Conn, infoSHA [SHALEN]byte, peerId [IDLen]byte) error {
+// 交换握手消息，返回对方的握手消息
+func handshake(conn net.Conn, infoSHA [SHALEN]byte, peerId [IDLen]byte) (*HandShakeMsg, error) {
 	conn.SetDeadline(time.Now().Add(3 * time.Second))
 	defer conn.SetDeadline(time.Time{})
 	// send HandshakeMsg
 	req := NewHandShakeMsg(infoSHA, peerId)
 	_, err := WriteHandShake(conn, req)
 	if err != nil {
-		fmt.Println("send handshake failed")
-		return err
+		return nil, err
 	}
 	// read HandshakeMsg
 	res, err := ReadHandShake(conn)
 	if err != nil {
-		fmt.Println("read handshake failed")
-		return err
+		return nil, err
 	}
 	// check HandshakeMsg
 	if !bytes.Equal(res.InfoSHA[:], infoSHA[:]) {
-		fmt.Println("check handshake failed")
-		return fmt.Errorf("handshake msg error: " + string(res.InfoSHA[:]))
+		return nil, fmt.Errorf("handshake msg error: " + string(res.InfoSHA[:]))
 	}
-	return nil
+	return res, nil
 }
 
-func fillBitField(c *PeerConn) error {
-	c.SetDeadline(time.Now().Add(5 * time.Second))
-	defer c.SetDeadline(time.Time{})
+// 接收方先读取对方的握手消息，校验info hash后再回复
+func acceptHandshake(conn net.Conn, infoSHA [SHALEN]byte, peerId [IDLen]byte) (*HandShakeMsg, error) {
+	res, _, err := routeHandshake(conn, peerId, func(h [SHALEN]byte) (int, bool) {
+		return 0, h == infoSHA
+	})
+	return res, err
+}
 
-	msg, err := c.ReadMsg()
+// 读取对方的握手消息，用lookup找到info hash对应的任务后再回复
+func routeHandshake(conn net.Conn, peerId [IDLen]byte, lookup func([SHALEN]byte) (int, bool)) (*HandShakeMsg, int, error) {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	res, err := ReadHandShake(conn)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
-	if msg == nil {
-		return fmt.Errorf("expect bitfield")
+	numPieces, ok := lookup(res.InfoSHA)
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: %x", ErrUnknownTorrent, res.InfoSHA)
 	}
-	if msg.ID != MsgBitfield {
-		return fmt.Errorf("expect bitfield, get %d", msg.ID)
+	if _, err = WriteHandShake(conn, NewHandShakeMsg(res.InfoSHA, peerId)); err != nil {
+		return nil, 0, err
 	}
-	log.Println("fill bitfield successfully, peer = ", c.peer.IP.String())
-	c.Field = msg.Payload
-	return nil
+	return res, numPieces, nil
 }
 
 // GetIndex 获取消息中的信息：分片序号
@@ -159,11 +855,11 @@ func GetIndex(msg *PeerMsg) (int, error) {
 	if msg.ID != MsgHave {
 		return 0, fmt.Errorf("expect msg id have, get %d", msg.ID)
 	}
-	if len(msg.Payload) != 4 {
-		return 0, fmt.Errorf("expect payload length 4, get %d", len(msg.Payload))
+	have := &Have{}
+	if err := have.UnmarshalBinary(msg.Payload); err != nil {
+		return 0, err
 	}
-	index := binary.BigEndian.Uint32(msg.Payload)
-	return int(index), nil
+	return int(have.Index), nil
 }
 
 // CopyPieceData 把通信消息中对应分片的子分片内容拷贝到内存buf中
@@ -171,22 +867,21 @@ func CopyPieceData(index int, buf []byte, msg *PeerMsg) (int, error) {
 	if msg.ID != MsgPiece {
 		return 0, fmt.Errorf("expect msg id piece, get %d", msg.ID)
 	}
-	if len(msg.Payload) < 8 {
-		return 0, fmt.Errorf("payload too short, expect 8, get %d", len(msg.Payload))
+	piece := &Piece{}
+	if err := piece.UnmarshalBinary(msg.Payload); err != nil {
+		return 0, err
 	}
-	parseIndex := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
-	if parseIndex != index {
-		return 0, fmt.Errorf("expect index %d, get %d", index, parseIndex)
+	if int(piece.Index) != index {
+		return 0, fmt.Errorf("expect index %d, get %d", index, piece.Index)
 	}
-	parseOffset := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	parseOffset := int(piece.Begin)
 	if parseOffset >= len(buf) {
 		return 0, fmt.Errorf("offset too big, offset %d >= bufLen %d", parseOffset, len(buf))
 	}
-	parseData := msg.Payload[8:]
-	if parseOffset+len(parseData) > len(buf) {
-		return 0, fmt.Errorf("data too big, offset %d, dataLen %d, bufLen %d", parseOffset, len(parseData), len(buf))
+	if parseOffset+len(piece.Block) > len(buf) {
+		return 0, fmt.Errorf("data too big, offset %d, dataLen %d, bufLen %d", parseOffset, len(piece.Block), len(buf))
 	}
 	// 拷贝消息内容到对应位置
-	copy(buf[parseOffset:], parseData)
-	return len(parseData), nil
+	copy(buf[parseOffset:], piece.Block)
+	return len(piece.Block), nil
 }
@@ -2,11 +2,15 @@ package torrent
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/rand"
 	"fmt"
 	"net"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestPeer(t *testing.T) {
@@ -20,9 +24,291 @@ func TestPeer(t *testing.T) {
 	var peerID [IDLen]byte
 	_, _ = rand.Read(peerID[:])
 
-	conn, err := NewPeerConn(peer, tf.InfoSHA, peerID)
+	conn, err := NewPeerConn(peer, tf.InfoSHA, peerID, len(tf.PieceSHA))
 	if err != nil {
 		t.Error("new peer err : " + err.Error())
 	}
 	fmt.Println(conn)
 }
+
+// 测试连接的分片数量
+const testPieces = 16
+
+// 用net.Pipe模拟对方，remote直接读写原始消息
+func newTestConn(keepAlive, idle time.Duration) (*PeerConn, *PeerConn) {
+	local, remote := net.Pipe()
+	saveKeepAlive, saveIdle := KeepAliveInterval, IdleTimeout
+	KeepAliveInterval, IdleTimeout = keepAlive, idle
+	defer func() { KeepAliveInterval, IdleTimeout = saveKeepAlive, saveIdle }()
+	pc := newPeerConn(local, PeerInfo{IP: net.IPv4(127, 0, 0, 1), Port: 6881}, [SHALEN]byte{}, [IDLen]byte{}, testPieces, false)
+	return pc, &PeerConn{Conn: remote}
+}
+
+// 协商了Fast扩展的连接
+func newFastTestConn() (*PeerConn, *PeerConn) {
+	local, remote := net.Pipe()
+	pc := newPeerConn(local, PeerInfo{IP: net.IPv4(127, 0, 0, 1), Port: 6881}, [SHALEN]byte{}, [IDLen]byte{}, testPieces, true)
+	return pc, &PeerConn{Conn: remote}
+}
+
+func TestPeerConnState(t *testing.T) {
+	pc, remote := newTestConn(time.Minute, time.Minute)
+	defer pc.Close()
+	assert.Equal(t, true, pc.AmChoking())
+	assert.Equal(t, true, pc.PeerChoking())
+
+	// 对方发来的消息更新连接状态，并分发出去
+	msgs := []*PeerMsg{
+		{MsgBitfield, []byte{0x80, 0x00}},
+		{MsgUnchoke, []byte{}},
+		{MsgInterested, []byte{}},
+		{MsgHave, []byte{0, 0, 0, 9}},
+	}
+	go func() {
+		for _, msg := range msgs {
+			remote.WriteMsg(msg)
+			remote.WriteMsg(nil)
+		}
+	}()
+	for _, expect := range msgs {
+		msg := <-pc.Msgs()
+		assert.Equal(t, expect, msg)
+	}
+	assert.Equal(t, false, pc.PeerChoking())
+	assert.Equal(t, true, pc.PeerInterested())
+	assert.Equal(t, true, pc.HasPiece(0))
+	assert.Equal(t, true, pc.HasPiece(9))
+	assert.Equal(t, false, pc.HasPiece(1))
+
+	// 发送的消息按顺序写出
+	assert.Equal(t, nil, pc.Send(&PeerMsg{MsgInterested, nil}))
+	assert.Equal(t, nil, pc.Send(&PeerMsg{MsgUnchoke, nil}))
+	assert.Equal(t, true, pc.AmInterested())
+	assert.Equal(t, false, pc.AmChoking())
+	msg, err := remote.ReadMsg()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, MsgInterested, msg.ID)
+	msg, _ = remote.ReadMsg()
+	assert.Equal(t, MsgUnchoke, msg.ID)
+
+	// 对方断开后通道被关闭
+	remote.Conn.Close()
+	_, ok := <-pc.Msgs()
+	assert.Equal(t, false, ok)
+	assert.NotEqual(t, nil, pc.Err())
+	assert.Equal(t, ErrConnClosed, pc.Send(&PeerMsg{MsgChoke, nil}))
+}
+
+func TestPeerConnKeepAlive(t *testing.T) {
+	pc, remote := newTestConn(20*time.Millisecond, time.Minute)
+	defer pc.Close()
+	// 没有消息要发送时定时发送keep-alive
+	for i := 0; i < 2; i++ {
+		remote.SetReadDeadline(time.Now().Add(time.Second))
+		msg, err := remote.ReadMsg()
+		assert.Equal(t, nil, err)
+		assert.Equal(t, (*PeerMsg)(nil), msg)
+	}
+}
+
+func TestPeerConnIdle(t *testing.T) {
+	pc, remote := newTestConn(time.Minute, 50*time.Millisecond)
+	defer remote.Conn.Close()
+	// 对方一直不发消息，连接被断开
+	select {
+	case <-pc.Done():
+	case <-time.After(time.Second):
+		t.Fatal("idle peer not dropped")
+	}
+	assert.Equal(t, ErrIdleTimeout, pc.Err())
+}
+
+func TestPeerConnProtocolError(t *testing.T) {
+	cases := []struct {
+		name   string
+		msgs   []*PeerMsg
+		raw    []byte
+		expect error
+	}{
+		{"too large", nil, []byte{0x10, 0, 0, 0, byte(MsgPiece)}, ErrMsgTooLarge},
+		{"short bitfield", []*PeerMsg{{MsgBitfield, []byte{0xff}}}, nil, ErrBadBitfield},
+		{"long bitfield", []*PeerMsg{{MsgBitfield, []byte{0xff, 0xff, 0}}}, nil, ErrBadBitfield},
+		{"late bitfield", []*PeerMsg{{MsgUnchoke, nil}, {MsgBitfield, []byte{0xff, 0xff}}}, nil, ErrBadBitfield},
+		{"have out of range", []*PeerMsg{{MsgHave, []byte{0, 0, 0, testPieces}}}, nil, ErrBadIndex},
+		{"have bad length", []*PeerMsg{{MsgHave, []byte{0, 0, 1}}}, nil, ErrBadPayload},
+		{"choke with payload", []*PeerMsg{{MsgChoke, []byte{1}}}, nil, ErrBadPayload},
+		{"unsolicited piece", []*PeerMsg{{MsgPiece, []byte{0, 0, 0, 1, 0, 0, 0, 0, 'x'}}}, nil, ErrUnsolicitedPiece},
+		{"request too long", []*PeerMsg{{MsgRequest, NewRequestMsg(0, 0, MaxBlockLen+1).Payload}}, nil, ErrBadPayload},
+		{"have all without fast", []*PeerMsg{{MsgHaveAll, nil}}, nil, ErrFastDisabled},
+	}
+	for _, c := range cases {
+		pc, remote := newTestConn(time.Minute, time.Minute)
+		go func(msgs []*PeerMsg, raw []byte) {
+			for _, msg := range msgs {
+				remote.WriteMsg(msg)
+			}
+			remote.Write(raw)
+		}(c.msgs, c.raw)
+		for range pc.Msgs() {
+		}
+		var pe *ProtocolError
+		assert.ErrorAs(t, pc.Err(), &pe, c.name)
+		assert.ErrorIs(t, pc.Err(), c.expect, c.name)
+		remote.Conn.Close()
+	}
+
+	// 多余的位不能被设置：15个分片的bitfield最后一位是多余的
+	assert.ErrorIs(t, checkBitfield([]byte{0xff, 0xff}, 15), ErrBadBitfield)
+	assert.Equal(t, nil, checkBitfield([]byte{0xff, 0xfe}, 15))
+}
+
+func TestPeerConnRequestedPiece(t *testing.T) {
+	pc, remote := newTestConn(time.Minute, time.Minute)
+	defer remote.Conn.Close()
+	defer pc.Close()
+	go func() {
+		remote.ReadMsg()
+		// 对方只发送我们请求过的子分片
+		remote.WriteMsg(&PeerMsg{MsgPiece, []byte{0, 0, 0, 3, 0, 0, 0, 4, 'a', 'b'}})
+	}()
+	assert.Equal(t, nil, pc.Send(NewRequestMsg(3, 4, 2)))
+	msg := <-pc.Msgs()
+	assert.Equal(t, MsgPiece, msg.ID)
+	// choke之前已经在路上的数据直接丢弃，不算违反协议
+	go func() {
+		remote.ReadMsg()
+		remote.WriteMsg(&PeerMsg{MsgChoke, nil})
+		remote.WriteMsg(&PeerMsg{MsgPiece, []byte{0, 0, 0, 3, 0, 0, 0, 8, 'c', 'd'}})
+		remote.WriteMsg(&PeerMsg{MsgUnchoke, nil})
+	}()
+	assert.Equal(t, nil, pc.Send(NewRequestMsg(3, 8, 2)))
+	assert.Equal(t, MsgChoke, (<-pc.Msgs()).ID)
+	assert.Equal(t, MsgUnchoke, (<-pc.Msgs()).ID)
+
+	// 同一个请求的数据只能收一次
+	go remote.WriteMsg(&PeerMsg{MsgPiece, []byte{0, 0, 0, 3, 0, 0, 0, 4, 'a', 'b'}})
+	_, ok := <-pc.Msgs()
+	assert.Equal(t, false, ok)
+	assert.ErrorIs(t, pc.Err(), ErrUnsolicitedPiece)
+}
+
+func TestPeerConnFast(t *testing.T) {
+	pc, remote := newFastTestConn()
+	defer remote.Conn.Close()
+	defer pc.Close()
+	assert.Equal(t, true, pc.Fast())
+
+	// 握手后先收到have none，然后是allowed fast集合
+	msg, _ := remote.ReadMsg()
+	assert.Equal(t, MsgHaveNone, msg.ID)
+	expect := AllowedFastSet(net.IPv4(127, 0, 0, 1), [SHALEN]byte{}, testPieces, AllowedFastNum)
+	var allowed []int
+	for range expect {
+		msg, _ = remote.ReadMsg()
+		index, _ := ParseMsg(msg)
+		allowed = append(allowed, int(index.(*AllowedFast).Index))
+	}
+	assert.Equal(t, expect, allowed)
+
+	// have all代替bitfield
+	go func() {
+		remote.WriteMsg(&PeerMsg{MsgHaveAll, []byte{}})
+		remote.WriteMsg(&PeerMsg{MsgAllowedFast, []byte{0, 0, 0, 3}})
+		remote.WriteMsg(&PeerMsg{MsgSuggest, []byte{0, 0, 0, 5}})
+	}()
+	assert.Equal(t, MsgHaveAll, (<-pc.Msgs()).ID)
+	assert.Equal(t, testPieces, pc.PieceCount())
+	assert.Equal(t, MsgAllowedFast, (<-pc.Msgs()).ID)
+	assert.Equal(t, true, pc.AllowedFast(3))
+	assert.Equal(t, false, pc.AllowedFast(4))
+	assert.Equal(t, MsgSuggest, (<-pc.Msgs()).ID)
+	assert.Equal(t, []int{5}, pc.Suggested())
+
+	// choke不会丢弃请求，被reject的请求马上分发出去
+	assert.Equal(t, nil, pc.Send(NewRequestMsg(3, 0, BLOCKSIZE)))
+	remote.ReadMsg()
+	reject, _ := NewMsg(&RejectRequest{Index: 3, Begin: 0, Length: BLOCKSIZE})
+	go func() {
+		remote.WriteMsg(&PeerMsg{MsgChoke, []byte{}})
+		remote.WriteMsg(reject)
+	}()
+	assert.Equal(t, MsgChoke, (<-pc.Msgs()).ID)
+	assert.Equal(t, reject, <-pc.Msgs())
+
+	// 我方choke时，不在allowed fast集合中的请求直接被拒绝
+	notAllowed := 0
+	for notAllowed < testPieces {
+		if _, ok := pc.allowedOut[uint32(notAllowed)]; !ok {
+			break
+		}
+		notAllowed++
+	}
+	go remote.WriteMsg(NewRequestMsg(notAllowed, 0, BLOCKSIZE))
+	msg, _ = remote.ReadMsg()
+	expectReject, _ := NewMsg(&RejectRequest{Index: uint32(notAllowed), Length: BLOCKSIZE})
+	assert.Equal(t, expectReject, msg)
+	go remote.WriteMsg(NewRequestMsg(expect[0], 0, BLOCKSIZE))
+	assert.Equal(t, MsgRequest, (<-pc.Msgs()).ID)
+
+	// 没有发过的请求被reject是违反协议的
+	go remote.WriteMsg(reject)
+	_, ok := <-pc.Msgs()
+	assert.Equal(t, false, ok)
+	assert.ErrorIs(t, pc.Err(), ErrBadReject)
+}
+
+func TestPeerConnUpload(t *testing.T) {
+	pc, remote := newFastTestConn()
+	defer remote.Conn.Close()
+	defer pc.Close()
+	// 我方只有分片0以外的分片
+	pc.setSource(func(index, begin, length int) ([]byte, bool) {
+		if index == 0 {
+			return nil, false
+		}
+		return bytes.Repeat([]byte{byte(index)}, length), true
+	})
+	msg, _ := remote.ReadMsg()
+	assert.Equal(t, MsgHaveNone, msg.ID)
+	allowed := AllowedFastSet(net.IPv4(127, 0, 0, 1), [SHALEN]byte{}, testPieces, AllowedFastNum)
+	for range allowed {
+		remote.ReadMsg()
+	}
+	notAllowed := 0
+	for ; notAllowed < testPieces; notAllowed++ {
+		if _, ok := pc.allowedOut[uint32(notAllowed)]; !ok && notAllowed != 0 {
+			break
+		}
+	}
+
+	// choke期间allowed fast集合中的请求直接回复数据，不会分发
+	index := allowed[0]
+	if index == 0 {
+		index = allowed[1]
+	}
+	go remote.WriteMsg(NewRequestMsg(index, 0, 4))
+	msg, _ = remote.ReadMsg()
+	expect, _ := NewMsg(&Piece{Index: uint32(index), Block: bytes.Repeat([]byte{byte(index)}, 4)})
+	assert.Equal(t, expect, msg)
+
+	// 对方interested后马上unchoke，之后所有我方有的分片都能请求
+	go remote.WriteMsg(&PeerMsg{MsgInterested, nil})
+	msg, _ = remote.ReadMsg()
+	assert.Equal(t, MsgUnchoke, msg.ID)
+	assert.Equal(t, MsgInterested, (<-pc.Msgs()).ID)
+	go remote.WriteMsg(NewRequestMsg(notAllowed, 8, 2))
+	msg, _ = remote.ReadMsg()
+	expect, _ = NewMsg(&Piece{Index: uint32(notAllowed), Begin: 8, Block: bytes.Repeat([]byte{byte(notAllowed)}, 2)})
+	assert.Equal(t, expect, msg)
+
+	// 我方没有的分片回复reject
+	go remote.WriteMsg(NewRequestMsg(0, 0, BLOCKSIZE))
+	msg, _ = remote.ReadMsg()
+	expect, _ = NewMsg(&RejectRequest{Index: 0, Length: BLOCKSIZE})
+	assert.Equal(t, expect, msg)
+	select {
+	case msg := <-pc.Msgs():
+		t.Fatalf("unexpected msg %v", msg.ID)
+	default:
+	}
+}
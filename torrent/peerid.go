@@ -0,0 +1,273 @@
+package torrent
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 我方的客户端代码和版本号，按Azureus风格编码到peer id中
+const (
+	ClientCode    = "GB"
+	ClientVersion = "0001"
+)
+
+// NewPeerID 生成-GB0001-开头、后面12个随机字母数字的peer id
+func NewPeerID() [IDLen]byte {
+	const chars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	var id [IDLen]byte
+	prefix := "-" + ClientCode + ClientVersion + "-"
+	copy(id[:], prefix)
+	random := make([]byte, IDLen-len(prefix))
+	rand.Read(random)
+	for i, b := range random {
+		id[len(prefix)+i] = chars[int(b)%len(chars)]
+	}
+	return id
+}
+
+// Azureus风格：-XX1234-，XX是客户端代码
+var azureusClients = map[string]string{
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"FW": "FrostWire",
+	"GB": "go-bittorrent",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "rTorrent",
+	"qB": "qBittorrent",
+	"SD": "Thunder",
+	"TR": "Transmission",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+}
+
+// Shadow风格：一个字母表示客户端，后面最多5个字符表示版本号
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// ClientInfo 从peer id中解析出的客户端名称和版本
+type ClientInfo struct {
+	Name    string
+	Version string
+}
+
+func (c ClientInfo) String() string {
+	if c.Version == "" {
+		return c.Name
+	}
+	return c.Name + " " + c.Version
+}
+
+// ParseClient 按Azureus风格或Shadow风格解析peer id，无法识别时Name为unknown
+func ParseClient(id [IDLen]byte) ClientInfo {
+	if id[0] == '-' && id[7] == '-' && isAlnum(id[1]) && isAlnum(id[2]) {
+		code := string(id[1:3])
+		name, ok := azureusClients[code]
+		if !ok {
+			name = code
+		}
+		return ClientInfo{Name: name, Version: azureusVersion(code, id[3:7])}
+	}
+	if name, ok := shadowClients[id[0]]; ok {
+		if version, ok := shadowVersion(id[1:6]); ok {
+			return ClientInfo{Name: name, Version: version}
+		}
+	}
+	return ClientInfo{Name: "unknown"}
+}
+
+func isAlnum(b byte) bool {
+	return b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
+
+// 每个字符是一段版本号，字母表示10以上的数字，最后一段为0时省略
+func azureusVersion(code string, v []byte) string {
+	if code == "TR" {
+		// Transmission：2940表示2.94
+		major, _ := strconv.Atoi(string(v[0:1]))
+		minor, _ := strconv.Atoi(string(v[1:3]))
+		return fmt.Sprintf("%d.%02d", major, minor)
+	}
+	parts := make([]string, 0, len(v))
+	for _, c := range v {
+		n, ok := versionDigit(c)
+		if !ok {
+			return string(v)
+		}
+		parts = append(parts, strconv.Itoa(n))
+	}
+	if parts[3] == "0" {
+		parts = parts[:3]
+	}
+	return strings.Join(parts, ".")
+}
+
+// Shadow风格的版本号：0-9、A-Z、a-z、'.'、'-'分别表示0到63，'-'也用来补齐长度
+func shadowVersion(v []byte) (string, bool) {
+	var parts []string
+	for i, c := range v {
+		if c == '-' {
+			// 后面都必须是补齐的'-'
+			for _, rest := range v[i:] {
+				if rest != '-' {
+					return "", false
+				}
+			}
+			break
+		}
+		n, ok := versionDigit(c)
+		if !ok && c != '.' {
+			return "", false
+		}
+		if c == '.' {
+			n = 62
+		}
+		parts = append(parts, strconv.Itoa(n))
+	}
+	if len(parts) == 0 {
+		return "", false
+	}
+	return strings.Join(parts, "."), true
+}
+
+func versionDigit(c byte) (int, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0'), true
+	case c >= 'A' && c <= 'Z':
+		return int(c-'A') + 10, true
+	case c >= 'a' && c <= 'z':
+		return int(c-'a') + 36, true
+	}
+	return 0, false
+}
+
+// 校验对方握手时的peer id：不能是自己，tracker提供了peer id时必须一致
+func checkPeerID(peer PeerInfo, remote, local [IDLen]byte) error {
+	if remote == local {
+		return ErrSelfConnect
+	}
+	if peer.ID != ([IDLen]byte{}) && peer.ID != remote {
+		return fmt.Errorf("%w: expect %q, get %q", ErrPeerIDMismatch, peer.ID[:], remote[:])
+	}
+	return nil
+}
+
+// PeerSet 已经建立的连接，同一个peer id或者同一个地址只保留一个连接
+type PeerSet struct {
+	mu    sync.Mutex
+	ids   map[[IDLen]byte]*PeerConn
+	addrs map[string]*PeerConn
+}
+
+func NewPeerSet() *PeerSet {
+	return &PeerSet{
+		ids:   make(map[[IDLen]byte]*PeerConn),
+		addrs: make(map[string]*PeerConn),
+	}
+}
+
+// Add 加入一个连接，已经有同一个peer的连接时返回ErrDuplicatePeer
+func (s *PeerSet) Add(c *PeerConn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addr := c.peer.Addr()
+	if _, ok := s.ids[c.peerID]; ok {
+		return fmt.Errorf("%w: peer id %q", ErrDuplicatePeer, c.peerID[:])
+	}
+	if _, ok := s.addrs[addr]; ok {
+		return fmt.Errorf("%w: address %s", ErrDuplicatePeer, addr)
+	}
+	s.ids[c.peerID] = c
+	s.addrs[addr] = c
+	return nil
+}
+
+// Remove 连接断开后移除
+func (s *PeerSet) Remove(c *PeerConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ids[c.peerID] == c {
+		delete(s.ids, c.peerID)
+	}
+	if addr := c.peer.Addr(); s.addrs[addr] == c {
+		delete(s.addrs, addr)
+	}
+}
+
+// Connected 是否已经有到这个地址的连接，用来避免重复发起连接
+func (s *PeerSet) Connected(peer PeerInfo) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.addrs[peer.Addr()]
+	return ok
+}
+
+// CloseAll 断开所有连接
+func (s *PeerSet) CloseAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.addrs {
+		c.Close()
+	}
+}
+
+// CloseIP 断开这个IP的所有连接
+func (s *PeerSet) CloseIP(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.addrs {
+		if c.peer.IP.String() == ip {
+			c.Close()
+		}
+	}
+}
+
+// Send 给所有连接发送同一条消息，比如新校验通过的分片的have
+func (s *PeerSet) Send(msg *PeerMsg) {
+	s.mu.Lock()
+	conns := make([]*PeerConn, 0, len(s.addrs))
+	for _, c := range s.addrs {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+	// 发送队列满时会阻塞，不能持有锁
+	for _, c := range conns {
+		c.Send(msg)
+	}
+}
+
+// Any 是否有连接满足fn
+func (s *PeerSet) Any(fn func(c *PeerConn) bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.addrs {
+		if fn(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *PeerSet) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.ids)
+}
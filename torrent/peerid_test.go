@@ -0,0 +1,92 @@
+package torrent
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func toPeerID(s string) [IDLen]byte {
+	var id [IDLen]byte
+	copy(id[:], s)
+	return id
+}
+
+func TestNewPeerID(t *testing.T) {
+	a, b := NewPeerID(), NewPeerID()
+	assert.Equal(t, true, strings.HasPrefix(string(a[:]), "-GB0001-"))
+	assert.NotEqual(t, a, b)
+	assert.Equal(t, ClientInfo{"go-bittorrent", "0.0.0.1"}, ParseClient(a))
+}
+
+func TestParseClient(t *testing.T) {
+	cases := []struct {
+		id     string
+		client string
+	}{
+		{"-qB4250-abcdefghijkl", "qBittorrent 4.2.5"},
+		{"-TR2940-abcdefghijkl", "Transmission 2.94"},
+		{"-UT3550-abcdefghijkl", "µTorrent 3.5.5"},
+		{"-lt0D60-abcdefghijkl", "rTorrent 0.13.6"},
+		{"-ZZ1000-abcdefghijkl", "ZZ 1.0.0"},
+		{"S58B-----abcdefghijk", "Shadow 5.8.11"},
+		{"T03I--00000000000000", "BitTornado 0.3.18"},
+		{"M4-3-6--abcdefghijkl", "unknown"},
+		{"", "unknown"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.client, ParseClient(toPeerID(c.id)).String(), c.id)
+	}
+}
+
+func TestCheckPeerID(t *testing.T) {
+	local := toPeerID("-GB0001-aaaaaaaaaaaa")
+	remote := toPeerID("-qB4250-bbbbbbbbbbbb")
+	assert.Equal(t, nil, checkPeerID(PeerInfo{}, remote, local))
+	assert.Equal(t, nil, checkPeerID(PeerInfo{ID: remote}, remote, local))
+	assert.Equal(t, ErrSelfConnect, checkPeerID(PeerInfo{}, local, local))
+	err := checkPeerID(PeerInfo{ID: toPeerID("-TR2940-cccccccccccc")}, remote, local)
+	assert.Equal(t, true, errors.Is(err, ErrPeerIDMismatch))
+}
+
+func TestPeerSet(t *testing.T) {
+	peer := PeerInfo{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+	a := &PeerConn{peer: peer, peerID: toPeerID("a")}
+	set := NewPeerSet()
+	assert.Equal(t, nil, set.Add(a))
+	assert.Equal(t, true, set.Connected(peer))
+	// 同一个地址或者同一个peer id
+	err := set.Add(&PeerConn{peer: peer, peerID: toPeerID("b")})
+	assert.Equal(t, true, errors.Is(err, ErrDuplicatePeer))
+	err = set.Add(&PeerConn{peer: PeerInfo{IP: net.IPv4(127, 0, 0, 2), Port: 6881}, peerID: toPeerID("a")})
+	assert.Equal(t, true, errors.Is(err, ErrDuplicatePeer))
+	assert.Equal(t, 1, set.Len())
+
+	set.Remove(a)
+	assert.Equal(t, false, set.Connected(peer))
+	assert.Equal(t, 0, set.Len())
+}
+
+func TestSelfConnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer ln.Close()
+	infoSHA := [SHALEN]byte{5}
+	id := NewPeerID()
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		_, err = AcceptPeerConn(conn, infoSHA, id, testPieces)
+		accepted <- err
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	_, err = NewPeerConn(PeerInfo{IP: addr.IP, Port: uint16(addr.Port)}, infoSHA, id, testPieces)
+	assert.Equal(t, ErrSelfConnect, err)
+	assert.Equal(t, ErrSelfConnect, <-accepted)
+}
@@ -0,0 +1,141 @@
+package torrent
+
+import "sync"
+
+// piecePicker 决定peer下一个下载哪个分片
+/*
+1. 先下载Reader预读窗口中的分片，按序号从小到大，保证正在读取的位置最先可用
+2. 然后是对方通过SuggestPiece建议的分片，对方通常已经把它们读到了缓存中
+3. 顺序模式下按序号从小到大下载，否则按加入的顺序，下载失败放回的分片排到最后
+4. 只分配对方拥有的分片，对方发过错误数据的分片先让给其他peer
+*/
+type piecePicker struct {
+	mu         sync.Mutex
+	pending    []*pieceTask              // 等待下载的分片，按加入的顺序
+	windows    map[interface{}]pieceSpan // 每个Reader的预读窗口
+	sequential bool
+	changed    chan struct{} // 有分片放回时关闭，唤醒空闲的peer
+}
+
+// 分片区间[first, last)
+type pieceSpan struct {
+	first, last int
+}
+
+func newPiecePicker() *piecePicker {
+	return &piecePicker{
+		windows: make(map[interface{}]pieceSpan),
+		changed: make(chan struct{}),
+	}
+}
+
+// 开始新一次下载时替换所有等待下载的分片
+func (p *piecePicker) reset(tasks []*pieceTask) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending = tasks
+	p.notify()
+}
+
+// 放回没有下载成功的分片
+func (p *piecePicker) put(task *pieceTask) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending = append(p.pending, task)
+	p.notify()
+}
+
+// 分片的优先级，数值越大越优先
+const (
+	rankNormal    = iota
+	rankSuggested // 对方建议下载
+	rankWindow    // 在预读窗口中
+)
+
+// 取出一个分片，has判断对方是否拥有，skip返回true的分片不分配，suggested是对方建议的分片，没有合适的分片时返回nil
+func (p *piecePicker) pick(has func(int) bool, skip func(int) bool, suggested []int) *pieceTask {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	best, bestRank := -1, rankNormal
+	for i, task := range p.pending {
+		if !has(task.index) || (skip != nil && skip(task.index)) {
+			continue
+		}
+		rank := p.rank(task.index, suggested)
+		switch {
+		case best < 0:
+		case rank > bestRank:
+		case rank == bestRank && (rank == rankWindow || p.sequential) && task.index < p.pending[best].index:
+		default:
+			continue
+		}
+		best, bestRank = i, rank
+	}
+	if best < 0 {
+		return nil
+	}
+	task := p.pending[best]
+	p.pending = append(p.pending[:best], p.pending[best+1:]...)
+	return task
+}
+
+// 需要持有锁
+func (p *piecePicker) rank(index int, suggested []int) int {
+	if p.inWindow(index) {
+		return rankWindow
+	}
+	for _, i := range suggested {
+		if i == index {
+			return rankSuggested
+		}
+	}
+	return rankNormal
+}
+
+// 需要持有锁
+func (p *piecePicker) inWindow(index int) bool {
+	for _, w := range p.windows {
+		if index >= w.first && index < w.last {
+			return true
+		}
+	}
+	return false
+}
+
+// 等待下一次有分片放回
+func (p *piecePicker) wait() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.changed
+}
+
+// 唤醒空闲的peer重新选择分片
+func (p *piecePicker) wake() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.notify()
+}
+
+// 需要持有锁
+func (p *piecePicker) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+func (p *piecePicker) setWindow(key interface{}, span pieceSpan) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.windows[key] = span
+}
+
+func (p *piecePicker) removeWindow(key interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.windows, key)
+}
+
+func (p *piecePicker) setSequential(on bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sequential = on
+}
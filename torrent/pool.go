@@ -0,0 +1,409 @@
+package torrent
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	MaxPeers          = 30              // 希望保持的连接数
+	MaxHalfOpen       = 8               // 同时正在建立的连接数上限
+	MaxPeerFailures   = 5               // 连续失败这么多次后不再重连
+	ReconnectDelay    = 5 * time.Second // 第一次重连前的等待时间，之后每次翻倍
+	MaxReconnectDelay = 5 * time.Minute // 重连等待时间的上限
+	NoPeersTimeout    = time.Minute     // 所有peer都放弃之后等待新peer的时间，比如tracker重新announce的结果
+)
+
+// peer在连接池中的状态
+const (
+	peerIdle       = iota // 等待连接
+	peerConnecting        // 正在建立连接
+	peerConnected         // 已经建立连接
+	peerDropped           // 不再连接
+)
+
+type poolPeer struct {
+	info     PeerInfo
+	state    int
+	failures int       // 连续失败次数
+	next     time.Time // 最早什么时候可以重连
+}
+
+// PeerPool 管理一个下载任务的所有peer
+/*
+1. 运行过程中可以随时加入新的peer，比如tracker重新announce的结果
+2. 保持MaxPeers个连接，同时建立中的连接不超过MaxHalfOpen个
+3. 连接失败或者断开后按指数退避重连，连续失败MaxPeerFailures次后放弃，
+   只有下载到校验通过的分片才清零失败次数，握手之后一直choke或者超时的peer照样会被放弃
+4. 所有peer都放弃之后等待NoPeersTimeout，期间没有新的peer加入才关闭Exhausted()，下载不可能再有进展，
+   之后再加入新的peer时Exhausted()换成新的通道，需要重新获取
+*/
+type PeerPool struct {
+	mu        sync.Mutex
+	peers     map[string]*poolPeer // key是peer的地址
+	order     []*poolPeer          // 按加入的顺序尝试连接
+	connected int
+	halfOpen  int
+
+	connect func(PeerInfo) (*PeerConn, error)
+	serve   func(*PeerConn) error // 使用连接直到断开，返回nil表示正常结束，不再重连
+	conns   *connLimit            // 多个任务共享的连接数限制，为nil时不限制
+
+	maxPeers    int
+	maxHalfOpen int
+	maxFailures int
+	delay       time.Duration
+	maxDelay    time.Duration
+	noPeers     time.Duration
+
+	wake      chan struct{}
+	exhausted chan struct{}
+	giveUp    *time.Timer // 所有peer都放弃后开始计时，到期时关闭exhausted
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewPeerPool(connect func(PeerInfo) (*PeerConn, error), serve func(*PeerConn) error) *PeerPool {
+	p := &PeerPool{
+		peers:       make(map[string]*poolPeer),
+		connect:     connect,
+		serve:       serve,
+		maxPeers:    MaxPeers,
+		maxHalfOpen: MaxHalfOpen,
+		maxFailures: MaxPeerFailures,
+		delay:       ReconnectDelay,
+		maxDelay:    MaxReconnectDelay,
+		noPeers:     NoPeersTimeout,
+		wake:        make(chan struct{}, 1),
+		exhausted:   make(chan struct{}),
+		closed:      make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Add 加入新的peer，已经在池中的地址和PeerFilter屏蔽的IP会被忽略，返回新加入的个数
+// 加入的peer列表为空并且池中没有可用的peer时，等待NoPeersTimeout后关闭Exhausted()
+func (p *PeerPool) Add(peers ...PeerInfo) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, peer := range peers {
+		// 在黑名单中的peer不加入
+		if PeerFilter.Blocked(peer.IP) {
+			continue
+		}
+		addr := peer.Addr()
+		if _, ok := p.peers[addr]; ok {
+			continue
+		}
+		pp := &poolPeer{info: peer}
+		p.peers[addr] = pp
+		p.order = append(p.order, pp)
+		n++
+	}
+	// 已经放弃过所有peer，新的peer让下载可以继续
+	if n > 0 && p.isExhausted() {
+		p.exhausted = make(chan struct{})
+	}
+	p.checkExhausted()
+	p.notify()
+	return n
+}
+
+// Connected 已经建立的连接数
+func (p *PeerPool) Connected() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.connected
+}
+
+// Known 池中的peer数，包括还没有连接上和已经放弃的
+func (p *PeerPool) Known() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.order)
+}
+
+// 设置多个任务共享的连接数限制，需要在Add之前调用
+func (p *PeerPool) setConnLimit(l *connLimit) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conns = l
+}
+
+// Accept 使用对方主动建立的连接，连接断开后不会重连
+func (p *PeerPool) Accept(conn *PeerConn) error {
+	p.mu.Lock()
+	select {
+	case <-p.closed:
+		p.mu.Unlock()
+		conn.Close()
+		return ErrNotRunning
+	default:
+	}
+	if p.connected >= p.maxPeers || !p.conns.acquire() {
+		p.mu.Unlock()
+		conn.Close()
+		return ErrTooManyPeers
+	}
+	p.connected++
+	p.mu.Unlock()
+
+	go func() {
+		p.serve(conn)
+		p.mu.Lock()
+		p.connected--
+		p.conns.release()
+		p.notify()
+		p.mu.Unlock()
+	}()
+	return nil
+}
+
+// 是否还有之后可能连接上的peer，包括等待重连和正在建立连接的，所有peer都放弃后还在等待新peer时也算
+func (p *PeerPool) waiting() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.giveUp != nil {
+		return true
+	}
+	for _, pp := range p.order {
+		if pp.state == peerIdle || pp.state == peerConnecting {
+			return true
+		}
+	}
+	return false
+}
+
+// Exhausted 所有peer都已经放弃并且等待NoPeersTimeout后还没有新的peer时关闭，之后加入新的peer时会换成新的通道
+func (p *PeerPool) Exhausted() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.exhausted
+}
+
+// Close 停止发起新的连接，已经建立的连接由serve自己结束
+func (p *PeerPool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.mu.Lock()
+		p.stopGiveUp()
+		p.mu.Unlock()
+	})
+}
+
+func (p *PeerPool) run() {
+	for {
+		var retry <-chan time.Time
+		var timer *time.Timer
+		if wait := p.fill(); wait > 0 {
+			timer = time.NewTimer(wait)
+			retry = timer.C
+		}
+		select {
+		case <-p.wake:
+		case <-retry:
+		case <-p.closed:
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// 连接等待中的peer，直到达到连接数上限，返回下一个peer可以重连前还要等待的时间
+func (p *PeerPool) fill() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var wait time.Duration
+	for _, pp := range p.order {
+		if p.connected+p.halfOpen >= p.maxPeers || p.halfOpen >= p.maxHalfOpen {
+			// 有连接结束时会被唤醒
+			return 0
+		}
+		if pp.state != peerIdle {
+			continue
+		}
+		if d := pp.next.Sub(now); d > 0 {
+			if wait == 0 || d < wait {
+				wait = d
+			}
+			continue
+		}
+		// 达到全局连接数上限，其他任务的连接结束时不会唤醒这里，稍后再试
+		if !p.conns.acquire() {
+			return connLimitRetry
+		}
+		pp.state = peerConnecting
+		p.halfOpen++
+		go p.dial(pp)
+	}
+	return wait
+}
+
+func (p *PeerPool) dial(pp *poolPeer) {
+	conn, err := p.connect(pp.info)
+	p.mu.Lock()
+	p.halfOpen--
+	if err != nil {
+		p.conns.release()
+		p.release(pp, err)
+		p.mu.Unlock()
+		return
+	}
+	select {
+	case <-p.closed:
+		p.conns.release()
+		pp.state = peerIdle
+		p.mu.Unlock()
+		conn.Close()
+		return
+	default:
+	}
+	pp.state = peerConnected
+	p.connected++
+	// 空出了一个建立中的名额
+	p.notify()
+	p.mu.Unlock()
+
+	err = p.serve(conn)
+	p.mu.Lock()
+	p.connected--
+	p.conns.release()
+	if conn.verifiedPieces() > 0 {
+		pp.failures = 0
+	}
+	p.release(pp, err)
+	p.mu.Unlock()
+}
+
+// 连接结束后决定是否重连，需要持有锁
+func (p *PeerPool) release(pp *poolPeer, err error) {
+	defer p.notify()
+	defer p.checkExhausted()
+	if err == nil || errors.Is(err, ErrSelfConnect) || errors.Is(err, ErrPeerIDMismatch) || errors.Is(err, ErrDuplicatePeer) || errors.Is(err, ErrBannedPeer) || errors.Is(err, ErrBlockedIP) {
+		pp.state = peerDropped
+		return
+	}
+	pp.failures++
+	if pp.failures >= p.maxFailures {
+		log.Printf("drop peer after %d failures, peer = [%s], err = [%v]\n", pp.failures, pp.info.Addr(), err)
+		pp.state = peerDropped
+		return
+	}
+	pp.state = peerIdle
+	pp.next = time.Now().Add(p.backoff(pp.failures))
+}
+
+// connLimit 连接数上限，建立中的连接也算在内
+type connLimit struct {
+	mu  sync.Mutex
+	max int
+	n   int
+}
+
+// 达到上限时多久之后重试
+const connLimitRetry = time.Second
+
+func newConnLimit(max int) *connLimit {
+	return &connLimit{max: max}
+}
+
+func (l *connLimit) acquire() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.n >= l.max {
+		return false
+	}
+	l.n++
+	return true
+}
+
+func (l *connLimit) release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.n--
+}
+
+func (l *connLimit) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.n
+}
+
+// 第n次失败后的重连等待时间
+func (p *PeerPool) backoff(failures int) time.Duration {
+	d := p.delay
+	for i := 1; i < failures && d < p.maxDelay; i++ {
+		d *= 2
+	}
+	if d > p.maxDelay {
+		d = p.maxDelay
+	}
+	return d
+}
+
+// 所有peer都放弃后开始计时，等待期间有新的peer加入时停止计时，需要持有锁
+func (p *PeerPool) checkExhausted() {
+	for _, pp := range p.order {
+		if pp.state != peerDropped {
+			p.stopGiveUp()
+			return
+		}
+	}
+	if p.giveUp != nil || p.isExhausted() {
+		return
+	}
+	if p.noPeers <= 0 {
+		close(p.exhausted)
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(p.noPeers, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		// 已经被停止或者换成了新的计时
+		if p.giveUp != timer {
+			return
+		}
+		p.giveUp = nil
+		close(p.exhausted)
+	})
+	p.giveUp = timer
+}
+
+// 需要持有锁
+func (p *PeerPool) stopGiveUp() {
+	if p.giveUp != nil {
+		p.giveUp.Stop()
+		p.giveUp = nil
+	}
+}
+
+// 需要持有锁
+func (p *PeerPool) isExhausted() bool {
+	select {
+	case <-p.exhausted:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *PeerPool) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,428 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setPoolConfig(maxPeers, halfOpen, failures int, delay time.Duration) func() {
+	save := []interface{}{MaxPeers, MaxHalfOpen, MaxPeerFailures, ReconnectDelay}
+	MaxPeers, MaxHalfOpen, MaxPeerFailures, ReconnectDelay = maxPeers, halfOpen, failures, delay
+	return func() {
+		MaxPeers, MaxHalfOpen, MaxPeerFailures = save[0].(int), save[1].(int), save[2].(int)
+		ReconnectDelay = save[3].(time.Duration)
+	}
+}
+
+// 所有peer都放弃后等待新peer的时间，为0时马上关闭Exhausted()
+func setNoPeersTimeout(d time.Duration) func() {
+	save := NoPeersTimeout
+	NoPeersTimeout = d
+	return func() { NoPeersTimeout = save }
+}
+
+func testPeer(i int) PeerInfo {
+	return PeerInfo{IP: net.IPv4(10, 0, 0, byte(i)), Port: 6881}
+}
+
+func TestPeerPoolBackoff(t *testing.T) {
+	p := &PeerPool{delay: time.Second, maxDelay: 10 * time.Second}
+	assert.Equal(t, time.Second, p.backoff(1))
+	assert.Equal(t, 2*time.Second, p.backoff(2))
+	assert.Equal(t, 8*time.Second, p.backoff(4))
+	assert.Equal(t, 10*time.Second, p.backoff(5))
+	assert.Equal(t, 10*time.Second, p.backoff(100))
+}
+
+func TestPeerPoolExhausted(t *testing.T) {
+	defer setPoolConfig(30, 8, 3, 10*time.Millisecond)()
+	defer setNoPeersTimeout(0)()
+	var mu sync.Mutex
+	attempts := make(map[string][]time.Time)
+	pool := NewPeerPool(func(peer PeerInfo) (*PeerConn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[peer.Addr()] = append(attempts[peer.Addr()], time.Now())
+		return nil, ErrConnClosed
+	}, nil)
+	defer pool.Close()
+	assert.Equal(t, 2, pool.Add(testPeer(1), testPeer(2), testPeer(1)))
+
+	select {
+	case <-pool.Exhausted():
+	case <-time.After(5 * time.Second):
+		t.Fatal("pool not exhausted")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for addr, times := range attempts {
+		assert.Equal(t, 3, len(times), addr)
+		// 第二次重连的等待时间是第一次的两倍
+		assert.Equal(t, true, times[2].Sub(times[1]) >= 20*time.Millisecond, addr)
+	}
+	assert.Equal(t, 2, len(attempts))
+}
+
+func TestPeerPoolEmpty(t *testing.T) {
+	defer setNoPeersTimeout(0)()
+	pool := NewPeerPool(nil, nil)
+	defer pool.Close()
+	pool.Add()
+	select {
+	case <-pool.Exhausted():
+	default:
+		t.Fatal("empty pool should be exhausted")
+	}
+}
+
+func TestPeerPoolRevive(t *testing.T) {
+	defer setPoolConfig(30, 8, 1, time.Hour)()
+	defer setNoPeersTimeout(50 * time.Millisecond)()
+	pool := NewPeerPool(func(peer PeerInfo) (*PeerConn, error) {
+		return nil, ErrConnClosed
+	}, nil)
+	defer pool.Close()
+	waitExhausted := func(ch <-chan struct{}) {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatal("pool not exhausted")
+		}
+	}
+	start := time.Now()
+	pool.Add(testPeer(1))
+	// 所有peer都放弃之后还要等待一段时间
+	waitExhausted(pool.Exhausted())
+	assert.Equal(t, true, time.Since(start) >= 50*time.Millisecond)
+	assert.Equal(t, false, pool.waiting())
+
+	// 放弃所有peer之后加入新的peer，换成新的通道
+	pool.Add(testPeer(2))
+	exhausted := pool.Exhausted()
+	select {
+	case <-exhausted:
+		t.Fatal("pool exhausted after adding a new peer")
+	default:
+	}
+	waitExhausted(exhausted)
+
+	// 等待期间加入新的peer，不会关闭通道
+	pool.Add(testPeer(3))
+	exhausted = pool.Exhausted()
+	time.Sleep(20 * time.Millisecond)
+	pool.Add(testPeer(4))
+	time.Sleep(40 * time.Millisecond)
+	select {
+	case <-exhausted:
+		t.Fatal("pool exhausted while waiting for new peers")
+	default:
+	}
+	waitExhausted(exhausted)
+}
+
+func TestPeerPoolLimits(t *testing.T) {
+	defer setPoolConfig(4, 2, 3, time.Hour)()
+	var mu sync.Mutex
+	dialing, maxDialing := 0, 0
+	release := make(chan struct{})
+	stop := make(chan struct{})
+	pool := NewPeerPool(func(peer PeerInfo) (*PeerConn, error) {
+		mu.Lock()
+		dialing++
+		if dialing > maxDialing {
+			maxDialing = dialing
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		dialing--
+		mu.Unlock()
+		local, remote := net.Pipe()
+		go func() {
+			<-stop
+			remote.Close()
+		}()
+		return newPeerConn(local, peer, [SHALEN]byte{}, [IDLen]byte{}, testPieces, false), nil
+	}, func(conn *PeerConn) error {
+		<-conn.Msgs()
+		conn.Close()
+		return conn.Err()
+	})
+	defer pool.Close()
+	for i := 1; i <= 10; i++ {
+		pool.Add(testPeer(i))
+	}
+	waitDialing := func(n int) {
+		for i := 0; i < 100; i++ {
+			mu.Lock()
+			d := dialing
+			mu.Unlock()
+			if d == n {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	// 每次只有两个连接在建立中
+	for i := 0; i < 4; i++ {
+		waitDialing(2)
+		release <- struct{}{}
+	}
+	for i := 0; i < 100 && pool.Connected() < 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 4, pool.Connected())
+	mu.Lock()
+	assert.Equal(t, 2, maxDialing)
+	mu.Unlock()
+	// 已经达到连接数上限，不会再发起新的连接
+	select {
+	case release <- struct{}{}:
+		t.Fatal("dial beyond max peers")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(stop)
+}
+
+// 按请求返回多个分片的数据
+func pieceSeeder(remote *PeerConn, data []byte, pieceLen int, bitfield []byte) {
+	remote.WriteMsg(&PeerMsg{MsgBitfield, bitfield})
+	remote.WriteMsg(&PeerMsg{MsgUnchoke, nil})
+	for {
+		msg, err := remote.ReadMsg()
+		if err != nil {
+			return
+		}
+		if msg == nil || msg.ID != MsgRequest {
+			continue
+		}
+		req := &Request{}
+		req.UnmarshalBinary(msg.Payload)
+		begin := int(req.Index)*pieceLen + int(req.Begin)
+		piece, _ := NewMsg(&Piece{Index: req.Index, Begin: req.Begin, Block: data[begin : begin+int(req.Length)]})
+		remote.WriteMsg(piece)
+	}
+}
+
+func newTestTask(t *testing.T, data []byte, pieceLen int) *TorrentTask {
+	task := &TorrentTask{
+		PeerID:   NewPeerID(),
+		InfoSHA:  [SHALEN]byte{3},
+		FileName: filepath.Join(t.TempDir(), "out"),
+		FileLen:  len(data),
+		PieceLen: pieceLen,
+	}
+	for i := 0; i*pieceLen < len(data); i++ {
+		begin, end := task.getPieceBounds(i)
+		task.PieceSHA = append(task.PieceSHA, sha1.Sum(data[begin:end]))
+	}
+	return task
+}
+
+// 在addr上监听，对每个连接按请求返回data中的数据
+func listenSeeder(t *testing.T, addr string, infoSHA [SHALEN]byte, data []byte, pieceLen int) PeerInfo {
+	return listenPartialSeeder(t, addr, infoSHA, data, pieceLen, []byte{0xff, 0xff})
+}
+
+// 只拥有bitfield中的分片
+func listenPartialSeeder(t *testing.T, addr string, infoSHA [SHALEN]byte, data []byte, pieceLen int, bitfield []byte) PeerInfo {
+	return listenTestPeer(t, addr, infoSHA, func(remote *PeerConn) {
+		pieceSeeder(remote, data, pieceLen, bitfield)
+	})
+}
+
+// 监听addr，完成握手后用serve处理每个连接
+func listenTestPeer(t *testing.T, addr string, infoSHA [SHALEN]byte, serve func(remote *PeerConn)) PeerInfo {
+	ln, err := net.Listen("tcp", addr)
+	assert.Equal(t, nil, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c, err := mseAccept(conn, [][SHALEN]byte{infoSHA}, Encryption)
+			if err == nil {
+				_, err = acceptHandshake(c, infoSHA, NewPeerID())
+			}
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go serve(&PeerConn{Conn: c})
+		}
+	}()
+	tcp := ln.Addr().(*net.TCPAddr)
+	return PeerInfo{IP: tcp.IP, Port: uint16(tcp.Port)}
+}
+
+func TestDownloadReconnect(t *testing.T) {
+	defer setPoolConfig(30, 8, 3, 10*time.Millisecond)()
+	const pieceLen = 1024
+	data := make([]byte, testPieces*pieceLen-100)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	task := newTestTask(t, data, pieceLen)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer ln.Close()
+	go func() {
+		for n := 0; ; n++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// 第一次连接直接断开，之后正常提供数据
+			if n == 0 {
+				conn.Close()
+				continue
+			}
+			c, err := mseAccept(conn, [][SHALEN]byte{task.InfoSHA}, Encryption)
+			if err == nil {
+				_, err = acceptHandshake(c, task.InfoSHA, NewPeerID())
+			}
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go pieceSeeder(&PeerConn{Conn: c}, data, pieceLen, []byte{0xff, 0xff})
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	task.AddPeers(PeerInfo{IP: addr.IP, Port: uint16(addr.Port)})
+	assert.Equal(t, nil, Download(task))
+	got, err := os.ReadFile(task.FileName)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, bytes.Equal(data, got))
+}
+
+func TestDownloadNoPeers(t *testing.T) {
+	defer setPoolConfig(30, 8, 2, 10*time.Millisecond)()
+	defer setNoPeersTimeout(0)()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	addr := ln.Addr().(*net.TCPAddr)
+	// 关闭监听，所有连接都会失败
+	ln.Close()
+	task := &TorrentTask{
+		PeerID:   NewPeerID(),
+		PeerList: []PeerInfo{{IP: addr.IP, Port: uint16(addr.Port)}},
+		FileName: filepath.Join(t.TempDir(), "out"),
+		FileLen:  10,
+		PieceLen: 10,
+		PieceSHA: make([][SHALEN]byte, 1),
+	}
+	err = Download(task)
+	assert.Equal(t, true, errors.Is(err, ErrNoPeers))
+
+	task.PeerList = nil
+	task.pool = nil
+	err = Download(task)
+	assert.Equal(t, true, errors.Is(err, ErrNoPeers))
+}
+
+func TestDownloadExistingFile(t *testing.T) {
+	const pieceLen = 1024
+	data := testData(testPieces*pieceLen, 29)
+	task := newTestTask(t, data, pieceLen)
+	// 文件中前一半是上一次下载校验通过的分片，后面是不完整的内容
+	existing := append([]byte(nil), data[:len(data)/2]...)
+	existing = append(existing, bytes.Repeat([]byte{0xee}, pieceLen+10)...)
+	assert.Equal(t, nil, os.WriteFile(task.FileName, existing, 0644))
+
+	// peer只有后一半，文件中的分片不会被清空，也不需要重新下载
+	task.PeerList = []PeerInfo{listenPartialSeeder(t, "127.0.0.1:0", task.InfoSHA, data, pieceLen, []byte{0x00, 0xff})}
+	assert.Equal(t, nil, Download(task))
+	got, err := os.ReadFile(task.FileName)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, bytes.Equal(data, got))
+}
+
+func TestDownloadNoProgress(t *testing.T) {
+	defer setPoolConfig(30, 8, 3, 10*time.Millisecond)()
+	defer setNoPeersTimeout(0)()
+	const pieceLen = 1024
+	data := testData(testPieces*pieceLen, 17)
+
+	// 握手成功但是每次收到请求都断开，失败次数不会因为握手成功而清零
+	task := newTestTask(t, data, pieceLen)
+	var conns int32
+	task.PeerList = []PeerInfo{listenTestPeer(t, "127.0.0.1:0", task.InfoSHA, func(remote *PeerConn) {
+		atomic.AddInt32(&conns, 1)
+		remote.WriteMsg(&PeerMsg{MsgBitfield, []byte{0xff, 0xff}})
+		remote.WriteMsg(&PeerMsg{MsgUnchoke, nil})
+		for {
+			msg, err := remote.ReadMsg()
+			if err != nil || (msg != nil && msg.ID == MsgRequest) {
+				remote.Conn.Close()
+				return
+			}
+		}
+	})}
+	err := Download(task)
+	assert.Equal(t, true, errors.Is(err, ErrNoPeers))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&conns))
+
+	// 连接上的peer没有剩下的分片
+	task = newTestTask(t, data, pieceLen)
+	task.PeerList = []PeerInfo{listenPartialSeeder(t, "127.0.0.1:0", task.InfoSHA, data, pieceLen, []byte{0xff, 0x00})}
+	err = Download(task)
+	assert.Equal(t, true, errors.Is(err, ErrNoPeers))
+	assert.Equal(t, testPieces/2, task.Status().PiecesDone)
+	// 校验通过的分片已经写入文件
+	got, err := os.ReadFile(task.FileName)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, len(data), len(got))
+	assert.Equal(t, true, bytes.Equal(data[:len(data)/2], got[:len(data)/2]))
+}
+
+func TestDownloadPeersAfterExhausted(t *testing.T) {
+	defer setPoolConfig(30, 8, 1, 10*time.Millisecond)()
+	defer setNoPeersTimeout(5 * time.Second)()
+	const pieceLen = 1024
+	data := testData(testPieces*pieceLen, 23)
+	task := newTestTask(t, data, pieceLen)
+	// 第一批peer全部连接失败
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	addr := ln.Addr().(*net.TCPAddr)
+	ln.Close()
+	task.PeerList = []PeerInfo{{IP: addr.IP, Port: uint16(addr.Port)}}
+	errs := make(chan error, 1)
+	go func() { errs <- Download(task) }()
+	dropped := func() bool {
+		task.mu.Lock()
+		pool := task.pool
+		task.mu.Unlock()
+		if pool == nil {
+			return false
+		}
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		return pool.giveUp != nil
+	}
+	for i := 0; i < 100 && !dropped(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, true, dropped())
+
+	// 所有peer都已经放弃之后，重新announce得到的peer仍然可以继续下载
+	task.AddPeers(listenSeeder(t, "127.0.0.1:0", task.InfoSHA, data, pieceLen))
+	assert.Equal(t, nil, <-errs)
+	got, err := os.ReadFile(task.FileName)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, bytes.Equal(data, got))
+}
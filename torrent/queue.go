@@ -0,0 +1,371 @@
+package torrent
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/Ryan-ovo/go-bittorrent/bencode"
+)
+
+var (
+	MaxActiveDownloads = 5           // Client同时下载的任务数，0表示不限制
+	MaxActiveSeeds     = 5           // Client同时做种的任务数，0表示不限制
+	StallTimeout       = time.Minute // 下载中的任务超过这么久没有任何peer连接就算停滞，不再占用名额
+)
+
+// 检查停滞任务的间隔
+const queueCheckInterval = time.Second
+
+// QueueState 任务在下载队列中的状态
+type QueueState int
+
+const (
+	StateQueued      QueueState = iota // 等待空闲名额
+	StateDownloading                   // 正在下载
+	StateStalled                       // 正在下载但是没有peer，不占用名额，有peer并且有空闲名额时恢复成StateDownloading
+	StatePaused                        // 被暂停，不会自动开始
+	StateCompleted                     // 下载完成
+	StateFailed                        // 下载失败，Resume后重新排队
+	StateSeeding                       // 下载完成后继续上传，不占用下载名额，停止做种后变成StateCompleted
+)
+
+func (s QueueState) String() string {
+	switch s {
+	case StateQueued:
+		return "queued"
+	case StateDownloading:
+		return "downloading"
+	case StateStalled:
+		return "stalled"
+	case StatePaused:
+		return "paused"
+	case StateCompleted:
+		return "completed"
+	case StateFailed:
+		return "failed"
+	case StateSeeding:
+		return "seeding"
+	}
+	return fmt.Sprintf("QueueState(%d)", int(s))
+}
+
+// QueueItem 队列中一个任务的信息
+type QueueItem struct {
+	InfoSHA  [SHALEN]byte
+	FileName string
+	State    QueueState
+	Priority int
+}
+
+// 下载队列
+/*
+1. 队列按优先级从高到低排列，相同优先级按加入的顺序，可以用MoveUp和MoveDown在相同优先级内调整
+2. 按队列顺序开始等待中的任务，直到正在下载的任务数达到上限，已经开始的任务不会被优先级更高的任务抢占
+3. 任务结束、暂停、移除或者停滞时，马上开始下一个等待中的任务
+4. 下载完成的任务有空闲的做种名额时直接开始做种，否则变成完成状态，之后有空闲名额时按队列顺序开始做种，
+   做种的任务只占用做种名额，下载数和做种数分别有上限
+5. 调用LoadQueue后，队列的变化都会保存到文件中，下次启动时恢复，没有完成的任务会重新开始下载，先校验文件中已有的分片，校验通过的不再下载，做种的任务保存成完成状态
+*/
+
+// Queue 按队列顺序返回所有任务的状态
+func (c *Client) Queue() []QueueItem {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	items := make([]QueueItem, 0, len(c.order))
+	for _, ct := range c.order {
+		items = append(items, QueueItem{
+			InfoSHA:  ct.task.InfoSHA,
+			FileName: ct.task.FileName,
+			State:    ct.state,
+			Priority: ct.priority,
+		})
+	}
+	return items
+}
+
+// SetMaxActive 调整同时下载的任务数，0表示不限制，超出上限时不会停止已经开始的任务
+func (c *Client) SetMaxActive(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxActive = n
+	c.schedule()
+}
+
+// SetMaxSeeds 调整同时做种的任务数，0表示不限制，超出上限时不会停止已经开始做种的任务
+func (c *Client) SetMaxSeeds(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxSeeds = n
+	c.schedule()
+}
+
+// SetPriority 调整任务的优先级，任务移动到新优先级的最后
+func (c *Client) SetPriority(infoSHA [SHALEN]byte, priority int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ct, ok := c.tasks[infoSHA]
+	if !ok {
+		return ErrUnknownTorrent
+	}
+	if ct.priority == priority {
+		return nil
+	}
+	ct.priority = priority
+	c.order = append(removeTask(c.order, ct), ct)
+	c.sortQueue()
+	c.schedule()
+	c.save()
+	return nil
+}
+
+// MoveUp 和前一个相同优先级的任务交换位置，已经在最前面时什么也不做
+func (c *Client) MoveUp(infoSHA [SHALEN]byte) error {
+	return c.move(infoSHA, -1)
+}
+
+// MoveDown 和后一个相同优先级的任务交换位置，已经在最后面时什么也不做
+func (c *Client) MoveDown(infoSHA [SHALEN]byte) error {
+	return c.move(infoSHA, 1)
+}
+
+func (c *Client) move(infoSHA [SHALEN]byte, step int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ct, ok := c.tasks[infoSHA]
+	if !ok {
+		return ErrUnknownTorrent
+	}
+	i := indexTask(c.order, ct)
+	j := i + step
+	if j < 0 || j >= len(c.order) || c.order[j].priority != ct.priority {
+		return nil
+	}
+	c.order[i], c.order[j] = c.order[j], c.order[i]
+	c.schedule()
+	c.save()
+	return nil
+}
+
+// 按优先级排序，相同优先级保持原来的顺序，需要持有锁
+func (c *Client) sortQueue() {
+	sort.SliceStable(c.order, func(i, j int) bool {
+		return c.order[i].priority > c.order[j].priority
+	})
+}
+
+func indexTask(order []*clientTask, ct *clientTask) int {
+	for i, t := range order {
+		if t == ct {
+			return i
+		}
+	}
+	return -1
+}
+
+func removeTask(order []*clientTask, ct *clientTask) []*clientTask {
+	if i := indexTask(order, ct); i >= 0 {
+		return append(order[:i], order[i+1:]...)
+	}
+	return order
+}
+
+// 按队列顺序开始等待中的任务和完成的任务的做种，直到分别达到上限，需要持有锁
+func (c *Client) schedule() {
+	if c.closed {
+		return
+	}
+	c.startAll(StateQueued, StateDownloading, c.maxActive)
+	c.startAll(StateCompleted, StateSeeding, c.maxSeeds)
+}
+
+// 把from状态的任务按队列顺序开始成to状态，直到to状态的任务数达到max，需要持有锁
+func (c *Client) startAll(from, to QueueState, max int) {
+	active := c.count(to)
+	for _, ct := range c.order {
+		if max > 0 && active >= max {
+			return
+		}
+		if ct.state != from {
+			continue
+		}
+		// 上一次下载还没有完全退出，结束后会再次调度
+		if err := c.start(ct, to); err != nil {
+			continue
+		}
+		active++
+	}
+}
+
+// 处于state的任务数，需要持有锁
+func (c *Client) count(state QueueState) int {
+	n := 0
+	for _, ct := range c.order {
+		if ct.state == state {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *Client) queueLoop() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(queueCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.checkStalled()
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// 更新下载中的任务是否停滞，停滞的任务空出的名额给下一个任务
+// 停滞的任务重新有peer时，名额已经被其他任务占满就停止下载重新排队，有空闲名额时再开始
+func (c *Client) checkStalled() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	active := c.count(StateDownloading)
+	for _, ct := range c.order {
+		if ct.state != StateDownloading && ct.state != StateStalled {
+			continue
+		}
+		switch {
+		case ct.task.Status().ConnectedPeers > 0:
+			ct.lastPeer = now
+			if ct.state == StateDownloading {
+				break
+			}
+			if c.maxActive > 0 && active >= c.maxActive {
+				// 下载结束后回到等待状态，见start
+				ct.state = StateQueued
+				ct.task.Stop()
+				break
+			}
+			ct.state = StateDownloading
+			active++
+		case ct.state == StateDownloading && now.Sub(ct.lastPeer) >= c.stallTime:
+			ct.state = StateStalled
+			active--
+		}
+	}
+	c.schedule()
+}
+
+// 队列文件中的一个任务，保存了重新创建任务需要的信息
+type queueRecord struct {
+	InfoSHA     [SHALEN]byte `bencode:"info hash"`
+	Tracker     string       `bencode:"announce,omitempty"`
+	Name        string       `bencode:"name"`
+	Length      int          `bencode:"length"`
+	PieceLength int          `bencode:"piece length"`
+	Pieces      PieceHashes  `bencode:"pieces"`
+	Priority    int          `bencode:"priority"`
+	State       QueueState   `bencode:"state"`
+}
+
+type queueFile struct {
+	Torrents []queueRecord `bencode:"torrents"`
+}
+
+// LoadQueue 从文件恢复下载队列，之后队列的变化都会保存到这个文件中，文件不存在时从空队列开始
+// 返回恢复的任务，已经在Client中的任务会被跳过
+func (c *Client) LoadQueue(path string) ([]*TorrentTask, error) {
+	var saved queueFile
+	f, err := os.Open(path)
+	if err == nil {
+		err = bencode.Unmarshal(f, &saved)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var tasks []*TorrentTask
+	for _, r := range saved.Torrents {
+		task := &TorrentTask{
+			Tracker:  r.Tracker,
+			InfoSHA:  r.InfoSHA,
+			FileName: r.Name,
+			FileLen:  r.Length,
+			PieceLen: r.PieceLength,
+			PieceSHA: r.Pieces,
+		}
+		state := r.State
+		// 只有完成的文件还在时才保持完成状态
+		if state == StateCompleted {
+			if _, err := os.Stat(task.FileName); err == nil {
+				task.markCompleted()
+			} else {
+				state = StateQueued
+			}
+		}
+		if state != StatePaused && state != StateCompleted {
+			state = StateQueued
+		}
+		if err := c.add(task, r.Priority, state); err != nil {
+			if err == ErrTorrentExists {
+				continue
+			}
+			return tasks, err
+		}
+		tasks = append(tasks, task)
+	}
+	c.queueFile = path
+	c.schedule()
+	c.save()
+	return tasks, nil
+}
+
+// 把队列写入文件，先写临时文件再替换，需要持有锁
+func (c *Client) save() {
+	if c.queueFile == "" {
+		return
+	}
+	var saved queueFile
+	for _, ct := range c.order {
+		t := ct.task
+		state := ct.state
+		switch state {
+		case StatePaused, StateCompleted:
+		case StateSeeding:
+			state = StateCompleted
+		default:
+			state = StateQueued
+		}
+		saved.Torrents = append(saved.Torrents, queueRecord{
+			InfoSHA:     t.InfoSHA,
+			Tracker:     t.Tracker,
+			Name:        t.FileName,
+			Length:      t.FileLen,
+			PieceLength: t.PieceLen,
+			Pieces:      t.PieceSHA,
+			Priority:    ct.priority,
+			State:       state,
+		})
+	}
+	tmp := c.queueFile + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		log.Println("save queue error = ", err)
+		return
+	}
+	err = bencode.NewEncoder(f).Encode(&saved)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, c.queueFile)
+	}
+	if err != nil {
+		log.Println("save queue error = ", err)
+	}
+}
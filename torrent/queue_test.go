@@ -0,0 +1,237 @@
+package torrent
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 没有peer的任务，开始后一直处于下载中
+func idleTask(t *testing.T, id byte) *TorrentTask {
+	task := newTestTask(t, testData(testPieces*1024, id), 1024)
+	task.InfoSHA = [SHALEN]byte{id}
+	return task
+}
+
+func queueStates(c *Client) map[[SHALEN]byte]QueueState {
+	states := make(map[[SHALEN]byte]QueueState)
+	for _, item := range c.Queue() {
+		states[item.InfoSHA] = item.State
+	}
+	return states
+}
+
+func queueOrder(c *Client) []byte {
+	var order []byte
+	for _, item := range c.Queue() {
+		order = append(order, item.InfoSHA[0])
+	}
+	return order
+}
+
+func waitState(t *testing.T, c *Client, infoSHA [SHALEN]byte, state QueueState) {
+	for i := 0; i < 300; i++ {
+		if queueStates(c)[infoSHA] == state {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("task %x not %s, got %s", infoSHA[0], state, queueStates(c)[infoSHA])
+}
+
+func TestQueueSchedule(t *testing.T) {
+	c := newTestClient(t)
+	c.SetMaxActive(1)
+	a, b, d := idleTask(t, 1), idleTask(t, 2), idleTask(t, 3)
+	assert.Equal(t, nil, c.Add(a))
+	assert.Equal(t, nil, c.Add(b))
+	assert.Equal(t, nil, c.AddWithPriority(d, 5))
+	// 优先级高的排在前面，已经开始的任务不会被抢占
+	assert.Equal(t, []byte{3, 1, 2}, queueOrder(c))
+	assert.Equal(t, map[[SHALEN]byte]QueueState{
+		a.InfoSHA: StateDownloading,
+		b.InfoSHA: StateQueued,
+		d.InfoSHA: StateQueued,
+	}, queueStates(c))
+
+	// 暂停后开始队列中的下一个
+	assert.Equal(t, nil, c.Pause(a.InfoSHA))
+	assert.Equal(t, StatePaused, queueStates(c)[a.InfoSHA])
+	assert.Equal(t, StateDownloading, queueStates(c)[d.InfoSHA])
+	assert.Equal(t, ErrStopped, c.Wait(a.InfoSHA))
+
+	// 只能在相同优先级内移动
+	assert.Equal(t, nil, c.MoveUp(b.InfoSHA))
+	assert.Equal(t, []byte{3, 2, 1}, queueOrder(c))
+	assert.Equal(t, nil, c.MoveUp(b.InfoSHA))
+	assert.Equal(t, []byte{3, 2, 1}, queueOrder(c))
+	assert.Equal(t, nil, c.MoveDown(d.InfoSHA))
+	assert.Equal(t, []byte{3, 2, 1}, queueOrder(c))
+	assert.Equal(t, nil, c.SetPriority(a.InfoSHA, 9))
+	assert.Equal(t, []byte{1, 3, 2}, queueOrder(c))
+	assert.Equal(t, ErrUnknownTorrent, c.MoveUp([SHALEN]byte{99}))
+
+	// 移除后开始下一个
+	assert.Equal(t, nil, c.Remove(d.InfoSHA))
+	assert.Equal(t, StateDownloading, queueStates(c)[b.InfoSHA])
+	assert.Equal(t, nil, c.Resume(a.InfoSHA))
+	assert.Equal(t, StateQueued, queueStates(c)[a.InfoSHA])
+	c.SetMaxActive(2)
+	assert.Equal(t, StateDownloading, queueStates(c)[a.InfoSHA])
+}
+
+func TestQueueStalled(t *testing.T) {
+	defer func(d time.Duration) { StallTimeout = d }(StallTimeout)
+	StallTimeout = 50 * time.Millisecond
+	const pieceLen = 1024
+	c := newTestClient(t)
+	c.SetMaxActive(1)
+	stalled := idleTask(t, 1)
+	assert.Equal(t, nil, c.Add(stalled))
+	data := testData(testPieces*pieceLen, 9)
+	task := newTestTask(t, data, pieceLen)
+	task.PeerList = []PeerInfo{listenSeeder(t, "127.0.0.1:0", task.InfoSHA, data, pieceLen)}
+	assert.Equal(t, nil, c.Add(task))
+	assert.Equal(t, StateQueued, queueStates(c)[task.InfoSHA])
+
+	// 没有peer的任务不再占用名额
+	waitState(t, c, stalled.InfoSHA, StateStalled)
+	assert.Equal(t, nil, c.Wait(task.InfoSHA))
+	assert.Equal(t, StateStalled, queueStates(c)[stalled.InfoSHA])
+
+	// 有peer连接后恢复下载
+	dialSeeder(t, c.Addr().String(), stalled.InfoSHA, testData(testPieces*1024, 1), 1024)
+	assert.Equal(t, nil, c.Wait(stalled.InfoSHA))
+}
+
+func TestQueueStalledLimit(t *testing.T) {
+	defer func(d time.Duration) { StallTimeout = d }(StallTimeout)
+	StallTimeout = 50 * time.Millisecond
+	c := newTestClient(t)
+	c.SetMaxActive(1)
+	stalled, next := idleTask(t, 1), idleTask(t, 2)
+	assert.Equal(t, nil, c.Add(stalled))
+	waitState(t, c, stalled.InfoSHA, StateStalled)
+
+	// 停滞的任务空出名额，下一个任务有peer连接，一直处于下载中
+	assert.Equal(t, nil, c.Add(next))
+	waitState(t, c, next.InfoSHA, StateDownloading)
+	waitRunning(t, next)
+	dialSeeder(t, c.Addr().String(), next.InfoSHA, nil, 0)
+
+	// 停滞的任务重新有peer，但是名额已经被占用，重新排队
+	waitRunning(t, stalled)
+	dialSeeder(t, c.Addr().String(), stalled.InfoSHA, nil, 0)
+	waitState(t, c, stalled.InfoSHA, StateQueued)
+	assert.Equal(t, StateDownloading, queueStates(c)[next.InfoSHA])
+
+	// 有空闲名额后重新开始
+	assert.Equal(t, nil, c.Pause(next.InfoSHA))
+	waitState(t, c, stalled.InfoSHA, StateDownloading)
+}
+
+func TestQueueSeeding(t *testing.T) {
+	const pieceLen = 1024
+	c := newTestClient(t)
+	c.SetMaxActive(1)
+	c.SetMaxSeeds(1)
+	var tasks []*TorrentTask
+	var datas [][]byte
+	for i := 0; i < 2; i++ {
+		data := testData(testPieces*pieceLen, byte(i+5))
+		task := newTestTask(t, data, pieceLen)
+		task.InfoSHA = [SHALEN]byte{byte(i + 20)}
+		task.PeerList = []PeerInfo{listenSeeder(t, "127.0.0.1:0", task.InfoSHA, data, pieceLen)}
+		assert.Equal(t, nil, c.Add(task))
+		tasks = append(tasks, task)
+		datas = append(datas, data)
+	}
+	// 做种的任务不占用下载名额，做种名额满了之后完成的任务不做种
+	a, b := tasks[0].InfoSHA, tasks[1].InfoSHA
+	assert.Equal(t, nil, c.Wait(a))
+	assert.Equal(t, nil, c.Wait(b))
+	waitState(t, c, b, StateCompleted)
+	assert.Equal(t, StateSeeding, queueStates(c)[a])
+
+	// 另一个客户端从做种的任务下载
+	leecher := newTestClient(t)
+	task := newTestTask(t, datas[0], pieceLen)
+	task.InfoSHA = a
+	task.PeerList = []PeerInfo{{IP: net.IPv4(127, 0, 0, 1), Port: uint16(c.Port())}}
+	assert.Equal(t, nil, leecher.Add(task))
+	assert.Equal(t, nil, leecher.Wait(a))
+	got, err := os.ReadFile(task.FileName)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, bytes.Equal(datas[0], got))
+	assert.Equal(t, true, tasks[0].Status().UploadRate > 0)
+
+	// 暂停做种的任务后，空出的名额给完成的任务
+	assert.Equal(t, nil, c.Pause(a))
+	waitState(t, c, b, StateSeeding)
+	assert.Equal(t, StatePaused, queueStates(c)[a])
+}
+
+func TestQueuePersist(t *testing.T) {
+	const pieceLen = 1024
+	path := filepath.Join(t.TempDir(), "queue")
+	c := newTestClient(t)
+	tasks, err := c.LoadQueue(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(tasks))
+
+	data := testData(testPieces*pieceLen, 4)
+	done := newTestTask(t, data, pieceLen)
+	done.Tracker = "http://tracker.example/announce"
+	done.PeerList = []PeerInfo{listenSeeder(t, "127.0.0.1:0", done.InfoSHA, data, pieceLen)}
+	paused, queued := idleTask(t, 1), idleTask(t, 2)
+	assert.Equal(t, nil, c.Add(done))
+	assert.Equal(t, nil, c.Add(paused))
+	assert.Equal(t, nil, c.AddWithPriority(queued, 3))
+	assert.Equal(t, nil, c.Wait(done.InfoSHA))
+	assert.Equal(t, nil, c.Pause(paused.InfoSHA))
+	assert.Equal(t, nil, c.Close())
+	// 没有完成的任务的文件中已经有一半分片
+	half := testData(testPieces*1024, 2)[:testPieces*1024/2]
+	assert.Equal(t, nil, os.WriteFile(queued.FileName, half, 0644))
+
+	c = newTestClient(t)
+	tasks, err = c.LoadQueue(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, len(tasks))
+	assert.Equal(t, []byte{2, 3, 1}, queueOrder(c))
+	assert.Equal(t, []QueueItem{
+		{InfoSHA: queued.InfoSHA, FileName: queued.FileName, State: StateDownloading, Priority: 3},
+		{InfoSHA: done.InfoSHA, FileName: done.FileName, State: StateSeeding},
+		{InfoSHA: paused.InfoSHA, FileName: paused.FileName, State: StatePaused},
+	}, c.Queue())
+	restored := c.Get(done.InfoSHA)
+	assert.Equal(t, done.Tracker, restored.Tracker)
+	assert.Equal(t, done.PieceSHA, restored.PieceSHA)
+	assert.Equal(t, testPieces, restored.Status().PiecesDone)
+	assert.Equal(t, nil, c.Wait(done.InfoSHA))
+	// 恢复后校验文件中已有的分片，不会清空文件
+	for i := 0; i < 100 && c.Get(queued.InfoSHA).Status().PiecesDone == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, testPieces/2, c.Get(queued.InfoSHA).Status().PiecesDone)
+	got, err := os.ReadFile(queued.FileName)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, half, got)
+
+	// 完成的文件被删除后重新下载
+	assert.Equal(t, nil, c.Close())
+	os.Remove(done.FileName)
+	c = newTestClient(t)
+	_, err = c.LoadQueue(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, StateDownloading, queueStates(c)[done.InfoSHA])
+
+	os.WriteFile(path, []byte("garbage"), 0644)
+	_, err = newTestClient(t).LoadQueue(path)
+	assert.NotEqual(t, nil, err)
+}
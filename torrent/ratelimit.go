@@ -0,0 +1,176 @@
+package torrent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 全局限速，对所有连接生效，速率单位是字节每秒，0表示不限速
+var (
+	UploadLimiter   = NewLimiter(0)
+	DownloadLimiter = NewLimiter(0)
+)
+
+// Limiter 令牌桶限速器，每秒补充rate个令牌，最多积累一秒的令牌，可以在运行中调整速率
+type Limiter struct {
+	mu      sync.Mutex
+	rate    int
+	tokens  float64
+	last    time.Time
+	changed chan struct{} // 调整速率时关闭，唤醒正在等待的连接
+}
+
+// NewLimiter rate为每秒字节数，0表示不限速
+func NewLimiter(rate int) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		tokens:  float64(rate),
+		last:    time.Now(),
+		changed: make(chan struct{}),
+	}
+}
+
+// SetRate 调整速率，0表示不限速
+func (l *Limiter) SetRate(rate int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate = rate
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *Limiter) Rate() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// 需要持有锁
+func (l *Limiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+}
+
+// WaitN 等待n个字节的令牌，超过一秒的量分多次获取，cancel关闭时返回ErrConnClosed
+func (l *Limiter) WaitN(n int, cancel <-chan struct{}) error {
+	if l == nil {
+		return nil
+	}
+	for n > 0 {
+		l.mu.Lock()
+		if l.rate <= 0 {
+			l.mu.Unlock()
+			return nil
+		}
+		now := time.Now()
+		l.refill(now)
+		take := n
+		if take > l.rate {
+			take = l.rate
+		}
+		if l.tokens >= float64(take) {
+			l.tokens -= float64(take)
+			n -= take
+			l.mu.Unlock()
+			continue
+		}
+		wait := time.Duration((float64(take) - l.tokens) / float64(l.rate) * float64(time.Second))
+		changed := l.changed
+		l.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		case <-cancel:
+			timer.Stop()
+			return ErrConnClosed
+		}
+	}
+	return nil
+}
+
+// 依次从每个限速器获取令牌
+func waitLimiters(limiters []*Limiter, n int, cancel <-chan struct{}) error {
+	for _, l := range limiters {
+		if err := l.WaitN(n, cancel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScheduleRule 一天中某个时间段的限速，Start和End是从0点开始的时间，End小于Start时跨过0点
+type ScheduleRule struct {
+	Start, End time.Duration
+	Upload     int
+	Download   int
+}
+
+// Schedule 按一天中的时间段调整限速，没有匹配的时间段时使用默认速率
+type Schedule struct {
+	Rules    []ScheduleRule
+	Upload   int // 默认上传速率
+	Download int // 默认下载速率
+}
+
+// Rates 某个时刻的上传和下载速率，有多个匹配的时间段时使用第一个
+func (s *Schedule) Rates(t time.Time) (int, int) {
+	day := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	for _, r := range s.Rules {
+		in := day >= r.Start && day < r.End
+		if r.End < r.Start {
+			in = day >= r.Start || day < r.End
+		}
+		if in {
+			return r.Upload, r.Download
+		}
+	}
+	return s.Upload, s.Download
+}
+
+// Run 每分钟按时间表调整up和down的速率，直到stop被关闭
+func (s *Schedule) Run(up, down *Limiter, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		u, d := s.Rates(time.Now())
+		if up.Rate() != u {
+			up.SetRate(u)
+		}
+		if down.Rate() != d {
+			down.SetRate(d)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ParseScheduleRule 解析"01:00-07:00"形式的时间段
+func ParseScheduleRule(span string, upload, download int) (ScheduleRule, error) {
+	var h1, m1, h2, m2 int
+	if _, err := fmt.Sscanf(span, "%d:%d-%d:%d", &h1, &m1, &h2, &m2); err != nil {
+		return ScheduleRule{}, fmt.Errorf("invalid time span %q: %w", span, err)
+	}
+	if h1 < 0 || h1 > 24 || h2 < 0 || h2 > 24 || m1 < 0 || m1 > 59 || m2 < 0 || m2 > 59 {
+		return ScheduleRule{}, fmt.Errorf("invalid time span %q", span)
+	}
+	return ScheduleRule{
+		Start:    time.Duration(h1)*time.Hour + time.Duration(m1)*time.Minute,
+		End:      time.Duration(h2)*time.Hour + time.Duration(m2)*time.Minute,
+		Upload:   upload,
+		Download: download,
+	}, nil
+}
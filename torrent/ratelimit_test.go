@@ -0,0 +1,89 @@
+package torrent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	// 开始时有一秒的令牌，之后按速率补充
+	l := NewLimiter(100000)
+	start := time.Now()
+	assert.Equal(t, nil, l.WaitN(150000, nil))
+	elapsed := time.Since(start)
+	assert.Equal(t, true, elapsed >= 450*time.Millisecond && elapsed < 2*time.Second, elapsed)
+
+	// 调整速率会唤醒等待的连接
+	l.SetRate(10)
+	done := make(chan error, 1)
+	go func() { done <- l.WaitN(1000, nil) }()
+	time.Sleep(20 * time.Millisecond)
+	l.SetRate(0)
+	select {
+	case err := <-done:
+		assert.Equal(t, nil, err)
+	case <-time.After(time.Second):
+		t.Fatal("waiter not woken by SetRate")
+	}
+
+	// 连接关闭时不再等待
+	l.SetRate(10)
+	cancel := make(chan struct{})
+	go func() { done <- l.WaitN(1000, cancel) }()
+	close(cancel)
+	assert.Equal(t, ErrConnClosed, <-done)
+	assert.Equal(t, nil, (*Limiter)(nil).WaitN(1000, nil))
+}
+
+func TestPeerConnRateLimit(t *testing.T) {
+	pc, remote := newTestConn(time.Minute, time.Minute)
+	defer pc.Close()
+	defer remote.Conn.Close()
+	pc.SetLimiters(nil, NewLimiter(50000))
+	block := make([]byte, BLOCKSIZE)
+	start := time.Now()
+	go func() {
+		remote.WriteMsg(&PeerMsg{MsgBitfield, []byte{0xff, 0xff}})
+		for i := 0; i < 4; i++ {
+			remote.ReadMsg()
+			piece, _ := NewMsg(&Piece{Index: 0, Begin: uint32(i * BLOCKSIZE), Block: block})
+			remote.WriteMsg(piece)
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		pc.Send(NewRequestMsg(0, i*BLOCKSIZE, BLOCKSIZE))
+	}
+	for i := 0; i < 5; i++ {
+		_, ok := <-pc.Msgs()
+		assert.Equal(t, true, ok, pc.Err())
+	}
+	// 超过一秒令牌的部分按50000字节每秒读取
+	elapsed := time.Since(start)
+	assert.Equal(t, true, elapsed >= 250*time.Millisecond, elapsed)
+}
+
+func TestSchedule(t *testing.T) {
+	night, err := ParseScheduleRule("23:00-07:00", 0, 0)
+	assert.Equal(t, nil, err)
+	work, err := ParseScheduleRule("09:00-18:00", 10000, 50000)
+	assert.Equal(t, nil, err)
+	s := &Schedule{Rules: []ScheduleRule{night, work}, Upload: 20000, Download: 100000}
+	at := func(h, m int) time.Time {
+		return time.Date(2024, 1, 1, h, m, 0, 0, time.Local)
+	}
+	up, down := s.Rates(at(2, 30))
+	assert.Equal(t, []int{0, 0}, []int{up, down})
+	up, down = s.Rates(at(23, 0))
+	assert.Equal(t, []int{0, 0}, []int{up, down})
+	up, down = s.Rates(at(12, 0))
+	assert.Equal(t, []int{10000, 50000}, []int{up, down})
+	up, down = s.Rates(at(18, 0))
+	assert.Equal(t, []int{20000, 100000}, []int{up, down})
+
+	_, err = ParseScheduleRule("7-9", 0, 0)
+	assert.NotEqual(t, nil, err)
+	_, err = ParseScheduleRule("07:00-25:00", 0, 0)
+	assert.NotEqual(t, nil, err)
+}
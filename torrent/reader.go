@@ -0,0 +1,242 @@
+package torrent
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// DefaultReadahead Reader默认的预读字节数
+var DefaultReadahead int64 = 4 << 20
+
+// Reader 读取任务的内容，实现io.ReadSeeker和io.ReaderAt，可以在下载过程中使用
+/*
+1. 读取还没有校验通过的部分时阻塞，直到对应的分片校验通过，下载失败或者被停止时返回下载的错误
+2. 当前位置开始readahead字节内的分片优先下载，配合SetSequential可以边下载边读取
+3. 校验通过的分片已经写入FileName，内容都从文件中读取，读取的内容不会一直留在内存中
+*/
+type Reader struct {
+	t         *TorrentTask
+	mu        sync.Mutex
+	pos       int64
+	readahead int64
+	file      *os.File // 第一次读取时打开FileName
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewReader 从头开始读取任务的内容，不再使用时需要Close，否则预读窗口中的分片会一直优先下载
+func (t *TorrentTask) NewReader() *Reader {
+	r := &Reader{
+		t:         t,
+		readahead: DefaultReadahead,
+		closed:    make(chan struct{}),
+	}
+	r.updateWindow()
+	return r
+}
+
+// SetReadahead 调整预读的字节数
+func (r *Reader) SetReadahead(n int64) {
+	r.mu.Lock()
+	r.readahead = n
+	r.mu.Unlock()
+	r.updateWindow()
+}
+
+// Read 至少等到当前位置的分片可用，返回当前位置开始连续可用的内容
+func (r *Reader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	r.mu.Lock()
+	pos := r.pos
+	r.mu.Unlock()
+	n, err := r.readAt(p, pos, false)
+	r.mu.Lock()
+	r.pos += int64(n)
+	r.mu.Unlock()
+	r.updateWindow()
+	return n, err
+}
+
+// ReadAt 等到p对应的内容全部可用，不影响Read的位置，读取期间这段内容优先下载
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	key := new(byte)
+	r.t.mu.Lock()
+	picker := r.t.pieces()
+	r.t.mu.Unlock()
+	picker.setWindow(key, r.t.pieceSpan(off, int64(len(p))))
+	defer picker.removeWindow(key)
+	return r.readAt(p, off, true)
+}
+
+// Seek 设置下一次Read的位置，预读窗口随之移动
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	pos := offset
+	switch whence {
+	case io.SeekCurrent:
+		pos += r.pos
+	case io.SeekEnd:
+		pos += int64(r.t.FileLen)
+	case io.SeekStart:
+	default:
+		r.mu.Unlock()
+		return r.pos, ErrBadOffset
+	}
+	if pos < 0 {
+		r.mu.Unlock()
+		return r.pos, ErrBadOffset
+	}
+	r.pos = pos
+	r.mu.Unlock()
+	r.updateWindow()
+	return pos, nil
+}
+
+// Close 取消预读，正在阻塞的读取返回ErrReaderClosed
+func (r *Reader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		r.t.mu.Lock()
+		picker := r.t.pieces()
+		r.t.mu.Unlock()
+		picker.removeWindow(r)
+		r.mu.Lock()
+		if r.file != nil {
+			r.file.Close()
+		}
+		r.mu.Unlock()
+	})
+	return nil
+}
+
+// 把当前位置开始的预读窗口告诉picker
+func (r *Reader) updateWindow() {
+	select {
+	case <-r.closed:
+		return
+	default:
+	}
+	r.mu.Lock()
+	span := r.t.pieceSpan(r.pos, r.readahead)
+	r.mu.Unlock()
+	r.t.mu.Lock()
+	picker := r.t.pieces()
+	r.t.mu.Unlock()
+	picker.setWindow(r, span)
+}
+
+// [off, off+n)覆盖的分片，至少包含off所在的分片
+func (t *TorrentTask) pieceSpan(off, n int64) pieceSpan {
+	if t.PieceLen <= 0 {
+		return pieceSpan{}
+	}
+	first := int(off / int64(t.PieceLen))
+	last := int((off + n + int64(t.PieceLen) - 1) / int64(t.PieceLen))
+	if last <= first {
+		last = first + 1
+	}
+	if last > len(t.PieceSHA) {
+		last = len(t.PieceSHA)
+	}
+	return pieceSpan{first, last}
+}
+
+// 从off开始读取，至少等到第一个字节可用，full为true时等到p全部可用
+func (r *Reader) readAt(p []byte, off int64, full bool) (int, error) {
+	if off < 0 {
+		return 0, ErrBadOffset
+	}
+	if off >= int64(r.t.FileLen) {
+		return 0, io.EOF
+	}
+	want := p
+	if left := int64(r.t.FileLen) - off; int64(len(want)) > left {
+		want = want[:left]
+	}
+	n, err := r.t.waitAvailable(off, len(want), full, r.closed)
+	if err != nil {
+		return 0, err
+	}
+	if err = r.readFile(want[:n], off); err != nil {
+		return 0, err
+	}
+	if n < len(p) && (full || off+int64(n) == int64(r.t.FileLen)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// 从下载的文件中读取已经校验通过的内容
+func (r *Reader) readFile(p []byte, off int64) error {
+	r.mu.Lock()
+	select {
+	case <-r.closed:
+		r.mu.Unlock()
+		return ErrReaderClosed
+	default:
+	}
+	if r.file == nil {
+		file, err := os.Open(r.t.FileName)
+		if err != nil {
+			r.mu.Unlock()
+			return err
+		}
+		r.file = file
+	}
+	file := r.file
+	r.mu.Unlock()
+	_, err := file.ReadAt(p, off)
+	return err
+}
+
+// 等待off开始的n个字节可用，返回连续可用的字节数，至少是1，full为true时等到全部可用
+func (t *TorrentTask) waitAvailable(off int64, n int, full bool, cancel <-chan struct{}) (int, error) {
+	for {
+		t.mu.Lock()
+		// 从队列文件恢复的已完成任务没有have
+		avail := n
+		if t.piecesDone < len(t.PieceSHA) {
+			avail = t.available(off, n)
+		}
+		if avail == n || (!full && avail > 0) {
+			t.mu.Unlock()
+			return avail, nil
+		}
+		if t.done && t.err != nil {
+			err := t.err
+			t.mu.Unlock()
+			return 0, err
+		}
+		verified := t.verifiedCh()
+		t.mu.Unlock()
+		select {
+		case <-verified:
+		case <-cancel:
+			return 0, ErrReaderClosed
+		}
+	}
+}
+
+// off开始最多n个字节中连续可用的字节数，需要持有锁
+func (t *TorrentTask) available(off int64, n int) int {
+	if t.have == nil {
+		return 0
+	}
+	end := off + int64(n)
+	pos := off
+	for pos < end {
+		index := int(pos / int64(t.PieceLen))
+		if !t.have[index] {
+			break
+		}
+		_, pieceEnd := t.getPieceBounds(index)
+		pos = int64(pieceEnd)
+	}
+	if pos > end {
+		pos = end
+	}
+	return int(pos - off)
+}
@@ -0,0 +1,159 @@
+package torrent
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func pickOrder(p *piecePicker, has func(int) bool, skip func(int) bool, suggested ...int) []int {
+	var order []int
+	for task := p.pick(has, skip, suggested); task != nil; task = p.pick(has, skip, suggested) {
+		order = append(order, task.index)
+	}
+	return order
+}
+
+func TestPiecePicker(t *testing.T) {
+	all := func(int) bool { return true }
+	tasks := func(indexes ...int) []*pieceTask {
+		var ts []*pieceTask
+		for _, i := range indexes {
+			ts = append(ts, &pieceTask{index: i})
+		}
+		return ts
+	}
+	p := newPiecePicker()
+	p.reset(tasks(3, 0, 4, 1, 2))
+	assert.Equal(t, []int{3, 0, 4, 1, 2}, pickOrder(p, all, nil))
+
+	p.reset(tasks(3, 0, 4, 1, 2))
+	even := func(i int) bool { return i%2 == 0 }
+	assert.Equal(t, []int{0, 4}, pickOrder(p, even, func(i int) bool { return i == 2 }))
+	assert.Equal(t, []int{3, 1, 2}, pickOrder(p, all, nil))
+
+	p.setSequential(true)
+	p.reset(tasks(3, 0, 4, 1, 2))
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, pickOrder(p, all, nil))
+
+	// 预读窗口中的分片优先
+	p.setSequential(false)
+	p.setWindow("a", pieceSpan{3, 5})
+	p.reset(tasks(0, 1, 4, 2, 3))
+	assert.Equal(t, []int{3, 4, 0, 1, 2}, pickOrder(p, all, nil))
+	p.removeWindow("a")
+	p.reset(tasks(0, 1, 4, 2, 3))
+	assert.Equal(t, []int{0, 1, 4, 2, 3}, pickOrder(p, all, nil))
+
+	// 对方建议的分片排在预读窗口之后
+	p.reset(tasks(0, 1, 4, 2, 3))
+	assert.Equal(t, []int{4, 2, 0, 1, 3}, pickOrder(p, all, nil, 2, 4))
+	p.setWindow("a", pieceSpan{3, 4})
+	p.reset(tasks(0, 1, 4, 2, 3))
+	assert.Equal(t, []int{3, 4, 2, 0, 1}, pickOrder(p, all, nil, 2, 4))
+	p.removeWindow("a")
+
+	// 放回分片时唤醒等待的peer
+	changed := p.wait()
+	p.put(&pieceTask{index: 1})
+	select {
+	case <-changed:
+	default:
+		t.Fatal("put did not notify")
+	}
+}
+
+func TestReader(t *testing.T) {
+	const pieceLen = 1024
+	data := testData(testPieces*pieceLen-100, 11)
+	task := newTestTask(t, data, pieceLen)
+	task.PeerList = []PeerInfo{listenSeeder(t, "127.0.0.1:0", task.InfoSHA, data, pieceLen)}
+	task.SetSequential(true)
+	r := task.NewReader()
+	defer r.Close()
+	r.SetReadahead(2 * pieceLen)
+	done := make(chan error, 1)
+	go func() { done <- Download(task) }()
+
+	got, err := io.ReadAll(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, data, got)
+	assert.Equal(t, nil, <-done)
+
+	pos, err := r.Seek(-100, io.SeekEnd)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(len(data)-100), pos)
+	got, err = io.ReadAll(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, data[len(data)-100:], got)
+	_, err = r.Seek(-1, io.SeekStart)
+	assert.Equal(t, ErrBadOffset, err)
+
+	buf := make([]byte, 3000)
+	n, err := r.ReadAt(buf, 500)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3000, n)
+	assert.Equal(t, data[500:3500], buf)
+	n, err = r.ReadAt(buf, int64(len(data)-10))
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, data[len(data)-10:], buf[:n])
+}
+
+func TestReaderReadahead(t *testing.T) {
+	const pieceLen = 1024
+	data := testData(testPieces*pieceLen, 13)
+	task := newTestTask(t, data, pieceLen)
+	task.PeerList = []PeerInfo{listenSeeder(t, "127.0.0.1:0", task.InfoSHA, data, pieceLen)}
+	// 从最后两个分片开始读取，这两个分片最先下载
+	r := task.NewReader()
+	defer r.Close()
+	r.SetReadahead(2 * pieceLen)
+	_, err := r.Seek(-2*pieceLen, io.SeekEnd)
+	assert.Equal(t, nil, err)
+	events, cancel := task.Subscribe()
+	defer cancel()
+	go Download(task)
+
+	got, err := io.ReadAll(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, data[len(data)-2*pieceLen:], got)
+	var verified []int
+	for e := range events {
+		if e.Type == EventPieceVerified && len(verified) < 2 {
+			verified = append(verified, e.Piece)
+		}
+	}
+	assert.Equal(t, []int{testPieces - 2, testPieces - 1}, verified)
+}
+
+func TestReaderError(t *testing.T) {
+	defer setNoPeersTimeout(0)()
+	task := &TorrentTask{
+		PeerID:   NewPeerID(),
+		FileName: filepath.Join(t.TempDir(), "out"),
+		FileLen:  10,
+		PieceLen: 10,
+		PieceSHA: make([][SHALEN]byte, 1),
+	}
+	// 关闭后阻塞的读取马上返回
+	r := task.NewReader()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	r.Close()
+	assert.Equal(t, ErrReaderClosed, <-errs)
+
+	// 下载失败时返回下载的错误
+	r = task.NewReader()
+	defer r.Close()
+	go Download(task)
+	_, err := r.Read(make([]byte, 1))
+	assert.Equal(t, true, errors.Is(err, ErrNoPeers))
+}
@@ -0,0 +1,108 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"sort"
+	"sync"
+)
+
+// BanThreshold 确认一个peer发送了这么多个错误的子分片后封禁它
+var BanThreshold = 3
+
+// 一个子分片的来源和内容的哈希值
+type blockRecord struct {
+	peer string // 发送者的IP
+	sum  [SHALEN]byte
+}
+
+// smartBan 找出发送错误数据的peer
+/*
+1. 分片校验失败时，按子分片记录发送者和内容的哈希值
+2. 之后分片被重新下载并且校验通过时，逐个子分片和失败的记录比较，内容不同的子分片就是错误数据
+3. 每个错误的子分片给发送者记一次，达到BanThreshold就封禁
+*/
+type smartBan struct {
+	mu           sync.Mutex
+	failed       map[int][][]blockRecord // 校验失败的分片，每次失败一份记录
+	scores       map[string]int          // 每个peer确认发送的错误子分片数
+	banned       map[string]bool
+	hashFailures int
+}
+
+func newSmartBan() *smartBan {
+	return &smartBan{
+		failed: make(map[int][][]blockRecord),
+		scores: make(map[string]int),
+		banned: make(map[string]bool),
+	}
+}
+
+// 把分片数据按子分片计算哈希值，整个分片都来自同一个peer
+func blockRecords(peer string, data []byte) []blockRecord {
+	records := make([]blockRecord, 0, (len(data)+BLOCKSIZE-1)/BLOCKSIZE)
+	for begin := 0; begin < len(data); begin += BLOCKSIZE {
+		end := begin + BLOCKSIZE
+		if end > len(data) {
+			end = len(data)
+		}
+		records = append(records, blockRecord{peer, sha1.Sum(data[begin:end])})
+	}
+	return records
+}
+
+// Failed 记录一次校验失败的分片
+func (b *smartBan) Failed(index int, records []blockRecord) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.hashFailures++
+	b.failed[index] = append(b.failed[index], records)
+}
+
+// Passed 分片校验通过，和之前失败的记录比较，返回这次新封禁的peer
+func (b *smartBan) Passed(index int, data []byte) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	attempts, ok := b.failed[index]
+	if !ok {
+		return nil
+	}
+	delete(b.failed, index)
+	good := blockRecords("", data)
+	var banned []string
+	for _, records := range attempts {
+		for i, r := range records {
+			if i < len(good) && r.sum == good[i].sum {
+				continue
+			}
+			b.scores[r.peer]++
+			if b.scores[r.peer] >= BanThreshold && !b.banned[r.peer] {
+				b.banned[r.peer] = true
+				banned = append(banned, r.peer)
+			}
+		}
+	}
+	return banned
+}
+
+func (b *smartBan) Banned(peer string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.banned[peer]
+}
+
+func (b *smartBan) stats() TaskStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := TaskStats{
+		HashFailures: b.hashFailures,
+		PeerFailures: make(map[string]int, len(b.scores)),
+	}
+	for peer, n := range b.scores {
+		s.PeerFailures[peer] = n
+	}
+	for peer := range b.banned {
+		s.Banned = append(s.Banned, peer)
+	}
+	sort.Strings(s.Banned)
+	return s
+}
@@ -0,0 +1,138 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSmartBan(t *testing.T) {
+	save := BanThreshold
+	BanThreshold = 3
+	defer func() { BanThreshold = save }()
+
+	good := make([]byte, 4*BLOCKSIZE+10)
+	for i := range good {
+		good[i] = byte(i)
+	}
+	corrupt := func(blocks ...int) []byte {
+		data := append([]byte(nil), good...)
+		for _, b := range blocks {
+			data[b*BLOCKSIZE] ^= 0xff
+		}
+		return data
+	}
+	ban := newSmartBan()
+	// a只发错了一个子分片，b发错了三个
+	ban.Failed(0, blockRecords("a", corrupt(2)))
+	ban.Failed(0, blockRecords("b", corrupt(0, 1, 4)))
+	assert.Equal(t, false, ban.Banned("b"))
+	assert.Equal(t, []string{"b"}, ban.Passed(0, good))
+	assert.Equal(t, true, ban.Banned("b"))
+	assert.Equal(t, false, ban.Banned("a"))
+	// 记录已经比较过，不会重复计数
+	assert.Equal(t, []string(nil), ban.Passed(0, good))
+
+	ban.Failed(1, blockRecords("a", corrupt(3)))
+	ban.Failed(1, blockRecords("a", corrupt(3)))
+	assert.Equal(t, []string{"a"}, ban.Passed(1, good))
+	assert.Equal(t, TaskStats{
+		HashFailures: 4,
+		PeerFailures: map[string]int{"a": 3, "b": 3},
+		Banned:       []string{"a", "b"},
+	}, ban.stats())
+}
+
+func TestDownloadSmartBan(t *testing.T) {
+	defer setPoolConfig(30, 8, 3, 10*time.Millisecond)()
+	save := BanThreshold
+	BanThreshold = 1
+	defer func() { BanThreshold = save }()
+
+	const pieceLen = 1024
+	data := make([]byte, testPieces*pieceLen)
+	for i := range data {
+		data[i] = byte(i * 17)
+	}
+	bad := append([]byte(nil), data...)
+	for i := 0; i < len(bad); i += pieceLen {
+		bad[i] ^= 0xff
+	}
+	task := newTestTask(t, data, pieceLen)
+
+	// 先只连接发送错误数据的peer，出现校验失败后再加入正常的peer
+	poisoner := listenSeeder(t, "127.0.0.1:0", task.InfoSHA, bad, pieceLen)
+	honest := listenSeeder(t, "127.0.0.2:0", task.InfoSHA, data, pieceLen)
+	task.AddPeers(poisoner)
+	go func() {
+		for task.Stats().HashFailures == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		task.AddPeers(honest)
+	}()
+	assert.Equal(t, nil, Download(task))
+	got, err := os.ReadFile(task.FileName)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, bytes.Equal(data, got))
+
+	stats := task.Stats()
+	assert.Equal(t, true, stats.HashFailures > 0)
+	assert.Equal(t, stats.HashFailures, stats.PeerFailures["127.0.0.1"])
+	assert.Equal(t, []string{"127.0.0.1"}, stats.Banned)
+}
+
+func TestDownloadRetryCorrupt(t *testing.T) {
+	defer setPoolConfig(30, 8, 3, 10*time.Millisecond)()
+	const pieceLen = 1024
+	data := testData(testPieces*pieceLen, 19)
+	last := testPieces - 1
+	// 最后一个分片的前corrupt次请求发送错误的数据
+	seeder := func(task *TorrentTask, corrupt int) PeerInfo {
+		return listenTestPeer(t, "127.0.0.1:0", task.InfoSHA, func(remote *PeerConn) {
+			remote.WriteMsg(&PeerMsg{MsgBitfield, []byte{0xff, 0xff}})
+			remote.WriteMsg(&PeerMsg{MsgUnchoke, nil})
+			for {
+				msg, err := remote.ReadMsg()
+				if err != nil {
+					return
+				}
+				if msg == nil || msg.ID != MsgRequest {
+					continue
+				}
+				req := &Request{}
+				req.UnmarshalBinary(msg.Payload)
+				begin := int(req.Index)*pieceLen + int(req.Begin)
+				block := append([]byte(nil), data[begin:begin+int(req.Length)]...)
+				if int(req.Index) == last && corrupt > 0 {
+					corrupt--
+					block[0] ^= 0xff
+				}
+				piece, _ := NewMsg(&Piece{Index: req.Index, Begin: req.Begin, Block: block})
+				remote.WriteMsg(piece)
+			}
+		})
+	}
+
+	// 只有这一个peer拥有这个分片时，从它重新下载
+	task := newTestTask(t, data, pieceLen)
+	task.SetSequential(true)
+	task.PeerList = []PeerInfo{seeder(task, 1)}
+	assert.Equal(t, nil, Download(task))
+	got, err := os.ReadFile(task.FileName)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, bytes.Equal(data, got))
+	assert.Equal(t, 1, task.Stats().HashFailures)
+
+	// 一直发送错误的数据，重试几次后放弃
+	task = newTestTask(t, data, pieceLen)
+	task.SetSequential(true)
+	task.PeerList = []PeerInfo{seeder(task, 100)}
+	err = Download(task)
+	assert.Equal(t, true, errors.Is(err, ErrNoPeers))
+	assert.Equal(t, maxPieceFailures, task.Stats().HashFailures)
+	assert.Equal(t, testPieces-1, task.Status().PiecesDone)
+}
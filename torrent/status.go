@@ -0,0 +1,234 @@
+package torrent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EventType 下载任务的事件类型
+type EventType int
+
+const (
+	EventPieceVerified    EventType = iota // 分片校验通过
+	EventHashFailed                        // 分片校验失败
+	EventPeerConnected                     // 和peer建立了连接
+	EventPeerDisconnected                  // 和peer的连接断开
+	EventAnnounce                          // 向tracker获取peer的结果
+	EventCompleted                         // 下载完成，之后不会再有事件
+	EventError                             // 下载失败，之后不会再有事件
+	EventStopped                           // 下载被停止，之后不会再有事件
+	EventSeeding                           // 下载完成后开始做种，停止做种时发送EventCompleted
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPieceVerified:
+		return "piece verified"
+	case EventHashFailed:
+		return "hash failed"
+	case EventPeerConnected:
+		return "peer connected"
+	case EventPeerDisconnected:
+		return "peer disconnected"
+	case EventAnnounce:
+		return "announce"
+	case EventCompleted:
+		return "completed"
+	case EventError:
+		return "error"
+	case EventStopped:
+		return "stopped"
+	case EventSeeding:
+		return "seeding"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event 下载任务的事件，只有和事件类型相关的字段有值
+type Event struct {
+	Type  EventType
+	Time  time.Time
+	Piece int      // 分片事件的分片序号
+	Peer  PeerInfo // peer事件的peer，分片校验失败时是发送数据的peer
+	Peers int      // announce返回的peer数量
+	Err   error    // 断开连接、announce失败或者下载失败的原因
+}
+
+// Status 下载任务的状态快照
+type Status struct {
+	PiecesDone     int
+	PiecesTotal    int
+	BytesDone      int64         // 已经校验通过的字节数
+	BytesLeft      int64         // 还需要下载的字节数
+	DownloadRate   float64       // 最近几秒的下载速度，字节每秒，包括协议开销
+	UploadRate     float64       // 最近几秒的上传速度
+	ETA            time.Duration // 按当前下载速度估算的剩余时间，速度为0时为-1
+	ConnectedPeers int
+	KnownPeers     int  // 连接池中的peer数，包括还没有连接上的
+	Done           bool // 下载已经结束，成功或者失败
+	Err            error
+}
+
+const (
+	eventQueueLen = 256 // 每个订阅者最多缓存多少个事件
+	meterWindow   = 5   // 按最近几秒计算速度
+)
+
+// 把事件分发给所有订阅者，订阅者处理不过来时丢弃事件，不阻塞下载
+// 每个订阅者的通道多留一个位置给最后一个事件，缓存满了也不会丢失下载的结果
+type eventHub struct {
+	mu     sync.Mutex
+	subs   map[chan Event]struct{}
+	closed bool
+}
+
+func (h *eventHub) subscribe() chan Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan Event, eventQueueLen+1)
+	if h.closed {
+		close(ch)
+		return ch
+	}
+	if h.subs == nil {
+		h.subs = make(map[chan Event]struct{})
+	}
+	h.subs[ch] = struct{}{}
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+func (h *eventHub) publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		// 只有持有锁时才会发送，检查之后不会被其他人占满
+		if len(ch) < eventQueueLen {
+			ch <- e
+		}
+	}
+}
+
+// 发送最后一个事件后关闭所有订阅者的通道，最后一个事件使用预留的位置，一定能送达
+func (h *eventHub) close(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		ch <- e
+		close(ch)
+	}
+	h.subs = nil
+	h.closed = true
+}
+
+func (h *eventHub) isClosed() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.closed
+}
+
+// 按秒统计最近meterWindow秒的流量
+type rateMeter struct {
+	mu      sync.Mutex
+	buckets [meterWindow]int64
+	last    int64 // 最新一个桶对应的秒数
+}
+
+func (m *rateMeter) add(n int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().Unix()
+	m.advance(now)
+	m.buckets[now%meterWindow] += int64(n)
+}
+
+// 清空已经过期的桶，需要持有锁
+func (m *rateMeter) advance(now int64) {
+	if now-m.last >= meterWindow {
+		m.buckets = [meterWindow]int64{}
+	} else {
+		for s := m.last + 1; s <= now; s++ {
+			m.buckets[s%meterWindow] = 0
+		}
+	}
+	m.last = now
+}
+
+// 每秒字节数
+func (m *rateMeter) rate() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance(time.Now().Unix())
+	var sum int64
+	for _, n := range m.buckets {
+		sum += n
+	}
+	return float64(sum) / meterWindow
+}
+
+// Subscribe 订阅下载任务的事件，cancel取消订阅并关闭通道
+// 订阅者处理不过来时事件会被丢弃，下载结束后通道会被关闭，最终状态可以通过Status获取
+func (t *TorrentTask) Subscribe() (<-chan Event, func()) {
+	ch := t.hub().subscribe()
+	return ch, func() { t.hub().unsubscribe(ch) }
+}
+
+// Status 获取下载任务的状态快照
+func (t *TorrentTask) Status() Status {
+	t.mu.Lock()
+	s := Status{
+		PiecesDone:  t.piecesDone,
+		PiecesTotal: len(t.PieceSHA),
+		BytesDone:   t.bytesDone,
+		BytesLeft:   int64(t.FileLen) - t.bytesDone,
+		Done:        t.done,
+		Err:         t.err,
+		KnownPeers:  len(t.PeerList),
+	}
+	pool := t.pool
+	t.mu.Unlock()
+	s.DownloadRate = t.downMeter.rate()
+	s.UploadRate = t.upMeter.rate()
+	s.ETA = -1
+	if s.BytesLeft == 0 {
+		s.ETA = 0
+	} else if s.DownloadRate > 0 {
+		s.ETA = time.Duration(float64(s.BytesLeft) / s.DownloadRate * float64(time.Second))
+	}
+	if pool != nil {
+		s.ConnectedPeers = pool.Connected()
+		s.KnownPeers = pool.Known()
+	}
+	return s
+}
+
+func (t *TorrentTask) hub() *eventHub {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.events == nil {
+		t.events = &eventHub{}
+	}
+	return t.events
+}
+
+func (t *TorrentTask) publish(e Event) {
+	t.hub().publish(e)
+}
@@ -0,0 +1,120 @@
+package torrent
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Ryan-ovo/go-bittorrent/bencode"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadEvents(t *testing.T) {
+	const pieceLen = 1024
+	data := make([]byte, testPieces*pieceLen-10)
+	for i := range data {
+		data[i] = byte(i * 11)
+	}
+	task := newTestTask(t, data, pieceLen)
+	task.AddPeers(listenSeeder(t, "127.0.0.1:0", task.InfoSHA, data, pieceLen))
+	status := task.Status()
+	assert.Equal(t, int64(len(data)), status.BytesLeft)
+	assert.Equal(t, 1, status.KnownPeers)
+	assert.Equal(t, time.Duration(-1), status.ETA)
+
+	events, _ := task.Subscribe()
+	assert.Equal(t, nil, Download(task))
+	count := make(map[EventType]int)
+	var last Event
+	for e := range events {
+		count[e.Type]++
+		last = e
+	}
+	assert.Equal(t, testPieces, count[EventPieceVerified])
+	assert.Equal(t, 1, count[EventPeerConnected])
+	assert.Equal(t, EventCompleted, last.Type)
+
+	status = task.Status()
+	assert.Equal(t, true, status.Done)
+	assert.Equal(t, testPieces, status.PiecesDone)
+	assert.Equal(t, int64(len(data)), status.BytesDone)
+	assert.Equal(t, int64(0), status.BytesLeft)
+	assert.Equal(t, time.Duration(0), status.ETA)
+	assert.Equal(t, true, status.DownloadRate > 0)
+	assert.Equal(t, true, status.UploadRate > 0)
+
+	// 下载结束后订阅的通道直接关闭
+	_, ok := <-func() <-chan Event { ch, _ := task.Subscribe(); return ch }()
+	assert.Equal(t, false, ok)
+}
+
+func TestDownloadErrorEvent(t *testing.T) {
+	defer setNoPeersTimeout(0)()
+	task := &TorrentTask{PeerID: NewPeerID(), FileLen: 10, PieceLen: 10, PieceSHA: make([][SHALEN]byte, 1)}
+	events, _ := task.Subscribe()
+	err := Download(task)
+	assert.Equal(t, true, errors.Is(err, ErrNoPeers))
+	e := <-events
+	assert.Equal(t, EventError, e.Type)
+	assert.Equal(t, err, e.Err)
+	_, ok := <-events
+	assert.Equal(t, false, ok)
+	assert.Equal(t, err, task.Status().Err)
+}
+
+func TestAnnounceEvent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bencode.Marshal(w, &TrackerResp{Interval: 900, Peers: Peers{testPeer(1), testPeer(2)}})
+	}))
+	defer srv.Close()
+	task := &TorrentTask{PeerID: NewPeerID()}
+	events, cancel := task.Subscribe()
+	assert.Equal(t, nil, task.Announce(&TorrentFile{Announce: srv.URL}))
+	e := <-events
+	assert.Equal(t, EventAnnounce, e.Type)
+	assert.Equal(t, 2, e.Peers)
+	assert.Equal(t, 2, task.Status().KnownPeers)
+
+	srv.Close()
+	assert.NotEqual(t, nil, task.Announce(&TorrentFile{Announce: srv.URL}))
+	e = <-events
+	assert.NotEqual(t, nil, e.Err)
+
+	// 取消订阅后通道关闭
+	cancel()
+	_, ok := <-events
+	assert.Equal(t, false, ok)
+}
+
+func TestEventHubDrop(t *testing.T) {
+	h := &eventHub{}
+	ch := h.subscribe()
+	for i := 0; i < eventQueueLen+10; i++ {
+		h.publish(Event{Type: EventPieceVerified, Piece: i})
+	}
+	// 处理不过来的事件被丢弃，不会阻塞
+	assert.Equal(t, eventQueueLen, len(ch))
+	assert.Equal(t, 0, (<-ch).Piece)
+
+	// 缓存满了最后一个事件也能送达
+	h.publish(Event{Type: EventPieceVerified})
+	h.close(Event{Type: EventCompleted})
+	var last Event
+	for e := range ch {
+		last = e
+	}
+	assert.Equal(t, EventCompleted, last.Type)
+}
+
+func TestRateMeter(t *testing.T) {
+	m := &rateMeter{}
+	m.add(5000)
+	m.add(5000)
+	assert.Equal(t, 10000.0/meterWindow, m.rate())
+	// 超过统计窗口的流量不再计算
+	m.buckets = [meterWindow]int64{1, 1, 1, 1, 1}
+	m.last = time.Now().Unix() - meterWindow
+	assert.Equal(t, 0.0, m.rate())
+}
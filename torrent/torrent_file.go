@@ -3,61 +3,101 @@ package torrent
 import (
 	"bytes"
 	"crypto/sha1"
+	"fmt"
 	"github.com/Ryan-ovo/go-bittorrent/bencode"
 	"io"
 	"log"
+	"time"
 )
 
 const SHALEN int = 20
 
+// PieceHashes 种子文件中的pieces字段，每20字节是一个分片的哈希值
+type PieceHashes [][SHALEN]byte
+
+func (p PieceHashes) MarshalBencode() ([]byte, error) {
+	bs := make([]byte, 0, len(p)*SHALEN)
+	for _, h := range p {
+		bs = append(bs, h[:]...)
+	}
+	buf := new(bytes.Buffer)
+	bencode.EncodeString(buf, string(bs))
+	return buf.Bytes(), nil
+}
+
+func (p *PieceHashes) UnmarshalBencode(data []byte) error {
+	var bs []byte
+	if err := bencode.Unmarshal(bytes.NewReader(data), &bs); err != nil {
+		return err
+	}
+	if len(bs)%SHALEN != 0 {
+		return fmt.Errorf("pieces length %d is not a multiple of %d", len(bs), SHALEN)
+	}
+	hash := make(PieceHashes, len(bs)/SHALEN)
+	for i := range hash {
+		copy(hash[i][:], bs[i*SHALEN:(i+1)*SHALEN])
+	}
+	*p = hash
+	return nil
+}
+
 type rawInfo struct {
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
-	PieceLength int    `bencode:"piece length"`
-	Pieces      string `bencode:"pieces"`
+	Length      int         `bencode:"length"`
+	Name        string      `bencode:"name"`
+	PieceLength int         `bencode:"piece length"`
+	Pieces      PieceHashes `bencode:"pieces"`
 }
 
 type rawFile struct {
-	Announce string  `bencode:"announce"`
-	Info     rawInfo `bencode:"info"`
+	Announce     string    `bencode:"announce"`
+	CreationDate time.Time `bencode:"creation date,omitempty"`
 }
 
 type TorrentFile struct {
-	Announce string
-	InfoSHA  [SHALEN]byte
-	FileName string
-	FileLen  int
-	PieceLen int
-	PieceSHA [][SHALEN]byte
+	Announce     string
+	CreationDate time.Time
+	InfoSHA      [SHALEN]byte
+	FileName     string
+	FileLen      int
+	PieceLen     int
+	PieceSHA     [][SHALEN]byte
 }
 
 func ParseFile(r io.Reader) (*TorrentFile, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	root, err := bencode.ParseBytes(data)
+	if err != nil {
+		log.Printf("Parse file error, err = [%v]", err)
+		return nil, err
+	}
 	raw := &rawFile{}
-	// 将流中的数据反序列化到rawFile结构中
-	if err := bencode.Unmarshal(r, raw); err != nil {
+	// 将种子文件反序列化到rawFile结构中
+	if err = root.Decode(raw); err != nil {
 		log.Printf("Parse file error, err = [%v]", err)
 		return nil, err
 	}
+	// info是原始输入中的一段，不会被重新编码
+	infoRaw, err := root.Get("info")
+	if err != nil {
+		log.Printf("Parse file info error, err = [%v]", err)
+		return nil, err
+	}
+	info := &rawInfo{}
+	if err = infoRaw.Decode(info); err != nil {
+		log.Printf("Parse file info error, err = [%v]", err)
+		return nil, err
+	}
 	tf := &TorrentFile{}
 	tf.Announce = raw.Announce
-	tf.FileName = raw.Info.Name
-	tf.FileLen = raw.Info.Length
-	tf.PieceLen = raw.Info.PieceLength
-
-	buf := bytes.NewBuffer([]byte{})
-	// 单独把raw的核心数据序列化到流中
-	wLen := bencode.Marshal(buf, raw.Info)
-	if wLen == 0 {
-		log.Println("marshal raw file info to stream error")
-	}
-	// 求整个文件的sha1哈希值
-	tf.InfoSHA = sha1.Sum(buf.Bytes())
-	// 求每个分片的哈希值
-	bs := []byte(raw.Info.Pieces)
-	hash := make([][SHALEN]byte, len(bs)/SHALEN)
-	for i := 0; i < len(bs)/SHALEN; i++ {
-		copy(hash[i][:], bs[i*SHALEN:(i+1)*SHALEN])
-	}
-	tf.PieceSHA = hash
+	tf.CreationDate = raw.CreationDate
+	tf.FileName = info.Name
+	tf.FileLen = info.Length
+	tf.PieceLen = info.PieceLength
+	// 直接对info的原始编码求哈希，不受未识别字段和非规范编码的影响
+	tf.InfoSHA = sha1.Sum(infoRaw)
+	tf.PieceSHA = info.Pieces
 	return tf, nil
 }
@@ -2,6 +2,8 @@ package torrent
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha1"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"testing"
@@ -13,6 +15,7 @@ func TestParseFile(t *testing.T) {
 	tf, err := ParseFile(bufio.NewReader(file))
 	assert.Equal(t, nil, err)
 	assert.Equal(t, "http://bttracker.debian.org:6969/announce", tf.Announce)
+	assert.Equal(t, int64(1639833767), tf.CreationDate.Unix())
 	assert.Equal(t, "debian-11.2.0-amd64-netinst.iso", tf.FileName)
 	assert.Equal(t, 396361728, tf.FileLen)
 	assert.Equal(t, 262144, tf.PieceLen)
@@ -21,3 +24,14 @@ func TestParseFile(t *testing.T) {
 		0xce, 0xb6, 0xfb, 0x58, 0x61, 0x7e, 0x69, 0x95, 0xa7, 0xed, 0xdb}
 	assert.Equal(t, expectHASH, tf.InfoSHA)
 }
+
+func TestParseFileNonCanonical(t *testing.T) {
+	// info中的key没有排序，infohash必须是原始编码的哈希
+	info := "d4:name1:a6:lengthi1e12:piece lengthi1e6:pieces20:" + string(make([]byte, SHALEN)) + "e"
+	tf, err := ParseFile(bytes.NewBufferString("d8:announce1:x4:info" + info + "e"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, sha1.Sum([]byte(info)), tf.InfoSHA)
+	assert.Equal(t, "a", tf.FileName)
+	assert.Equal(t, 1, tf.FileLen)
+	assert.Equal(t, 1, len(tf.PieceSHA))
+}
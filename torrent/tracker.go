@@ -1,7 +1,9 @@
 package torrent
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"github.com/Ryan-ovo/go-bittorrent/bencode"
 	"log"
 	"net"
@@ -19,14 +21,87 @@ const (
 	IDLen    = 20
 )
 
+// AnnouncePort 告诉tracker的监听端口，使用Client时设置成Client监听的端口
+var AnnouncePort = PeerPort
+
 type PeerInfo struct {
 	IP   net.IP
 	Port uint16
+	ID   [IDLen]byte // tracker返回的peer id，紧凑格式中没有，全0表示未知
+}
+
+// Addr 用于建立连接的地址
+func (p PeerInfo) Addr() string {
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
+}
+
+// Peers tracker返回的peer列表，兼容紧凑格式（每6字节一个ip+port）和字典列表格式
+type Peers []PeerInfo
+
+func (p Peers) MarshalBencode() ([]byte, error) {
+	bs := make([]byte, 0, len(p)*PeerLen)
+	for _, peer := range p {
+		ip := peer.IP.To4()
+		if ip == nil {
+			return nil, fmt.Errorf("cannot encode %s in compact format", peer.IP)
+		}
+		port := make([]byte, PortLen)
+		binary.BigEndian.PutUint16(port, peer.Port)
+		bs = append(bs, ip...)
+		bs = append(bs, port...)
+	}
+	buf := new(bytes.Buffer)
+	bencode.EncodeString(buf, string(bs))
+	return buf.Bytes(), nil
+}
+
+func (p *Peers) UnmarshalBencode(data []byte) error {
+	// 非紧凑格式：[{ip: "1.2.3.4", port: 6881}, ...]
+	if len(data) > 0 && data[0] == 'l' {
+		var list []struct {
+			ID   string `bencode:"peer id"`
+			IP   string `bencode:"ip"`
+			Port uint16 `bencode:"port"`
+		}
+		if err := bencode.Unmarshal(bytes.NewReader(data), &list); err != nil {
+			return err
+		}
+		ps := make(Peers, 0, len(list))
+		for _, item := range list {
+			ip := net.ParseIP(item.IP)
+			if ip == nil {
+				continue
+			}
+			peer := PeerInfo{IP: ip, Port: item.Port}
+			if len(item.ID) == IDLen {
+				copy(peer.ID[:], item.ID)
+			}
+			ps = append(ps, peer)
+		}
+		*p = ps
+		return nil
+	}
+	var peers []byte
+	if err := bencode.Unmarshal(bytes.NewReader(data), &peers); err != nil {
+		return err
+	}
+	// 数据格式错误
+	if len(peers)%PeerLen != 0 {
+		return fmt.Errorf("irregular peer data, length = %d", len(peers))
+	}
+	ps := make(Peers, len(peers)/PeerLen)
+	for i := 0; i < len(peers)/PeerLen; i++ {
+		offset := i * PeerLen
+		ps[i].IP = peers[offset : offset+IpLen]
+		ps[i].Port = binary.BigEndian.Uint16(peers[offset+IpLen : offset+PeerLen])
+	}
+	*p = ps
+	return nil
 }
 
 type TrackerResp struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
+	Interval int   `bencode:"interval"`
+	Peers    Peers `bencode:"peers"`
 }
 
 // 利用net/url库封装带参数的Get请求
@@ -39,7 +114,7 @@ func buildURL(tf *TorrentFile, peerID [IDLen]byte) (string, error) {
 	params := url.Values{
 		"info_hash":  []string{string(tf.InfoSHA[:])},
 		"peer_id":    []string{string(peerID[:])},
-		"port":       []string{strconv.Itoa(PeerPort)},
+		"port":       []string{strconv.Itoa(AnnouncePort)},
 		"left":       []string{strconv.Itoa(tf.FileLen)},
 		"uploaded":   []string{"0"},
 		"downloaded": []string{"0"},
@@ -49,43 +124,32 @@ func buildURL(tf *TorrentFile, peerID [IDLen]byte) (string, error) {
 	return base.String(), nil
 }
 
-// 将tracker返回的结果解析成(ip, port)列表
-func buildPeerInfo(peers []byte) []PeerInfo {
-	// 数据格式错误
-	if len(peers)%PeerLen != 0 {
-		log.Println("irregular peer data")
-		return nil
-	}
-	ps := make([]PeerInfo, len(peers)/PeerLen)
-	for i := 0; i < len(peers)/PeerLen; i++ {
-		offset := i * PeerLen
-		ps[i].IP = peers[offset : offset+IpLen]
-		ps[i].Port = binary.BigEndian.Uint16(peers[offset+IpLen : offset+PeerLen])
-	}
-	return ps
-}
-
-func FindPeers(tf *TorrentFile, peerID [IDLen]byte) []PeerInfo {
+// Announce 向tracker请求peer列表
+func Announce(tf *TorrentFile, peerID [IDLen]byte) (*TrackerResp, error) {
 	url, err := buildURL(tf, peerID)
 	if err != nil {
-		log.Println("build tracker url error = ", err)
-		return nil
+		return nil, err
 	}
-
 	// 发送http请求
 	client := &http.Client{Timeout: 15 * time.Second}
 	resp, err := client.Get(url)
 	if err != nil {
-		log.Println("connect to tracker error = ", err)
-		return nil
+		return nil, err
 	}
 	defer resp.Body.Close()
 	trackerResp := new(TrackerResp)
 	// 将返回的结果反序列化到TrackerResp中
 	if err = bencode.Unmarshal(resp.Body, trackerResp); err != nil {
-		log.Println("unmarshal tracker resp error = ", err)
+		return nil, err
+	}
+	return trackerResp, nil
+}
+
+func FindPeers(tf *TorrentFile, peerID [IDLen]byte) []PeerInfo {
+	resp, err := Announce(tf, peerID)
+	if err != nil {
+		log.Println("announce to tracker error = ", err)
 		return nil
 	}
-	// 解析出ip, port列表
-	return buildPeerInfo([]byte(trackerResp.Peers))
+	return resp.Peers
 }
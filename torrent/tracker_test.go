@@ -2,8 +2,12 @@ package torrent
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/rand"
 	"fmt"
+	"github.com/Ryan-ovo/go-bittorrent/bencode"
+	"github.com/stretchr/testify/assert"
+	"net"
 	"os"
 	"testing"
 )
@@ -21,3 +25,40 @@ func TestFindPeers(t *testing.T) {
 		fmt.Printf("Peer %d, Ip: %s, Port: %d\n", i, p.IP, p.Port)
 	}
 }
+
+func TestTrackerResp(t *testing.T) {
+	// 紧凑格式
+	compact := "d8:intervali900e5:peers12:\x0a\x00\x00\x01\x1a\xe1\xc0\xa8\x01\x02\x1a\xe2e"
+	resp := new(TrackerResp)
+	err := bencode.Unmarshal(bytes.NewBufferString(compact), resp)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 900, resp.Interval)
+	assert.Equal(t, 2, len(resp.Peers))
+	assert.Equal(t, "10.0.0.1", resp.Peers[0].IP.String())
+	assert.Equal(t, uint16(6881), resp.Peers[0].Port)
+	assert.Equal(t, "192.168.1.2", resp.Peers[1].IP.String())
+	assert.Equal(t, uint16(6882), resp.Peers[1].Port)
+
+	buf := new(bytes.Buffer)
+	bencode.Marshal(buf, resp)
+	assert.Equal(t, compact, buf.String())
+
+	// 字典列表格式
+	dict := "d8:intervali900e5:peersld2:ip8:10.0.0.14:porti6881eeee"
+	resp = new(TrackerResp)
+	err = bencode.Unmarshal(bytes.NewBufferString(dict), resp)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, Peers{{IP: net.ParseIP("10.0.0.1"), Port: 6881}}, resp.Peers)
+
+	// 带peer id的字典格式
+	dict = "d8:intervali900e5:peersld2:ip8:10.0.0.17:peer id20:-qB4250-abcdefghijkl4:porti6881eeee"
+	resp = new(TrackerResp)
+	err = bencode.Unmarshal(bytes.NewBufferString(dict), resp)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "-qB4250-abcdefghijkl", string(resp.Peers[0].ID[:]))
+	assert.Equal(t, "10.0.0.1:6881", resp.Peers[0].Addr())
+
+	// 长度不是6的倍数
+	err = bencode.Unmarshal(bytes.NewBufferString("d5:peers5:abcdee"), resp)
+	assert.NotEqual(t, nil, err)
+}
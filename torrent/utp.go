@@ -0,0 +1,915 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+uTP（BEP 29）是基于UDP的可靠传输协议，拥塞控制使用LEDBAT：
+根据单向延迟估计排队延迟，低于目标值时增大窗口，高于目标值时减小窗口，
+这样在和TCP竞争上行带宽时会主动让步，不会把上行带宽占满。
+
+UTPSocket在一个UDP端口上复用多个连接，每个连接都实现了net.Conn，可以直接交给PeerConn使用
+*/
+
+// 包类型
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+)
+
+const (
+	utpVersion   = 1
+	utpHeaderLen = 20
+	extSack      = 1 // selective ack扩展
+
+	utpPayload         = 1200    // 每个包的最大数据长度，保证不超过常见的MTU
+	utpRecvBuf         = 1 << 20 // 接收缓冲区，也是通告给对方的最大窗口
+	utpSendBuf         = 1 << 20 // 发送缓冲区，也是拥塞窗口的上限
+	utpTarget          = 100 * time.Millisecond
+	utpMaxCwndIncrease = 3000 // 每个RTT窗口最多增加的字节数
+	utpMaxSack         = 32   // selective ack最多覆盖32*8个包
+
+	utpInitRTO     = time.Second
+	utpMinRTO      = 500 * time.Millisecond
+	utpMaxRTO      = 30 * time.Second
+	utpMaxTimeouts = 8 // 连续超时这么多次后断开连接
+	utpTick        = 50 * time.Millisecond
+	utpLinger      = 10 * time.Second // 关闭后最多等待多久让对方也关闭
+	utpDelayWindow = 2                // 基础延迟取最近几分钟的最小值
+	utpBacklog     = 32
+)
+
+var (
+	errUTPReset   = errors.New("utp: connection reset by peer")
+	errUTPTimeout = errors.New("utp: connection timed out")
+	errUTPPacket  = errors.New("utp: invalid packet")
+)
+
+// 包头：类型和版本、扩展、连接id、时间戳、时间差、窗口、序号、确认号
+type utpHeader struct {
+	typ    uint8
+	connID uint16
+	tsUs   uint32 // 发送时的时间戳，单位微秒
+	tsDiff uint32 // 最近收到的包的接收时间减去发送时间，用来估计单向延迟
+	wnd    uint32 // 接收窗口剩余的字节数
+	seq    uint16
+	ack    uint16
+	sack   []byte // 第i位表示ack+2+i是否已经收到
+}
+
+func (h *utpHeader) marshal(payload []byte) []byte {
+	buf := make([]byte, utpHeaderLen, utpHeaderLen+2+len(h.sack)+len(payload))
+	buf[0] = h.typ<<4 | utpVersion
+	if len(h.sack) > 0 {
+		buf[1] = extSack
+	}
+	binary.BigEndian.PutUint16(buf[2:4], h.connID)
+	binary.BigEndian.PutUint32(buf[4:8], h.tsUs)
+	binary.BigEndian.PutUint32(buf[8:12], h.tsDiff)
+	binary.BigEndian.PutUint32(buf[12:16], h.wnd)
+	binary.BigEndian.PutUint16(buf[16:18], h.seq)
+	binary.BigEndian.PutUint16(buf[18:20], h.ack)
+	if len(h.sack) > 0 {
+		buf = append(buf, 0, byte(len(h.sack)))
+		buf = append(buf, h.sack...)
+	}
+	return append(buf, payload...)
+}
+
+func parseUTP(b []byte) (*utpHeader, []byte, error) {
+	if len(b) < utpHeaderLen || b[0]&0x0f != utpVersion || b[0]>>4 > stSyn {
+		return nil, nil, errUTPPacket
+	}
+	h := &utpHeader{
+		typ:    b[0] >> 4,
+		connID: binary.BigEndian.Uint16(b[2:4]),
+		tsUs:   binary.BigEndian.Uint32(b[4:8]),
+		tsDiff: binary.BigEndian.Uint32(b[8:12]),
+		wnd:    binary.BigEndian.Uint32(b[12:16]),
+		seq:    binary.BigEndian.Uint16(b[16:18]),
+		ack:    binary.BigEndian.Uint16(b[18:20]),
+	}
+	rest := b[utpHeaderLen:]
+	// 扩展是链表：下一个扩展类型 + 长度 + 内容
+	for ext := b[1]; ext != 0; {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return nil, nil, errUTPPacket
+		}
+		next, size := rest[0], int(rest[1])
+		if ext == extSack {
+			h.sack = rest[2 : 2+size]
+		}
+		ext, rest = next, rest[2+size:]
+	}
+	return h, rest, nil
+}
+
+// 序号是16位的，会回绕
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+// sack中第i位表示ack+2+i
+func sackSeqs(ack uint16, sack []byte) []uint16 {
+	var seqs []uint16
+	for i := 0; i < len(sack)*8; i++ {
+		if sack[i/8]&(1<<uint(i%8)) != 0 {
+			seqs = append(seqs, ack+2+uint16(i))
+		}
+	}
+	return seqs
+}
+
+/*
+LEDBAT：delay是排队延迟的估计值，acked是这次确认的字节数。
+慢启动阶段每确认多少字节窗口就增加多少，延迟接近目标值或者丢包后进入拥塞避免，
+之后每个RTT窗口最多增加utpMaxCwndIncrease字节，延迟超过目标值时按比例减小
+*/
+func ledbat(cwnd float64, delay time.Duration, acked int, slowStart bool) (float64, bool) {
+	if slowStart && delay < utpTarget/2 {
+		cwnd += float64(acked)
+	} else {
+		slowStart = false
+		offTarget := float64(utpTarget-delay) / float64(utpTarget)
+		cwnd += utpMaxCwndIncrease * offTarget * float64(acked) / cwnd
+	}
+	if cwnd < utpPayload {
+		cwnd = utpPayload
+	}
+	if cwnd > utpSendBuf {
+		cwnd = utpSendBuf
+	}
+	return cwnd, slowStart
+}
+
+// 按分钟记录单向延迟的最小值，对方的时钟和我们不同步，减去基础延迟后才是排队延迟
+type delayHist struct {
+	mins   []uint32
+	rotate time.Time
+}
+
+func (h *delayHist) add(sample uint32, now time.Time) {
+	if len(h.mins) == 0 || now.After(h.rotate) {
+		h.mins = append(h.mins, sample)
+		if len(h.mins) > utpDelayWindow {
+			h.mins = h.mins[1:]
+		}
+		h.rotate = now.Add(time.Minute)
+		return
+	}
+	if last := &h.mins[len(h.mins)-1]; int32(sample-*last) < 0 {
+		*last = sample
+	}
+}
+
+func (h *delayHist) base() uint32 {
+	b := h.mins[0]
+	for _, m := range h.mins[1:] {
+		if int32(m-b) < 0 {
+			b = m
+		}
+	}
+	return b
+}
+
+// 连接的key：对方地址 + 我方的接收id
+type utpKey struct {
+	addr string
+	id   uint16
+}
+
+// UTPSocket 一个UDP端口上的所有uTP连接，同时实现了net.Listener
+type UTPSocket struct {
+	pc        net.PacketConn
+	start     time.Time
+	mu        sync.Mutex
+	conns     map[utpKey]*utpConn
+	accept    chan *utpConn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// ListenUTP 在UDP地址上监听uTP连接，同一个socket也可以发起连接
+func ListenUTP(addr string) (*UTPSocket, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return newUTPSocket(pc), nil
+}
+
+func newUTPSocket(pc net.PacketConn) *UTPSocket {
+	s := &UTPSocket{
+		pc:     pc,
+		start:  time.Now(),
+		conns:  make(map[utpKey]*utpConn),
+		accept: make(chan *utpConn, utpBacklog),
+		done:   make(chan struct{}),
+	}
+	go s.readLoop()
+	go s.tickLoop()
+	return s
+}
+
+// Accept 等待对方发起的连接
+func (s *UTPSocket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *UTPSocket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// Close 关闭socket，所有连接都会断开
+func (s *UTPSocket) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.pc.Close()
+		s.mu.Lock()
+		conns := s.conns
+		s.conns = make(map[utpKey]*utpConn)
+		s.mu.Unlock()
+		for _, c := range conns {
+			c.mu.Lock()
+			c.fail(net.ErrClosed)
+			c.mu.Unlock()
+		}
+	})
+	return nil
+}
+
+// DialTimeout 发起uTP连接，等待对方确认SYN
+func (s *UTPSocket) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		return nil, net.ErrClosed
+	default:
+	}
+	// 随机选一个没有被占用的接收id，对方回复时使用这个id，发送时使用id+1
+	var id uint16
+	for {
+		var b [2]byte
+		rand.Read(b[:])
+		id = binary.BigEndian.Uint16(b[:])
+		if _, ok := s.conns[utpKey{raddr.String(), id}]; !ok {
+			break
+		}
+	}
+	c := s.newConn(raddr, id, id+1)
+	s.conns[utpKey{raddr.String(), id}] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = utpSynSent
+	c.seq = 1
+	c.queue = append(c.queue, &utpOut{typ: stSyn})
+	c.trySend(time.Now())
+	deadline := time.Now().Add(timeout)
+	for c.state == utpSynSent {
+		if c.err != nil {
+			return nil, c.err
+		}
+		if err := c.wait(deadline); err != nil {
+			c.fail(err)
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (s *UTPSocket) newConn(addr net.Addr, recvID, sendID uint16) *utpConn {
+	return &utpConn{
+		s:         s,
+		remote:    addr,
+		recvID:    recvID,
+		sendID:    sendID,
+		notify:    make(chan struct{}),
+		cwnd:      2 * utpPayload,
+		slowStart: true,
+		peerWnd:   utpRecvBuf,
+		rto:       utpInitRTO,
+		ooo:       make(map[uint16]*utpIn),
+	}
+}
+
+// 时间戳，单位微秒，只用来计算差值，回绕不影响
+func (s *UTPSocket) micros() uint32 {
+	return uint32(time.Since(s.start) / time.Microsecond)
+}
+
+func (s *UTPSocket) readLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			s.Close()
+			return
+		}
+		h, payload, err := parseUTP(buf[:n])
+		if err != nil {
+			continue
+		}
+		s.dispatch(h, append([]byte(nil), payload...), addr)
+	}
+}
+
+// 按连接id把包分发给对应的连接，SYN会建立新的连接
+func (s *UTPSocket) dispatch(h *utpHeader, payload []byte, addr net.Addr) {
+	s.mu.Lock()
+	c := s.conns[utpKey{addr.String(), h.connID}]
+	created := false
+	if c == nil && h.typ == stSyn {
+		// 对方的SYN带的是它的接收id，我方用id+1接收，重复的SYN交给已经建立的连接处理
+		key := utpKey{addr.String(), h.connID + 1}
+		if c = s.conns[key]; c == nil {
+			c = s.newConn(addr, h.connID+1, h.connID)
+			s.conns[key] = c
+			created = true
+		}
+	}
+	s.mu.Unlock()
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !created {
+		c.handle(h, payload, time.Now())
+		return
+	}
+	c.acceptSyn(h)
+	select {
+	case s.accept <- c:
+	default:
+		// 没有及时Accept的连接直接拒绝
+		c.sendPacket(stReset, c.seq, nil)
+		c.fail(errUTPReset)
+	}
+}
+
+// 定时处理超时重传和连接关闭
+func (s *UTPSocket) tickLoop() {
+	ticker := time.NewTicker(utpTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			conns := make(map[utpKey]*utpConn, len(s.conns))
+			for k, c := range s.conns {
+				conns[k] = c
+			}
+			s.mu.Unlock()
+			for k, c := range conns {
+				if c.tick(now) {
+					s.mu.Lock()
+					delete(s.conns, k)
+					s.mu.Unlock()
+				}
+			}
+		}
+	}
+}
+
+const (
+	utpSynSent = iota
+	utpConnected
+)
+
+// 待发送或者等待确认的包
+type utpOut struct {
+	typ        uint8
+	seq        uint16
+	payload    []byte
+	sentAt     time.Time
+	sends      int
+	fastResent bool
+}
+
+// 乱序到达的包
+type utpIn struct {
+	fin  bool
+	data []byte
+}
+
+type utpConn struct {
+	s      *UTPSocket
+	remote net.Addr
+	recvID uint16
+	sendID uint16
+
+	mu      sync.Mutex
+	notify  chan struct{} // 状态变化时关闭并替换，唤醒所有等待的读写
+	state   int
+	err     error
+	dead    bool      // 已经不能再收发，等待从socket中移除
+	closing bool      // 本地已经调用Close
+	linger  time.Time // FIN被确认后最多等待对方关闭到什么时候
+
+	// 发送方向
+	seq         uint16    // 下一个包的序号
+	queue       []*utpOut // 还没有发送的包
+	queueBytes  int
+	inflight    []*utpOut // 已经发送、等待确认的包，按序号排列
+	flightBytes int
+	finAcked    bool
+	cwnd        float64 // 拥塞窗口，单位字节
+	slowStart   bool
+	peerWnd     int
+	lastAck     uint16
+	dupAcks     int
+	lastLoss    time.Time
+	delays      delayHist
+	ourDelay    time.Duration
+	rtt         time.Duration
+	rttVar      time.Duration
+	rto         time.Duration
+	timeouts    int
+
+	// 接收方向
+	ack        uint16 // 最后一个按顺序收到的序号
+	ooo        map[uint16]*utpIn
+	oooBytes   int
+	readBuf    bytes.Buffer
+	eof        bool
+	replyMicro uint32
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// 状态变化，唤醒等待的读写
+func (c *utpConn) broadcast() {
+	close(c.notify)
+	c.notify = make(chan struct{})
+}
+
+// 持有锁时调用，等待状态变化或者超时，返回时重新持有锁
+func (c *utpConn) wait(deadline time.Time) error {
+	ch := c.notify
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	c.mu.Unlock()
+	defer c.mu.Lock()
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (c *utpConn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.dead = true
+	c.broadcast()
+}
+
+func (c *utpConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if c.closing {
+			return 0, net.ErrClosed
+		}
+		if c.readBuf.Len() > 0 {
+			before := c.recvWindow()
+			n, _ := c.readBuf.Read(b)
+			// 窗口从几乎关闭重新打开时通知对方，否则对方要等超时才会继续发送
+			if before < utpPayload && c.recvWindow() >= utpPayload {
+				c.sendState()
+			}
+			return n, nil
+		}
+		if c.eof {
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		if err := c.wait(c.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *utpConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for n < len(b) {
+		if c.closing {
+			return n, net.ErrClosed
+		}
+		if c.err != nil {
+			return n, c.err
+		}
+		if c.queueBytes+c.flightBytes >= utpSendBuf {
+			if err := c.wait(c.writeDeadline); err != nil {
+				return n, err
+			}
+			continue
+		}
+		size := len(b) - n
+		if size > utpPayload {
+			size = utpPayload
+		}
+		c.queue = append(c.queue, &utpOut{typ: stData, payload: append([]byte(nil), b[n:n+size]...)})
+		c.queueBytes += size
+		n += size
+		c.trySend(time.Now())
+	}
+	return n, nil
+}
+
+// Close 发送完缓冲的数据后发送FIN
+func (c *utpConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing {
+		return nil
+	}
+	c.closing = true
+	c.linger = time.Now().Add(utpLinger)
+	if c.err == nil && c.state == utpConnected {
+		c.queue = append(c.queue, &utpOut{typ: stFin})
+		c.trySend(time.Now())
+	} else {
+		c.dead = true
+	}
+	c.broadcast()
+	return nil
+}
+
+func (c *utpConn) LocalAddr() net.Addr {
+	return c.s.pc.LocalAddr()
+}
+
+func (c *utpConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *utpConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.broadcast()
+	return nil
+}
+
+func (c *utpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.broadcast()
+	return nil
+}
+
+func (c *utpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.broadcast()
+	return nil
+}
+
+// 作为接收方处理对方的SYN，回复STATE
+func (c *utpConn) acceptSyn(h *utpHeader) {
+	var b [2]byte
+	rand.Read(b[:])
+	c.state = utpConnected
+	c.seq = binary.BigEndian.Uint16(b[:])
+	c.ack = h.seq
+	c.peerWnd = int(h.wnd)
+	c.replyMicro = c.s.micros() - h.tsUs
+	c.sendState()
+}
+
+func (c *utpConn) handle(h *utpHeader, payload []byte, now time.Time) {
+	if c.dead {
+		return
+	}
+	c.replyMicro = c.s.micros() - h.tsUs
+	c.peerWnd = int(h.wnd)
+	if h.tsDiff != 0 {
+		c.delays.add(h.tsDiff, now)
+		c.ourDelay = time.Duration(int32(h.tsDiff-c.delays.base())) * time.Microsecond
+	}
+	switch h.typ {
+	case stReset:
+		c.fail(errUTPReset)
+		return
+	case stSyn:
+		// 对方没有收到我们的STATE，重新回复
+		c.sendState()
+		return
+	}
+	if c.state == utpSynSent {
+		// STATE不占用序号，对方的第一个数据包就是这个序号
+		c.state = utpConnected
+		c.ack = h.seq - 1
+	}
+	c.processAck(h, now)
+	if h.typ == stData || h.typ == stFin {
+		c.receive(h, payload)
+		c.sendState()
+	}
+	c.trySend(now)
+	c.broadcast()
+}
+
+// 处理累计确认和selective ack，更新RTT和拥塞窗口
+func (c *utpConn) processAck(h *utpHeader, now time.Time) {
+	// 确认了还没有发送的序号，忽略
+	if !seqLess(h.ack, c.seq) {
+		return
+	}
+	acked := 0
+	for len(c.inflight) > 0 && !seqLess(h.ack, c.inflight[0].seq) {
+		acked += c.ackPacket(c.inflight[0], now)
+		c.inflight = c.inflight[1:]
+	}
+	lost := false
+	if sacked := sackSeqs(h.ack, h.sack); len(sacked) > 0 {
+		kept := c.inflight[:0]
+		for _, p := range c.inflight {
+			got := false
+			for _, s := range sacked {
+				if s == p.seq {
+					got = true
+					break
+				}
+			}
+			if got {
+				acked += c.ackPacket(p, now)
+			} else {
+				kept = append(kept, p)
+			}
+		}
+		c.inflight = kept
+		// 某个包之后已经有3个包被确认，认为这个包丢失了
+		for _, p := range c.inflight {
+			after := 0
+			for _, s := range sacked {
+				if seqLess(p.seq, s) {
+					after++
+				}
+			}
+			if after >= 3 && !p.fastResent {
+				p.fastResent = true
+				c.transmit(p, now)
+				lost = true
+			}
+		}
+	}
+	// 重复的确认也说明后面的包到了，第一个未确认的包可能丢失
+	if acked == 0 && h.typ == stState && len(c.inflight) > 0 && h.ack == c.lastAck {
+		c.dupAcks++
+		if c.dupAcks == 3 && !c.inflight[0].fastResent {
+			c.inflight[0].fastResent = true
+			c.transmit(c.inflight[0], now)
+			lost = true
+		}
+	} else if acked > 0 {
+		c.dupAcks = 0
+	}
+	c.lastAck = h.ack
+	if lost && now.Sub(c.lastLoss) > c.rtt {
+		// 每个RTT最多减半一次
+		c.lastLoss = now
+		c.slowStart = false
+		c.cwnd /= 2
+		if c.cwnd < utpPayload {
+			c.cwnd = utpPayload
+		}
+	}
+	if acked > 0 {
+		c.timeouts = 0
+		c.resetRTO()
+		c.cwnd, c.slowStart = ledbat(c.cwnd, c.ourDelay, acked, c.slowStart)
+	}
+}
+
+// 一个包被确认，返回确认的字节数
+func (c *utpConn) ackPacket(p *utpOut, now time.Time) int {
+	c.flightBytes -= len(p.payload)
+	if p.typ == stFin {
+		c.finAcked = true
+	}
+	// 重传过的包无法确定确认的是哪一次发送，不用来计算RTT
+	if p.sends == 1 {
+		sample := now.Sub(p.sentAt)
+		if c.rtt == 0 {
+			c.rtt, c.rttVar = sample, sample/2
+		} else {
+			delta := c.rtt - sample
+			if delta < 0 {
+				delta = -delta
+			}
+			c.rttVar += (delta - c.rttVar) / 4
+			c.rtt += (sample - c.rtt) / 8
+		}
+	}
+	return len(p.payload)
+}
+
+// 按RTT估计值计算重传超时，收到新的确认后退避的超时也恢复
+func (c *utpConn) resetRTO() {
+	if c.rtt == 0 {
+		return
+	}
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < utpMinRTO {
+		c.rto = utpMinRTO
+	}
+	if c.rto > utpMaxRTO {
+		c.rto = utpMaxRTO
+	}
+}
+
+// 按序号把数据放进读缓冲，乱序的包先暂存
+func (c *utpConn) receive(h *utpHeader, payload []byte) {
+	if c.eof || !seqLess(c.ack, h.seq) {
+		return
+	}
+	if _, ok := c.ooo[h.seq]; ok || c.readBuf.Len()+c.oooBytes+len(payload) > utpRecvBuf {
+		return
+	}
+	c.ooo[h.seq] = &utpIn{fin: h.typ == stFin, data: payload}
+	c.oooBytes += len(payload)
+	for {
+		in, ok := c.ooo[c.ack+1]
+		if !ok {
+			return
+		}
+		delete(c.ooo, c.ack+1)
+		c.oooBytes -= len(in.data)
+		c.ack++
+		if in.fin {
+			c.eof = true
+			c.ooo = make(map[uint16]*utpIn)
+			c.oooBytes = 0
+			return
+		}
+		c.readBuf.Write(in.data)
+	}
+}
+
+func (c *utpConn) recvWindow() int {
+	if n := utpRecvBuf - c.readBuf.Len() - c.oooBytes; n > 0 {
+		return n
+	}
+	return 0
+}
+
+// 乱序到达的包用selective ack告诉对方
+func (c *utpConn) buildSack() []byte {
+	if len(c.ooo) == 0 {
+		return nil
+	}
+	var sack [utpMaxSack]byte
+	size := 0
+	for seq := range c.ooo {
+		i := int(seq - c.ack - 2)
+		if i < 0 || i >= utpMaxSack*8 {
+			continue
+		}
+		sack[i/8] |= 1 << uint(i%8)
+		if n := (i/32 + 1) * 4; n > size {
+			size = n
+		}
+	}
+	if size == 0 {
+		return nil
+	}
+	return sack[:size]
+}
+
+func (c *utpConn) sendPacket(typ uint8, seq uint16, payload []byte) {
+	id := c.sendID
+	if typ == stSyn {
+		id = c.recvID
+	}
+	h := &utpHeader{
+		typ:    typ,
+		connID: id,
+		tsUs:   c.s.micros(),
+		tsDiff: c.replyMicro,
+		wnd:    uint32(c.recvWindow()),
+		seq:    seq,
+		ack:    c.ack,
+		sack:   c.buildSack(),
+	}
+	// UDP发送失败和丢包一样，由重传处理
+	c.s.pc.WriteTo(h.marshal(payload), c.remote)
+}
+
+// STATE不占用序号
+func (c *utpConn) sendState() {
+	c.sendPacket(stState, c.seq, nil)
+}
+
+func (c *utpConn) transmit(p *utpOut, now time.Time) {
+	p.sentAt = now
+	p.sends++
+	c.sendPacket(p.typ, p.seq, p.payload)
+}
+
+// 在拥塞窗口和对方接收窗口允许的范围内发送排队的包，没有在途的包时至少发送一个
+func (c *utpConn) trySend(now time.Time) {
+	if c.dead || c.state == utpSynSent && len(c.inflight) > 0 {
+		return
+	}
+	window := int(c.cwnd)
+	if c.peerWnd < window {
+		window = c.peerWnd
+	}
+	for len(c.queue) > 0 {
+		p := c.queue[0]
+		if len(c.inflight) > 0 && c.flightBytes+len(p.payload) > window {
+			return
+		}
+		c.queue = c.queue[1:]
+		c.queueBytes -= len(p.payload)
+		p.seq = c.seq
+		c.seq++
+		c.transmit(p, now)
+		c.inflight = append(c.inflight, p)
+		c.flightBytes += len(p.payload)
+	}
+}
+
+// 定时检查超时重传，返回true表示连接可以从socket中移除
+func (c *utpConn) tick(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dead {
+		return true
+	}
+	if len(c.inflight) > 0 && now.Sub(c.inflight[0].sentAt) > c.rto {
+		c.timeouts++
+		if c.timeouts > utpMaxTimeouts {
+			c.fail(errUTPTimeout)
+			return true
+		}
+		// 超时说明网络严重拥塞，窗口降到最小，退避重传
+		c.cwnd, c.slowStart = utpPayload, false
+		c.rto *= 2
+		if c.rto > utpMaxRTO {
+			c.rto = utpMaxRTO
+		}
+		c.transmit(c.inflight[0], now)
+	}
+	c.trySend(now)
+	// FIN被确认后等待对方也关闭，FIN一直没有被确认时由超时次数决定是否断开
+	if c.closing && c.finAcked && (c.eof || now.After(c.linger)) {
+		c.fail(net.ErrClosed)
+		return true
+	}
+	return false
+}
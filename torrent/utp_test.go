@@ -0,0 +1,191 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 按规则丢弃发出的包，模拟有丢包的网络
+type lossyConn struct {
+	net.PacketConn
+	mu    sync.Mutex
+	n     int
+	every int
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.n++
+	drop := c.every > 0 && c.n%c.every == 0
+	c.mu.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func newTestUTP(t *testing.T, dropEvery int) *UTPSocket {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	return newUTPSocket(&lossyConn{PacketConn: pc, every: dropEvery})
+}
+
+// 建立一对uTP连接
+func utpPair(t *testing.T, dropEvery int) (net.Conn, net.Conn, func()) {
+	a, b := newTestUTP(t, dropEvery), newTestUTP(t, dropEvery)
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := b.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	dialed, err := a.DialTimeout(b.Addr().String(), 5*time.Second)
+	assert.Equal(t, nil, err)
+	return dialed, <-accepted, func() {
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestUTPHeader(t *testing.T) {
+	h := &utpHeader{typ: stState, connID: 7, tsUs: 1, tsDiff: 2, wnd: 3, seq: 65535, ack: 9, sack: []byte{0x05, 0, 0, 0}}
+	res, payload, err := parseUTP(h.marshal([]byte("abc")))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, h, res)
+	assert.Equal(t, "abc", string(payload))
+	// ack+2和ack+4已经收到
+	assert.Equal(t, []uint16{11, 13}, sackSeqs(res.ack, res.sack))
+	assert.Equal(t, true, seqLess(65535, 0))
+
+	_, _, err = parseUTP([]byte{0x41, 1, 0, 0})
+	assert.Equal(t, errUTPPacket, err)
+	bad := h.marshal(nil)
+	_, _, err = parseUTP(bad[:utpHeaderLen+3])
+	assert.Equal(t, errUTPPacket, err)
+}
+
+func TestLedbat(t *testing.T) {
+	// 慢启动阶段按确认的字节数增长
+	cwnd, slow := ledbat(10000, 0, 1000, true)
+	assert.Equal(t, 11000.0, cwnd)
+	assert.Equal(t, true, slow)
+	// 延迟接近目标值后进入拥塞避免
+	_, slow = ledbat(10000, utpTarget*3/4, 1000, true)
+	assert.Equal(t, false, slow)
+	// 延迟低于目标值时增大，高于目标值时减小
+	grow, _ := ledbat(10000, utpTarget/4, 10000, false)
+	assert.Equal(t, true, grow > 10000 && grow <= 10000+utpMaxCwndIncrease)
+	shrink, _ := ledbat(10000, utpTarget*2, 10000, false)
+	assert.Equal(t, true, shrink < 10000)
+	// 窗口不小于一个包
+	min, _ := ledbat(utpPayload, 10*utpTarget, 1000000, false)
+	assert.Equal(t, float64(utpPayload), min)
+}
+
+func TestUTPTransfer(t *testing.T) {
+	for _, drop := range []int{0, 7} {
+		client, server, closeAll := utpPair(t, drop)
+		up := make([]byte, 400*1024)
+		down := make([]byte, 100*1024)
+		rand.Read(up)
+		rand.Read(down)
+
+		// 双向同时传输
+		go func() {
+			client.Write(up)
+			client.Close()
+		}()
+		go server.Write(down)
+		got, err := io.ReadAll(server)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, bytes.Equal(up, got), "drop every %d", drop)
+
+		buf := make([]byte, len(down))
+		_, err = io.ReadFull(client, buf)
+		// 本地已经关闭，不能再读
+		assert.Equal(t, true, errors.Is(err, net.ErrClosed))
+		server.Close()
+		closeAll()
+	}
+}
+
+func TestUTPDeadline(t *testing.T) {
+	client, server, closeAll := utpPair(t, 0)
+	defer closeAll()
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := client.Read(make([]byte, 1))
+	var ne net.Error
+	assert.Equal(t, true, errors.As(err, &ne) && ne.Timeout())
+
+	// 清除deadline之后可以继续读
+	client.SetReadDeadline(time.Time{})
+	go server.Write([]byte("x"))
+	buf := make([]byte, 1)
+	_, err = client.Read(buf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "x", string(buf))
+}
+
+func TestPeerConnUTP(t *testing.T) {
+	client, server, closeAll := utpPair(t, 0)
+	defer closeAll()
+	infoSHA := [SHALEN]byte{7}
+	go acceptHandshake(server, infoSHA, [IDLen]byte{'b'})
+	res, err := handshake(client, infoSHA, [IDLen]byte{'a'})
+	assert.Equal(t, nil, err)
+	pc := newPeerConn(client, addrPeer(client.RemoteAddr()), infoSHA, res.PeerID, testPieces, false)
+	defer pc.Close()
+	assert.Equal(t, [IDLen]byte{'b'}, res.PeerID)
+	assert.Equal(t, uint16(server.LocalAddr().(*net.UDPAddr).Port), pc.peer.Port)
+
+	remote := &PeerConn{Conn: server}
+	go remote.WriteMsg(&PeerMsg{MsgUnchoke, []byte{}})
+	assert.Equal(t, MsgUnchoke, (<-pc.Msgs()).ID)
+	assert.Equal(t, false, pc.PeerChoking())
+}
+
+func TestDialPolicy(t *testing.T) {
+	sock := newTestUTP(t, 0)
+	defer sock.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	// 只有TCP在监听，uTP连接会超时，race时使用TCP
+	conn, err := dialWith(ln.Addr().String(), DialRace, sock)
+	assert.Equal(t, nil, err)
+	_, isTCP := conn.(*net.TCPConn)
+	assert.Equal(t, true, isTCP)
+	conn.Close()
+
+	// uTP可用时优先使用uTP
+	server := newTestUTP(t, 0)
+	defer server.Close()
+	go server.Accept()
+	conn, err = dialWith(server.Addr().String(), DialUTPPreferred, sock)
+	assert.Equal(t, nil, err)
+	_, isUTP := conn.(*utpConn)
+	assert.Equal(t, true, isUTP)
+	conn.Close()
+
+	conn, err = dialWith(ln.Addr().String(), DialTCP, sock)
+	assert.Equal(t, nil, err)
+	conn.Close()
+}